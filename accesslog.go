@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	logFormatJSON     = "json"
+	logFormatCombined = "combined"
+)
+
+// accessLogger writes one line per request, as JSON or in the Combined Log Format
+type accessLogger struct {
+	format string
+	json   *slog.Logger
+	// trustedProxies are the TRUSTED_PROXIES whose X-Forwarded-For gives the client IP
+	trustedProxies []netip.Prefix
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newAccessLogger(format string, trustedProxies []netip.Prefix, out io.Writer) *accessLogger {
+	return &accessLogger{
+		format:         format,
+		json:           slog.New(slog.NewJSONHandler(out, nil)),
+		trustedProxies: trustedProxies,
+		out:            out,
+	}
+}
+
+// accessLogEntry is what is known of a request once it's served
+type accessLogEntry struct {
+	time      time.Time
+	remoteIP  string
+	method    string
+	uri       string
+	proto     string
+	status    int
+	bytes     int64
+	referer   string
+	userAgent string
+	cache     string
+	duration  time.Duration
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		l.log(accessLogEntry{
+			time:      start,
+			remoteIP:  clientIP(r, l.trustedProxies),
+			method:    r.Method,
+			uri:       r.URL.RequestURI(),
+			proto:     r.Proto,
+			status:    rec.status,
+			bytes:     rec.bytes,
+			referer:   r.Referer(),
+			userAgent: r.UserAgent(),
+			cache:     rec.Header().Get("X-Cache"),
+			duration:  time.Since(start),
+		})
+	})
+}
+
+func (l *accessLogger) log(e accessLogEntry) {
+	if l.format == logFormatCombined {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		fmt.Fprintln(l.out, combinedLine(e))
+		return
+	}
+
+	l.json.Info("access",
+		"remote_ip", e.remoteIP,
+		"method", e.method,
+		"uri", e.uri,
+		"proto", e.proto,
+		"status", e.status,
+		"bytes", e.bytes,
+		"referer", e.referer,
+		"user_agent", e.userAgent,
+		"cache", e.cache,
+		"duration_ms", e.duration.Milliseconds(),
+	)
+}
+
+// combinedLine formats an entry in the Combined Log Format, with the cache result appended
+func combinedLine(e accessLogEntry) string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s "%s" "%s" %s`,
+		e.remoteIP,
+		e.time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.method, e.uri, e.proto,
+		e.status,
+		dashIfEmpty(bytesField(e.bytes)),
+		dashIfEmpty(e.referer),
+		dashIfEmpty(e.userAgent),
+		dashIfEmpty(e.cache),
+	)
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprint(n)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// responseRecorder captures the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush streamed responses
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
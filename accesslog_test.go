@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func serveLogged(t *testing.T, format string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	logger := newAccessLogger(format, nil, &out)
+	handler := logger.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		w.Write([]byte("image bytes"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/_/rs:fill:50:50/plain/https%3A%2F%2Fexample.com%2Fcat.jpg", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("User-Agent", "curl/8.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	return out.String()
+}
+
+func TestCombinedAccessLogLine(t *testing.T) {
+	line := serveLogged(t, logFormatCombined)
+
+	pattern := regexp.MustCompile(`^192\.0\.2\.10 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] ` +
+		`"GET /_/rs:fill:50:50/plain/https%3A%2F%2Fexample\.com%2Fcat\.jpg HTTP/1\.1" 200 11 "-" "curl/8\.0" HIT\n$`)
+	if !pattern.MatchString(line) {
+		t.Fatalf("Unexpected combined log line: %q", line)
+	}
+}
+
+func TestJSONAccessLogLine(t *testing.T) {
+	line := serveLogged(t, logFormatJSON)
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &entry); err != nil {
+		t.Fatalf("Invalid JSON log line %q: %v", line, err)
+	}
+	if entry["remote_ip"] != "192.0.2.10" || entry["status"] != float64(200) || entry["bytes"] != float64(11) || entry["cache"] != "HIT" {
+		t.Fatalf("Unexpected JSON log entry: %v", entry)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// adminTokenHeader carries ADMIN_TOKEN, apart from the Authorization header used by tenant tokens
+const adminTokenHeader = "X-Admin-Token"
+
+// adminAuth guards an admin route. In tenant mode, the tenant credential grants the routes
+// scoped to its prefix. Global routes, and every route outside of tenant mode, require ADMIN_TOKEN
+func (s *server) adminAuth(route adminRoute) http.Handler {
+	if s.cfg.TenantMode != "" && !route.global {
+		return route.handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			http.Error(w, "admin API disabled, ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+		if !s.hasAdminToken(r) {
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		route.handler(w, r)
+	})
+}
+
+// hasAdminToken reports whether a request carries ADMIN_TOKEN, never when it isn't set
+func (s *server) hasAdminToken(r *http.Request) bool {
+	return s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(adminTokenHeader)), []byte(s.cfg.AdminToken)) == 1
+}
+
+// Bounds of the page size of admin listings
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type variant struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+type variantsResponse struct {
+	Source     string    `json:"source"`
+	Prefix     string    `json:"prefix"`
+	Variants   []variant `json:"variants"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// handleVariants lists the cached variants of a source URL.
+// Only the by-source key layouts group variants by source, so flat keys can't be listed.
+// The content types come from a HEAD per variant, each one through the S3 limiter
+func (s *server) handleVariants(w http.ResponseWriter, r *http.Request) {
+	if !groupsBySource(s.cfg.KeyLayout) {
+		http.Error(w, "listing variants requires KEY_LAYOUT=by-source or by-source-options", http.StatusNotImplemented)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		http.Error(w, "missing source parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit, ok := parseListLimit(r.URL.Query().Get("limit"))
+	if !ok {
+		http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+		return
+	}
+
+	prefix := s.keys.sourcePrefix(tenantFrom(r.Context()), source)
+	page, err := s.store.List(r.Context(), prefix, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		slog.Error("Failed to list variants", "source", source, "prefix", prefix, "error", err)
+		http.Error(w, "failed to list variants", http.StatusBadGateway)
+		return
+	}
+
+	resp := variantsResponse{
+		Source:     source,
+		Prefix:     prefix,
+		Variants:   []variant{},
+		NextCursor: page.NextCursor,
+	}
+	for _, obj := range page.Objects {
+		info, err := s.store.Head(r.Context(), obj.Key)
+		if errors.Is(err, ErrNotFound) {
+			// Purged since it was listed
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to get variant", "source", source, "key", obj.Key, "error", err)
+			http.Error(w, "failed to list variants", http.StatusBadGateway)
+			return
+		}
+		resp.Variants = append(resp.Variants, variant{Key: obj.Key, Size: info.Size, ContentType: info.ContentType})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type cacheEntry struct {
+	Path         string    `json:"path"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+	Pinned       bool      `json:"pinned"`
+}
+
+// handleCacheInfo describes the cached image of an imgproxy path.
+// The key is derived from the caller's tenant, so other tenants' images can't be reached
+func (s *server) handleCacheInfo(w http.ResponseWriter, r *http.Request) {
+	path, key, ok := s.cacheEntryKey(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := s.store.Head(r.Context(), key)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to get cache entry", "path", path, "key", key, "error", err)
+		http.Error(w, "failed to get cache entry", http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cacheEntry{
+		Path:         path,
+		Key:          key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Pinned:       info.Pinned,
+	})
+}
+
+// handleCachePurge removes the cached image of an imgproxy path, within the caller's tenant
+func (s *server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	path, key, ok := s.cacheEntryKey(w, r)
+	if !ok {
+		return
+	}
+
+	// The reads of the key in flight finish first, the ones starting meanwhile regenerate the image
+	unlock, err := s.lockPurge(r.Context(), key)
+	if err != nil {
+		http.Error(w, "purge canceled while waiting for the reads in flight", http.StatusGatewayTimeout)
+		return
+	}
+	defer unlock()
+
+	if _, err := s.store.Head(r.Context(), key); errors.Is(err, ErrNotFound) {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	if err := s.store.Delete(r.Context(), key); err != nil {
+		slog.Error("Failed to purge cache entry", "path", path, "key", key, "error", err)
+		http.Error(w, "failed to purge cache entry", http.StatusBadGateway)
+		return
+	}
+
+	slog.Info("Purged cache entry", "path", path, "key", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type keyInfo struct {
+	Path           string `json:"path"`
+	NormalizedPath string `json:"normalized_path"`
+	Key            string `json:"key"`
+}
+
+// handleKey reports the key a path is stored under, with the same logic as image requests
+func (s *server) handleKey(w http.ResponseWriter, r *http.Request) {
+	path, key, ok := s.cacheEntryKey(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keyInfo{
+		Path:           path,
+		NormalizedPath: s.keys.normalizedPath(path),
+		Key:            key,
+	})
+}
+
+// cacheEntryKey returns the path queried by an admin cache request and its key in the caller's tenant.
+// The path is rewritten as image requests are, so the key is the one its image is stored under
+func (s *server) cacheEntryKey(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path parameter", http.StatusBadRequest)
+		return "", "", false
+	}
+	path, err := s.rewrittenPath(r.Context(), path)
+	if err != nil {
+		status := http.StatusBadRequest
+		var rewriteErr *rewriteError
+		if errors.As(err, &rewriteErr) {
+			status = rewriteErr.status()
+		}
+		http.Error(w, err.Error(), status)
+		return "", "", false
+	}
+	return path, s.keys.key(tenantFrom(r.Context()), path), true
+}
+
+func parseListLimit(v string) (int, bool) {
+	if v == "" {
+		return defaultListLimit, true
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 {
+		return 0, false
+	}
+	return min(limit, maxListLimit), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "error", err)
+	}
+}
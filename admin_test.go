@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminToken is the ADMIN_TOKEN of the test servers
+const testAdminToken = "test-admin-token"
+
+// adminDo sends a request authenticated with the admin token
+func adminDo(t *testing.T, method, requestURL string) *http.Response {
+	t.Helper()
+	return adminDoWithBody(t, method, requestURL, "")
+}
+
+func adminDoWithBody(t *testing.T, method, requestURL, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, requestURL, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set(adminTokenHeader, testAdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminRoutesRequireTheAdminToken(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	for _, token := range []string{"", "wrong"} {
+		req, _ := http.NewRequest(http.MethodPut, proxy.URL+"/admin/maintenance", strings.NewReader(`{"enabled":true}`))
+		req.Header.Set(adminTokenHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+	if srv.maintenance.Load() {
+		t.Fatal("Expected maintenance to stay off")
+	}
+
+	srv.cfg.AdminToken = ""
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path=/_/plain/http://example.com/kitten.jpg"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the admin API to be disabled without ADMIN_TOKEN, got %d", resp.StatusCode)
+	}
+}
+
+func TestVariantsListsOnlyTheQueriedSource(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{KeyLayout: keyLayoutBySource}, imgproxyStub())
+
+	kitten := "https://example.com/kitten.jpg"
+	puppy := "https://example.com/puppy.jpg"
+	seed := []string{
+		"/_/rs:fill:50:50/plain/" + kitten,
+		"/_/rs:fill:100:100/plain/" + kitten + "@webp",
+		"/_/rs:fill:10:10/" + base64.RawURLEncoding.EncodeToString([]byte(kitten)) + ".avif",
+		"/_/rs:fill:50:50/plain/" + puppy,
+		"/_/rs:fill:100:100/plain/" + puppy,
+	}
+	for _, path := range seed {
+		if err := srv.storeProcessed(context.Background(), path, []byte(path), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+			t.Fatalf("Failed to seed %s: %v", path, err)
+		}
+	}
+
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/variants?source="+url.QueryEscape(kitten))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var body variantsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+
+	if len(body.Variants) != 3 {
+		t.Fatalf("Expected the 3 kitten variants, got %+v", body.Variants)
+	}
+	for _, v := range body.Variants {
+		if !strings.HasPrefix(v.Key, sourceKeyPrefix(kitten)) || v.ContentType != "image/jpeg" || v.Size == 0 {
+			t.Errorf("Unexpected variant %+v", v)
+		}
+	}
+}
+
+func TestVariantsPaginates(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{KeyLayout: keyLayoutBySource}, imgproxyStub())
+
+	source := "https://example.com/kitten.jpg"
+	for _, size := range []string{"10", "20", "30"} {
+		srv.storeProcessed(context.Background(), "/_/rs:fill:"+size+":"+size+"/plain/"+source, []byte(size), ObjectMeta{})
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for range 3 {
+		resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/variants?limit=2&source="+url.QueryEscape(source)+"&cursor="+url.QueryEscape(cursor))
+		var body variantsResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		for _, v := range body.Variants {
+			seen[v.Key] = true
+		}
+		if cursor = body.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("Expected 3 variants across pages, got %d", len(seen))
+	}
+}
+
+func TestVariantsRequiresBySourceLayout(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/variants?source="+url.QueryEscape("https://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected status 501 with flat keys, got %d", resp.StatusCode)
+	}
+}
+
+func TestKeyEndpointMatchesGenerateS3Key(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	paths := []string{
+		"/_/rs:fill:300:300/plain/https://example.com/cat.jpg@webp",
+		"/_/rs:fill:300:300/plain/https://EXAMPLE.com/%7Euser/cat.jpg",
+		"/sig/rs:fit:100:100/dpr:2/" + base64.RawURLEncoding.EncodeToString([]byte("https://example.com/cat.jpg")) + ".avif",
+		"/_/w:100/enc/encrypted-source",
+	}
+	for _, path := range paths {
+		resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/key?path="+url.QueryEscape(path))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, resp.StatusCode)
+		}
+
+		var body keyInfo
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		if body.Path != path || body.Key != GenerateS3Key(path) {
+			t.Errorf("Expected key %s for %s, got %+v", GenerateS3Key(path), path, body)
+		}
+		if body.NormalizedPath != normalizeKeyPath(path) {
+			t.Errorf("Expected normalized path %s for %s, got %s", normalizeKeyPath(path), path, body.NormalizedPath)
+		}
+	}
+
+	if resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/key"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 without a path, got %d", resp.StatusCode)
+	}
+}
+
+func TestKeyEndpointCleansSlashesLikeImageRequests(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{NormalizePathSlashes: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50//plain/http://example.com/a.jpg"
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	var body keyInfo
+	if err := json.NewDecoder(adminDo(t, http.MethodGet, proxy.URL+"/admin/key?path="+url.QueryEscape(path)).Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if _, ok := store.get(body.Key); !ok {
+		t.Fatalf("Expected the image to be stored under %s", body.Key)
+	}
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the purge to find the image, got %d", resp.StatusCode)
+	}
+}
+
+func TestKeyEndpointRewritesPathsLikeImageRequests(t *testing.T) {
+	cfg := Config{QualityDefaults: map[string]int{"webp": 75}, ForceStripMetadata: true}
+	srv, proxy, store := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/a.jpg") + "@webp"
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	var body keyInfo
+	if err := json.NewDecoder(adminDo(t, http.MethodGet, proxy.URL+"/admin/key?path="+url.QueryEscape(path)).Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if _, ok := store.get(body.Key); !ok {
+		t.Fatalf("Expected the image to be stored under %s, the key of %s", body.Key, body.Path)
+	}
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the purge to find the image, got %d", resp.StatusCode)
+	}
+}
+
+// putExpectingContinue sends an admin PUT with Expect: 100-continue on a raw connection, the body only
+// following the server's 100 Continue, and returns the status announced first and the final response
+func putExpectingContinue(t *testing.T, proxyURL, path, token, body string) (string, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	head := fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: %d\r\nExpect: 100-continue\r\n", path, len(body))
+	if token != "" {
+		head += adminTokenHeader + ": " + token + "\r\n"
+	}
+	if _, err := io.WriteString(conn, head+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected the server to answer the headers, got %v", err)
+	}
+	first = strings.TrimSpace(first)
+	if !strings.HasPrefix(first, "HTTP/1.1 100") {
+		resp, err := http.ReadResponse(bufio.NewReader(io.MultiReader(strings.NewReader(first+"\r\n"), reader)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return first, resp
+	}
+
+	// The blank line ending the interim response
+	reader.ReadString('\n')
+	if _, err := io.WriteString(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Expected a response once the body was sent, got %v", err)
+	}
+	return first, resp
+}
+
+func TestAdminBodiesAreRequestedWithExpectContinue(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	first, resp := putExpectingContinue(t, proxy.URL, "/admin/maintenance", testAdminToken, `{"enabled": true}`)
+	if first != "HTTP/1.1 100 Continue" {
+		t.Fatalf("Expected a 100 Continue before the body, got %q", first)
+	}
+	if resp.StatusCode != http.StatusOK || !srv.maintenance.Load() {
+		t.Fatalf("Expected the request to complete once the body was sent, got %d", resp.StatusCode)
+	}
+
+	// A request that would be rejected isn't asked for its body
+	first, resp = putExpectingContinue(t, proxy.URL, "/admin/maintenance", "", `{"enabled": false}`)
+	if resp.StatusCode != http.StatusUnauthorized || strings.HasPrefix(first, "HTTP/1.1 100") {
+		t.Fatalf("Expected a 401 without a 100 Continue, got %q then %d", first, resp.StatusCode)
+	}
+}
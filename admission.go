@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errAdmissionQueueFull = errors.New("too many requests waiting")
+	errAdmissionTimeout   = errors.New("waited too long for a request slot")
+)
+
+// admissionQueue lets at most MAX_CONCURRENT image requests in, and queues up to ADMISSION_QUEUE_SIZE
+// more for ADMISSION_MAX_WAIT. Waiting requests are admitted in arrival order, as goroutines
+// blocked on a channel are woken up first in, first out.
+// It's nil when MAX_CONCURRENT is unset, every request is then admitted
+type admissionQueue struct {
+	slots   chan struct{}
+	waiting chan struct{}
+	maxWait time.Duration
+}
+
+func newAdmissionQueue(cfg Config) *admissionQueue {
+	if cfg.MaxConcurrent == 0 {
+		return nil
+	}
+	return &admissionQueue{
+		slots:   make(chan struct{}, cfg.MaxConcurrent),
+		waiting: make(chan struct{}, cfg.AdmissionQueueSize),
+		maxWait: cfg.AdmissionMaxWait,
+	}
+}
+
+// hasLimits reports whether the queue already enforces the admission settings of a configuration
+func (q *admissionQueue) hasLimits(cfg Config) bool {
+	if q == nil {
+		return cfg.MaxConcurrent == 0
+	}
+	return cap(q.slots) == cfg.MaxConcurrent && cap(q.waiting) == cfg.AdmissionQueueSize && q.maxWait == cfg.AdmissionMaxWait
+}
+
+// admit waits for a slot, the returned function must be called to release it
+func (q *admissionQueue) admit(ctx context.Context) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	release := func() { <-q.slots }
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	select {
+	case q.waiting <- struct{}{}:
+		defer func() { <-q.waiting }()
+	default:
+		return nil, errAdmissionQueueFull
+	}
+
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errAdmissionTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// admitted answers 503 with a Retry-After when the request can't get a slot
+func (s *server) admitted(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	queue := s.admission.Load()
+	release, err := queue.admit(r.Context())
+	if err == nil {
+		return release, true
+	}
+
+	slog.Warn("Rejected request over MAX_CONCURRENT", "path", requestPath(r.URL), "error", err)
+	w.Header().Set("Retry-After", retryAfter(queue.maxWait))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return nil, false
+}
+
+// retryAfter formats a delay as whole seconds, rounded up so that a sub-second delay isn't 0
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// blockingStub holds every request until unblock is closed
+func blockingStub(unblock chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Write([]byte("image"))
+	})
+}
+
+func TestAdmissionQueuesThenRejectsWhenFull(t *testing.T) {
+	unblock := make(chan struct{})
+	srv, proxy, _ := newTestServer(t, Config{MaxConcurrent: 1, AdmissionQueueSize: 1, AdmissionMaxWait: 5 * time.Second}, blockingStub(unblock))
+	image := func(name string) string {
+		return proxy.URL + "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/"+name+".jpg")
+	}
+
+	first := getAsync(image("first"))
+	waitFor(t, func() bool { return len(srv.admission.Load().slots) == 1 })
+
+	queued := getAsync(image("queued"))
+	waitFor(t, func() bool { return len(srv.admission.Load().waiting) == 1 })
+
+	rejected := get(t, image("rejected"))
+	if rejected.StatusCode != http.StatusServiceUnavailable || rejected.Header.Get("Retry-After") != "5" {
+		t.Fatalf("Expected 503 with Retry-After: 5 when the queue is full, got %d %q", rejected.StatusCode, rejected.Header.Get("Retry-After"))
+	}
+
+	close(unblock)
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", status)
+	}
+	if status := <-queued; status != http.StatusOK {
+		t.Fatalf("Expected the queued request to be admitted after waiting, got %d", status)
+	}
+}
+
+func TestAdmissionRejectsAfterMaxWait(t *testing.T) {
+	unblock := make(chan struct{})
+	srv, proxy, _ := newTestServer(t, Config{MaxConcurrent: 1, AdmissionQueueSize: 10, AdmissionMaxWait: 50 * time.Millisecond}, blockingStub(unblock))
+	// Registered last so it runs first, the servers wait for the held request when closed
+	t.Cleanup(func() { close(unblock) })
+	image := proxy.URL + "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	getAsync(image)
+	waitFor(t, func() bool { return len(srv.admission.Load().slots) == 1 })
+
+	if resp := get(t, image); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 once ADMISSION_MAX_WAIT is exceeded, got %d", resp.StatusCode)
+	}
+}
+
+// getAsync sends a request in the background and reports its status, 0 if it failed
+func getAsync(requestURL string) <-chan int {
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(requestURL)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
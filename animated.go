@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// animatedProbeSize is how much of a source is read to tell whether it's animated,
+// the markers of animated GIFs, WebPs and PNGs come before their first frame's data
+const animatedProbeSize = 64 << 10
+
+// animatableTypes are the source content types that may hold an animation
+var animatableTypes = []string{"image/gif", "image/webp", "image/png", "image/apng"}
+
+// parseAnimatedOptions reads the imgproxy options of ANIMATED_OPTIONS, such as max_animation_frames:10 or da:1
+func parseAnimatedOptions(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	options := strings.Split(value, "/")
+	for _, o := range options {
+		if name, _, ok := strings.Cut(o, ":"); !ok || name == "" {
+			return nil, fmt.Errorf("invalid ANIMATED_OPTIONS %q, expected options such as max_animation_frames:10", value)
+		}
+	}
+	return options, nil
+}
+
+// isAnimated reports whether the start of an image holds the marker of an animation: the looping extension
+// of a GIF, the animation flag of an extended WebP or the animation control chunk of a PNG, before its image data
+func isAnimated(head []byte) bool {
+	switch {
+	case bytes.HasPrefix(head, []byte("GIF8")):
+		return bytes.Contains(head, []byte("NETSCAPE2.0")) || bytes.Contains(head, []byte("ANIMEXTS1.0"))
+	case len(head) >= 21 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return string(head[12:16]) == "VP8X" && head[20]&0x02 != 0
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		for i := 8; i+8 <= len(head); {
+			size := int(binary.BigEndian.Uint32(head[i:]))
+			switch string(head[i+4 : i+8]) {
+			case "acTL":
+				return true
+			case "IDAT":
+				return false
+			}
+			i += 12 + size
+		}
+	}
+	return false
+}
+
+// probeAnimated reads the start of the source of a path to tell whether it's animated.
+// Sources of other content types are left unread
+func (p *sourcePolicy) probeAnimated(ctx context.Context, path string) (bool, error) {
+	if err := p.checkHost(path); err != nil {
+		return false, err
+	}
+	source, err := decodeSource(path)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", animatedProbeSize-1))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false, fmt.Errorf("source responded with status %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !slices.Contains(animatableTypes, mediaType) {
+		return false, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, animatedProbeSize))
+	if err != nil {
+		return false, err
+	}
+	return isAnimated(head), nil
+}
+
+type animatedContextKey struct{}
+
+// keyPath returns the path a request's image is stored under: the requested one when ANIMATED_OPTIONS
+// rewrote the path sent to imgproxy, the path itself otherwise
+func keyPath(ctx context.Context, path string) string {
+	if requested, ok := ctx.Value(animatedContextKey{}).(string); ok {
+		return requested
+	}
+	return path
+}
+
+// isAnimatedRequest reports whether a request's source was found animated, its image then carries ANIMATED_OBJECT_TAGS
+func isAnimatedRequest(ctx context.Context) bool {
+	_, ok := ctx.Value(animatedContextKey{}).(string)
+	return ok
+}
+
+// animatedPath returns the path imgproxy processes an animated source with: the path followed by ANIMATED_OPTIONS,
+// signed again. It reports whether the source is animated, probing it on misses only, since the key stays the one
+// of the requested path. Sources that can't be probed, such as encrypted ones, are processed as static images
+func (s *server) animatedPath(ctx context.Context, path string) (string, bool, error) {
+	if len(s.cfg.AnimatedOptions) == 0 && len(s.cfg.AnimatedObjectTags) == 0 {
+		return path, false, nil
+	}
+	p, err := parseImgproxyPath(path)
+	if err != nil || p.Encrypted {
+		return path, false, nil
+	}
+	// The source is probed, and the rewritten path signed again, so an invalid signature must not get through
+	if err := s.signatures.verify(path); err != nil {
+		return "", false, err
+	}
+	animated, err := s.sources.probeAnimated(ctx, path)
+	if err != nil {
+		slog.Warn("Failed to probe the source for an animation, processing it as a static image", "path", path, "error", err)
+		return path, false, nil
+	}
+	if !animated || len(s.cfg.AnimatedOptions) == 0 {
+		return path, animated, nil
+	}
+
+	p.Options = append(p.Options, s.cfg.AnimatedOptions...)
+	return s.signatures.resign(p).String(), true, nil
+}
+
+// applyAnimatedPolicy sends the misses of animated sources to imgproxy with ANIMATED_OPTIONS.
+// The image is still stored under the key of the requested path
+func (s *server) applyAnimatedPolicy(r *http.Request) (*http.Request, error) {
+	path := requestPath(r.URL)
+	processed, animated, err := s.animatedPath(r.Context(), path)
+	if err != nil || !animated {
+		return r, err
+	}
+	slog.Debug("Processing an animated source", "path", path, "processed_path", processed)
+	r = r.WithContext(context.WithValue(r.Context(), animatedContextKey{}, path))
+	return r, setRequestPath(r, processed)
+}
+
+// animatedMeta adds the ANIMATED_OBJECT_TAGS of an animated source to the metadata of its image
+func (s *server) animatedMeta(animated bool, meta ObjectMeta) ObjectMeta {
+	if animated && len(s.cfg.AnimatedObjectTags) > 0 {
+		meta.Tags = s.cfg.AnimatedObjectTags
+	}
+	return meta
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func gifFrames(t *testing.T, n int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for range n {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, anim); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// withPNGChunk inserts a chunk right after the header chunk of a PNG
+func withPNGChunk(t *testing.T, chunk string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	png.Encode(&out, image.NewGray(image.Rect(0, 0, 4, 4)))
+	body := out.Bytes()
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(body[8:]))
+	inserted := binary.BigEndian.AppendUint32(nil, 8)
+	inserted = append(inserted, chunk...)
+	inserted = append(inserted, make([]byte, 8+4)...)
+	return slices.Concat(body[:ihdrEnd], inserted, body[ihdrEnd:])
+}
+
+func TestIsAnimated(t *testing.T) {
+	webp := func(flags byte) []byte {
+		return append([]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00"), flags, 0, 0, 0)
+	}
+	for name, tt := range map[string]struct {
+		head []byte
+		want bool
+	}{
+		"animated gif":  {gifFrames(t, 2), true},
+		"static gif":    {gifFrames(t, 1), false},
+		"animated webp": {webp(0x02), true},
+		"static webp":   {webp(0x10), false},
+		"animated png":  {withPNGChunk(t, "acTL"), true},
+		"static png":    {withPNGChunk(t, "tEXt"), false},
+		"jpeg":          {[]byte("\xff\xd8\xff\xe0"), false},
+	} {
+		if got := isAnimated(tt.head); got != tt.want {
+			t.Errorf("Expected isAnimated of the %s to be %v", name, tt.want)
+		}
+	}
+}
+
+func TestAnimatedSourcesUseTheAnimatedPolicy(t *testing.T) {
+	images := map[string][]byte{"/animated.gif": gifFrames(t, 3), "/static.gif": gifFrames(t, 1)}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(images[r.URL.Path])
+	}))
+	t.Cleanup(origin.Close)
+
+	var mu sync.Mutex
+	var processed []string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		processed = append(processed, requestPath(r.URL))
+		mu.Unlock()
+		w.Write([]byte("image"))
+	})
+	cfg := Config{
+		AllowLoopbackSources: true,
+		AnimatedOptions:      []string{"max_animation_frames:1"},
+		AnimatedObjectTags:   map[string]string{"tier": "animated"},
+	}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	animated := "/_/rs:fill:50:50/plain/" + url.QueryEscape(origin.URL+"/animated.gif")
+	static := "/_/rs:fill:50:50/plain/" + url.QueryEscape(origin.URL+"/static.gif")
+	get(t, proxy.URL+animated)
+	get(t, proxy.URL+static)
+	srv.uploads.Wait()
+
+	want := []string{"/_/rs:fill:50:50/max_animation_frames:1/plain/" + url.QueryEscape(origin.URL+"/animated.gif"), static}
+	if !slices.Equal(processed, want) {
+		t.Fatalf("Expected imgproxy to be sent\n%v\ngot\n%v", want, processed)
+	}
+
+	info, err := store.Head(t.Context(), GenerateS3Key(animated))
+	if err != nil {
+		t.Fatal("Expected the animated image to be stored under the key of the requested path")
+	}
+	if info.Tags["tier"] != "animated" {
+		t.Fatalf("Expected the animated image to carry ANIMATED_OBJECT_TAGS, got %v", info.Tags)
+	}
+	if info, err := store.Head(t.Context(), GenerateS3Key(static)); err != nil || info.Tags != nil {
+		t.Fatal("Expected the static image to be stored as usual")
+	}
+
+	if resp := get(t, proxy.URL+animated); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected the animated image to be served from the cache")
+	}
+
+	warmed := "/_/rs:fill:80:80/plain/" + url.QueryEscape(origin.URL+"/animated.gif")
+	resp := adminDoWithBody(t, http.MethodPost, proxy.URL+"/admin/warm", `{"paths": ["`+warmed+`"]}`)
+	io.Copy(io.Discard, resp.Body)
+	mu.Lock()
+	defer mu.Unlock()
+	if last := processed[len(processed)-1]; last != "/_/rs:fill:80:80/max_animation_frames:1/plain/"+url.QueryEscape(origin.URL+"/animated.gif") {
+		t.Fatalf("Expected warmups to use the animated policy too, got %q", last)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// auditTargetParams are the query parameters naming what an admin action acts on, the first one set is its target
+var auditTargetParams = []string{"path", "prefix", "source"}
+
+// auditLogger writes one entry per admin action, apart from the access log: who called which
+// endpoint on what, and how it ended. Tokens are never logged, only who they identify
+type auditLogger struct {
+	json *slog.Logger
+}
+
+func newAuditLogger(out io.Writer) *auditLogger {
+	return &auditLogger{json: slog.New(slog.NewJSONHandler(out, nil))}
+}
+
+// setAuditLogOutput writes the audit log to out, such as AUDIT_LOG_FILE. It must be set before serving
+func (s *server) setAuditLogOutput(out io.Writer) {
+	s.audit = newAuditLogger(out)
+}
+
+type auditContextKey struct{}
+
+// auditRecord is the target of an admin action, set by handlers that read it from their body
+type auditRecord struct {
+	target string
+}
+
+// setAuditTarget records what an admin action acts on, when it isn't one of its query parameters
+func setAuditTarget(ctx context.Context, target string) {
+	if record, ok := ctx.Value(auditContextKey{}).(*auditRecord); ok {
+		record.target = target
+	}
+}
+
+// audited logs an audit entry for every call of an admin route once it's answered, including the calls
+// ADMIN_TOKEN rejects. In tenant mode, the calls without a valid tenant credential are rejected before
+func (s *server) audited(route adminRoute, next http.Handler) http.Handler {
+	action := route.method + " " + route.path
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{}
+		for _, param := range auditTargetParams {
+			if record.target = r.URL.Query().Get(param); record.target != "" {
+				break
+			}
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		s.audit.json.Info("audit",
+			"actor", s.auditActor(r),
+			"action", action,
+			"target", record.target,
+			"tenant", tenantFrom(r.Context()),
+			"status", rec.status,
+			"result", auditResult(rec.status),
+			"remote_ip", clientIP(r, s.cfg.TrustedProxies),
+		)
+	})
+}
+
+// auditActor names who called an admin route: the holder of ADMIN_TOKEN, a tenant authorized by its
+// credential, or anonymous for a call that wasn't authorized
+func (s *server) auditActor(r *http.Request) string {
+	if s.hasAdminToken(r) {
+		return "admin"
+	}
+	if tenant := tenantFrom(r.Context()); tenant != "" {
+		return "tenant:" + tenant
+	}
+	return "anonymous"
+}
+
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= http.StatusBadRequest:
+		return "failed"
+	}
+	return "ok"
+}
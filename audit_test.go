@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// auditEntries serves requests in-process and returns the audit entries they logged
+func auditEntries(t *testing.T, srv *server, reqs ...*http.Request) []map[string]any {
+	t.Helper()
+	var out bytes.Buffer
+	srv.setAuditLogOutput(&out)
+	handler := srv.handler()
+	for _, req := range reqs {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid audit entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestPurgeIsAudited(t *testing.T) {
+	srv, _, store := newTestServer(t, Config{}, imgproxyStub())
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("image"), ObjectMeta{})
+
+	purge := httptest.NewRequest(http.MethodDelete, "/admin/cache?path="+url.QueryEscape(path), nil)
+	purge.Header.Set(adminTokenHeader, testAdminToken)
+	denied := httptest.NewRequest(http.MethodDelete, "/admin/cache?path="+url.QueryEscape(path), nil)
+	image := httptest.NewRequest(http.MethodGet, path, nil)
+
+	entries := auditEntries(t, srv, purge, denied, image)
+	if len(entries) != 2 {
+		t.Fatalf("Expected an audit entry per admin call and none for images, got %v", entries)
+	}
+
+	entry := entries[0]
+	if entry["msg"] != "audit" || entry["actor"] != "admin" || entry["action"] != "DELETE /admin/cache" || entry["target"] != path ||
+		entry["status"] != float64(http.StatusNoContent) || entry["result"] != "ok" || entry["time"] == nil {
+		t.Fatalf("Unexpected audit entry of the purge: %v", entry)
+	}
+	if entry := entries[1]; entry["actor"] != "anonymous" || entry["result"] != "denied" || entry["target"] != path {
+		t.Fatalf("Unexpected audit entry of the unauthorized purge: %v", entry)
+	}
+	for _, entry := range entries {
+		if line, _ := json.Marshal(entry); strings.Contains(string(line), testAdminToken) {
+			t.Fatalf("Expected the admin token never to be logged: %s", line)
+		}
+	}
+}
+
+func TestAuditTargetFromTheBody(t *testing.T) {
+	srv, _, _ := newTestServer(t, Config{}, imgproxyStub())
+	srv.setWarmSource(newMemoryStore())
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/warm/bucket", strings.NewReader(`{"prefix": "2024/"}`))
+	req.Header.Set(adminTokenHeader, testAdminToken)
+	entries := auditEntries(t, srv, req)
+	if len(entries) != 1 || entries[0]["action"] != "POST /admin/warm/bucket" || entries[0]["target"] != "2024/" {
+		t.Fatalf("Expected the prefix of the body to be the target, got %v", entries)
+	}
+}
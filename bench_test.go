@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// benchImageSize is the size of a typical processed image
+const benchImageSize = 256 * 1024
+
+// sizedStub answers every path with an image of benchImageSize bytes
+func sizedStub() http.Handler {
+	image := bytes.Repeat([]byte{0xff}, benchImageSize)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(image)
+	})
+}
+
+// benchGet requests a URL and reads the whole body, as a client would
+func benchGet(b *testing.B, requestURL string) {
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		b.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		b.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+// benchmarkHit measures the hit path: S3 read and serve
+func benchmarkHit(b *testing.B, store CacheStore) {
+	for _, size := range []int{4 * 1024, 32 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size/1024), func(b *testing.B) {
+			_, proxy := newTestServerWithStore(b, Config{CopyBufferSize: size}, sizedStub(), store)
+
+			path := "/_/rs:fill:300:300/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+			if err := store.Put(context.Background(), GenerateS3Key(path), bytes.NewReader(bytes.Repeat([]byte{0xff}, benchImageSize)), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+				b.Fatalf("Failed to seed the cache: %v", err)
+			}
+
+			b.SetBytes(benchImageSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				benchGet(b, proxy.URL+path)
+			}
+		})
+	}
+}
+
+// benchmarkMiss measures the miss path: processing by the upstream stub and store
+func benchmarkMiss(b *testing.B, store CacheStore) {
+	srv, proxy := newTestServerWithStore(b, Config{}, sizedStub(), store)
+
+	b.SetBytes(benchImageSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchGet(b, proxy.URL+fmt.Sprintf("/_/rs:fill:%d:300/plain/", i)+url.QueryEscape("http://example.com/kitten.jpg"))
+	}
+	srv.uploads.Wait()
+}
+
+func BenchmarkHit(b *testing.B) {
+	benchmarkHit(b, newMemoryStore())
+}
+
+func BenchmarkMiss(b *testing.B) {
+	benchmarkMiss(b, newMemoryStore())
+}
+
+// smallImageSize is the size of a thumbnail, served in a few writes
+const smallImageSize = 16 * 1024
+
+// chunkedStore returns bodies read in small chunks, as they come off a slow S3 connection
+type chunkedStore struct {
+	CacheStore
+	chunk int
+}
+
+func (s chunkedStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	obj, err := s.CacheStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	obj.Body = io.NopCloser(&chunkedReader{r: obj.Body, chunk: s.chunk})
+	return obj, nil
+}
+
+type chunkedReader struct {
+	r     io.Reader
+	chunk int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	return r.r.Read(p[:min(len(p), r.chunk)])
+}
+
+// countingListener counts the writes to the connections it accepts, one per write syscall
+type countingListener struct {
+	net.Listener
+	writes *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, writes: l.writes}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// BenchmarkSmallHitWrites reports the writes per hit of a small image read in 512B chunks,
+// with and without RESPONSE_BUFFER_SIZE
+func BenchmarkSmallHitWrites(b *testing.B) {
+	for _, size := range []int{0, smallImageSize} {
+		b.Run(fmt.Sprintf("response_buffer=%dKB", size/1024), func(b *testing.B) {
+			store := newMemoryStore()
+			srv, _ := newTestServerWithStore(b, Config{ResponseBufferSize: size}, sizedStub(), chunkedStore{CacheStore: store, chunk: 512})
+
+			var writes atomic.Int64
+			proxy := httptest.NewUnstartedServer(srv.handler())
+			proxy.Listener = countingListener{Listener: proxy.Listener, writes: &writes}
+			proxy.Start()
+			b.Cleanup(proxy.Close)
+
+			path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+			if err := store.Put(context.Background(), GenerateS3Key(path), bytes.NewReader(bytes.Repeat([]byte{0xff}, smallImageSize)), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+				b.Fatalf("Failed to seed the cache: %v", err)
+			}
+
+			b.SetBytes(smallImageSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				benchGet(b, proxy.URL+path)
+			}
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// minIOBenchStore starts MinIO and returns a store backed by a fresh bucket
+func minIOBenchStore(b *testing.B) CacheStore {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(b, ctx)
+	b.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(b, ctx, dockerNetwork)
+	b.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(b, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		b.Fatalf("Failed to create bucket: %v", err)
+	}
+	return newS3Store(client, processedBucket, "bench/")
+}
+
+func BenchmarkHitMinIO(b *testing.B) {
+	benchmarkHit(b, minIOBenchStore(b))
+}
+
+func BenchmarkMissMinIO(b *testing.B) {
+	benchmarkMiss(b, minIOBenchStore(b))
+}
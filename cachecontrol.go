@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CACHE_MODE values: read-write is the default, read-only serves the cached images without
+// storing new ones, and off bypasses the cache as if every request carried no-store
+const (
+	cacheModeReadWrite = "read-write"
+	cacheModeReadOnly  = "read-only"
+	cacheModeOff       = "off"
+)
+
+// cacheControl holds the request Cache-Control directives the proxy honors
+type cacheControl struct {
+	// noStore bypasses the cache entirely: nothing is read nor written
+	noStore bool
+	// noCache skips the cached image, the fresh result is still stored
+	noCache bool
+	// readOnly keeps the fresh result out of the cache, the cached image is still served
+	readOnly bool
+}
+
+// cacheControl returns the directives of a request combined with the current CACHE_MODE
+func (s *server) cacheControl(h http.Header) cacheControl {
+	cc := parseCacheControl(h)
+	switch *s.cacheMode.Load() {
+	case cacheModeReadOnly:
+		cc.readOnly = true
+	case cacheModeOff:
+		cc.noStore = true
+	}
+	return cc
+}
+
+// parseCacheControl reads the Cache-Control directives of a request.
+// Directive names are case-insensitive and may be spread across several header lines
+func parseCacheControl(h http.Header) cacheControl {
+	var cc cacheControl
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "no-store":
+				cc.noStore = true
+			case "no-cache":
+				cc.noCache = true
+			}
+		}
+	}
+	return cc
+}
+
+// skipRead reports whether the cached image must not be served
+func (cc cacheControl) skipRead() bool {
+	return cc.noStore || cc.noCache
+}
+
+// skipWrite reports whether the processed image must not be stored
+func (cc cacheControl) skipWrite() bool {
+	return cc.noStore || cc.readOnly
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   cacheControl
+	}{
+		{nil, cacheControl{}},
+		{[]string{"max-age=0"}, cacheControl{}},
+		{[]string{"no-store"}, cacheControl{noStore: true}},
+		{[]string{"No-Cache"}, cacheControl{noCache: true}},
+		{[]string{"max-age=0, no-cache=\"Set-Cookie\""}, cacheControl{noCache: true}},
+		{[]string{"no-cache", "no-store"}, cacheControl{noStore: true, noCache: true}},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		for _, v := range tt.values {
+			h.Add("Cache-Control", v)
+		}
+		if got := parseCacheControl(h); got != tt.want {
+			t.Errorf("parseCacheControl(%q) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+type cacheGenerationState struct {
+	Generation int64 `json:"generation"`
+}
+
+// handleCacheGeneration reports the CACHE_GENERATION keys are derived in
+func (s *server) handleCacheGeneration(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cacheGenerationState{Generation: s.keys.currentGeneration()})
+}
+
+// handleBumpCacheGeneration moves every key to the next generation, a global purge that doesn't touch the bucket:
+// the images cached so far are unreachable, left for the bucket's lifecycle rules to expire.
+// The bump lasts until the next restart, CACHE_GENERATION must be raised along with it to keep it
+func (s *server) handleBumpCacheGeneration(w http.ResponseWriter, r *http.Request) {
+	generation := s.keys.bumpGeneration()
+	slog.Warn("Cache generation bumped, the images cached before are unreachable", "generation", generation)
+	writeJSON(w, http.StatusOK, cacheGenerationState{Generation: generation})
+}
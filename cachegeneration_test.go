@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCacheGenerationChangesEveryKey(t *testing.T) {
+	path := "/rs:fill:300:300/plain/https://example.com/cat.jpg@webp"
+
+	for _, layout := range []string{keyLayoutFlat, keyLayoutBySource, keyLayoutBySourceOptions} {
+		keys := newKeyScheme(Config{KeyLayout: layout, ImgproxyVersionTag: "v3.28.0"})
+		before := keys.key("acme", path)
+		keys.bumpGeneration()
+		after := keys.key("acme", path)
+
+		if before == after {
+			t.Fatalf("Expected the %s key to change with the generation, got %s", layout, after)
+		}
+		if !strings.HasPrefix(after, "v3.28.0/gen-1/acme/") {
+			t.Errorf("Expected the generation folder between the version and tenant ones, got %s", after)
+		}
+		if strings.TrimPrefix(after, "v3.28.0/gen-1/") != strings.TrimPrefix(before, "v3.28.0/") {
+			t.Errorf("Expected only the generation folder to be added, got %s and %s", before, after)
+		}
+	}
+
+	if got := newKeyScheme(Config{}).key("", path); got != GenerateS3Key(path) {
+		t.Fatalf("Expected the keys of generation 0 to be unchanged, got %s", got)
+	}
+}
+
+func TestRaiseGenerationNeverGoesBack(t *testing.T) {
+	keys := newKeyScheme(Config{CacheGeneration: 3})
+	if got := keys.raiseGeneration(2); got != 3 {
+		t.Fatalf("Expected the generation to stay 3, got %d", got)
+	}
+	if got := keys.raiseGeneration(5); got != 5 || keys.currentGeneration() != 5 {
+		t.Fatalf("Expected the generation to be raised to 5, got %d", got)
+	}
+}
+
+func TestAdminBumpPurgesEveryImage(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected a hit before the bump")
+	}
+
+	resp := adminDo(t, http.MethodPost, proxy.URL+"/admin/generation")
+	var state cacheGenerationState
+	json.NewDecoder(resp.Body).Decode(&state)
+	if resp.StatusCode != http.StatusOK || state.Generation != 1 {
+		t.Fatalf("Expected the generation to be bumped to 1, got status %d and %+v", resp.StatusCode, state)
+	}
+
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatal("Expected the image cached before the bump to be unreachable")
+	}
+	srv.uploads.Wait()
+	if store.len() != 2 {
+		t.Fatalf("Expected the old image to be left in the bucket, got %d objects", store.len())
+	}
+	if _, ok := store.get("gen-1/" + GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the image to be stored again in the new generation")
+	}
+
+	resp = adminDo(t, http.MethodGet, proxy.URL+"/admin/generation")
+	json.NewDecoder(resp.Body).Decode(&state)
+	if state.Generation != 1 {
+		t.Fatalf("Expected the bumped generation to be reported, got %d", state.Generation)
+	}
+}
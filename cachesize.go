@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runCacheSizeScan lists the whole cache every CACHE_SIZE_SCAN_INTERVAL, so the size gauges are read
+// from memory on scrapes instead of listing the bucket each time. The first scan starts right away
+func (s *server) runCacheSizeScan(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.CacheSizeScanInterval)
+	defer ticker.Stop()
+
+	for {
+		s.scanCacheSize(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanCacheSize counts the objects of the cache and their bytes, a page of maxListLimit objects at a time
+// through the S3 limiter. A scan can't run longer than the interval, and a failed one keeps the last values
+func (s *server) scanCacheSize(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.CacheSizeScanInterval)
+	defer cancel()
+
+	start := time.Now()
+	var objects, bytes int64
+	cursor := ""
+	for {
+		page, err := s.store.List(ctx, "", cursor, maxListLimit)
+		if err != nil {
+			slog.Warn("Cache size scan failed", "objects_listed", objects, "error", err)
+			return
+		}
+		for _, obj := range page.Objects {
+			objects++
+			bytes += obj.Size
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	s.cacheObjects.Set(float64(objects))
+	s.cacheBytes.Set(float64(bytes))
+	s.cacheSizeScanned.Set(float64(time.Now().Unix()))
+	slog.Debug("Scanned the cache size", "objects", objects, "bytes", bytes, "duration", time.Since(start))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSizeScanUpdatesTheGauges(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{CacheSizeScanInterval: 10 * time.Millisecond}, imgproxyStub())
+	// More objects than a listing page, so the scan follows the cursor
+	for i := range maxListLimit + 5 {
+		store.Put(context.Background(), fmt.Sprintf("key-%04d", i), strings.NewReader("ab"), ObjectMeta{})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.runCacheSizeScan(ctx)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.cacheObjects.Value() != maxListLimit+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the scan to count the objects, got %g", srv.cacheObjects.Value())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	resp := get(t, proxy.URL+"/metrics")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), fmt.Sprintf("\nimgproxy_cache_objects_total %d\n", maxListLimit+5)) ||
+		!strings.Contains(string(body), fmt.Sprintf("\nimgproxy_cache_bytes_total %d\n", 2*(maxListLimit+5))) {
+		t.Fatalf("Expected the cache size gauges in the metrics, got %s", body)
+	}
+	if srv.cacheSizeScanned.Value() == 0 {
+		t.Fatal("Expected the time of the scan to be recorded")
+	}
+}
+
+func TestFailedCacheSizeScanKeepsTheLastValues(t *testing.T) {
+	srv, _ := newTestServerWithStore(t, Config{CacheSizeScanInterval: time.Minute}, imgproxyStub(), cancelledListStore{newMemoryStore()})
+	srv.cacheObjects.Set(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.scanCacheSize(ctx)
+	if srv.cacheObjects.Value() != 3 {
+		t.Fatalf("Expected a failed scan to keep the last count, got %g", srv.cacheObjects.Value())
+	}
+}
+
+// cancelledListStore fails its listings once their context is done
+type cancelledListStore struct {
+	*memoryStore
+}
+
+func (c cancelledListStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.memoryStore.List(ctx, prefix, cursor, limit)
+}
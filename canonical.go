@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+)
+
+// canonicalPath returns a cleaned path with its source URL normalized as keys are, lowercase scheme and host
+// and no needless percent-encoding, signed again. Paths that can't be parsed are returned as is
+func (s *server) canonicalPath(path string) string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return path
+	}
+	source, err := p.SourceURL()
+	if err != nil {
+		return path
+	}
+	normalized := normalizeSourceURL(source)
+	if normalized == source {
+		return path
+	}
+
+	if p.Plain {
+		p.Source = url.QueryEscape(normalized)
+	} else {
+		p.Source = base64.RawURLEncoding.EncodeToString([]byte(normalized))
+	}
+	return s.signatures.resign(p).String()
+}
+
+// linkCanonical adds a Link header with rel="canonical" to the response of a request whose path was normalized,
+// by NORMALIZE_PATH_SLASHES or the source URL normalization of keys, so clients and CDNs converge on one URL.
+// The canonical path is signed again, so it's only advertised once the requested path's signature is verified
+func (s *server) linkCanonical(w http.ResponseWriter, requested, cleaned string) {
+	if !s.cfg.CanonicalLink {
+		return
+	}
+	canonical := s.canonicalPath(cleaned)
+	if canonical == requested || s.signatures.verify(requested) != nil {
+		return
+	}
+	w.Header().Add("Link", "<"+canonical+`>; rel="canonical"`)
+}
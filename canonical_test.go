@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizedRequestLinksToCanonicalPath(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{NormalizePathSlashes: true, CanonicalLink: true}, imgproxyStub())
+
+	canonical := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/cat.jpg")
+	tests := []struct {
+		name, path, want string
+	}{
+		{"duplicate slashes", "/_//rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/cat.jpg"), "<" + canonical + `>; rel="canonical"`},
+		{"uppercase host", "/_/rs:fill:50:50/plain/" + url.QueryEscape("HTTP://Example.COM/cat.jpg"), "<" + canonical + `>; rel="canonical"`},
+		{"canonical", canonical, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, proxy.URL+tt.path)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Link"); got != tt.want {
+				t.Fatalf("Expected Link %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCanonicalLinkIsSignedOnlyForValidSignatures(t *testing.T) {
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	cfg := Config{CanonicalLink: true, ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32}
+	_, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/rs:fill:50:50/plain/" + url.QueryEscape("HTTP://Example.com/cat.jpg")
+	resp := get(t, proxy.URL+sign(key, salt, path))
+	want := "<" + sign(key, salt, "/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/cat.jpg")) + `>; rel="canonical"`
+	if got := resp.Header.Get("Link"); got != want {
+		t.Fatalf("Expected Link %q, got %q", want, got)
+	}
+
+	if resp := get(t, proxy.URL+sign([]byte("other-key"), salt, path)); resp.Header.Get("Link") != "" {
+		t.Fatalf("Expected no canonical path to be signed for an invalid signature, got %q", resp.Header.Get("Link"))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// imageMethods are the methods an image path answers
+var imageMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// defaultCapabilityTransforms are the imgproxy options advertised when CAPABILITY_TRANSFORMS isn't set
+var defaultCapabilityTransforms = []string{
+	"resize", "size", "width", "height", "dpr", "quality", "format", "crop", "gravity", "blur", "sharpen", "rotate", "strip_metadata",
+}
+
+// capabilitiesHeader advertises the formats and transforms of an image path alongside the Allow header
+const capabilitiesHeader = "X-Image-Capabilities"
+
+// capabilities is the body of an OPTIONS request on an image path
+type capabilities struct {
+	Methods            []string `json:"methods"`
+	Formats            []string `json:"formats"`
+	Transforms         []string `json:"transforms"`
+	NegotiatedFormats  []string `json:"negotiated_formats,omitempty"`
+	MaxOutputDimension int      `json:"max_output_dimension,omitempty"`
+	MaxPixels          int      `json:"max_pixels,omitempty"`
+}
+
+// parseCapabilityFormats reads the output formats of CAPABILITY_FORMATS, the negotiable ones by default
+func parseCapabilityFormats(items []string) ([]string, error) {
+	if len(items) == 0 {
+		return negotiableFormats, nil
+	}
+	formats := make([]string, 0, len(items))
+	for _, item := range items {
+		format := canonicalFormat(item)
+		if !isExtension(format) {
+			return nil, fmt.Errorf("invalid CAPABILITY_FORMATS item %q", item)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// parseCapabilityTransforms reads the imgproxy option names of CAPABILITY_TRANSFORMS
+func parseCapabilityTransforms(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return defaultCapabilityTransforms, nil
+	}
+	for _, name := range names {
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			return nil, fmt.Errorf("invalid CAPABILITY_TRANSFORMS item %q, expected an imgproxy option name such as resize", name)
+		}
+	}
+	return names, nil
+}
+
+// handleImageOptions answers an OPTIONS request on an image path with the methods it allows and the output formats
+// and transforms of CAPABILITY_FORMATS and CAPABILITY_TRANSFORMS, so clients can decide what to request.
+// They are summed up in the X-Image-Capabilities header and detailed, with the proxy's own limits, in the body
+func (s *server) handleImageOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(imageMethods, ", "))
+	w.Header().Set(capabilitiesHeader, fmt.Sprintf("formats=%s; transforms=%s",
+		strings.Join(s.cfg.CapabilityFormats, ","), strings.Join(s.cfg.CapabilityTransforms, ",")))
+	writeJSON(w, http.StatusOK, capabilities{
+		Methods:            imageMethods,
+		Formats:            s.cfg.CapabilityFormats,
+		Transforms:         s.cfg.CapabilityTransforms,
+		NegotiatedFormats:  s.cfg.AcceptFormats,
+		MaxOutputDimension: s.cfg.MaxOutputDimension,
+		MaxPixels:          s.cfg.MaxPixels,
+	})
+}
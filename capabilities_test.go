@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	if formats, err := parseCapabilityFormats([]string{"WebP", "jpeg"}); err != nil || !slices.Equal(formats, []string{"webp", "jpg"}) {
+		t.Fatalf("Unexpected formats %v, %v", formats, err)
+	}
+	if _, err := parseCapabilityFormats([]string{"web p"}); err == nil {
+		t.Fatal("Expected an invalid format to be rejected")
+	}
+	if transforms, _ := parseCapabilityTransforms(nil); !slices.Equal(transforms, defaultCapabilityTransforms) {
+		t.Fatalf("Expected the default transforms, got %v", transforms)
+	}
+	if _, err := parseCapabilityTransforms([]string{"resize;width"}); err == nil {
+		t.Fatal("Expected an invalid transform to be rejected")
+	}
+}
+
+func TestOptionsAdvertisesCapabilities(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+	})
+	cfg := Config{
+		CapabilityFormats:    []string{"avif", "webp", "jpg"},
+		CapabilityTransforms: []string{"resize", "quality"},
+		AcceptFormats:        []string{"avif", "webp"},
+		MaxOutputDimension:   4096,
+	}
+	_, proxy, store := newTestServer(t, cfg, stub)
+
+	req, _ := http.NewRequest(http.MethodOptions, proxy.URL+"/_/rs:fill:300:300/plain/"+url.QueryEscape("http://example.com/kitten.jpg"), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Fatalf("Unexpected Allow header %q", got)
+	}
+	if got := resp.Header.Get(capabilitiesHeader); got != "formats=avif,webp,jpg; transforms=resize,quality" {
+		t.Fatalf("Unexpected capabilities header %q", got)
+	}
+
+	var body capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(body.Formats, cfg.CapabilityFormats) || !slices.Equal(body.Transforms, cfg.CapabilityTransforms) ||
+		!slices.Equal(body.NegotiatedFormats, cfg.AcceptFormats) || body.MaxOutputDimension != 4096 || body.MaxPixels != 0 {
+		t.Fatalf("Unexpected capabilities %+v", body)
+	}
+
+	if upstreamCalls.Load() != 0 || store.len() != 0 {
+		t.Fatal("Expected OPTIONS to be answered by the proxy alone")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NEW_KEY_POLICY values, applied to the misses over MAX_NEW_KEYS_PER_MINUTE
+const (
+	newKeyBypass = "bypass"
+	newKeyReject = "reject"
+)
+
+// newKeyWindow is the window MAX_NEW_KEYS_PER_MINUTE counts the new keys over
+const newKeyWindow = time.Minute
+
+// newKeyGuard tracks the unique keys cached over the last minute, so clients creating endless variants
+// can't fill the bucket. Keys are forgotten once their minute has passed
+type newKeyGuard struct {
+	max int
+
+	mu sync.Mutex
+	// seen holds the time each key of the window was admitted at, and order its keys from the oldest
+	seen  map[string]time.Time
+	order []string
+}
+
+func newNewKeyGuard(max int) *newKeyGuard {
+	return &newKeyGuard{max: max, seen: map[string]time.Time{}}
+}
+
+// admit records a new key, unless the window already has max of them. A key seen within the window is always
+// admitted. Otherwise, it returns how long until the window has room again
+func (g *newKeyGuard) admit(key string, now time.Time) (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for len(g.order) > 0 && now.Sub(g.seen[g.order[0]]) >= newKeyWindow {
+		delete(g.seen, g.order[0])
+		g.order = g.order[1:]
+	}
+	if _, ok := g.seen[key]; ok {
+		return true, 0
+	}
+	if len(g.order) >= g.max {
+		return false, newKeyWindow - now.Sub(g.seen[g.order[0]])
+	}
+	g.seen[key] = now
+	g.order = append(g.order, key)
+	return true, 0
+}
+
+type uncachedContextKey struct{}
+
+// admitNewKey applies MAX_NEW_KEYS_PER_MINUTE to a miss about to be processed. Over the limit, the image
+// is processed but not stored with the bypass NEW_KEY_POLICY, and the request answers 429 with reject.
+// Cached images are still served, the limit only applies to the keys the request would create
+func (s *server) admitNewKey(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.newKeys == nil || s.skipStore(r) {
+		return r, true
+	}
+	path := requestPath(r.URL)
+	ok, retryAfter := s.newKeys.admit(s.cacheKey(r.Context(), path), time.Now())
+	if ok {
+		return r, true
+	}
+	s.newKeysOverLimit.Add(1)
+
+	if s.cfg.NewKeyPolicy == newKeyReject {
+		slog.Warn("Rejected new key over MAX_NEW_KEYS_PER_MINUTE", "path", path)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "too many new variants, retry later", http.StatusTooManyRequests)
+		return nil, false
+	}
+	slog.Warn("Serving new key over MAX_NEW_KEYS_PER_MINUTE without caching it", "path", path)
+	return r.WithContext(context.WithValue(r.Context(), uncachedContextKey{}, true)), true
+}
+
+// skipStore reports whether the processed image of a request must not be stored, because of its
+// Cache-Control directives or because its key is over MAX_NEW_KEYS_PER_MINUTE
+func (s *server) skipStore(r *http.Request) bool {
+	uncached, _ := r.Context().Value(uncachedContextKey{}).(bool)
+	return uncached || s.cacheControl(r.Header).skipWrite()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewKeyGuardSlidesOverAMinute(t *testing.T) {
+	guard := newNewKeyGuard(2)
+	start := time.Now()
+
+	for _, key := range []string{"a", "b", "a"} {
+		if ok, _ := guard.admit(key, start); !ok {
+			t.Fatalf("Expected %q to be admitted", key)
+		}
+	}
+	ok, retryAfter := guard.admit("c", start.Add(20*time.Second))
+	if ok || retryAfter != 40*time.Second {
+		t.Fatalf("Expected a third key to wait 40s, got %v, %v", ok, retryAfter)
+	}
+	if ok, _ := guard.admit("c", start.Add(time.Minute)); !ok {
+		t.Fatal("Expected a new key to be admitted once the first ones are a minute old")
+	}
+}
+
+func manyVariantPaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/_/rs:fill:%d:%d/plain/", 10+i, 10+i) + url.QueryEscape("http://example.com/kitten.jpg")
+	}
+	return paths
+}
+
+func TestNewKeysOverTheLimitAreServedUncached(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{MaxNewKeysPerMinute: 5}, imgproxyStub())
+
+	paths := manyVariantPaths(20)
+	for _, path := range paths {
+		if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected every variant to be served, got status %d", resp.StatusCode)
+		}
+	}
+	srv.uploads.Wait()
+	if store.len() != 5 {
+		t.Fatalf("Expected caching to stop after 5 new keys, got %d cached images", store.len())
+	}
+	if srv.newKeysOverLimit.Load() != 15 {
+		t.Fatalf("Expected 15 misses over the limit, got %d", srv.newKeysOverLimit.Load())
+	}
+
+	if resp := get(t, proxy.URL+paths[0]); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected a cached variant to still be served from the cache")
+	}
+	if resp := get(t, proxy.URL+paths[19]); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatal("Expected a variant over the limit not to be cached")
+	}
+}
+
+func TestNewKeysOverTheLimitAreRejected(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{MaxNewKeysPerMinute: 2, NewKeyPolicy: newKeyReject}, imgproxyStub())
+
+	paths := manyVariantPaths(3)
+	get(t, proxy.URL+paths[0])
+	get(t, proxy.URL+paths[1])
+	resp := get(t, proxy.URL+paths[2])
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected status 429 with a Retry-After, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if store.len() != 2 {
+		t.Fatalf("Expected 2 cached images, got %d", store.len())
+	}
+	if resp := get(t, proxy.URL+paths[1]); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected a cached variant to still be served")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// setClientHints advertises the ACCEPT_CH client hints so that browsers send them with
+// their next requests, and the CRITICAL_CH ones they should retry the request with
+func (s *server) setClientHints(w http.ResponseWriter) {
+	if len(s.cfg.AcceptCH) == 0 {
+		return
+	}
+	w.Header().Set("Accept-CH", strings.Join(s.cfg.AcceptCH, ", "))
+	if len(s.cfg.CriticalCH) > 0 {
+		w.Header().Set("Critical-CH", strings.Join(s.cfg.CriticalCH, ", "))
+	}
+}
+
+// missingCriticalHint returns a CRITICAL_CH hint that isn't in ACCEPT_CH, browsers ignore those
+func missingCriticalHint(accept, critical []string) (string, bool) {
+	for _, hint := range critical {
+		if !slices.ContainsFunc(accept, func(a string) bool { return strings.EqualFold(a, hint) }) {
+			return hint, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestAcceptCHAdvertisesConfiguredHints(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{AcceptCH: []string{"Sec-CH-DPR", "Sec-CH-Width"}, CriticalCH: []string{"Sec-CH-DPR"}}, imgproxyStub())
+	path := proxy.URL + "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	miss := get(t, path)
+	srv.uploads.Wait()
+	hit := get(t, path)
+
+	for _, resp := range []struct {
+		name, acceptCH, criticalCH string
+	}{
+		{"miss", miss.Header.Get("Accept-CH"), miss.Header.Get("Critical-CH")},
+		{"hit", hit.Header.Get("Accept-CH"), hit.Header.Get("Critical-CH")},
+	} {
+		if resp.acceptCH != "Sec-CH-DPR, Sec-CH-Width" {
+			t.Errorf("Expected Accept-CH: Sec-CH-DPR, Sec-CH-Width on the %s, got %q", resp.name, resp.acceptCH)
+		}
+		if resp.criticalCH != "Sec-CH-DPR" {
+			t.Errorf("Expected Critical-CH: Sec-CH-DPR on the %s, got %q", resp.name, resp.criticalCH)
+		}
+	}
+}
+
+func TestAcceptCHIsOmittedByDefault(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.Header.Get("Accept-CH") != "" {
+		t.Fatalf("Expected no Accept-CH header, got %q", resp.Header.Get("Accept-CH"))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies reads the IPs and CIDR ranges of TRUSTED_PROXIES, the proxies whose X-Forwarded-For is believed
+func parseTrustedProxies(items []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(items))
+	for _, item := range items {
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES item %q, expected an IP or a CIDR range", item)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// parseHostIP reads the IP of a RemoteAddr or X-Forwarded-For entry, with or without a port,
+// IPv6 addresses being bracketed when there's one. IPv4-mapped IPv6 addresses are unmapped
+func parseHostIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr.WithZone("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client of a request. When the connection comes from a trusted proxy,
+// X-Forwarded-For is walked from the closest hop, and the first address that isn't a trusted proxy is the client.
+// Entries that can't be parsed stop the walk, the hop before them is the client
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	remote, ok := parseHostIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(remote, trusted) {
+		return remote.String()
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostIP(hops[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !isTrustedProxy(addr, trusted) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse the trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name, remoteAddr, forwardedFor, want string
+	}{
+		{"IPv4 connection", "198.51.100.7:5432", "", "198.51.100.7"},
+		{"IPv6 connection", "[2001:db8::1]:5432", "", "2001:db8::1"},
+		{"IPv6 connection with a zone", "[fe80::1%eth0]:5432", "", "fe80::1%eth0"},
+		{"IPv4-mapped connection", "[::ffff:198.51.100.7]:5432", "", "198.51.100.7"},
+		{"untrusted proxy", "[2001:db8::1]:5432", "2001:db8::99", "2001:db8::1"},
+		{"trusted IPv6 proxy", "[fd00::1]:443", "2001:db8::7", "2001:db8::7"},
+		{"bracketed entry with a port", "[fd00::1]:443", "[2001:db8::8]:1234", "2001:db8::8"},
+		{"bracketed entry", "10.1.2.3:443", "[2001:db8::9]", "2001:db8::9"},
+		{"closest untrusted hop", "10.1.2.3:443", "2001:db8::1, 203.0.113.5, fd00::2", "203.0.113.5"},
+		{"trusted single IP", "192.0.2.1:443", "203.0.113.5:80", "203.0.113.5"},
+		{"unparsable entry", "[fd00::1]:443", "2001:db8::1, not-an-ip", "fd00::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidItems(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("Expected an invalid range to be rejected")
+	}
+}
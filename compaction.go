@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// compactionRetry is the wait before listing a page of the cache again after a failure
+const compactionRetry = time.Minute
+
+// parseCompactFrom reads the formats of COMPACT_FROM
+func parseCompactFrom(items []string) ([]string, error) {
+	formats := make([]string, 0, len(items))
+	for _, item := range items {
+		format := canonicalFormat(item)
+		if !slices.Contains(negotiableFormats, format) {
+			return nil, fmt.Errorf("invalid COMPACT_FROM item %q", item)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// compactionCheckpoint is the progress of a compaction saved to COMPACT_CHECKPOINT_FILE after each page,
+// so a restarted instance resumes from the page it stopped at. Done is set once the whole cache was compacted
+type compactionCheckpoint struct {
+	Format string `json:"format"`
+	Cursor string `json:"cursor"`
+	Done   bool   `json:"done"`
+}
+
+// runCompaction re-encodes the cached images in the COMPACT_FROM formats to COMPACT_FORMAT, one page of
+// maxListLimit objects at a time and at most COMPACT_RATE images per second, replacing each under its own key.
+// Only the images whose path left the format to imgproxy are re-encoded, the others asked for their format
+func (s *server) runCompaction(ctx context.Context) {
+	checkpoint := s.loadCompactionCheckpoint()
+	if checkpoint.Done {
+		slog.Info("Cache already compacted", "format", checkpoint.Format)
+		return
+	}
+	slog.Info("Compacting the cache", "format", s.cfg.CompactFormat, "from", s.cfg.CompactFrom, "cursor", checkpoint.Cursor)
+
+	throttle := time.NewTicker(time.Second / time.Duration(s.cfg.CompactRate))
+	defer throttle.Stop()
+
+	for {
+		page, err := s.store.List(ctx, "", checkpoint.Cursor, maxListLimit)
+		if err != nil {
+			slog.Warn("Failed to list the cache to compact", "cursor", checkpoint.Cursor, "error", err)
+			select {
+			case <-time.After(compactionRetry):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for _, obj := range page.Objects {
+			info, ok := s.compactionCandidate(ctx, obj.Key)
+			if !ok {
+				continue
+			}
+			select {
+			case <-throttle.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := s.compactObject(ctx, info); err != nil {
+				slog.Warn("Failed to compact a cached image", "key", obj.Key, "source", info.SourceURL, "error", err)
+			}
+		}
+
+		checkpoint.Cursor, checkpoint.Done = page.NextCursor, page.NextCursor == ""
+		s.saveCompactionCheckpoint(checkpoint)
+		if checkpoint.Done {
+			slog.Info("Compacted the cache", "format", s.cfg.CompactFormat,
+				"compacted", s.compacted.Load(), "saved_bytes", s.compactionSaved.Load())
+			return
+		}
+	}
+}
+
+// compactionCandidate returns the cached image of a key when it can be re-encoded to COMPACT_FORMAT. Errors cached
+// with TTL_BY_STATUS, pinned images and images stored without STORE_SOURCE_METADATA are left as is
+func (s *server) compactionCandidate(ctx context.Context, key string) (*ObjectInfo, bool) {
+	info, err := s.store.Head(ctx, key)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) && ctx.Err() == nil {
+			slog.Warn("Failed to read a cached image to compact", "key", key, "error", err)
+		}
+		return nil, false
+	}
+	if info.Status != 0 || info.Pinned || info.SourceURL == "" || info.Format != formatAuto {
+		return nil, false
+	}
+	return info, slices.Contains(s.cfg.CompactFrom, formatFromContentType(info.ContentType))
+}
+
+// compactObject processes the source URL and options of a cached image into COMPACT_FORMAT and stores the result
+// under the same key, unless it isn't smaller. The stored metadata keeps describing the path the key was derived from
+func (s *server) compactObject(ctx context.Context, info *ObjectInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	var options []string
+	if info.Options != "" {
+		options = strings.Split(info.Options, "/")
+	}
+	path := s.signatures.resign(plainPath(info.SourceURL, options, "")).String()
+	resp, err := s.fetchUpstream(ctx, s.signatures.resign(plainPath(info.SourceURL, options, s.cfg.CompactFormat)).String())
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusOK {
+		return fmt.Errorf("imgproxy responded with status %d", resp.status)
+	}
+	body, meta, err := s.hook.Transform(ctx, path, resp.body, ObjectMeta{ContentType: resp.contentType})
+	if err != nil {
+		return fmt.Errorf("response hook failed: %w", err)
+	}
+	if format := formatFromContentType(meta.ContentType); format != s.cfg.CompactFormat {
+		return fmt.Errorf("imgproxy answered %q instead of %s", meta.ContentType, s.cfg.CompactFormat)
+	}
+	if int64(len(body)) >= info.Size {
+		slog.Debug("Compacted image isn't smaller, keeping the cached one", "key", info.Key, "size", info.Size, "compacted_size", len(body))
+		return nil
+	}
+
+	if err := s.storeObject(ctx, info.Key, path, body, meta); err != nil {
+		return err
+	}
+	s.compacted.Add(1)
+	s.compactionSaved.Add(info.Size - int64(len(body)))
+	slog.Debug("Compacted a cached image", "key", info.Key, "path", path, "size", info.Size, "compacted_size", len(body))
+	return nil
+}
+
+// loadCompactionCheckpoint returns the checkpoint of COMPACT_CHECKPOINT_FILE. A compaction to another format,
+// or a missing or unreadable checkpoint, starts from the beginning
+func (s *server) loadCompactionCheckpoint() compactionCheckpoint {
+	fresh := compactionCheckpoint{Format: s.cfg.CompactFormat}
+	if s.cfg.CompactCheckpointFile == "" {
+		return fresh
+	}
+	data, err := os.ReadFile(s.cfg.CompactCheckpointFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to read the compaction checkpoint, starting over", "file", s.cfg.CompactCheckpointFile, "error", err)
+		}
+		return fresh
+	}
+	var checkpoint compactionCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		slog.Warn("Invalid compaction checkpoint, starting over", "file", s.cfg.CompactCheckpointFile, "error", err)
+		return fresh
+	}
+	if checkpoint.Format != s.cfg.CompactFormat {
+		return fresh
+	}
+	return checkpoint
+}
+
+// saveCompactionCheckpoint replaces COMPACT_CHECKPOINT_FILE, a failure only costs redoing the pages since the last one
+func (s *server) saveCompactionCheckpoint(checkpoint compactionCheckpoint) {
+	if s.cfg.CompactCheckpointFile == "" {
+		return
+	}
+	data, err := json.Marshal(checkpoint)
+	if err == nil {
+		tmp := s.cfg.CompactCheckpointFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.cfg.CompactCheckpointFile)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to save the compaction checkpoint", "file", s.cfg.CompactCheckpointFile, "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// avifStub answers paths asking for AVIF with a small AVIF image, and the others with a larger JPEG
+func avifStub(calls *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if strings.HasSuffix(requestPath(r.URL), "@avif") {
+			w.Header().Set("Content-Type", "image/avif")
+			w.Write([]byte("avif"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("a much larger jpeg image"))
+	})
+}
+
+func TestCompactionReencodesCachedImages(t *testing.T) {
+	var calls atomic.Int64
+	cfg := Config{StoreSourceMetadata: true, CompactFormat: "avif", CompactFrom: []string{"jpg", "webp"}, CompactRate: 1000}
+	srv, proxy, store := newTestServer(t, cfg, avifStub(&calls))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	explicit := path + "@jpg"
+	for _, p := range []string{path, explicit} {
+		get(t, proxy.URL+p)
+	}
+	srv.uploads.Wait()
+
+	srv.runCompaction(context.Background())
+
+	info, err := store.Head(context.Background(), GenerateS3Key(path))
+	if err != nil {
+		t.Fatalf("Expected the image to stay cached: %v", err)
+	}
+	if body, _ := store.get(GenerateS3Key(path)); !bytes.Equal(body, []byte("avif")) || info.ContentType != "image/avif" {
+		t.Fatalf("Expected the cached image to be replaced by its AVIF encoding, got %q (%s)", body, info.ContentType)
+	}
+	if info.Format != formatAuto || info.Options != "rs:fill:50:50" || info.SourceURL != "http://example.com/kitten.jpg" {
+		t.Fatalf("Expected the metadata to keep describing the requested path, got %+v", info.ObjectMeta)
+	}
+	if body, _ := store.get(GenerateS3Key(explicit)); bytes.Equal(body, []byte("avif")) {
+		t.Fatal("Expected an image whose path asked for its format to be left as is")
+	}
+	if srv.compacted.Load() != 1 {
+		t.Fatalf("Expected a single compacted image, got %d", srv.compacted.Load())
+	}
+
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Content-Type") != "image/avif" {
+		t.Fatalf("Expected the compacted image to be served from the cache, got %s %s", resp.Header.Get("X-Cache"), resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestCompactionResumesFromItsCheckpoint(t *testing.T) {
+	var calls atomic.Int64
+	checkpointFile := filepath.Join(t.TempDir(), "compaction.json")
+	cfg := Config{StoreSourceMetadata: true, CompactFormat: "avif", CompactFrom: []string{"jpg"}, CompactRate: 1000, CompactCheckpointFile: checkpointFile}
+	srv, _, store := newTestServer(t, cfg, avifStub(&calls))
+
+	meta := ObjectMeta{ContentType: "image/jpeg", SourceURL: "http://example.com/kitten.jpg", Options: "w:300", Format: formatAuto}
+	store.Put(context.Background(), "compacted-before", strings.NewReader("a much larger jpeg image"), meta)
+	store.Put(context.Background(), "not-yet", strings.NewReader("a much larger jpeg image"), meta)
+	os.WriteFile(checkpointFile, []byte(`{"format":"avif","cursor":"compacted-before"}`), 0o600)
+
+	srv.runCompaction(context.Background())
+	if body, _ := store.get("compacted-before"); bytes.Equal(body, []byte("avif")) {
+		t.Fatal("Expected the objects before the checkpoint not to be compacted again")
+	}
+	if body, _ := store.get("not-yet"); !bytes.Equal(body, []byte("avif")) {
+		t.Fatalf("Expected the objects after the checkpoint to be compacted, got %q", body)
+	}
+
+	before := calls.Load()
+	srv.runCompaction(context.Background())
+	if calls.Load() != before {
+		t.Fatal("Expected a finished compaction not to run again")
+	}
+}
+
+func TestParseCompactFrom(t *testing.T) {
+	if formats, err := parseCompactFrom([]string{"JPEG", "webp"}); err != nil || !slices.Equal(formats, []string{"jpg", "webp"}) {
+		t.Fatalf("Unexpected formats %v: %v", formats, err)
+	}
+	if _, err := parseCompactFrom([]string{"bmp"}); err == nil {
+		t.Fatal("Expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// STORE_READ_ORDER names of the S3_BUCKET and SECONDARY_S3_BUCKET stores
+const (
+	storePrimary   = "primary"
+	storeSecondary = "secondary"
+)
+
+// compositeStore reads through several stores in order and writes to a single primary one,
+// to migrate from a backend to another without starting with an empty cache
+type compositeStore struct {
+	primary CacheStore
+	// readers are tried in order for reads, the primary is one of them
+	readers []CacheStore
+	// backfill copies the objects found in another store to the primary
+	backfill bool
+}
+
+func newCompositeStore(primary CacheStore, readers []CacheStore, backfill bool) *compositeStore {
+	return &compositeStore{primary: primary, readers: readers, backfill: backfill}
+}
+
+// Get returns the object from the first store holding it. A failing store doesn't hide the
+// others, its error is only returned when none of them has the object
+func (c *compositeStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	var firstErr error
+	for _, store := range c.readers {
+		obj, err := store.Get(ctx, key)
+		if err == nil {
+			// A byte range can't be copied, the next whole read of the key back-fills it
+			if store != c.primary && c.backfill && obj.ContentRange == "" {
+				return c.backfillPrimary(ctx, key, obj)
+			}
+			return obj, nil
+		}
+		if !errors.Is(err, ErrNotFound) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNotFound
+}
+
+// backfillPrimary copies an object found in another store to the primary before serving it,
+// so the next reads of the key don't go past the primary
+func (c *compositeStore) backfillPrimary(ctx context.Context, key string, obj *CachedObject) (*CachedObject, error) {
+	body, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// A client going away must not leave the copy half done
+	if err := c.primary.Put(context.WithoutCancel(ctx), key, bytes.NewReader(body), obj.ObjectMeta); err != nil {
+		slog.Warn("Failed to back-fill the primary store", "key", key, "error", err)
+	} else {
+		slog.Info("Back-filled the primary store", "key", key)
+	}
+
+	obj.Body = io.NopCloser(bytes.NewReader(body))
+	obj.ContentLength = int64(len(body))
+	return obj, nil
+}
+
+func (c *compositeStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	var firstErr error
+	for _, store := range c.readers {
+		info, err := store.Head(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, ErrNotFound) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNotFound
+}
+
+func (c *compositeStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	return c.primary.Put(ctx, key, r, meta)
+}
+
+// Delete removes the object from every store, or a purged image would be read through again
+func (c *compositeStore) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, store := range c.readers {
+		errs = append(errs, store.Delete(ctx, key))
+	}
+	return errors.Join(errs...)
+}
+
+// List only lists the primary store, whose pages can't be merged with the others'
+func (c *compositeStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	return c.primary.List(ctx, prefix, cursor, limit)
+}
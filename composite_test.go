@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompositeStoreReadsThroughTheSecondary(t *testing.T) {
+	primary, secondary := newMemoryStore(), newMemoryStore()
+	secondary.Put(context.Background(), "old", strings.NewReader("old image"), ObjectMeta{ContentType: "image/jpeg"})
+	store := newCompositeStore(primary, []CacheStore{primary, secondary}, false)
+
+	obj, err := store.Get(context.Background(), "old")
+	if err != nil {
+		t.Fatalf("Expected the object to be read from the secondary store: %v", err)
+	}
+	defer obj.Body.Close()
+	if body, _ := io.ReadAll(obj.Body); string(body) != "old image" || obj.ContentType != "image/jpeg" {
+		t.Fatalf("Expected the secondary object, got %q %q", body, obj.ContentType)
+	}
+	if _, ok := primary.get("old"); ok {
+		t.Fatal("Expected the primary not to be back-filled by default")
+	}
+
+	if err := store.Put(context.Background(), "new", strings.NewReader("new image"), ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secondary.get("new"); ok {
+		t.Fatal("Expected writes to go to the primary only")
+	}
+	if _, err := store.Get(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound when no store has the object, got %v", err)
+	}
+}
+
+func TestCompositeStoreBackfillsThePrimary(t *testing.T) {
+	primary, secondary := newMemoryStore(), newMemoryStore()
+	secondary.Put(context.Background(), "old", strings.NewReader("old image"), ObjectMeta{ContentType: "image/jpeg"})
+	store := newCompositeStore(primary, []CacheStore{primary, secondary}, true)
+
+	obj, err := store.Get(context.Background(), "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+	if body, _ := io.ReadAll(obj.Body); string(body) != "old image" {
+		t.Fatalf("Expected the secondary object to be served, got %q", body)
+	}
+	if stored, ok := primary.get("old"); !ok || string(stored) != "old image" {
+		t.Fatalf("Expected the primary to be back-filled, got %q", stored)
+	}
+
+	if err := store.Delete(context.Background(), "old"); err != nil {
+		t.Fatal(err)
+	}
+	if primary.len()+secondary.len() != 0 {
+		t.Fatal("Expected a purge to remove the object from every store")
+	}
+}
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	S3Bucket                      string
+	S3Buckets                     []string
+	S3Folder                      string
+	TigrisProxyBind               string
+	ListenNetwork                 string
+	TrustedProxies                []netip.Prefix
+	HealthCheckTimeout            time.Duration
+	HealthCheckProbeTimeout       time.Duration
+	HealthCheckMaxRedirects       int
+	UploadSpoolDir                string
+	SpriteMaxImages               int
+	UploadSpoolRetryInterval      time.Duration
+	SyntheticProbeInterval        time.Duration
+	CacheSizeScanInterval         time.Duration
+	CompactRate                   int
+	SyntheticProbePath            string
+	WarmConcurrency               int
+	SSEHeartbeatInterval          time.Duration
+	WarmPresets                   []warmPreset
+	WarmSourceBucket              string
+	WarmSourceURLPrefix           string
+	PregenerateFormats            []string
+	CompactFrom                   []string
+	CompactFormat                 string
+	CompactCheckpointFile         string
+	FormatFallbackChain           []string
+	SourceFallback                bool
+	PassthroughContentTypes       []string
+	AcceptCH                      []string
+	CriticalCH                    []string
+	TimingAllowOrigins            []string
+	WidthHintBuckets              []int
+	SrcsetLadder                  []int
+	SrcsetPrefetchConcurrency     int
+	QualityDefaults               map[string]int
+	SaveDataQuality               int
+	StrictPathDecoding            bool
+	RangeRequests                 bool
+	IfRange                       bool
+	MinQuality                    int
+	LegacyUAPatterns              []*regexp.Regexp
+	LegacyFormat                  string
+	AcceptFormats                 []string
+	CapabilityFormats             []string
+	AnimatedOptions               []string
+	AnimatedObjectTags            map[string]string
+	CapabilityTransforms          []string
+	FormatPrecedence              string
+	RequestTimeout                time.Duration
+	AdminTimeout                  time.Duration
+	MaxConcurrent                 int
+	AdmissionQueueSize            int
+	AdmissionMaxWait              time.Duration
+	MaxNewKeysPerMinute           int
+	NewKeyPolicy                  string
+	MissBehavior                  string
+	MissDefaultImage              []byte
+	KeyLayout                     string
+	KeyIgnoreSignature            bool
+	KeyInclude                    []string
+	QueryInKey                    bool
+	ForwardAcceptToSource         bool
+	KeyExtension                  bool
+	NormalizePathSlashes          bool
+	NormalizeOptions              bool
+	CanonicalLink                 bool
+	ForceStripMetadata            bool
+	ImgproxyVersionTag            string
+	CacheGeneration               int
+	LogFormat                     string
+	AccessLogFile                 string
+	AccessLogMaxSize              int
+	AccessLogCompress             bool
+	AuditLogFile                  string
+	MinCacheBytes                 int
+	MaxOutputSizeRatio            float64
+	MaxOutputDimension            int
+	MaxPixels                     int
+	OversizePolicy                string
+	IdentityPolicy                string
+	CopyBufferSize                int
+	ResponseBufferSize            int
+	S3MaxConcurrency              int
+	S3ThrottleRetries             int
+	S3ThrottleBackoff             time.Duration
+	StaleCacheBytes               int
+	MemoryCacheTTL                time.Duration
+	CacheTTL                      time.Duration
+	PurgeLocks                    bool
+	UploadDedup                   bool
+	TTLByStatus                   map[int]time.Duration
+	UploadMode                    string
+	CleanupOrphanedUploads        bool
+	OrphanedUploadMaxAge          time.Duration
+	OrphanedUploadCleanupInterval time.Duration
+	S3ObjectTags                  map[string]string
+	EmbedImgproxy                 bool
+	ImgproxyBinary                string
+	ImgproxyURL                   string
+	HedgeImgproxyURL              string
+	HedgeDelay                    time.Duration
+	HeadTriggersGenerate          bool
+	MaintenanceMode               bool
+	MaintenanceRetryAfter         time.Duration
+	CacheMode                     string
+	StoreSourceMetadata           bool
+	VerifyAfterWrite              string
+	SendContentMD5                bool
+
+	// Limits of the incoming HTTP server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// Built-in TLS, plain HTTP is served when TLSCertFile is empty
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+
+	// TLS settings of the clients of imgproxy and S3
+	UpstreamCAFile     string
+	S3CAFile           string
+	InsecureSkipVerify bool
+
+	// imgproxy signature settings, shared with imgproxy
+	ImgproxyKey   []byte
+	ImgproxySalt  []byte
+	SignatureSize int
+
+	// TenantMode is empty when the cache isn't partitioned by tenant
+	TenantMode   string
+	TenantDomain string
+	TenantTokens map[string]string
+	TenantLimits map[string]tenantLimit
+
+	// Secondary bucket read through while migrating to S3_BUCKET, disabled when SecondaryS3Bucket is empty
+	SecondaryS3Bucket   string
+	SecondaryS3Folder   string
+	SecondaryS3Endpoint string
+	// StoreReadOrder lists primary and secondary in the order reads try them
+	StoreReadOrder  []string
+	BackfillPrimary bool
+	// READ_FAILOVER replicas read when the primary region fails
+	ReadFailover         []readReplica
+	ReadFailoverEndpoint string
+	ReadFailoverTimeout  time.Duration
+
+	// AdminToken guards the admin endpoints, which are disabled without it outside of tenant mode
+	AdminToken string
+	// DebugHeaders adds X-Imgproxy-Transform to the image responses of requests carrying AdminToken
+	DebugHeaders bool
+
+	AllowedSourceHosts []string
+	SourceHostAliases  map[string]string
+	// The IMGPROXY_ALLOW_*_SOURCE_ADDRESSES settings shared with imgproxy, applied to the sources the proxy reaches itself
+	AllowLoopbackSources  bool
+	AllowLinkLocalSources bool
+	// BlockSourceRedirects is set when FOLLOW_SOURCE_REDIRECTS is false
+	BlockSourceRedirects bool
+	// The PREVALIDATE_SOURCE preflight of the sources of misses
+	PrevalidateSource         bool
+	PrevalidateSourceRetries  int
+	PrevalidateSourceFailures int
+	PrevalidateSourceCooldown time.Duration
+}
+
+// loadConfig reads the configuration from the environment
+func loadConfig() (Config, error) {
+	healthCheckTimeout := 30 * time.Second
+	if os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC") != "" {
+		t, err := strconv.ParseInt(os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC"), 10, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to parse HEALTH_CHECK_TIMEOUT_IN_SEC: %w", err)
+		}
+		healthCheckTimeout = time.Duration(t) * time.Second
+	}
+	healthCheckProbeTimeout, err := getEnvDuration("HEALTHCHECK_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	healthCheckMaxRedirects, err := getEnvNonNegativeInt("HEALTHCHECK_MAX_REDIRECTS", 3)
+	if err != nil {
+		return Config{}, err
+	}
+	syntheticProbeInterval, err := getEnvDuration("SYNTHETIC_PROBE_INTERVAL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	cacheSizeScanInterval, err := getEnvDuration("CACHE_SIZE_SCAN_INTERVAL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	compactRate, err := getEnvPositiveInt("COMPACT_RATE", 1)
+	if err != nil {
+		return Config{}, err
+	}
+	uploadSpoolRetryInterval, err := getEnvDuration("UPLOAD_SPOOL_RETRY_INTERVAL", time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	warmConcurrency, err := getEnvPositiveInt("WARM_CONCURRENCY", 4)
+	if err != nil {
+		return Config{}, err
+	}
+	srcsetPrefetchConcurrency, err := getEnvPositiveInt("SRCSET_PREFETCH_CONCURRENCY", 2)
+	if err != nil {
+		return Config{}, err
+	}
+
+	sseHeartbeatInterval, err := getEnvDuration("SSE_HEARTBEAT_INTERVAL", 15*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	requestTimeout, err := getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	adminTimeout, err := getEnvDuration("ADMIN_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxConcurrent, err := getEnvNonNegativeInt("MAX_CONCURRENT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	admissionQueueSize, err := getEnvNonNegativeInt("ADMISSION_QUEUE_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	admissionMaxWait, err := getEnvDuration("ADMISSION_MAX_WAIT", time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	cacheGeneration, err := getEnvNonNegativeInt("CACHE_GENERATION", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxNewKeysPerMinute, err := getEnvNonNegativeInt("MAX_NEW_KEYS_PER_MINUTE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	minCacheBytes, err := getEnvNonNegativeInt("MIN_CACHE_BYTES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxOutputSizeRatio, err := getEnvNonNegativeFloat("MAX_OUTPUT_SIZE_RATIO", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxOutputDimension, err := getEnvNonNegativeInt("MAX_OUTPUT_DIMENSION", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxPixels, err := getEnvNonNegativeInt("MAX_PIXELS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	spriteMaxImages, err := getEnvNonNegativeInt("SPRITE_MAX_IMAGES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	copyBufferSize, err := getEnvPositiveInt("COPY_BUFFER_SIZE", 32*1024)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// Unset, cached images are written to the client as they're read from S3
+	responseBufferSize, err := getEnvNonNegativeInt("RESPONSE_BUFFER_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	s3MaxConcurrency, err := getEnvNonNegativeInt("S3_MAX_CONCURRENCY", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	s3ThrottleRetries, err := getEnvNonNegativeInt("S3_THROTTLE_RETRIES", slowDownRetries)
+	if err != nil {
+		return Config{}, err
+	}
+	s3ThrottleBackoff, err := getEnvDuration("S3_THROTTLE_BACKOFF", slowDownBackoff)
+	if err != nil {
+		return Config{}, err
+	}
+	staleCacheBytes, err := getEnvNonNegativeInt("STALE_CACHE_BYTES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	memoryCacheTTL, err := getEnvDuration("MEMORY_CACHE_TTL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	hedgeDelay, err := getEnvDuration("HEDGE_DELAY", 200*time.Millisecond)
+	if err != nil {
+		return Config{}, err
+	}
+	cacheTTL, err := getEnvDuration("CACHE_TTL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	ttlByStatus, err := parseTTLByStatus(getEnvList("TTL_BY_STATUS"))
+	if err != nil {
+		return Config{}, err
+	}
+	purgeLocks, err := getEnvBool("PURGE_LOCKS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	uploadDedup, err := getEnvBool("UPLOAD_DEDUP", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cleanupOrphanedUploads, err := getEnvBool("CLEANUP_ORPHANED_UPLOADS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	orphanedUploadMaxAge, err := getEnvDuration("ORPHANED_UPLOAD_MAX_AGE", 24*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+	// Unset, orphaned uploads are only cleaned up on startup
+	orphanedUploadCleanupInterval, err := getEnvDuration("ORPHANED_UPLOAD_CLEANUP_INTERVAL", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	followSourceRedirects, err := getEnvBool("FOLLOW_SOURCE_REDIRECTS", true)
+	if err != nil {
+		return Config{}, err
+	}
+	missBehavior := getEnvWithDefault("MISS_BEHAVIOR", missGenerate)
+	var defaultImage []byte
+	if path := os.Getenv("MISS_DEFAULT_IMAGE"); path != "" {
+		if defaultImage, err = os.ReadFile(path); err != nil {
+			return Config{}, fmt.Errorf("failed to read MISS_DEFAULT_IMAGE: %w", err)
+		}
+	}
+	debugHeaders, err := getEnvBool("DEBUG_HEADERS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	prevalidateSource, err := getEnvBool("PREVALIDATE_SOURCE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	prevalidateSourceRetries, err := getEnvNonNegativeInt("PREVALIDATE_SOURCE_RETRIES", 2)
+	if err != nil {
+		return Config{}, err
+	}
+	prevalidateSourceFailures, err := getEnvPositiveInt("PREVALIDATE_SOURCE_FAILURES", 5)
+	if err != nil {
+		return Config{}, err
+	}
+	prevalidateSourceCooldown, err := getEnvDuration("PREVALIDATE_SOURCE_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	allowLoopbackSources, err := getEnvBool("IMGPROXY_ALLOW_LOOPBACK_SOURCE_ADDRESSES", false)
+	if err != nil {
+		return Config{}, err
+	}
+	allowLinkLocalSources, err := getEnvBool("IMGPROXY_ALLOW_LINK_LOCAL_SOURCE_ADDRESSES", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	sourceFallback, err := getEnvBool("SOURCE_FALLBACK", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	storeSourceMetadata, err := getEnvBool("STORE_SOURCE_METADATA", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	sendContentMD5, err := getEnvBool("SEND_CONTENT_MD5", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	storeReadOrder := getEnvList("STORE_READ_ORDER")
+	if len(storeReadOrder) == 0 {
+		storeReadOrder = []string{storePrimary, storeSecondary}
+	}
+	backfillPrimary, err := getEnvBool("BACKFILL_PRIMARY", false)
+	if err != nil {
+		return Config{}, err
+	}
+	readFailover, err := parseReadFailover(getEnvList("READ_FAILOVER"))
+	if err != nil {
+		return Config{}, err
+	}
+	readFailoverTimeout, err := getEnvDuration("READ_FAILOVER_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	embedImgproxy, err := getEnvBool("EMBED_IMGPROXY", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	headTriggersGenerate, err := getEnvBool("HEAD_TRIGGERS_GENERATE", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	readHeaderTimeout, err := getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	readTimeout, err := getEnvDuration("READ_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	writeTimeout, err := getEnvDuration("WRITE_TIMEOUT", 60*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	idleTimeout, err := getEnvDuration("IDLE_TIMEOUT", 120*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	maxHeaderBytes, err := getEnvPositiveInt("MAX_HEADER_BYTES", 64*1024)
+	if err != nil {
+		return Config{}, err
+	}
+
+	trustedProxies, err := parseTrustedProxies(getEnvList("TRUSTED_PROXIES"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	tlsMinVersion, err := parseTLSVersion(getEnvWithDefault("TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	accessLogMaxSize, err := getEnvPositiveInt("ACCESS_LOG_MAX_SIZE", 100*1024*1024)
+	if err != nil {
+		return Config{}, err
+	}
+	accessLogCompress, err := getEnvBool("ACCESS_LOG_COMPRESS", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	insecureSkipVerify, err := getEnvBool("INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maintenanceMode, err := getEnvBool("MAINTENANCE_MODE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	maintenanceRetryAfter, err := getEnvDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	keyIgnoreSignature, err := getEnvBool("KEY_IGNORE_SIGNATURE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	keyInclude, err := parseKeyInclude(getEnvList("KEY_INCLUDE"))
+	if err != nil {
+		return Config{}, err
+	}
+	queryInKey, err := getEnvBool("QUERY_IN_KEY", false)
+	if err != nil {
+		return Config{}, err
+	}
+	forwardAcceptToSource, err := getEnvBool("FORWARD_ACCEPT_TO_SOURCE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	appendKeyExtension, err := getEnvBool("KEY_EXTENSION", false)
+	if err != nil {
+		return Config{}, err
+	}
+	normalizePathSlashes, err := getEnvBool("NORMALIZE_PATH_SLASHES", true)
+	if err != nil {
+		return Config{}, err
+	}
+	normalizeOptions, err := getEnvBool("NORMALIZE_OPTIONS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	canonicalLink, err := getEnvBool("CANONICAL_LINK", false)
+	if err != nil {
+		return Config{}, err
+	}
+	forceStripMetadata, err := getEnvBool("FORCE_STRIP_METADATA", false)
+	if err != nil {
+		return Config{}, err
+	}
+	imgproxyKey, err := getEnvHex("IMGPROXY_KEY")
+	if err != nil {
+		return Config{}, err
+	}
+	imgproxySalt, err := getEnvHex("IMGPROXY_SALT")
+	if err != nil {
+		return Config{}, err
+	}
+	signatureSize, err := getEnvPositiveInt("IMGPROXY_SIGNATURE_SIZE", 32)
+	if err != nil {
+		return Config{}, err
+	}
+
+	objectTags, err := parseObjectTags(getEnvList("S3_OBJECT_TAGS"))
+	if err != nil {
+		return Config{}, err
+	}
+	animatedOptions, err := parseAnimatedOptions(os.Getenv("ANIMATED_OPTIONS"))
+	if err != nil {
+		return Config{}, err
+	}
+	animatedObjectTags, err := parseTags("ANIMATED_OBJECT_TAGS", getEnvList("ANIMATED_OBJECT_TAGS"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	widthHintBuckets, err := parseWidthBuckets(getEnvList("WIDTH_HINT_BUCKETS"))
+	if err != nil {
+		return Config{}, err
+	}
+	timingAllowOrigins, err := parseTimingAllowOrigins(getEnvList("TIMING_ALLOW_ORIGINS"))
+	if err != nil {
+		return Config{}, err
+	}
+	srcsetLadder, err := parseWidths("SRCSET_LADDER", getEnvList("SRCSET_LADDER"))
+	if err != nil {
+		return Config{}, err
+	}
+	qualityDefaults, err := parseQualityDefaults(getEnvList("QUALITY_DEFAULTS"))
+	if err != nil {
+		return Config{}, err
+	}
+	saveDataQuality, err := getEnvNonNegativeInt("SAVE_DATA_QUALITY", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	if saveDataQuality > 100 {
+		return Config{}, fmt.Errorf("invalid SAVE_DATA_QUALITY %d, expected a quality from 1 to 100", saveDataQuality)
+	}
+	strictPathDecoding, err := getEnvBool("STRICT_PATH_DECODING", false)
+	if err != nil {
+		return Config{}, err
+	}
+	rangeRequests, err := getEnvBool("RANGE_REQUESTS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	ifRange, err := getEnvBool("IF_RANGE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	minQuality, err := getEnvNonNegativeInt("MIN_QUALITY", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	if minQuality > 100 {
+		return Config{}, fmt.Errorf("invalid MIN_QUALITY %d, expected a quality from 1 to 100", minQuality)
+	}
+	legacyUAPatterns, err := parseLegacyUAPatterns(getEnvList("LEGACY_UA_PATTERNS"))
+	if err != nil {
+		return Config{}, err
+	}
+	compactFromItems := getEnvList("COMPACT_FROM")
+	if len(compactFromItems) == 0 {
+		compactFromItems = []string{"jpg", "webp"}
+	}
+	compactFrom, err := parseCompactFrom(compactFromItems)
+	if err != nil {
+		return Config{}, err
+	}
+	acceptFormats, err := parseAcceptFormats(getEnvList("ACCEPT_FORMATS"))
+	if err != nil {
+		return Config{}, err
+	}
+	capabilityFormats, err := parseCapabilityFormats(getEnvList("CAPABILITY_FORMATS"))
+	if err != nil {
+		return Config{}, err
+	}
+	capabilityTransforms, err := parseCapabilityTransforms(getEnvList("CAPABILITY_TRANSFORMS"))
+	if err != nil {
+		return Config{}, err
+	}
+	warmPresets, err := parseWarmPresets(getEnvList("WARM_PRESETS"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	sourceHostAliases, err := parseSourceHostAliases(getEnvList("SOURCE_HOST_ALIASES"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	tenantTokens, err := parseTenantTokens(getEnvList("TENANT_TOKENS"))
+	if err != nil {
+		return Config{}, err
+	}
+	tenantLimits, err := parseTenantLimits(getEnvList("TENANT_LIMITS"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		S3Bucket:                      os.Getenv("S3_BUCKET"),
+		S3Buckets:                     getEnvList("S3_BUCKETS"),
+		S3Folder:                      os.Getenv("S3_FOLDER"),
+		TigrisProxyBind:               cmp.Or(os.Getenv("LISTEN_ADDR"), os.Getenv("IMGPROXY_BIND")),
+		ListenNetwork:                 getEnvWithDefault("LISTEN_NETWORK", "tcp"),
+		TrustedProxies:                trustedProxies,
+		HealthCheckTimeout:            healthCheckTimeout,
+		HealthCheckProbeTimeout:       healthCheckProbeTimeout,
+		HealthCheckMaxRedirects:       healthCheckMaxRedirects,
+		UploadSpoolDir:                os.Getenv("UPLOAD_SPOOL_DIR"),
+		SpriteMaxImages:               spriteMaxImages,
+		UploadSpoolRetryInterval:      uploadSpoolRetryInterval,
+		SyntheticProbeInterval:        syntheticProbeInterval,
+		CacheSizeScanInterval:         cacheSizeScanInterval,
+		CompactRate:                   compactRate,
+		SyntheticProbePath:            os.Getenv("SYNTHETIC_PROBE_PATH"),
+		WarmConcurrency:               warmConcurrency,
+		SSEHeartbeatInterval:          sseHeartbeatInterval,
+		WarmPresets:                   warmPresets,
+		WarmSourceBucket:              os.Getenv("WARM_SOURCE_BUCKET"),
+		WarmSourceURLPrefix:           getEnvWithDefault("WARM_SOURCE_URL_PREFIX", "s3://"+os.Getenv("WARM_SOURCE_BUCKET")+"/"),
+		PregenerateFormats:            getEnvList("PREGENERATE_FORMATS"),
+		CompactFrom:                   compactFrom,
+		CompactFormat:                 canonicalFormat(os.Getenv("COMPACT_FORMAT")),
+		CompactCheckpointFile:         os.Getenv("COMPACT_CHECKPOINT_FILE"),
+		FormatFallbackChain:           getEnvList("FORMAT_FALLBACK_CHAIN"),
+		SourceFallback:                sourceFallback,
+		PassthroughContentTypes:       getEnvList("PASSTHROUGH_CONTENT_TYPES"),
+		AcceptCH:                      getEnvList("ACCEPT_CH"),
+		CriticalCH:                    getEnvList("CRITICAL_CH"),
+		TimingAllowOrigins:            timingAllowOrigins,
+		WidthHintBuckets:              widthHintBuckets,
+		SrcsetLadder:                  srcsetLadder,
+		SrcsetPrefetchConcurrency:     srcsetPrefetchConcurrency,
+		QualityDefaults:               qualityDefaults,
+		SaveDataQuality:               saveDataQuality,
+		StrictPathDecoding:            strictPathDecoding,
+		RangeRequests:                 rangeRequests,
+		IfRange:                       ifRange,
+		MinQuality:                    minQuality,
+		LegacyUAPatterns:              legacyUAPatterns,
+		LegacyFormat:                  canonicalFormat(getEnvWithDefault("LEGACY_FORMAT", "jpg")),
+		AcceptFormats:                 acceptFormats,
+		CapabilityFormats:             capabilityFormats,
+		AnimatedOptions:               animatedOptions,
+		AnimatedObjectTags:            animatedObjectTags,
+		CapabilityTransforms:          capabilityTransforms,
+		FormatPrecedence:              getEnvWithDefault("FORMAT_PRECEDENCE", precedencePath),
+		RequestTimeout:                requestTimeout,
+		AdminTimeout:                  adminTimeout,
+		MaxConcurrent:                 maxConcurrent,
+		AdmissionQueueSize:            admissionQueueSize,
+		AdmissionMaxWait:              admissionMaxWait,
+		MaxNewKeysPerMinute:           maxNewKeysPerMinute,
+		NewKeyPolicy:                  getEnvWithDefault("NEW_KEY_POLICY", newKeyBypass),
+		MissBehavior:                  missBehavior,
+		MissDefaultImage:              defaultImage,
+		KeyLayout:                     getEnvWithDefault("KEY_LAYOUT", keyLayoutFlat),
+		KeyIgnoreSignature:            keyIgnoreSignature,
+		KeyInclude:                    keyInclude,
+		QueryInKey:                    queryInKey,
+		ForwardAcceptToSource:         forwardAcceptToSource,
+		KeyExtension:                  appendKeyExtension,
+		NormalizePathSlashes:          normalizePathSlashes,
+		NormalizeOptions:              normalizeOptions,
+		CanonicalLink:                 canonicalLink,
+		ForceStripMetadata:            forceStripMetadata,
+		ImgproxyVersionTag:            os.Getenv("IMGPROXY_VERSION_TAG"),
+		CacheGeneration:               cacheGeneration,
+		LogFormat:                     getEnvWithDefault("LOG_FORMAT", logFormatJSON),
+		AccessLogFile:                 os.Getenv("ACCESS_LOG_FILE"),
+		AccessLogMaxSize:              accessLogMaxSize,
+		AccessLogCompress:             accessLogCompress,
+		AuditLogFile:                  os.Getenv("AUDIT_LOG_FILE"),
+		MinCacheBytes:                 minCacheBytes,
+		MaxOutputSizeRatio:            maxOutputSizeRatio,
+		MaxOutputDimension:            maxOutputDimension,
+		MaxPixels:                     maxPixels,
+		OversizePolicy:                getEnvWithDefault("OVERSIZE_POLICY", oversizeClamp),
+		IdentityPolicy:                getEnvWithDefault("IDENTITY_POLICY", identityProcess),
+		CopyBufferSize:                copyBufferSize,
+		ResponseBufferSize:            responseBufferSize,
+		S3MaxConcurrency:              s3MaxConcurrency,
+		S3ThrottleRetries:             s3ThrottleRetries,
+		S3ThrottleBackoff:             s3ThrottleBackoff,
+		StaleCacheBytes:               staleCacheBytes,
+		MemoryCacheTTL:                memoryCacheTTL,
+		CacheTTL:                      cacheTTL,
+		TTLByStatus:                   ttlByStatus,
+		PurgeLocks:                    purgeLocks,
+		UploadDedup:                   uploadDedup,
+		UploadMode:                    getEnvWithDefault("UPLOAD_MODE", uploadModeSDK),
+		CleanupOrphanedUploads:        cleanupOrphanedUploads,
+		OrphanedUploadMaxAge:          orphanedUploadMaxAge,
+		OrphanedUploadCleanupInterval: orphanedUploadCleanupInterval,
+		S3ObjectTags:                  objectTags,
+		EmbedImgproxy:                 embedImgproxy,
+		ImgproxyBinary:                getEnvWithDefault("IMGPROXY_BINARY", "imgproxy"),
+		ImgproxyURL:                   getEnvWithDefault("IMGPROXY_URL", "http://127.0.0.1:8081"),
+		HedgeImgproxyURL:              os.Getenv("HEDGE_IMGPROXY_URL"),
+		HedgeDelay:                    hedgeDelay,
+		HeadTriggersGenerate:          headTriggersGenerate,
+		MaintenanceMode:               maintenanceMode,
+		MaintenanceRetryAfter:         maintenanceRetryAfter,
+		CacheMode:                     getEnvWithDefault("CACHE_MODE", cacheModeReadWrite),
+		StoreSourceMetadata:           storeSourceMetadata,
+		VerifyAfterWrite:              getEnvWithDefault("VERIFY_AFTER_WRITE", verifyOff),
+		SendContentMD5:                sendContentMD5,
+
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+
+		TLSCertFile:   os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:    os.Getenv("TLS_KEY_FILE"),
+		TLSMinVersion: tlsMinVersion,
+
+		UpstreamCAFile:     os.Getenv("UPSTREAM_CA_FILE"),
+		S3CAFile:           os.Getenv("S3_CA_FILE"),
+		InsecureSkipVerify: insecureSkipVerify,
+
+		ImgproxyKey:   imgproxyKey,
+		ImgproxySalt:  imgproxySalt,
+		SignatureSize: signatureSize,
+
+		TenantMode:   os.Getenv("TENANT_MODE"),
+		TenantDomain: os.Getenv("TENANT_DOMAIN"),
+		TenantTokens: tenantTokens,
+		TenantLimits: tenantLimits,
+
+		SecondaryS3Bucket:   os.Getenv("SECONDARY_S3_BUCKET"),
+		SecondaryS3Folder:   os.Getenv("SECONDARY_S3_FOLDER"),
+		SecondaryS3Endpoint: getEnvWithDefault("SECONDARY_S3_ENDPOINT", getEnvWithDefault("S3_ENDPOINT", defaultS3Endpoint)),
+		StoreReadOrder:      storeReadOrder,
+		BackfillPrimary:     backfillPrimary,
+
+		ReadFailover:         readFailover,
+		ReadFailoverEndpoint: os.Getenv("READ_FAILOVER_ENDPOINT"),
+		ReadFailoverTimeout:  readFailoverTimeout,
+
+		AdminToken:   os.Getenv("ADMIN_TOKEN"),
+		DebugHeaders: debugHeaders,
+
+		AllowedSourceHosts:    getEnvList("ALLOWED_SOURCE_HOSTS"),
+		SourceHostAliases:     sourceHostAliases,
+		BlockSourceRedirects:  !followSourceRedirects,
+		AllowLoopbackSources:  allowLoopbackSources,
+		AllowLinkLocalSources: allowLinkLocalSources,
+
+		PrevalidateSource:         prevalidateSource,
+		PrevalidateSourceRetries:  prevalidateSourceRetries,
+		PrevalidateSourceFailures: prevalidateSourceFailures,
+		PrevalidateSourceCooldown: prevalidateSourceCooldown,
+	}
+	if cfg.S3Bucket == "" && len(cfg.S3Buckets) == 0 {
+		return cfg, errors.New("missing required environment variable S3_BUCKET")
+	}
+	for i, bucket := range cfg.S3Buckets {
+		if slices.Contains(cfg.S3Buckets[:i], bucket) {
+			return cfg, fmt.Errorf("invalid S3_BUCKETS, %q is listed twice", bucket)
+		}
+	}
+	if cfg.KeyLayout != keyLayoutFlat && !groupsBySource(cfg.KeyLayout) {
+		return cfg, fmt.Errorf("invalid KEY_LAYOUT %q, expected %s, %s or %s", cfg.KeyLayout, keyLayoutFlat, keyLayoutBySource, keyLayoutBySourceOptions)
+	}
+	if cfg.ImgproxyVersionTag != "" && !isVersionTag(cfg.ImgproxyVersionTag) {
+		return cfg, fmt.Errorf("invalid IMGPROXY_VERSION_TAG %q, expected letters, digits, dots, dashes or underscores", cfg.ImgproxyVersionTag)
+	}
+	if hint, ok := missingCriticalHint(cfg.AcceptCH, cfg.CriticalCH); ok {
+		return cfg, fmt.Errorf("CRITICAL_CH hint %q must also be listed in ACCEPT_CH", hint)
+	}
+	if !slices.Equal(cfg.StoreReadOrder, []string{storePrimary, storeSecondary}) && !slices.Equal(cfg.StoreReadOrder, []string{storeSecondary, storePrimary}) {
+		return cfg, fmt.Errorf("invalid STORE_READ_ORDER %q, expected %s,%s or %s,%s", strings.Join(cfg.StoreReadOrder, ","), storePrimary, storeSecondary, storeSecondary, storePrimary)
+	}
+	switch cfg.CacheMode {
+	case cacheModeReadWrite, cacheModeReadOnly, cacheModeOff:
+	default:
+		return cfg, fmt.Errorf("invalid CACHE_MODE %q, expected %s, %s or %s", cfg.CacheMode, cacheModeReadWrite, cacheModeReadOnly, cacheModeOff)
+	}
+	if tags := maps.Clone(cfg.S3ObjectTags); tags != nil {
+		maps.Copy(tags, cfg.AnimatedObjectTags)
+		if len(tags) > maxObjectTags {
+			return cfg, fmt.Errorf("S3_OBJECT_TAGS and ANIMATED_OBJECT_TAGS add up to %d tags, expected at most %d", len(tags), maxObjectTags)
+		}
+	}
+	if cfg.HedgeImgproxyURL != "" {
+		hedge, err := url.Parse(cfg.HedgeImgproxyURL)
+		if err != nil || (hedge.Scheme != "http" && hedge.Scheme != "https") || hedge.Host == "" || strings.Trim(hedge.Path, "/") != "" {
+			return cfg, fmt.Errorf("invalid HEDGE_IMGPROXY_URL %q, expected the http(s) URL of another imgproxy, without a path", cfg.HedgeImgproxyURL)
+		}
+	}
+	switch cfg.MissBehavior {
+	case missGenerate, missNotFound:
+	case missDefaultImage:
+		if len(cfg.MissDefaultImage) == 0 {
+			return cfg, fmt.Errorf("MISS_BEHAVIOR=%s requires MISS_DEFAULT_IMAGE", missDefaultImage)
+		}
+	default:
+		return cfg, fmt.Errorf("invalid MISS_BEHAVIOR %q, expected %s, %s or %s", cfg.MissBehavior, missGenerate, missDefaultImage, missNotFound)
+	}
+	if cfg.NewKeyPolicy != newKeyBypass && cfg.NewKeyPolicy != newKeyReject {
+		return cfg, fmt.Errorf("invalid NEW_KEY_POLICY %q, expected %s or %s", cfg.NewKeyPolicy, newKeyBypass, newKeyReject)
+	}
+	if cfg.OversizePolicy != oversizeClamp && cfg.OversizePolicy != oversizeReject {
+		return cfg, fmt.Errorf("invalid OVERSIZE_POLICY %q, expected %s or %s", cfg.OversizePolicy, oversizeClamp, oversizeReject)
+	}
+	switch cfg.IdentityPolicy {
+	case identityProcess, identityPassthrough, identityReject:
+	default:
+		return cfg, fmt.Errorf("invalid IDENTITY_POLICY %q, expected %s, %s or %s", cfg.IdentityPolicy, identityProcess, identityPassthrough, identityReject)
+	}
+	if cfg.WarmSourceBucket != "" && len(cfg.WarmPresets) == 0 {
+		return cfg, errors.New("WARM_SOURCE_BUCKET requires WARM_PRESETS")
+	}
+	if cfg.IfRange && !cfg.RangeRequests {
+		return cfg, errors.New("IF_RANGE requires RANGE_REQUESTS")
+	}
+	if cfg.CompactFormat != "" && !slices.Contains(negotiableFormats, cfg.CompactFormat) {
+		return cfg, fmt.Errorf("invalid COMPACT_FORMAT %q, expected one of %s", cfg.CompactFormat, strings.Join(negotiableFormats, ", "))
+	}
+	if cfg.CompactFormat != "" && !cfg.StoreSourceMetadata {
+		return cfg, errors.New("COMPACT_FORMAT requires STORE_SOURCE_METADATA, images are re-encoded from their metadata")
+	}
+	if cfg.UploadSpoolDir != "" && cfg.UploadSpoolRetryInterval <= 0 {
+		return cfg, errors.New("UPLOAD_SPOOL_RETRY_INTERVAL must be positive")
+	}
+	if cfg.SyntheticProbeInterval > 0 {
+		if _, err := parseImgproxyPath(cfg.SyntheticProbePath); err != nil {
+			return cfg, fmt.Errorf("SYNTHETIC_PROBE_INTERVAL requires SYNTHETIC_PROBE_PATH to be an imgproxy path, got %q", cfg.SyntheticProbePath)
+		}
+	}
+	if cfg.FormatPrecedence != precedencePath && cfg.FormatPrecedence != precedenceAccept {
+		return cfg, fmt.Errorf("invalid FORMAT_PRECEDENCE %q, expected %s or %s", cfg.FormatPrecedence, precedencePath, precedenceAccept)
+	}
+	if !slices.Contains(legacyFormats, cfg.LegacyFormat) {
+		return cfg, fmt.Errorf("invalid LEGACY_FORMAT %q, expected jpg or png", cfg.LegacyFormat)
+	}
+	if cfg.VerifyAfterWrite != verifyOff && cfg.VerifyAfterWrite != verifySize && cfg.VerifyAfterWrite != verifyChecksum {
+		return cfg, fmt.Errorf("invalid VERIFY_AFTER_WRITE %q, expected %s, %s or %s", cfg.VerifyAfterWrite, verifyOff, verifySize, verifyChecksum)
+	}
+	if cfg.UploadMode != uploadModeSDK && cfg.UploadMode != uploadModePresigned {
+		return cfg, fmt.Errorf("invalid UPLOAD_MODE %q, expected %s or %s", cfg.UploadMode, uploadModeSDK, uploadModePresigned)
+	}
+	if cfg.LogFormat != logFormatJSON && cfg.LogFormat != logFormatCombined {
+		return cfg, fmt.Errorf("invalid LOG_FORMAT %q, expected %s or %s", cfg.LogFormat, logFormatJSON, logFormatCombined)
+	}
+	if (len(cfg.ImgproxyKey) == 0) != (len(cfg.ImgproxySalt) == 0) {
+		return cfg, errors.New("IMGPROXY_KEY and IMGPROXY_SALT must be set together")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.WriteTimeout <= cfg.RequestTimeout {
+		return cfg, fmt.Errorf("WRITE_TIMEOUT (%v) must be longer than REQUEST_TIMEOUT (%v), or responses would be cut before their budget is spent", cfg.WriteTimeout, cfg.RequestTimeout)
+	}
+	switch cfg.TenantMode {
+	case "":
+	case tenantModeSubdomain:
+		if cfg.TenantDomain == "" {
+			return cfg, errors.New("TENANT_MODE=subdomain requires TENANT_DOMAIN")
+		}
+	case tenantModeToken:
+		if len(cfg.TenantTokens) == 0 {
+			return cfg, errors.New("TENANT_MODE=token requires TENANT_TOKENS")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid TENANT_MODE %q, expected %s or %s", cfg.TenantMode, tenantModeSubdomain, tenantModeToken)
+	}
+	if len(cfg.TenantLimits) > 0 && cfg.TenantMode == "" {
+		return cfg, errors.New("TENANT_LIMITS requires TENANT_MODE")
+	}
+	if cfg.TigrisProxyBind == "" {
+		cfg.TigrisProxyBind = ":8080"
+	}
+	if err := checkListenAddr(cfg.TigrisProxyBind); err != nil {
+		return cfg, err
+	}
+	if !slices.Contains(listenNetworks, cfg.ListenNetwork) {
+		return cfg, fmt.Errorf("invalid LISTEN_NETWORK %q, expected tcp, tcp4 or tcp6", cfg.ListenNetwork)
+	}
+
+	return cfg, nil
+}
+
+func getEnvWithDefault(key, defaultValue string) string {
+	env, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	return env
+}
+
+// getEnvList splits a comma-separated environment variable, ignoring empty items
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvPositiveInt(key string, defaultValue int) (int, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("failed to parse %s, expected a positive integer: %q", key, os.Getenv(key))
+	}
+	return v, nil
+}
+
+func getEnvNonNegativeInt(key string, defaultValue int) (int, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("failed to parse %s, expected a non-negative integer: %q", key, os.Getenv(key))
+	}
+	return v, nil
+}
+
+func getEnvNonNegativeFloat(key string, defaultValue float64) (float64, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("failed to parse %s, expected a non-negative number: %q", key, os.Getenv(key))
+	}
+	return v, nil
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s, expected true or false: %q", key, os.Getenv(key))
+	}
+	return v, nil
+}
+
+// getEnvHex decodes a hex-encoded environment variable, such as IMGPROXY_KEY
+func getEnvHex(key string) ([]byte, error) {
+	v, err := hex.DecodeString(os.Getenv(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s, expected a hex-encoded value: %w", key, err)
+	}
+	return v, nil
+}
+
+// getEnvDuration parses a duration such as "500ms" or "30s"
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	if os.Getenv(key) == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("failed to parse %s, expected a positive duration such as 30s: %q", key, os.Getenv(key))
+	}
+	return d, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OVERSIZE_POLICY values, applied to requests above MAX_OUTPUT_DIMENSION
+const (
+	oversizeClamp  = "clamp"
+	oversizeReject = "reject"
+)
+
+var (
+	errOversizeRequest = errors.New("requested dimensions exceed MAX_OUTPUT_DIMENSION")
+	errTooManyPixels   = errors.New("requested resolution exceeds MAX_PIXELS")
+)
+
+// dimensionArgs lists the arguments holding a width or a height, per imgproxy option
+var dimensionArgs = map[string][]int{
+	"rs": {1, 2}, "resize": {1, 2},
+	"s": {0, 1}, "size": {0, 1},
+	"w": {0}, "width": {0},
+	"h": {0}, "height": {0},
+}
+
+// outputDPR returns the device pixel ratio the dimensions of a path are multiplied by, 1 when unset
+func outputDPR(p imgproxyPath) float64 {
+	dpr := 1.0
+	for _, o := range p.Options {
+		name, args, _ := strings.Cut(o, ":")
+		if name != "dpr" {
+			continue
+		}
+		if v, err := strconv.ParseFloat(args, 64); err == nil && v > 0 {
+			dpr = v
+		}
+	}
+	return dpr
+}
+
+// outputSize returns the width and height requested by a path, multiplied by its DPR. Options are
+// applied in order as in imgproxy, so the last one setting a dimension wins. 0 is an unset dimension
+func outputSize(p imgproxyPath) (width, height float64) {
+	for _, o := range p.Options {
+		name, rest, _ := strings.Cut(o, ":")
+		indexes, ok := dimensionArgs[name]
+		if !ok {
+			continue
+		}
+
+		args := strings.Split(rest, ":")
+		switch name {
+		case "w", "width":
+			width = dimensionArg(args, 0, width)
+		case "h", "height":
+			height = dimensionArg(args, 0, height)
+		default:
+			width = dimensionArg(args, indexes[0], width)
+			height = dimensionArg(args, indexes[1], height)
+		}
+	}
+
+	dpr := outputDPR(p)
+	return width * dpr, height * dpr
+}
+
+// dimensionArg parses the dimension at index j of the arguments of an option, which keeps
+// the current one when it's missing or not a number
+func dimensionArg(args []string, j int, current float64) float64 {
+	if j >= len(args) {
+		return current
+	}
+	v, err := strconv.Atoi(args[j])
+	if err != nil {
+		return current
+	}
+	return float64(v)
+}
+
+// exceedsPixels reports whether a path requests more than max pixels. A path leaving a dimension
+// unset keeps the source's aspect ratio, unknown here, so it's only bounded by MAX_OUTPUT_DIMENSION
+func exceedsPixels(p imgproxyPath, max int) bool {
+	width, height := outputSize(p)
+	return width*height > float64(max)
+}
+
+// clampDimensions lowers the widths and heights of a path so that none exceeds max once multiplied by its DPR.
+// It reports whether any was above max
+func clampDimensions(p imgproxyPath, max int) (imgproxyPath, bool) {
+	dpr := outputDPR(p)
+	limit := int(math.Floor(float64(max) / dpr))
+
+	clamped := false
+	options := make([]string, len(p.Options))
+	for i, o := range p.Options {
+		options[i] = o
+		name, rest, _ := strings.Cut(o, ":")
+		indexes, ok := dimensionArgs[name]
+		if !ok {
+			continue
+		}
+
+		args := strings.Split(rest, ":")
+		for _, j := range indexes {
+			if j >= len(args) {
+				continue
+			}
+			if v, err := strconv.Atoi(args[j]); err == nil && float64(v)*dpr > float64(max) {
+				args[j] = strconv.Itoa(limit)
+				clamped = true
+			}
+		}
+		options[i] = name + ":" + strings.Join(args, ":")
+	}
+
+	p.Options = options
+	return p, clamped
+}
+
+// applyDimensionLimit enforces MAX_PIXELS and MAX_OUTPUT_DIMENSION on the requested width and height, so imgproxy
+// isn't asked for huge outputs. Requests above MAX_PIXELS are rejected. Depending on OVERSIZE_POLICY, the path is rewritten with the dimensions
+// clamped to the max, which is then part of the key, or the request is rejected
+func (s *server) applyDimensionLimit(r *http.Request) error {
+	if s.cfg.MaxOutputDimension == 0 && s.cfg.MaxPixels == 0 {
+		return nil
+	}
+	p, err := parseImgproxyPath(requestPath(r.URL))
+	if err != nil {
+		return nil
+	}
+	if s.cfg.MaxPixels > 0 && exceedsPixels(p, s.cfg.MaxPixels) {
+		return fmt.Errorf("%w (%d pixels)", errTooManyPixels, s.cfg.MaxPixels)
+	}
+	if s.cfg.MaxOutputDimension == 0 {
+		return nil
+	}
+
+	clamped, oversize := clampDimensions(p, s.cfg.MaxOutputDimension)
+	if !oversize {
+		return nil
+	}
+	if s.cfg.OversizePolicy == oversizeReject {
+		return fmt.Errorf("%w (%d pixels)", errOversizeRequest, s.cfg.MaxOutputDimension)
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		*p = clamped
+		return true
+	})
+}
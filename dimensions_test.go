@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClampDimensions(t *testing.T) {
+	tests := []struct {
+		path, want string
+		clamped    bool
+	}{
+		{"/_/rs:fill:5000:1000/plain/src", "/_/rs:fill:2000:1000/plain/src", true},
+		{"/_/w:3000/h:2500/plain/src", "/_/w:2000/h:2000/plain/src", true},
+		{"/_/s:1200:800/dpr:2/plain/src", "/_/s:1000:800/dpr:2/plain/src", true},
+		{"/_/rs:fit:1920:1080/q:80/plain/src", "/_/rs:fit:1920:1080/q:80/plain/src", false},
+	}
+	for _, tt := range tests {
+		p, err := parseImgproxyPath(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.path, err)
+		}
+		got, clamped := clampDimensions(p, 2000)
+		if got.String() != tt.want || clamped != tt.clamped {
+			t.Errorf("clampDimensions(%s) = %s, %v, want %s, %v", tt.path, got, clamped, tt.want, tt.clamped)
+		}
+	}
+}
+
+func TestOversizeRequestIsClamped(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{MaxOutputDimension: 2000}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+"/_/rs:fill:8000:6000"+source); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	if got, _ := requested.Load().(string); !strings.HasPrefix(got, "/_/rs:fill:2000:2000/") {
+		t.Fatalf("Expected imgproxy to be asked for the clamped dimensions, got %s", got)
+	}
+	if _, ok := store.get(GenerateS3Key("/_/rs:fill:2000:2000" + source)); !ok {
+		t.Fatal("Expected the image to be stored under the key of the clamped path")
+	}
+}
+
+func TestOversizeRequestIsRejected(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image"))
+	})
+	_, proxy, _ := newTestServer(t, Config{MaxOutputDimension: 2000, OversizePolicy: oversizeReject}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+"/_/w:2500"+source); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for an oversize request, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected an oversize request not to reach imgproxy")
+	}
+	if resp := get(t, proxy.URL+"/_/w:1500"+source); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 within the max, got %d", resp.StatusCode)
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	tests := []struct {
+		path          string
+		width, height float64
+	}{
+		{"/_/rs:fill:800:600/plain/src", 800, 600},
+		{"/_/w:300/h:200/plain/src", 300, 200},
+		{"/_/s:300:200/w:500/plain/src", 500, 200},
+		{"/_/rs:fit:400:300/dpr:2/plain/src", 800, 600},
+		{"/_/w:300/plain/src", 300, 0},
+	}
+	for _, tt := range tests {
+		p, err := parseImgproxyPath(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.path, err)
+		}
+		if width, height := outputSize(p); width != tt.width || height != tt.height {
+			t.Errorf("outputSize(%s) = %vx%v, want %vx%v", tt.path, width, height, tt.width, tt.height)
+		}
+	}
+}
+
+func TestRequestAboveMaxPixelsIsRejected(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image"))
+	})
+	_, proxy, _ := newTestServer(t, Config{MaxPixels: 4_000_000}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+"/_/rs:fill:2500:2000"+source); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 above MAX_PIXELS, got %d", resp.StatusCode)
+	}
+	if resp := get(t, proxy.URL+"/_/w:1500/h:1500/dpr:2"+source); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected the DPR to count towards MAX_PIXELS, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected the rejected requests not to reach imgproxy")
+	}
+
+	if resp := get(t, proxy.URL+"/_/rs:fill:2000:2000"+source); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 within MAX_PIXELS, got %d", resp.StatusCode)
+	}
+}
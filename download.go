@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+var errInvalidFilename = errors.New("invalid download filename")
+
+// maxFilenameLength bounds the filename of a download, as most file systems do
+const maxFilenameLength = 255
+
+type downloadContextKey struct{}
+
+// isDownload reports whether a request asked for its image as an attachment, proxied responses then
+// drop the Content-Disposition imgproxy set
+func isDownload(ctx context.Context) bool {
+	download, _ := ctx.Value(downloadContextKey{}).(bool)
+	return download
+}
+
+// applyDownload answers a request with ?download=1 with a Content-Disposition: attachment header, named after
+// its filename parameter. Both parameters are removed from the query string, so the download is served the
+// same cached bytes as the image and imgproxy never sees them
+func (s *server) applyDownload(r *http.Request, w http.ResponseWriter) (*http.Request, error) {
+	if r.URL.RawQuery == "" {
+		return r, nil
+	}
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil || (!query.Has("download") && !query.Has("filename")) {
+		return r, nil
+	}
+
+	download := query.Get("download")
+	filename := query.Get("filename")
+	query.Del("download")
+	query.Del("filename")
+	// The URL is shared with the access log, which reports the requested query
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	r.URL = &u
+
+	if download != "1" && download != "true" {
+		return r, nil
+	}
+	disposition, err := contentDisposition(filename)
+	if err != nil {
+		return r, err
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	return r.WithContext(context.WithValue(r.Context(), downloadContextKey{}, true)), nil
+}
+
+// contentDisposition returns the attachment disposition of a filename, without one when it's empty.
+// Filenames holding control characters or path separators are rejected, quotes are escaped and
+// non-ASCII names are encoded as RFC 2231 values, so a filename can't inject headers or parameters
+func contentDisposition(filename string) (string, error) {
+	if filename == "" {
+		return "attachment", nil
+	}
+	if len(filename) > maxFilenameLength || filename == "." || filename == ".." ||
+		strings.ContainsAny(filename, `/\`) || strings.IndexFunc(filename, unicode.IsControl) >= 0 {
+		return "", errInvalidFilename
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if disposition == "" {
+		return "", errInvalidFilename
+	}
+	return disposition, nil
+}
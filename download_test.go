@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"", "attachment"},
+		{"kitten.webp", "attachment; filename=kitten.webp"},
+		{"my kitten.webp", `attachment; filename="my kitten.webp"`},
+		{`say "hi".jpg`, `attachment; filename="say \"hi\".jpg"`},
+		{"chaton-été.jpg", "attachment; filename*=utf-8''chaton-%C3%A9t%C3%A9.jpg"},
+	}
+	for _, tt := range tests {
+		got, err := contentDisposition(tt.filename)
+		if err != nil || got != tt.want {
+			t.Errorf("contentDisposition(%q) = %q, %v, want %q", tt.filename, got, err, tt.want)
+		}
+	}
+
+	for _, malicious := range []string{
+		"kitten.jpg\r\nSet-Cookie: session=stolen",
+		"kitten.jpg\x00.exe",
+		"../../etc/passwd",
+		`..\kitten.jpg`,
+		"..",
+	} {
+		if _, err := contentDisposition(malicious); err != errInvalidFilename {
+			t.Errorf("contentDisposition(%q) = %v, want an invalid filename", malicious, err)
+		}
+	}
+}
+
+func TestDownloadIsServedFromTheSameCachedImage(t *testing.T) {
+	var requested atomic.Value
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		requested.Store(r.URL.String())
+		w.Header().Set("Content-Type", "image/webp")
+		w.Header().Set("Content-Disposition", `inline; filename="kitten.webp"`)
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{QueryInKey: true}, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg") + "@webp"
+	resp := get(t, proxy.URL+path+"?download=1&filename=kitten.webp")
+	if got := resp.Header.Values("Content-Disposition"); len(got) != 1 || got[0] != "attachment; filename=kitten.webp" {
+		t.Fatalf("Expected a single attachment disposition, got %q", got)
+	}
+	if got, _ := requested.Load().(string); got != path {
+		t.Fatalf("Expected the download parameters not to reach imgproxy, got %s", got)
+	}
+	srv.uploads.Wait()
+	if _, ok := store.get(GenerateS3Key(path)); !ok || store.len() != 1 {
+		t.Fatal("Expected the download to be stored under the key of the image")
+	}
+
+	resp = get(t, proxy.URL+path+"?filename=cat.webp&download=true")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("X-Cache") != "HIT" || string(body) != "image" || calls.Load() != 1 {
+		t.Fatalf("Expected the download to be served the cached image, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != "attachment; filename=cat.webp" {
+		t.Fatalf("Expected the attachment disposition on a hit, got %q", got)
+	}
+
+	if resp := get(t, proxy.URL+path); resp.Header.Get("Content-Disposition") != "" {
+		t.Fatalf("Expected no disposition without download, got %q", resp.Header.Get("Content-Disposition"))
+	}
+}
+
+func TestMaliciousDownloadFilenameIsRejected(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image"))
+	})
+	_, proxy, _ := newTestServer(t, Config{}, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	filename := url.QueryEscape("kitten.jpg\r\nSet-Cookie: session=stolen")
+	resp := get(t, proxy.URL+path+"?download=1&filename="+filename)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for a malicious filename, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Content-Disposition") != "" {
+		t.Fatal("Expected the filename not to reach the response headers")
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected a rejected download not to reach imgproxy")
+	}
+}
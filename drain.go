@@ -0,0 +1,14 @@
+package main
+
+import "net/http"
+
+type drainState struct {
+	Draining bool `json:"draining"`
+}
+
+// handleDrain marks the instance as draining until the next restart: /healthz fails so the load
+// balancer stops routing to it, while in-flight and new image requests are still served
+func (s *server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	s.draining.Store(true)
+	writeJSON(w, http.StatusOK, drainState{Draining: true})
+}
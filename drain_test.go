@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestDrainFailsHealthButKeepsServingImages(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	if resp := adminDo(t, http.MethodPost, proxy.URL+"/admin/drain"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	if resp := get(t, proxy.URL+"/healthz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected /healthz to report not-ready once draining, got %d", resp.StatusCode)
+	}
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected images to be served while draining, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// imgproxy logs this line once it accepts requests
+const imgproxyReadyLog = "Starting server at"
+
+// A dead child is restarted after embedRestartDelay, and given embedStopTimeout to exit on shutdown
+const (
+	embedRestartDelay = time.Second
+	embedStopTimeout  = 10 * time.Second
+)
+
+// embeddedImgproxy runs imgproxy as a child process bound to a free local port,
+// restarting it whenever it dies until it's stopped
+type embeddedImgproxy struct {
+	binary       string
+	args         []string
+	env          []string
+	readyTimeout time.Duration
+	bind         string
+	upstream     *url.URL
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	// exited is closed when the supervisor gave up on the child for good
+	exited chan struct{}
+}
+
+// startEmbeddedImgproxy launches imgproxy with the given environment and waits for its readiness log
+func startEmbeddedImgproxy(binary string, args, env []string, readyTimeout time.Duration) (*embeddedImgproxy, error) {
+	bind, err := freeLocalAddr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a port for imgproxy: %w", err)
+	}
+
+	e := &embeddedImgproxy{
+		binary:       binary,
+		args:         args,
+		env:          env,
+		readyTimeout: readyTimeout,
+		bind:         bind,
+		upstream:     &url.URL{Scheme: "http", Host: bind},
+		exited:       make(chan struct{}),
+	}
+
+	done, err := e.start()
+	if err != nil {
+		return nil, err
+	}
+	go e.supervise(done)
+
+	return e, nil
+}
+
+// start runs the child and waits until it's ready, the returned channel receives its exit error
+func (e *embeddedImgproxy) start() (<-chan error, error) {
+	cmd := exec.Command(e.binary, e.args...)
+	// The last value wins, so the child binds to the port we picked
+	cmd.Env = append(e.env, "IMGPROXY_BIND="+e.bind)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start imgproxy: %w", err)
+	}
+	e.mu.Lock()
+	e.cmd = cmd
+	if e.stopping {
+		// Stopped while restarting, the new child must not outlive us
+		cmd.Process.Kill()
+	}
+	e.mu.Unlock()
+	slog.Info("Started embedded imgproxy", "pid", cmd.Process.Pid, "bind", e.bind)
+
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	var output sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		output.Add(1)
+		go func() {
+			defer output.Done()
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				fmt.Fprintln(os.Stderr, scanner.Text())
+				if strings.Contains(scanner.Text(), imgproxyReadyLog) {
+					readyOnce.Do(func() { close(ready) })
+				}
+			}
+		}()
+	}
+
+	// The output must be fully read before waiting for the process
+	done := make(chan error, 1)
+	go func() {
+		output.Wait()
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case <-ready:
+		return done, nil
+	case err := <-done:
+		return nil, fmt.Errorf("imgproxy exited before being ready: %v", err)
+	case <-time.After(e.readyTimeout):
+		cmd.Process.Kill()
+		<-done
+		return nil, fmt.Errorf("imgproxy not ready after %v", e.readyTimeout)
+	}
+}
+
+// supervise restarts the child each time it dies, until stop is called
+func (e *embeddedImgproxy) supervise(done <-chan error) {
+	defer close(e.exited)
+
+	for {
+		err := <-done
+		if e.isStopping() {
+			return
+		}
+		slog.Error("Embedded imgproxy died, restarting it", "error", err)
+
+		for {
+			time.Sleep(embedRestartDelay)
+			if e.isStopping() {
+				return
+			}
+			if done, err = e.start(); err == nil {
+				break
+			}
+			slog.Error("Failed to restart embedded imgproxy", "error", err)
+		}
+	}
+}
+
+func (e *embeddedImgproxy) isStopping() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stopping
+}
+
+// stop terminates the child, killing it if it doesn't exit within embedStopTimeout
+func (e *embeddedImgproxy) stop() {
+	e.mu.Lock()
+	e.stopping = true
+	cmd := e.cmd
+	e.mu.Unlock()
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		slog.Error("Failed to terminate embedded imgproxy", "error", err)
+	}
+
+	select {
+	case <-e.exited:
+	case <-time.After(embedStopTimeout):
+		slog.Warn("Embedded imgproxy didn't exit in time, killing it")
+		e.mu.Lock()
+		e.cmd.Process.Kill()
+		e.mu.Unlock()
+		<-e.exited
+	}
+	slog.Info("Stopped embedded imgproxy")
+}
+
+// freeLocalAddr returns a loopback address with a port nothing listens on
+func freeLocalAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHelperImgproxy isn't a real test: it's the stub imgproxy binary run by the embedded mode tests
+func TestHelperImgproxy(t *testing.T) {
+	if os.Getenv("IMGPROXY_STUB") != "1" {
+		t.Skip("only runs as a child process")
+	}
+
+	fmt.Fprintf(os.Stderr, "INFO %s %s\n", imgproxyReadyLog, os.Getenv("IMGPROXY_BIND"))
+	err := http.ListenAndServe(os.Getenv("IMGPROXY_BIND"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "pid:%d", os.Getpid())
+	}))
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func startStubImgproxy(t *testing.T) *embeddedImgproxy {
+	t.Helper()
+
+	env := append(os.Environ(), "IMGPROXY_STUB=1")
+	e, err := startEmbeddedImgproxy(os.Args[0], []string{"-test.run=^TestHelperImgproxy$"}, env, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to start the embedded imgproxy: %v", err)
+	}
+	return e
+}
+
+// upstreamPid asks the embedded imgproxy stub for its pid, retrying while it restarts
+func upstreamPid(t *testing.T, e *embeddedImgproxy) string {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(e.upstream.String())
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return string(body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Embedded imgproxy unreachable: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEmbeddedImgproxyIsStartedAndStopped(t *testing.T) {
+	e := startStubImgproxy(t)
+
+	if got, want := upstreamPid(t, e), fmt.Sprintf("pid:%d", e.cmd.Process.Pid); got != want {
+		t.Fatalf("Expected the upstream to be the child, got %q want %q", got, want)
+	}
+
+	e.stop()
+	if err := e.cmd.Process.Signal(syscall.Signal(0)); err == nil {
+		t.Fatal("Expected the child to be terminated")
+	}
+	if _, err := http.Get(e.upstream.String()); err == nil {
+		t.Fatal("Expected the upstream to be down once stopped")
+	}
+}
+
+func TestEmbeddedImgproxyIsRestarted(t *testing.T) {
+	e := startStubImgproxy(t)
+	defer e.stop()
+
+	first := upstreamPid(t, e)
+	e.mu.Lock()
+	e.cmd.Process.Kill()
+	e.mu.Unlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for upstreamPid(t, e) == first {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the child to be restarted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
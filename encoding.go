@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// decodeContent decodes an imgproxy response body sent with a Content-Encoding, so that
+// the canonical image bytes are cached and served. The header is removed once decoded
+func decodeContent(h http.Header, body []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the %s body: %w", h.Get("Content-Encoding"), err)
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the %s body: %w", h.Get("Content-Encoding"), err)
+	}
+	h.Del("Content-Encoding")
+	return decoded, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestContentEncodedResponseIsDecodedBeforeCaching(t *testing.T) {
+	image := bytes.Repeat([]byte("image"), 100)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(image)
+	zw.Close()
+
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped.Bytes())
+	})
+	srv, proxy, store := newTestServer(t, Config{}, stub)
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	for _, want := range []string{"MISS", "HIT"} {
+		resp := get(t, proxy.URL+path)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.Header.Get("X-Cache") != want {
+			t.Fatalf("Expected X-Cache: %s, got %q", want, resp.Header.Get("X-Cache"))
+		}
+		if resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("Expected the %s to be served decoded, without Content-Encoding", want)
+		}
+		if !bytes.Equal(body, image) {
+			t.Fatalf("Expected the decoded image on the %s, got %d bytes", want, len(body))
+		}
+		srv.uploads.Wait()
+	}
+
+	if stored, ok := store.get(GenerateS3Key(path)); !ok || !bytes.Equal(stored, image) {
+		t.Fatal("Expected the decoded image to be stored")
+	}
+}
+
+func TestUnsupportedContentEncodingIsNotCached(t *testing.T) {
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("brotli bytes"))
+	})
+	srv, proxy, store := newTestServer(t, Config{}, stub)
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "br" {
+		t.Fatalf("Expected the response to be passed through with its encoding, got %d %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	srv.uploads.Wait()
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// readReplica is one of READ_FAILOVER: the bucket a region replicates the cache to
+type readReplica struct {
+	region string
+	bucket string
+}
+
+// parseReadFailover reads the region=bucket pairs of READ_FAILOVER, in the order reads fail over to them
+func parseReadFailover(items []string) ([]readReplica, error) {
+	replicas := make([]readReplica, 0, len(items))
+	for _, item := range items {
+		region, bucket, ok := strings.Cut(item, "=")
+		region, bucket = strings.TrimSpace(region), strings.TrimSpace(bucket)
+		if !ok || region == "" || bucket == "" || strings.Contains(bucket, "/") {
+			return nil, fmt.Errorf("invalid READ_FAILOVER item %q, expected region=bucket", item)
+		}
+		for _, r := range replicas {
+			if r.region == region && r.bucket == bucket {
+				return nil, fmt.Errorf("invalid READ_FAILOVER, %q is listed twice", item)
+			}
+		}
+		replicas = append(replicas, readReplica{region: region, bucket: bucket})
+	}
+	return replicas, nil
+}
+
+// failoverStore reads from the replicas of READ_FAILOVER, in order, when a read of the primary store fails,
+// so an outage of the primary region doesn't turn every request into a miss. A missing object isn't a
+// failure, the replicas lag behind the primary. Writes, purges and listings only reach the primary,
+// the replicas are left to the bucket replication
+type failoverStore struct {
+	primary  CacheStore
+	replicas []failoverReplica
+	// timeout bounds the wait for each replica, which shouldn't hold a request much longer than a miss
+	timeout time.Duration
+}
+
+type failoverReplica struct {
+	name  string
+	store CacheStore
+}
+
+func newFailoverStore(primary CacheStore, replicas []failoverReplica, timeout time.Duration) *failoverStore {
+	return &failoverStore{primary: primary, replicas: replicas, timeout: timeout}
+}
+
+// Get returns the object of the primary store, or of the first replica holding it when the primary
+// failed. The error of the primary is returned when no replica has the object
+func (f *failoverStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	obj, err := f.primary.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, errRangeNotSatisfiable) || ctx.Err() != nil {
+		return obj, err
+	}
+	for _, replica := range f.replicas {
+		// Only waiting for the object is bounded by the timeout, its body is streamed with the request's context
+		replicaCtx, cancel := context.WithCancelCause(ctx)
+		timer := time.AfterFunc(f.timeout, func() { cancel(context.DeadlineExceeded) })
+		replicaObj, replicaErr := replica.store.Get(replicaCtx, key)
+		if replicaErr != nil {
+			timer.Stop()
+			cancel(nil)
+			f.logFailover(replica, key, err, replicaErr)
+			continue
+		}
+		if !timer.Stop() {
+			replicaObj.Body.Close()
+			cancel(nil)
+			continue
+		}
+		slog.Warn("Read failed over to a replica", "replica", replica.name, "key", key, "error", err)
+		replicaObj.Body = &cancelOnClose{ReadCloser: replicaObj.Body, cancel: func() { cancel(nil) }}
+		return replicaObj, nil
+	}
+	return nil, err
+}
+
+func (f *failoverStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := f.primary.Head(ctx, key)
+	if err == nil || errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+		return info, err
+	}
+	for _, replica := range f.replicas {
+		replicaCtx, cancel := context.WithTimeout(ctx, f.timeout)
+		replicaInfo, replicaErr := replica.store.Head(replicaCtx, key)
+		cancel()
+		if replicaErr == nil {
+			slog.Warn("Read failed over to a replica", "replica", replica.name, "key", key, "error", err)
+			return replicaInfo, nil
+		}
+		f.logFailover(replica, key, err, replicaErr)
+	}
+	return nil, err
+}
+
+func (f *failoverStore) logFailover(replica failoverReplica, key string, err, replicaErr error) {
+	if !errors.Is(replicaErr, ErrNotFound) {
+		slog.Warn("Replica read failed", "replica", replica.name, "key", key, "primary_error", err, "error", replicaErr)
+	}
+}
+
+func (f *failoverStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	return f.primary.Put(ctx, key, r, meta)
+}
+
+func (f *failoverStore) Delete(ctx context.Context, key string) error {
+	return f.primary.Delete(ctx, key)
+}
+
+func (f *failoverStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	return f.primary.List(ctx, prefix, cursor, limit)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unavailableStore fails every read, as the store of a region in an outage would
+type unavailableStore struct {
+	*memoryStore
+}
+
+func (u unavailableStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	return nil, errors.New("service unavailable")
+}
+
+func (u unavailableStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	return nil, errors.New("service unavailable")
+}
+
+// stalledStore never answers a read before its context is done
+type stalledStore struct {
+	*memoryStore
+}
+
+func (s stalledStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	<-ctx.Done()
+	return nil, context.Cause(ctx)
+}
+
+func TestParseReadFailover(t *testing.T) {
+	replicas, err := parseReadFailover([]string{"us-west-2=cache-west", "eu-central-1 = cache-eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 2 || replicas[1] != (readReplica{region: "eu-central-1", bucket: "cache-eu"}) {
+		t.Fatalf("Unexpected replicas %+v", replicas)
+	}
+	for _, invalid := range []string{"us-west-2", "=cache", "us-west-2=", "us-west-2=cache/folder"} {
+		if _, err := parseReadFailover([]string{invalid}); err == nil {
+			t.Errorf("Expected READ_FAILOVER item %q to be rejected", invalid)
+		}
+	}
+	if _, err := parseReadFailover([]string{"us-west-2=cache", "us-west-2=cache"}); err == nil {
+		t.Error("Expected a duplicate replica to be rejected")
+	}
+}
+
+func TestReplicaServesWhenThePrimaryReadFails(t *testing.T) {
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	primary := unavailableStore{newMemoryStore()}
+	replica := newMemoryStore()
+	replica.Put(context.Background(), GenerateS3Key(path), strings.NewReader("replicated"), ObjectMeta{ContentType: "image/jpeg"})
+
+	replicas := []failoverReplica{{name: "down", store: stalledStore{newMemoryStore()}}, {name: "us-west-2/cache", store: replica}}
+	store := newFailoverStore(primary, replicas, 50*time.Millisecond)
+	srv, proxy := newTestServerWithStore(t, Config{}, imgproxyStub(), store)
+
+	resp := get(t, proxy.URL+path)
+	if resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the replica to serve the image, got %q", resp.Header.Get("X-Cache"))
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "replicated" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+
+	miss := "/_/rs:fill:80:80/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+miss); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a miss when no replica has the image, got %q", resp.Header.Get("X-Cache"))
+	}
+	srv.uploads.Wait()
+	if _, ok := primary.get(GenerateS3Key(miss)); !ok {
+		t.Fatal("Expected the regenerated image to be written to the primary")
+	}
+	if _, ok := replica.get(GenerateS3Key(miss)); ok {
+		t.Fatal("Expected the replicas not to be written to")
+	}
+}
+
+func TestReplicasAreOnlyReadWhenThePrimaryFails(t *testing.T) {
+	primary, replica := newMemoryStore(), newMemoryStore()
+	replica.Put(context.Background(), "key", strings.NewReader("replicated"), ObjectMeta{})
+	store := newFailoverStore(primary, []failoverReplica{{name: "replica", store: replica}}, time.Second)
+
+	if _, err := store.Get(context.Background(), "key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a miss of the primary not to fail over, got %v", err)
+	}
+	if _, err := store.Head(context.Background(), "key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a miss of the primary not to fail over, got %v", err)
+	}
+}
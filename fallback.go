@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// isFallbackStatus reports whether imgproxy failed to produce the requested format,
+// as opposed to failing on the source, which no other format would fix
+func isFallbackStatus(status int) bool {
+	return status == http.StatusUnprocessableEntity || status >= http.StatusInternalServerError
+}
+
+// fallbackPaths returns the same path requesting the formats following its own in FORMAT_FALLBACK_CHAIN
+func (s *server) fallbackPaths(path string) []string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return nil
+	}
+
+	i := slices.Index(s.cfg.FormatFallbackChain, strings.ToLower(p.Format()))
+	if i < 0 {
+		return nil
+	}
+
+	var paths []string
+	for _, format := range s.cfg.FormatFallbackChain[i+1:] {
+		paths = append(paths, p.WithFormat(format).String())
+	}
+	return paths
+}
+
+// fetchFallback requests the fallback formats of a failed path in order,
+// returning the first one imgproxy produces and the path it's cached under
+func (s *server) fetchFallback(ctx context.Context, path string) (string, *upstreamResponse, bool) {
+	for _, fallback := range s.fallbackPaths(path) {
+		resp, err := s.fetchUpstream(ctx, fallback)
+		if err != nil {
+			slog.Warn("Format fallback failed", "path", path, "fallback", fallback, "error", err)
+			return "", nil, false
+		}
+		if resp.status == http.StatusOK {
+			slog.Warn("Requested format failed, serving a fallback", "path", path, "fallback", fallback)
+			return fallback, resp, true
+		}
+		if !isFallbackStatus(resp.status) {
+			return "", nil, false
+		}
+	}
+	return "", nil, false
+}
+
+// fallbackDroppedHeaders describe the body of the failed response, not the one of its fallback
+var fallbackDroppedHeaders = []string{"Content-Encoding", "Content-Disposition", "Content-Range", "ETag", "Last-Modified"}
+
+// replaceWithFallback turns a failed imgproxy response into the fallback one
+func replaceWithFallback(resp *http.Response, fallback *upstreamResponse) {
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Status = http.StatusText(http.StatusOK)
+	for _, header := range fallbackDroppedHeaders {
+		resp.Header.Del(header)
+	}
+	resp.Header.Set("Content-Type", fallback.contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(fallback.body)))
+	resp.Body = io.NopCloser(bytes.NewReader(fallback.body))
+	resp.ContentLength = int64(len(fallback.body))
+}
+
+// serveSourceFallback replaces a response imgproxy failed to produce with the source itself, when
+// SOURCE_FALLBACK is set. It isn't stored: the next request gives imgproxy another chance
+func (s *server) serveSourceFallback(resp *http.Response, path string) bool {
+	source, err := s.sources.fetch(resp.Request.Context(), path)
+	if err != nil {
+		slog.Warn("Source fallback failed", "path", path, "error", err)
+		return false
+	}
+
+	slog.Warn("imgproxy failed, serving the source", "path", path, "status", resp.StatusCode)
+	replaceWithFallback(resp, source)
+	resp.Header.Set("X-Cache", "SOURCE")
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// avifFailingStub fails to encode AVIF and serves the other formats
+func avifFailingStub() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := parseImgproxyPath(requestPath(r.URL))
+		if p.Format() == "avif" {
+			http.Error(w, "AVIF encoder error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/"+p.Format())
+		w.Write([]byte("processed:" + requestPath(r.URL)))
+	})
+}
+
+func TestFailedFormatFallsBackToTheNextOne(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{FormatFallbackChain: []string{"avif", "webp", "jpg"}}, avifFailingStub())
+
+	source := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := get(t, proxy.URL+source+"@avif")
+	srv.uploads.Wait()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/webp" {
+		t.Fatalf("Expected a WebP fallback, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if _, ok := store.get(GenerateS3Key(source + "@webp")); !ok {
+		t.Fatal("Expected the fallback to be stored under the WebP key")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected only the fallback to be stored, got %d objects", store.len())
+	}
+}
+
+func TestFallbackDropsTheHeadersOfTheFailedResponse(t *testing.T) {
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := parseImgproxyPath(requestPath(r.URL))
+		if p.Format() == "avif" {
+			var body bytes.Buffer
+			zw := gzip.NewWriter(&body)
+			zw.Write([]byte("AVIF encoder error"))
+			zw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Disposition", `inline; filename="kitten.avif"`)
+			w.Header().Set("ETag", `"error"`)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "image/"+p.Format())
+		w.Write([]byte("processed:" + requestPath(r.URL)))
+	})
+	srv, proxy, _ := newTestServer(t, Config{FormatFallbackChain: []string{"avif", "webp"}}, stub)
+
+	source := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := get(t, proxy.URL+source+"@avif")
+	srv.uploads.Wait()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "processed:"+source+"@webp" {
+		t.Fatalf("Expected the WebP fallback as is, got %q (%v)", body, err)
+	}
+	for _, header := range []string{"Content-Encoding", "Content-Disposition", "ETag"} {
+		if value := resp.Header.Get(header); value != "" {
+			t.Errorf("Expected no %s from the failed response, got %q", header, value)
+		}
+	}
+}
+
+func TestWarmupFallsBackToTheNextFormat(t *testing.T) {
+	srv, _, store := newTestServer(t, Config{FormatFallbackChain: []string{"avif", "webp"}}, avifFailingStub())
+
+	source := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if _, err := srv.processAndStore(context.Background(), source+"@avif"); err != nil {
+		t.Fatalf("Expected the warmup to fall back, got %v", err)
+	}
+	if _, ok := store.get(GenerateS3Key(source + "@webp")); !ok {
+		t.Fatal("Expected the fallback to be stored under the WebP key")
+	}
+}
+
+func TestFormatsOutsideTheChainDontFallBack(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{FormatFallbackChain: []string{"webp", "jpg"}}, avifFailingStub())
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg")+"@avif")
+	srv.uploads.Wait()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected the imgproxy error, got %d", resp.StatusCode)
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
+
+func TestGzipSourceIsServedDecodedAsFallback(t *testing.T) {
+	image := bytes.Repeat([]byte("source image "), 100)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Expected the source to be requested with gzip, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(image)
+		gz.Close()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	t.Cleanup(source.Close)
+
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "processing failed", http.StatusInternalServerError)
+	})
+	srv, proxy, store := newTestServer(t, Config{SourceFallback: true, AllowLoopbackSources: true}, failing)
+
+	// Set explicitly, the client doesn't decode the response itself
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape(source.URL+"/kitten.jpg"), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	srv.uploads.Wait()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "SOURCE" {
+		t.Fatalf("Expected the source as a fallback, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, image) {
+		t.Fatalf("Expected the decoded source, got %q encoded body of %d bytes", resp.Header.Get("Content-Encoding"), len(body))
+	}
+	if resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected the source content type, got %q", resp.Header.Get("Content-Type"))
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected the source not to be cached, found %d objects", store.len())
+	}
+}
+
+func TestSourceFallbackIsDisabledByDefault(t *testing.T) {
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "processing failed", http.StatusInternalServerError)
+	})
+	_, proxy, _ := newTestServer(t, Config{AllowLoopbackSources: true}, failing)
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected imgproxy's error, got %d", resp.StatusCode)
+	}
+}
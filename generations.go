@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// generations deduplicates the images generated on behalf of HEAD requests: concurrent
+// requests for the same key wait for a single generation rather than starting their own
+type generations struct {
+	mu       sync.Mutex
+	inFlight map[string]*generation
+	// wg tracks the generations still running, they outlive the requests that started them
+	wg *sync.WaitGroup
+}
+
+// generation is an image being generated, its status and error are set once done is closed
+type generation struct {
+	done   chan struct{}
+	status int
+	err    error
+}
+
+func newGenerations(wg *sync.WaitGroup) *generations {
+	return &generations{inFlight: map[string]*generation{}, wg: wg}
+}
+
+// do starts generating the image of a key with fn, or joins the generation already running
+func (g *generations) do(key string, fn func() (int, error)) *generation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if gen, ok := g.inFlight[key]; ok {
+		return gen
+	}
+
+	gen := &generation{done: make(chan struct{})}
+	g.inFlight[key] = gen
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		gen.status, gen.err = fn()
+
+		g.mu.Lock()
+		delete(g.inFlight, key)
+		g.mu.Unlock()
+		close(gen.done)
+	}()
+	return gen
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var errTooManyHealthRedirects = errors.New("too many redirects from the imgproxy health endpoint")
+
+// newHealthClient returns the client probing imgproxy's health endpoint. Its HEALTHCHECK_TIMEOUT is
+// independent of REQUEST_TIMEOUT so a slow imgproxy can't hang readiness, and it follows at most
+// HEALTHCHECK_MAX_REDIRECTS redirects
+func newHealthClient(cfg Config, transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.HealthCheckProbeTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.HealthCheckMaxRedirects {
+				return errTooManyHealthRedirects
+			}
+			return nil
+		},
+	}
+}
+
+// probeHealth checks that imgproxy answers 200 on its health endpoint
+func probeHealth(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("imgproxy health endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleReadyz reports whether the proxy should receive traffic: it isn't draining and imgproxy is healthy
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if err := probeHealth(r.Context(), s.health, s.upstream.String()); err != nil {
+		http.Error(w, fmt.Sprintf("imgproxy isn't ready: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
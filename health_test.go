@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyzProbesImgproxy(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	if resp := get(t, proxy.URL+"/readyz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a healthy imgproxy to be ready, got %d", resp.StatusCode)
+	}
+
+	srv.draining.Store(true)
+	if resp := get(t, proxy.URL+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a draining instance not to be ready, got %d", resp.StatusCode)
+	}
+}
+
+func TestSlowImgproxyHealthFailsReadinessWithinTheTimeout(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	_, proxy, _ := newTestServer(t, Config{HealthCheckProbeTimeout: 100 * time.Millisecond, RequestTimeout: 10 * time.Second}, slow)
+
+	start := time.Now()
+	resp := get(t, proxy.URL+"/readyz")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a slow imgproxy not to be ready, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected readiness to fail within HEALTHCHECK_TIMEOUT, took %v", elapsed)
+	}
+}
+
+func TestHealthProbeStopsFollowingRedirects(t *testing.T) {
+	var probes atomic.Int32
+	looping := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		http.Redirect(w, r, "/health", http.StatusFound)
+	})
+	_, proxy, _ := newTestServer(t, Config{HealthCheckMaxRedirects: 2}, looping)
+
+	if resp := get(t, proxy.URL+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a redirect loop not to be ready, got %d", resp.StatusCode)
+	}
+	if n := probes.Load(); n != 3 {
+		t.Fatalf("Expected the probe and 2 redirects, got %d requests", n)
+	}
+}
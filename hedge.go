@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// hedgedTransport sends a second request to HEDGE_IMGPROXY_URL when imgproxy hasn't answered a GET
+// or a HEAD within HEDGE_DELAY, and returns the first response, cancelling the other request.
+// A request failing before any response leaves the other one running, so the hedge also covers it
+type hedgedTransport struct {
+	next  http.RoundTripper
+	hedge *url.URL
+	delay time.Duration
+
+	// hedged counts the requests sent to the hedge, wins the ones it answered first
+	hedged atomic.Int64
+	wins   atomic.Int64
+}
+
+type hedgeAttempt struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only idempotent requests without a body can be sent twice
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		return t.next.RoundTrip(req)
+	}
+
+	attempts := make(chan hedgeAttempt, 2)
+	var cancels [2]context.CancelFunc
+	cancels[0] = t.start(req, false, attempts)
+	started, done := 1, 0
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	delay := timer.C
+	for {
+		select {
+		case <-delay:
+			delay = nil
+			t.hedged.Add(1)
+			cancels[1] = t.start(req, true, attempts)
+			started++
+		case a := <-attempts:
+			done++
+			winner, loser := 0, 1
+			if a.hedge {
+				winner, loser = 1, 0
+			}
+			if a.err != nil {
+				cancels[winner]()
+				if done == started {
+					return nil, a.err
+				}
+				continue
+			}
+
+			if a.hedge {
+				t.wins.Add(1)
+			}
+			if cancels[loser] != nil {
+				cancels[loser]()
+			}
+			if done < started {
+				go discardHedgeAttempt(attempts)
+			}
+			a.resp.Body = &cancelOnClose{ReadCloser: a.resp.Body, cancel: cancels[winner]}
+			return a.resp, nil
+		}
+	}
+}
+
+// start sends an attempt of a request, to the hedge or as is, with its own context so it can be
+// cancelled on its own. The response body holds the context until it's closed
+func (t *hedgedTransport) start(req *http.Request, hedge bool, attempts chan<- hedgeAttempt) context.CancelFunc {
+	ctx, cancel := context.WithCancel(req.Context())
+	attempt := req.Clone(ctx)
+	if hedge {
+		if attempt.Host == req.URL.Host {
+			attempt.Host = t.hedge.Host
+		}
+		attempt.URL.Scheme = t.hedge.Scheme
+		attempt.URL.Host = t.hedge.Host
+	}
+	go func() {
+		resp, err := t.next.RoundTrip(attempt)
+		attempts <- hedgeAttempt{resp: resp, err: err, hedge: hedge}
+	}()
+	return cancel
+}
+
+// discardHedgeAttempt releases the response of the attempt that lost, once it returns
+func discardHedgeAttempt(attempts <-chan hedgeAttempt) {
+	if a := <-attempts; a.err == nil {
+		a.resp.Body.Close()
+	}
+}
+
+// cancelOnClose cancels the context of a request once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// hedged returns the transport of the requests to imgproxy, hedged with HEDGE_IMGPROXY_URL when it's set
+func (s *server) hedged(transport http.RoundTripper) http.RoundTripper {
+	if s.cfg.HedgeImgproxyURL == "" {
+		return transport
+	}
+	hedge, _ := url.Parse(s.cfg.HedgeImgproxyURL)
+	s.hedge = &hedgedTransport{next: transport, hedge: hedge, delay: s.cfg.HedgeDelay}
+	return s.hedge
+}
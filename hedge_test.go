@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSlowImgproxyRequestsAreHedged(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	})
+	hedge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hedged:" + requestPath(r.URL)))
+	}))
+	t.Cleanup(hedge.Close)
+
+	cfg := Config{HedgeImgproxyURL: hedge.URL, HedgeDelay: 20 * time.Millisecond}
+	srv, proxy, store := newTestServer(t, cfg, slow)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := get(t, proxy.URL+path)
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hedged:"+path {
+		t.Fatalf("Expected the hedge to answer the slow request, got %q", body)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the slow request to be cancelled")
+	}
+
+	srv.uploads.Wait()
+	if obj, ok := store.get(GenerateS3Key(path)); !ok || string(obj) != "hedged:"+path {
+		t.Fatal("Expected the hedged response to be cached")
+	}
+	if srv.hedge.hedged.Load() != 1 || srv.hedge.wins.Load() != 1 {
+		t.Fatalf("Expected a single hedged request won by the hedge, got %d hedged and %d wins", srv.hedge.hedged.Load(), srv.hedge.wins.Load())
+	}
+}
+
+func TestFastImgproxyRequestsAreNotHedged(t *testing.T) {
+	var hedged atomic.Int64
+	hedge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hedged.Add(1)
+		w.Write([]byte("hedged"))
+	}))
+	t.Cleanup(hedge.Close)
+
+	cfg := Config{HedgeImgproxyURL: hedge.URL, HedgeDelay: time.Second}
+	srv, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	body, _ := io.ReadAll(get(t, proxy.URL+path).Body)
+	if string(body) != "processed:"+path {
+		t.Fatalf("Expected imgproxy to answer, got %q", body)
+	}
+	srv.uploads.Wait()
+	if hedged.Load() != 0 || srv.hedge.hedged.Load() != 0 {
+		t.Fatal("Expected a fast request not to be hedged")
+	}
+}
+
+func TestHedgeCoversAPrimaryFailingAfterTheDelay(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(primary.Close)
+	hedge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("hedged"))
+	}))
+	t.Cleanup(hedge.Close)
+
+	transport := &hedgedTransport{next: http.DefaultTransport, delay: 10 * time.Millisecond}
+	transport.hedge, _ = url.Parse(hedge.URL)
+	req, _ := http.NewRequest(http.MethodGet, primary.URL+"/_/rs:fill:50:50/plain/kitten.jpg", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected the hedge to answer once imgproxy failed, got %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hedged" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+}
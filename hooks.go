@@ -0,0 +1,16 @@
+package main
+
+import "context"
+
+// ResponseHook transforms an image processed by imgproxy before it's cached.
+// The transformed body and metadata are what gets stored and served, on misses as well as on warmups
+type ResponseHook interface {
+	Transform(ctx context.Context, path string, body []byte, meta ObjectMeta) ([]byte, ObjectMeta, error)
+}
+
+// noopHook leaves images untouched, it's the default hook
+type noopHook struct{}
+
+func (noopHook) Transform(ctx context.Context, path string, body []byte, meta ObjectMeta) ([]byte, ObjectMeta, error) {
+	return body, meta, nil
+}
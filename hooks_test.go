@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"testing"
+)
+
+// upperHook uppercases bodies and serves them as text
+type upperHook struct{}
+
+func (upperHook) Transform(ctx context.Context, path string, body []byte, meta ObjectMeta) ([]byte, ObjectMeta, error) {
+	return bytes.ToUpper(body), ObjectMeta{ContentType: "text/plain"}, nil
+}
+
+func TestResponseHookTransformsServedAndStoredImage(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	srv.hook = upperHook{}
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	want := bytes.ToUpper([]byte("processed:" + path))
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, want) {
+		t.Fatalf("Expected the transformed body to be served, got %q", body)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Expected the transformed content type, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	if stored, _ := store.get(GenerateS3Key(path)); !bytes.Equal(stored, want) {
+		t.Fatalf("Expected the transformed body to be stored, got %q", stored)
+	}
+	if obj, err := store.Get(context.Background(), GenerateS3Key(path)); err != nil || obj.ContentType != "text/plain" {
+		t.Fatalf("Expected the transformed content type to be stored, got %+v (%v)", obj, err)
+	}
+}
+
+func TestResponseHookTransformsWarmedImage(t *testing.T) {
+	srv, _, store := newTestServer(t, Config{}, imgproxyStub())
+	srv.hook = upperHook{}
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if _, err := srv.processAndStore(context.Background(), path); err != nil {
+		t.Fatalf("Failed to warm %s: %v", path, err)
+	}
+
+	if stored, _ := store.get(GenerateS3Key(path)); !bytes.Equal(stored, bytes.ToUpper([]byte("processed:"+path))) {
+		t.Fatalf("Expected the transformed body to be stored, got %q", stored)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IDENTITY_POLICY values, applied to the paths that wouldn't change their source
+const (
+	identityProcess     = "process"
+	identityPassthrough = "passthrough"
+	identityReject      = "reject"
+)
+
+var errIdentityTransform = errors.New("transform leaves the source unchanged")
+
+// noopOption reports whether an imgproxy option leaves the source unchanged, like a zero width and height,
+// which keep the source's own, or a dpr of 1. Resizing types and enlarge don't matter without dimensions
+func noopOption(o string) bool {
+	name, rest, _ := strings.Cut(o, ":")
+	args := strings.Split(rest, ":")
+	switch name {
+	case "rs", "resize":
+		return zeroArgs(args[1:]...)
+	case "s", "size", "w", "width", "h", "height":
+		return zeroArgs(args...)
+	case "dpr":
+		v, err := strconv.ParseFloat(rest, 64)
+		return err == nil && v == 1
+	case "rt", "resizing_type", "el", "enlarge":
+		return true
+	}
+	return false
+}
+
+// zeroArgs reports whether every argument is empty, 0 or false, as imgproxy reads the unset ones
+func zeroArgs(args ...string) bool {
+	for _, a := range args {
+		if a != "" && a != "0" && a != "f" && a != "false" {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentity reports whether a path serves its source as is: no output format and only no-op options
+func isIdentity(p imgproxyPath) bool {
+	if p.Extension != "" {
+		return false
+	}
+	for _, o := range p.Options {
+		if !noopOption(o) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentityPassthrough reports whether a path is passed through by IDENTITY_POLICY, once applyIdentityPolicy dropped its options
+func (s *server) isIdentityPassthrough(path string) bool {
+	if s.cfg.IdentityPolicy != identityPassthrough {
+		return false
+	}
+	p, err := parseImgproxyPath(path)
+	return err == nil && !p.Encrypted && len(p.Options) == 0 && isIdentity(p)
+}
+
+// applyIdentityPolicy handles the paths that wouldn't change their source, such as /_/rs:fit:0:0/plain/...,
+// depending on IDENTITY_POLICY. With passthrough, the no-op options are dropped so every identity path of a source
+// shares one key, and the source is served and cached as is. With reject, the request is invalid
+func (s *server) applyIdentityPolicy(r *http.Request) error {
+	if s.cfg.IdentityPolicy == "" || s.cfg.IdentityPolicy == identityProcess {
+		return nil
+	}
+	p, err := parseImgproxyPath(requestPath(r.URL))
+	if err != nil || !isIdentity(p) {
+		return nil
+	}
+	if s.cfg.IdentityPolicy == identityReject {
+		return errIdentityTransform
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		// An encrypted source can't be fetched by the proxy, imgproxy still serves it
+		if p.Encrypted || len(p.Options) == 0 {
+			return false
+		}
+		p.Options = nil
+		return true
+	})
+}
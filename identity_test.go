@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsIdentity(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/_/plain/src", true},
+		{"/_/rs:fit:0:0/plain/src", true},
+		{"/_/w:0/h:0/dpr:1/plain/src", true},
+		{"/_/rt:fill/s:0:0:false/plain/src", true},
+		{"/_/rs:fit:0:0/plain/src@webp", false},
+		{"/_/rs:fit:300:0/plain/src", false},
+		{"/_/rs:fit:0:0:1:1/plain/src", false},
+		{"/_/dpr:2/plain/src", false},
+		{"/_/q:80/plain/src", false},
+	}
+	for _, tt := range tests {
+		p, err := parseImgproxyPath(tt.path)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.path, err)
+		}
+		if got := isIdentity(p); got != tt.want {
+			t.Errorf("isIdentity(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIdentityTransformIsPassedThrough(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg source"))
+	}))
+	t.Cleanup(source.Close)
+
+	var processed atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processed.Add(1)
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("processed"))
+	})
+	cfg := Config{IdentityPolicy: identityPassthrough, AllowLoopbackSources: true}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	plain := "/plain/" + url.QueryEscape(source.URL+"/cat.jpg")
+	resp := get(t, proxy.URL+"/_/rs:fit:0:0"+plain)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "jpeg source" {
+		t.Fatalf("Expected the source untouched, got %d %q", resp.StatusCode, body)
+	}
+	srv.uploads.Wait()
+	if processed.Load() != 0 {
+		t.Fatal("Expected an identity transform not to be processed by imgproxy")
+	}
+	if stored, ok := store.get(GenerateS3Key("/_" + plain)); !ok || string(stored) != "jpeg source" {
+		t.Fatalf("Expected the source to be cached under the key of the path without options, got %q", stored)
+	}
+
+	resp = get(t, proxy.URL+"/_/w:0/dpr:1"+plain)
+	if resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected another identity transform of the source to share its key, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+
+	resp = get(t, proxy.URL+"/_/rs:fit:300:0"+plain)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "processed" || processed.Load() != 1 {
+		t.Fatalf("Expected a resize to be processed, got %q", body)
+	}
+}
+
+func TestIdentityPassthroughRequiresAValidSignature(t *testing.T) {
+	var fetched atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("secret"))
+	}))
+	t.Cleanup(source.Close)
+
+	// imgproxy rejects forged signatures
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+	})
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	cfg := Config{IdentityPolicy: identityPassthrough, AllowLoopbackSources: true, ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	resp := get(t, proxy.URL+"/forged/plain/"+url.QueryEscape(source.URL+"/cat.jpg"))
+	srv.uploads.Wait()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the forged path to be left to imgproxy, got %d", resp.StatusCode)
+	}
+	if fetched.Load() != 0 || store.len() != 0 {
+		t.Fatalf("Expected the source of a forged path neither fetched nor cached, got %d fetches and %d objects", fetched.Load(), store.len())
+	}
+}
+
+func TestIdentityTransformIsRejected(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image"))
+	})
+	_, proxy, _ := newTestServer(t, Config{IdentityPolicy: identityReject}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+"/_/rs:fit:0:0"+source); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for an identity transform, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected an identity transform not to reach imgproxy")
+	}
+	if resp := get(t, proxy.URL+"/_/rs:fit:0:0"+source+"@webp"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a format conversion to be processed, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etag returns the strong ETag of a cached object, its SHA-256. Empty for objects stored without one
+func (m ObjectMeta) etag() string {
+	if m.ContentHash == "" {
+		return ""
+	}
+	return `"` + m.ContentHash + `"`
+}
+
+// setValidators sets the ETag and Last-Modified of a hit with IF_RANGE, so clients resuming a download
+// can send them back in If-Range
+func (s *server) setValidators(w http.ResponseWriter, meta ObjectMeta, lastModified time.Time) {
+	if !s.cfg.IfRange {
+		return
+	}
+	if etag := meta.etag(); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// ifRangeMatches evaluates an If-Range against a cached object as RFC 7233 does: an entity-tag matches by strong
+// comparison, so a weak one never does, and an HTTP-date only when it's exactly the object's Last-Modified.
+// A request without If-Range always matches
+func ifRangeMatches(ifRange string, meta ObjectMeta, lastModified time.Time) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := meta.etag()
+		return etag != "" && ifRange == etag
+	}
+	date, err := http.ParseTime(ifRange)
+	return err == nil && !lastModified.IsZero() && lastModified.Truncate(time.Second).Equal(date)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIfRangeMatches(t *testing.T) {
+	modified := time.Date(2025, 10, 20, 10, 30, 15, 500, time.UTC)
+	meta := ObjectMeta{ContentHash: "abc"}
+	for ifRange, want := range map[string]bool{
+		"":                              true,
+		`"abc"`:                         true,
+		`W/"abc"`:                       false,
+		`"def"`:                         false,
+		"Mon, 20 Oct 2025 10:30:15 GMT": true,
+		"Mon, 20 Oct 2025 10:30:14 GMT": false,
+		"Mon, 20 Oct 2025 10:30:16 GMT": false,
+		"yesterday":                     false,
+	} {
+		if got := ifRangeMatches(ifRange, meta, modified); got != want {
+			t.Errorf("Expected If-Range %q to match: %v, got %v", ifRange, want, got)
+		}
+	}
+	if ifRangeMatches(`""`, ObjectMeta{}, modified) {
+		t.Error("Expected an object without ETag not to match an entity-tag")
+	}
+}
+
+func getIfRange(t *testing.T, requestURL, byteRange, ifRange string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, requestURL, nil)
+	req.Header.Set("Range", byteRange)
+	req.Header.Set("If-Range", ifRange)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestIfRangeResumesOnlyTheSameImage(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{RangeRequests: true, IfRange: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	image, _ := store.get(GenerateS3Key(path))
+
+	hit := get(t, proxy.URL+path)
+	etag, lastModified := hit.Header.Get("ETag"), hit.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("Expected the hit to carry its validators, got %v", hit.Header)
+	}
+
+	for _, validator := range []string{etag, lastModified} {
+		resp, body := getIfRange(t, proxy.URL+path, "bytes=4-", validator)
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, image[4:]) {
+			t.Fatalf("Expected a matching If-Range %q to be served the range, got %d %q", validator, resp.StatusCode, body)
+		}
+	}
+
+	for _, validator := range []string{`"outdated"`, "W/" + etag, "Mon, 20 Oct 2025 10:30:15 GMT"} {
+		resp, body := getIfRange(t, proxy.URL+path, "bytes=4-", validator)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) || resp.Header.Get("Content-Range") != "" {
+			t.Fatalf("Expected an If-Range %q not matching to be served the whole image, got %d %q", validator, resp.StatusCode, body)
+		}
+		if resp.Header.Get("ETag") != etag {
+			t.Fatalf("Expected the whole image to carry its current ETag, got %q", resp.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestIfRangeIsIgnoredByDefault(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{RangeRequests: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	image, _ := store.get(GenerateS3Key(path))
+
+	resp, body := getIfRange(t, proxy.URL+path, "bytes=4-", `"anything"`)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) || resp.Header.Get("ETag") != "" {
+		t.Fatalf("Expected a conditional range to be served the whole image without validators, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// imgproxyPath is an imgproxy URL path split into its parts:
+// /%signature/%processing_options/plain/%source_url@%extension
+// /%signature/%processing_options/%encoded_source_url.%extension
+// /%signature/%processing_options/enc/%encrypted_source_url.%extension
+type imgproxyPath struct {
+	Signature string
+	Options   []string
+	Plain     bool
+	Encrypted bool
+	Source    string
+	Extension string
+}
+
+var (
+	errInvalidImgproxyPath = errors.New("invalid imgproxy path")
+	errEncryptedSource     = errors.New("encrypted source URL")
+)
+
+func parseImgproxyPath(path string) (imgproxyPath, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		return imgproxyPath{}, errInvalidImgproxyPath
+	}
+
+	p := imgproxyPath{Signature: parts[0]}
+	i := 1
+	for i < len(parts) && parts[i] != "plain" && strings.Contains(parts[i], ":") {
+		p.Options = append(p.Options, parts[i])
+		i++
+	}
+
+	if i < len(parts) && parts[i] == "plain" {
+		p.Plain = true
+		p.Source = strings.Join(parts[i+1:], "/")
+		if at := strings.LastIndex(p.Source, "@"); at >= 0 && isExtension(p.Source[at+1:]) {
+			p.Source, p.Extension = p.Source[:at], p.Source[at+1:]
+		}
+	} else {
+		if i < len(parts) && parts[i] == "enc" {
+			p.Encrypted = true
+			i++
+		}
+		p.Source = strings.Join(parts[i:], "/")
+		if dot := strings.LastIndex(p.Source, "."); dot >= 0 && isExtension(p.Source[dot+1:]) {
+			p.Source, p.Extension = p.Source[:dot], p.Source[dot+1:]
+		}
+	}
+
+	if p.Source == "" {
+		return imgproxyPath{}, errInvalidImgproxyPath
+	}
+	return p, nil
+}
+
+// cleanPathSlashes removes the duplicate and trailing slashes of an imgproxy path, so they don't
+// produce distinct keys. The slashes inside a plain source URL are kept, only the ones leading it
+// are removed. Base64 and encrypted sources ignore slashes, theirs are cleaned too
+func cleanPathSlashes(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	var cleaned []string
+	for i, segment := range segments {
+		if i > 0 && segment == "plain" {
+			source := strings.TrimLeft(strings.Join(segments[i+1:], "/"), "/")
+			return "/" + strings.Join(append(cleaned, "plain", source), "/")
+		}
+		if segment != "" {
+			cleaned = append(cleaned, segment)
+		}
+	}
+	return "/" + strings.Join(cleaned, "/")
+}
+
+func (p imgproxyPath) String() string {
+	var b strings.Builder
+	b.WriteString("/" + p.Signature)
+	for _, o := range p.Options {
+		b.WriteString("/" + o)
+	}
+
+	if p.Plain {
+		b.WriteString("/plain/" + p.Source)
+		if p.Extension != "" {
+			b.WriteString("@" + p.Extension)
+		}
+		return b.String()
+	}
+
+	if p.Encrypted {
+		b.WriteString("/enc")
+	}
+	b.WriteString("/" + p.Source)
+	if p.Extension != "" {
+		b.WriteString("." + p.Extension)
+	}
+	return b.String()
+}
+
+// SourceURL decodes the source URL the way imgproxy does.
+// Encrypted sources can't be decoded
+func (p imgproxyPath) SourceURL() (string, error) {
+	if p.Encrypted {
+		return "", errEncryptedSource
+	}
+	if p.Plain {
+		return url.PathUnescape(p.Source)
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.ReplaceAll(p.Source, "/", ""), "="))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// Format returns the requested output format, empty when imgproxy keeps the source one.
+// As in imgproxy, the extension takes precedence over the format option
+func (p imgproxyPath) Format() string {
+	if p.Extension != "" {
+		return p.Extension
+	}
+	for _, o := range p.Options {
+		name, args, _ := strings.Cut(o, ":")
+		if isFormatOption(name) {
+			return args
+		}
+	}
+	return ""
+}
+
+// plainPath returns the insecure path of a plain source URL processed with options into a format,
+// the source's own when empty
+func plainPath(source string, options []string, format string) imgproxyPath {
+	return imgproxyPath{Signature: "_", Options: options, Plain: true, Source: url.QueryEscape(source), Extension: format}
+}
+
+// WithFormat returns the same path requesting another output format
+func (p imgproxyPath) WithFormat(format string) imgproxyPath {
+	options := make([]string, 0, len(p.Options))
+	for _, o := range p.Options {
+		name, _, _ := strings.Cut(o, ":")
+		if !isFormatOption(name) {
+			options = append(options, o)
+		}
+	}
+
+	p.Options = options
+	p.Extension = format
+	return p
+}
+
+func isFormatOption(name string) bool {
+	return name == "format" || name == "f" || name == "ext"
+}
+
+func isExtension(s string) bool {
+	if s == "" || len(s) > 4 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// formatFromContentType maps an image content type to its imgproxy format name
+func formatFromContentType(contentType string) string {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png":
+		return "png"
+	case "image/webp":
+		return "webp"
+	case "image/avif":
+		return "avif"
+	case "image/gif":
+		return "gif"
+	case "image/svg+xml":
+		return "svg"
+	case "image/heic", "image/heif":
+		return "heic"
+	case "image/jxl":
+		return "jxl"
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParseImgproxyPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   imgproxyPath
+		format string
+	}{
+		{
+			path:   "/_/rs:fill:300:300/plain/https://example.com/cat.jpg",
+			want:   imgproxyPath{Signature: "_", Options: []string{"rs:fill:300:300"}, Plain: true, Source: "https://example.com/cat.jpg"},
+			format: "",
+		},
+		{
+			path:   "/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fcat.jpg@webp",
+			want:   imgproxyPath{Signature: "_", Options: []string{"rs:fill:300:300"}, Plain: true, Source: "https%3A%2F%2Fexample.com%2Fcat.jpg", Extension: "webp"},
+			format: "webp",
+		},
+		{
+			path:   "/sig/rs:fit:100:100/dpr:2/aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn.avif",
+			want:   imgproxyPath{Signature: "sig", Options: []string{"rs:fit:100:100", "dpr:2"}, Source: "aHR0cHM6Ly9leGFtcGxlLmNvbS9jYXQuanBn", Extension: "avif"},
+			format: "avif",
+		},
+		{
+			path:   "/_/f:png/aHR0cHM6Ly9l/eGFtcGxlLmNvbS9jYXQuanBn",
+			want:   imgproxyPath{Signature: "_", Options: []string{"f:png"}, Source: "aHR0cHM6Ly9l/eGFtcGxlLmNvbS9jYXQuanBn"},
+			format: "png",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseImgproxyPath(tt.path)
+		if err != nil {
+			t.Fatalf("parseImgproxyPath(%q) failed: %v", tt.path, err)
+		}
+		if got.String() != tt.path {
+			t.Errorf("Round trip of %q gave %q", tt.path, got.String())
+		}
+		if got.Signature != tt.want.Signature || got.Plain != tt.want.Plain || got.Source != tt.want.Source ||
+			got.Extension != tt.want.Extension || len(got.Options) != len(tt.want.Options) {
+			t.Errorf("parseImgproxyPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+		if got.Format() != tt.format {
+			t.Errorf("Format of %q = %q, want %q", tt.path, got.Format(), tt.format)
+		}
+	}
+}
+
+func TestParseImgproxyPathRejectsMissingSource(t *testing.T) {
+	for _, path := range []string{"/", "/_", "/_/rs:fill:300:300", "/_/rs:fill:300:300/plain/"} {
+		if _, err := parseImgproxyPath(path); err == nil {
+			t.Errorf("Expected %q to be rejected", path)
+		}
+	}
+}
+
+func TestWithFormat(t *testing.T) {
+	p, _ := parseImgproxyPath("/_/f:png/rs:fill:10:10/plain/https://example.com/cat.jpg")
+
+	got := p.WithFormat("webp").String()
+	want := "/_/rs:fill:10:10/plain/https://example.com/cat.jpg@webp"
+	if got != want {
+		t.Fatalf("WithFormat gave %q, want %q", got, want)
+	}
+}
+
+func TestCleanPathSlashes(t *testing.T) {
+	tests := map[string]string{
+		"/_/rs:fill:300:300/plain//https://example.com/a//cat.jpg":         "/_/rs:fill:300:300/plain/https://example.com/a//cat.jpg",
+		"/_//rs:fill:300:300/plain/https://example.com/cat.jpg@webp":       "/_/rs:fill:300:300/plain/https://example.com/cat.jpg@webp",
+		"//_/rs:fill:300:300/aHR0cHM6Ly9leGFtcGxl//LmNvbS9jYXQuanBn.avif/": "/_/rs:fill:300:300/aHR0cHM6Ly9leGFtcGxl/LmNvbS9jYXQuanBn.avif",
+		"/_/rs:fill:300:300/plain/https://example.com/dir/":                "/_/rs:fill:300:300/plain/https://example.com/dir/",
+	}
+	for path, want := range tests {
+		if got := cleanPathSlashes(path); got != want {
+			t.Errorf("cleanPathSlashes(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
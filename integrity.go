@@ -0,0 +1,17 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+)
+
+// withContentMD5 sets the Content-MD5 of an upload with SEND_CONTENT_MD5, so the provider rejects a body
+// altered on its way. It's kept when already set
+func (s *server) withContentMD5(meta ObjectMeta, body []byte) ObjectMeta {
+	if !s.cfg.SendContentMD5 || meta.ContentMD5 != "" {
+		return meta
+	}
+	sum := md5.Sum(body)
+	meta.ContentMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	return meta
+}
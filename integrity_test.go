@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func md5Of(body []byte) string {
+	sum := md5.Sum(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUploadsCarryContentMD5(t *testing.T) {
+	// Above the uploader's part size, which would drop the header of a multipart upload
+	body := bytes.Repeat([]byte("i"), 6*1024*1024)
+	for _, presigned := range []bool{false, true} {
+		var puts int
+		var contentMD5 string
+		fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut {
+				puts++
+				contentMD5 = r.Header.Get("Content-MD5")
+			}
+		}))
+		t.Cleanup(fakeS3.Close)
+
+		store := newS3Store(s3.New(s3.Options{
+			Region:       "auto",
+			BaseEndpoint: aws.String(fakeS3.URL),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		}), "bucket", "")
+		if presigned {
+			store.enablePresignedUploads()
+		}
+
+		if err := store.Put(context.Background(), "key", bytes.NewReader(body), ObjectMeta{ContentMD5: md5Of(body)}); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		if puts != 1 || contentMD5 != md5Of(body) {
+			t.Errorf("Expected a single PUT carrying the Content-MD5 (presigned: %v), got %d with %q", presigned, puts, contentMD5)
+		}
+	}
+}
+
+func TestStoredImagesCarryContentMD5(t *testing.T) {
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	srv, proxy, store := newTestServer(t, Config{SendContentMD5: true}, imgproxyStub())
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	body, _ := store.get(GenerateS3Key(path))
+	info, err := store.Head(context.Background(), GenerateS3Key(path))
+	if err != nil || info.ContentMD5 != md5Of(body) {
+		t.Fatalf("Expected the upload to carry the MD5 of the image, got %+v %v", info, err)
+	}
+
+	srv, proxy, store = newTestServer(t, Config{}, imgproxyStub())
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	if info, _ := store.Head(context.Background(), GenerateS3Key(path)); info.ContentMD5 != "" {
+		t.Fatalf("Expected no Content-MD5 without SEND_CONTENT_MD5, got %q", info.ContentMD5)
+	}
+}
+
+func TestCorruptedSpooledUploadIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	spool, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, proxy := newTestServerWithStore(t, Config{SendContentMD5: true}, imgproxyStub(), failingStore{newMemoryStore()})
+	srv.setUploadSpool(spool)
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	ids, err := spool.pending()
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("Expected the failed upload to be left in the spool, got %v %v", ids, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ids[0]+".body"), []byte("corrupted"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, _, store := newTestServer(t, Config{SendContentMD5: true}, imgproxyStub())
+	next.setUploadSpool(restarted)
+	next.replaySpool(context.Background())
+
+	if _, ok := store.get(GenerateS3Key(path)); ok {
+		t.Fatal("Expected the corrupted body not to be uploaded")
+	}
+	if ids, _ := restarted.pending(); len(ids) != 0 {
+		t.Fatalf("Expected the corrupted upload to be dropped from the spool, got %v", ids)
+	}
+}
+
+func TestContentMD5MinIO(t *testing.T) {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(t, ctx)
+	t.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(t, ctx, dockerNetwork)
+	t.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(t, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	store := newS3Store(client, processedBucket, "")
+	if err := store.Put(ctx, "intact", bytes.NewReader([]byte("image")), ObjectMeta{ContentMD5: md5Of([]byte("image"))}); err != nil {
+		t.Fatalf("Expected an intact upload to be stored, got %v", err)
+	}
+	if err := store.Put(ctx, "corrupted", bytes.NewReader([]byte("imagf")), ObjectMeta{ContentMD5: md5Of([]byte("image"))}); err == nil {
+		t.Fatal("Expected MinIO to reject a body not matching its Content-MD5")
+	}
+	if _, err := store.Head(ctx, "corrupted"); err == nil {
+		t.Fatal("Expected the corrupted upload not to be stored")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// KEY_INCLUDE categories, grouping the imgproxy options by what they change in the output
+const (
+	keyIncludeFormat     = "format"
+	keyIncludeDimensions = "dimensions"
+	keyIncludeQuality    = "quality"
+	keyIncludeOther      = "other"
+)
+
+var keyIncludeCategories = []string{keyIncludeFormat, keyIncludeDimensions, keyIncludeQuality, keyIncludeOther}
+
+// optionCategory returns the KEY_INCLUDE category of an imgproxy option
+func optionCategory(name string) string {
+	switch {
+	case isFormatOption(name):
+		return keyIncludeFormat
+	case name == "dpr":
+		return keyIncludeDimensions
+	case slices.Contains(qualityOptions, name):
+		return keyIncludeQuality
+	}
+	if _, ok := dimensionArgs[name]; ok {
+		return keyIncludeDimensions
+	}
+	return keyIncludeOther
+}
+
+// parseKeyInclude validates the categories of KEY_INCLUDE, empty when every option is part of the key
+func parseKeyInclude(items []string) ([]string, error) {
+	for _, item := range items {
+		if !slices.Contains(keyIncludeCategories, item) {
+			return nil, fmt.Errorf("invalid KEY_INCLUDE category %q, expected %s", item, strings.Join(keyIncludeCategories, ", "))
+		}
+	}
+	return items, nil
+}
+
+// keyingPath returns the form of a path with only the options of the included categories, and
+// the format with the format category. The signature differs for every set of options, it's
+// left out too. Paths that can't be parsed are used as is
+func keyingPath(path string, include []string) string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return path
+	}
+
+	options := make([]string, 0, len(p.Options))
+	for _, o := range p.Options {
+		name, _, _ := strings.Cut(o, ":")
+		if slices.Contains(include, optionCategory(name)) {
+			options = append(options, o)
+		}
+	}
+	p.Signature = "_"
+	p.Options = options
+	if !slices.Contains(include, keyIncludeFormat) {
+		p.Extension = ""
+	}
+	return p.String()
+}
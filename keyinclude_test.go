@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestKeyIncludePoliciesProduceDifferentCardinalities(t *testing.T) {
+	source := "/plain/https://example.com/cat.jpg"
+	paths := []string{
+		"/_/rs:fill:300:300/q:80" + source + "@webp",
+		"/_/rs:fill:300:300/q:60" + source + "@webp",
+		"/sig1/rs:fill:300:300/q:60/sm:1" + source + "@webp",
+		"/_/rs:fill:300:300/q:80" + source + "@avif",
+		"/_/rs:fill:600:600/q:80" + source + "@webp",
+		"/_/rs:fill:600:600/q:80/dpr:2" + source + "@webp",
+	}
+
+	tests := []struct {
+		include []string
+		want    int
+	}{
+		{nil, 6},
+		{[]string{keyIncludeFormat, keyIncludeDimensions, keyIncludeQuality}, 5},
+		{[]string{keyIncludeFormat, keyIncludeDimensions}, 4},
+		{[]string{keyIncludeFormat}, 2},
+	}
+	for _, tt := range tests {
+		keys := newKeyScheme(Config{KeyLayout: keyLayoutFlat, KeyInclude: tt.include})
+		distinct := map[string]bool{}
+		for _, path := range paths {
+			distinct[keys.key("", path)] = true
+		}
+		if len(distinct) != tt.want {
+			t.Errorf("KEY_INCLUDE=%v: expected %d distinct keys, got %d", tt.include, tt.want, len(distinct))
+		}
+	}
+}
+
+func TestKeyIncludeKeepsTheSourceInTheKey(t *testing.T) {
+	keys := newKeyScheme(Config{KeyLayout: keyLayoutFlat, KeyInclude: []string{keyIncludeFormat}})
+	if keys.key("", "/_/w:300/plain/https://example.com/cat.jpg") == keys.key("", "/_/w:300/plain/https://example.com/dog.jpg") {
+		t.Fatal("Expected different sources to keep different keys")
+	}
+}
+
+func TestKeyIncludeRejectsUnknownCategories(t *testing.T) {
+	if _, err := parseKeyInclude([]string{keyIncludeFormat, "crop"}); err == nil {
+		t.Fatal("Expected an unknown category to be rejected")
+	}
+}
+
+func TestKeyIncludeVerifiesSignaturesBeforeHits(t *testing.T) {
+	cfg := Config{KeyInclude: []string{keyIncludeFormat, keyIncludeDimensions}, ImgproxyKey: []byte("key"), ImgproxySalt: []byte("salt")}
+	_, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/forged/w:300/q:10/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a forged signature to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// keyLocks coordinates the purges and reads of a key within the process, with PURGE_LOCKS: a read
+// streams the object it found before a purge removes it, and a read starting during a purge waits
+// for it and regenerates the image, rather than racing the delete. Waiting for a lock is bounded by
+// the context of the request, a read holds its lock while its body streams
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is the lock of a key, dropped once no request holds or waits for it
+type keyLock struct {
+	readers int
+	// purge is closed when the purge holding or waiting for the key is done, nil without one
+	purge chan struct{}
+	// drained is closed when the last read ends, while a purge waits for it
+	drained chan struct{}
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*keyLock{}}
+}
+
+// read locks a key for a read, until the returned function is called
+func (l *keyLocks) read(ctx context.Context, key string) (func(), error) {
+	lock, err := l.awaitPurge(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lock.readers++
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.readers--; lock.readers == 0 && lock.drained != nil {
+			close(lock.drained)
+			lock.drained = nil
+		}
+		l.drop(key, lock)
+	}, nil
+}
+
+// purge locks a key for a purge, until the returned function is called. The reads starting meanwhile
+// wait for it, the ones in flight are waited for
+func (l *keyLocks) purge(ctx context.Context, key string) (func(), error) {
+	lock, err := l.awaitPurge(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	lock.purge = done
+	var drained chan struct{}
+	if lock.readers > 0 {
+		drained = make(chan struct{})
+		lock.drained = drained
+	}
+	l.mu.Unlock()
+
+	unlock := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.purge, lock.drained = nil, nil
+		close(done)
+		l.drop(key, lock)
+	}
+	if drained == nil {
+		return unlock, nil
+	}
+	select {
+	case <-drained:
+		return unlock, nil
+	case <-ctx.Done():
+		unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// awaitPurge waits for the purge of a key in flight, if any, and returns its lock with l.mu held
+func (l *keyLocks) awaitPurge(ctx context.Context, key string) (*keyLock, error) {
+	l.mu.Lock()
+	for {
+		lock, ok := l.locks[key]
+		if !ok {
+			lock = &keyLock{}
+			l.locks[key] = lock
+		}
+		if lock.purge == nil {
+			return lock, nil
+		}
+
+		purge := lock.purge
+		l.mu.Unlock()
+		select {
+		case <-purge:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+}
+
+// drop removes the lock of a key no request holds, with l.mu held
+func (l *keyLocks) drop(key string, lock *keyLock) {
+	if lock.readers == 0 && lock.purge == nil {
+		delete(l.locks, key)
+	}
+}
+
+// lockRead locks a key for a read with PURGE_LOCKS, the returned function unlocks it
+func (s *server) lockRead(ctx context.Context, key string) (func(), error) {
+	if s.keyLocks == nil {
+		return func() {}, nil
+	}
+	return s.keyLocks.read(ctx, key)
+}
+
+// lockPurge locks a key for a purge with PURGE_LOCKS, the returned function unlocks it
+func (s *server) lockPurge(ctx context.Context, key string) (func(), error) {
+	if s.keyLocks == nil {
+		return func() {}, nil
+	}
+	return s.keyLocks.purge(ctx, key)
+}
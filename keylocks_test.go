@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// racyStore pauses its reads and deletes until resumed, and fails the body of an object deleted
+// while it was being read, as an S3 stream cut by a delete would
+type racyStore struct {
+	*memoryStore
+	reading, deleting chan struct{}
+	resume            chan struct{}
+}
+
+func newRacyStore() *racyStore {
+	return &racyStore{memoryStore: newMemoryStore(), reading: make(chan struct{}, 1), deleting: make(chan struct{}, 1), resume: make(chan struct{})}
+}
+
+func (s *racyStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	obj, err := s.memoryStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	obj.Body = io.NopCloser(&racyBody{store: s, key: key, body: obj.Body})
+	return obj, nil
+}
+
+func (s *racyStore) Delete(ctx context.Context, key string) error {
+	s.deleting <- struct{}{}
+	<-s.resume
+	return s.memoryStore.Delete(ctx, key)
+}
+
+type racyBody struct {
+	store  *racyStore
+	key    string
+	body   io.Reader
+	paused bool
+}
+
+func (b *racyBody) Read(p []byte) (int, error) {
+	if !b.paused {
+		b.paused = true
+		b.store.reading <- struct{}{}
+		<-b.store.resume
+	}
+	if _, ok := b.store.get(b.key); !ok {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return b.body.Read(p)
+}
+
+// within reports whether a channel receives within a short delay
+func within[T any](ch <-chan T) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestPurgeWaitsForTheReadInFlight(t *testing.T) {
+	store := newRacyStore()
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached"), ObjectMeta{})
+	_, proxy := newTestServerWithStore(t, Config{PurgeLocks: true}, imgproxyStub(), store)
+
+	type result struct {
+		status int
+		body   string
+	}
+	read := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			read <- result{}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		read <- result{resp.StatusCode, string(body)}
+	}()
+	<-store.reading
+
+	purged := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path), nil)
+		req.Header.Set(adminTokenHeader, testAdminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			purged <- 0
+			return
+		}
+		resp.Body.Close()
+		purged <- resp.StatusCode
+	}()
+	if within(purged) {
+		t.Fatal("Expected the purge to wait for the read in flight")
+	}
+
+	close(store.resume)
+	if got := <-read; got.status != http.StatusOK || got.body != "cached" {
+		t.Fatalf("Expected the read to get the object found before the purge, got %d %q", got.status, got.body)
+	}
+	if status := <-purged; status != http.StatusNoContent {
+		t.Fatalf("Expected the purge to complete once the read is done, got %d", status)
+	}
+}
+
+func TestReadDuringPurgeRegenerates(t *testing.T) {
+	store := newRacyStore()
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached"), ObjectMeta{})
+	srv, proxy := newTestServerWithStore(t, Config{PurgeLocks: true}, imgproxyStub(), store)
+
+	go func() {
+		req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path), nil)
+		req.Header.Set(adminTokenHeader, testAdminToken)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-store.deleting
+
+	read := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(proxy.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		read <- resp
+	}()
+	if within(read) {
+		t.Fatal("Expected the read to wait for the purge in flight")
+	}
+
+	close(store.resume)
+	resp := <-read
+	if resp == nil || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the read to regenerate the purged image, got %+v", resp)
+	}
+	srv.uploads.Wait()
+}
+
+func TestKeyLocksAreDroppedOnceReleased(t *testing.T) {
+	ctx := context.Background()
+	locks := newKeyLocks()
+	unlock, _ := locks.read(ctx, "key")
+	other, _ := locks.read(ctx, "key")
+	other()
+	unlock()
+	purge, _ := locks.purge(ctx, "key")
+	purge()
+	if len(locks.locks) != 0 {
+		t.Fatalf("Expected no lock left, got %d", len(locks.locks))
+	}
+}
+
+func TestKeyLockWaitsEndWithTheirContext(t *testing.T) {
+	locks := newKeyLocks()
+	unlockRead, _ := locks.read(context.Background(), "key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := locks.purge(ctx, "key"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the purge to stop waiting for the read with its context, got %v", err)
+	}
+
+	// The canceled purge no longer holds the reads back
+	unlock, err := locks.read(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("Expected a read after the canceled purge to get the lock, got %v", err)
+	}
+	unlock()
+	unlockRead()
+
+	unlockPurge, _ := locks.purge(context.Background(), "key")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := locks.read(ctx, "key"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the read to stop waiting for the purge with its context, got %v", err)
+	}
+	unlockPurge()
+	if len(locks.locks) != 0 {
+		t.Fatalf("Expected no lock left, got %d", len(locks.locks))
+	}
+}
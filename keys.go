@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// GenerateS3Key creates a hash from the imgproxy URL path.
+// The source URL is normalized first, so the same image requested with
+// different encodings or host casing shares a single key
+func GenerateS3Key(path string) string {
+	hash := md5.Sum([]byte(normalizeKeyPath(path)))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyExtension returns the extension of the output format requested by the path, appended to keys
+// with KEY_EXTENSION. It's empty when imgproxy keeps the source format, since the key must be known before processing
+func keyExtension(path string) string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return ""
+	}
+
+	switch format := strings.ToLower(p.Format()); format {
+	case "jpg", "jpeg":
+		return ".jpg"
+	case "png", "webp", "avif", "gif", "ico", "svg", "heic", "bmp", "tiff", "jxl", "pdf":
+		return "." + format
+	}
+	return ""
+}
+
+// Key layouts: flat keys are the hash of the path, by-source keys are grouped
+// in a folder per source URL so the variants of a source can be listed.
+// by-source-options keys are named after their options instead of the whole path
+const (
+	keyLayoutFlat            = "flat"
+	keyLayoutBySource        = "by-source"
+	keyLayoutBySourceOptions = "by-source-options"
+)
+
+// groupsBySource reports whether the keys of a layout are grouped in a folder per source URL
+func groupsBySource(layout string) bool {
+	return layout == keyLayoutBySource || layout == keyLayoutBySourceOptions
+}
+
+// keyScheme derives the key a path is stored under from the key settings
+type keyScheme struct {
+	layout string
+	// ignoreSignature makes the insecure and signed forms of a path share their key
+	ignoreSignature bool
+	// versionTag is the IMGPROXY_VERSION_TAG namespace of the keys, empty when unset
+	versionTag string
+	// generation is the CACHE_GENERATION, shared by the copies of the scheme so a bump applies to every request
+	generation *atomic.Int64
+	// extension is KEY_EXTENSION, keys then end with the extension of the requested format
+	extension bool
+	// include is KEY_INCLUDE, the categories of options keys are derived from, all of them when empty
+	include []string
+	// cleanSlashes is NORMALIZE_PATH_SLASHES, cleaned paths are signed again with signatures
+	cleanSlashes bool
+	signatures   *signatureVerifier
+	// cleanOptions is NORMALIZE_OPTIONS, the spellings of the same options then share a key
+	cleanOptions bool
+}
+
+func newKeyScheme(cfg Config) keyScheme {
+	generation := new(atomic.Int64)
+	generation.Store(int64(cfg.CacheGeneration))
+	return keyScheme{
+		layout:          cfg.KeyLayout,
+		ignoreSignature: cfg.KeyIgnoreSignature,
+		versionTag:      cfg.ImgproxyVersionTag,
+		generation:      generation,
+		extension:       cfg.KeyExtension,
+		include:         cfg.KeyInclude,
+		cleanSlashes:    cfg.NormalizePathSlashes,
+		signatures:      newSignatureVerifier(cfg),
+		cleanOptions:    cfg.NormalizeOptions,
+	}
+}
+
+// cleanPath removes the duplicate and trailing slashes of a path, as image requests do before
+// forwarding it to imgproxy. The cleaned path is signed again, its original signature must be
+// verified by callers forwarding it
+func (k keyScheme) cleanPath(path string) string {
+	if !k.cleanSlashes {
+		return path
+	}
+	cleaned := cleanPathSlashes(path)
+	if cleaned == path {
+		return path
+	}
+	return k.signatures.resignPath(cleaned)
+}
+
+// key returns the key of a path. The keys of an imgproxy version, then of a tenant,
+// are all under their own top-level prefix
+func (k keyScheme) key(tenant, path string) string {
+	return k.variantKey(tenant, path, keyVariant{})
+}
+
+// keyVariant is what a request adds to the key of its path: its query string with QUERY_IN_KEY
+// and the Accept header forwarded with FORWARD_ACCEPT_TO_SOURCE
+type keyVariant struct {
+	query  string
+	accept string
+}
+
+// suffix returns what's appended to a path before hashing its key, empty for the path alone
+func (v keyVariant) suffix() string {
+	if v.query == "" && v.accept == "" {
+		return ""
+	}
+	suffix := "?" + normalizeQuery(v.query)
+	if v.accept != "" {
+		suffix += "\naccept:" + v.accept
+	}
+	return suffix
+}
+
+// variantKey returns the key of a path requested with a key variant.
+// The key of an empty variant is the one of the path alone
+func (k keyScheme) variantKey(tenant, path string, variant keyVariant) string {
+	path = k.keyingPath(path)
+
+	key := GenerateS3Key(path)
+	if suffix := variant.suffix(); suffix != "" {
+		hash := md5.Sum([]byte(normalizeKeyPath(path) + suffix))
+		key = hex.EncodeToString(hash[:])
+	}
+	if k.extension {
+		key += keyExtension(path)
+	}
+	if !groupsBySource(k.layout) {
+		return k.prefix(tenant) + key
+	}
+
+	// Encrypted sources can't be grouped, they stay at the top level
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return k.prefix(tenant) + key
+	}
+	source, err := p.SourceURL()
+	if err != nil {
+		return k.prefix(tenant) + key
+	}
+	if k.layout == keyLayoutBySourceOptions {
+		return k.sourcePrefix(tenant, source) + optionsKey(p, variant)
+	}
+	return k.sourcePrefix(tenant, source) + key
+}
+
+// optionsKey names a variant within its source folder in the by-source-options layout: a compact hash
+// of its signature, options and key variant, followed by the extension of the requested format
+func optionsKey(p imgproxyPath, variant keyVariant) string {
+	id := p.Signature + "/" + strings.Join(p.Options, "/") + "@" + p.Extension + variant.suffix()
+	hash := md5.Sum([]byte(id))
+	return hex.EncodeToString(hash[:8]) + keyExtension(p.String())
+}
+
+// keyingPath returns the cleaned path, without the parts that aren't part of its key
+func (k keyScheme) keyingPath(path string) string {
+	path = k.cleanPath(path)
+	if k.cleanOptions {
+		path = normalizeOptions(path)
+	}
+	if len(k.include) > 0 {
+		return keyingPath(path, k.include)
+	}
+	if k.ignoreSignature {
+		return unsignedPath(path)
+	}
+	return path
+}
+
+// sharesKeysAcrossSignatures reports whether paths with different signatures can share a key,
+// a cache hit then bypasses imgproxy's signature check
+func (k keyScheme) sharesKeysAcrossSignatures() bool {
+	return k.ignoreSignature || len(k.include) > 0
+}
+
+// normalizedPath returns the form of a path its key is the hash of
+func (k keyScheme) normalizedPath(path string) string {
+	return normalizeKeyPath(k.keyingPath(path))
+}
+
+// sourcePrefix returns the folder grouping the variants of a source URL for a tenant
+func (k keyScheme) sourcePrefix(tenant, source string) string {
+	return k.prefix(tenant) + sourceKeyPrefix(source)
+}
+
+// prefix returns the folder of the keys of a tenant, in the namespace of the imgproxy version and of the cache generation
+func (k keyScheme) prefix(tenant string) string {
+	prefix := tenantKeyPrefix(tenant)
+	if generation := k.currentGeneration(); generation > 0 {
+		prefix = "gen-" + strconv.FormatInt(generation, 10) + "/" + prefix
+	}
+	if k.versionTag == "" {
+		return prefix
+	}
+	return k.versionTag + "/" + prefix
+}
+
+// currentGeneration returns the CACHE_GENERATION keys are derived in, 0 leaves them outside of any generation folder
+func (k keyScheme) currentGeneration() int64 {
+	if k.generation == nil {
+		return 0
+	}
+	return k.generation.Load()
+}
+
+// bumpGeneration moves the keys to the next generation, making every key derived so far unreachable
+func (k keyScheme) bumpGeneration() int64 {
+	return k.generation.Add(1)
+}
+
+// raiseGeneration moves the keys to a generation when it's above the current one.
+// A generation never goes back, the images cached before its bump were purged on purpose
+func (k keyScheme) raiseGeneration(generation int64) int64 {
+	for {
+		current := k.generation.Load()
+		if generation <= current || k.generation.CompareAndSwap(current, generation) {
+			return max(current, generation)
+		}
+	}
+}
+
+// tenantKeyPrefix returns the folder of a tenant, empty when tenants are disabled
+func tenantKeyPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return tenant + "/"
+}
+
+// isVersionTag reports whether an IMGPROXY_VERSION_TAG can be used as a single key folder, such as v3.28.0
+func isVersionTag(s string) bool {
+	if s == "" || len(s) > 64 || s == "." || s == ".." {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7f || !isUnreserved(byte(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeKeyPath returns the canonical form of an imgproxy path, used to derive its key.
+// Paths that can't be parsed are used as is
+func normalizeKeyPath(path string) string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return path
+	}
+
+	if p.Plain {
+		p.Source = normalizePlainSource(p.Source)
+		return p.String()
+	}
+
+	source, err := p.SourceURL()
+	if err != nil {
+		return path
+	}
+	if normalized := normalizeSourceURL(source); normalized != source {
+		// Base64 sources are only re-encoded when their URL isn't normalized already,
+		// so keys of well-formed paths stay the MD5 of the path itself
+		p.Source = base64.RawURLEncoding.EncodeToString([]byte(normalized))
+	}
+	return p.String()
+}
+
+// normalizePlainSource normalizes a plain source as normalizeSourceURL does, without decoding it first.
+// imgproxy only unescapes the source once the path is split, on @ for the extension, so escaped reserved
+// characters aren't equivalent to literal ones and only the escapes of unreserved characters are decoded
+func normalizePlainSource(escaped string) string {
+	s := normalizePercentEncoding(escaped)
+
+	// The scheme and host are found in the decoded source, each of its bytes being a literal byte or an escape of s
+	var decoded []byte
+	var units []string
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			decoded, units = append(decoded, unhex(s[i+1])<<4|unhex(s[i+2])), append(units, s[i:i+3])
+			i += 2
+			continue
+		}
+		decoded, units = append(decoded, s[i]), append(units, s[i:i+1])
+	}
+
+	schemeEnd := strings.Index(string(decoded), "://")
+	if schemeEnd < 0 {
+		return s
+	}
+	authorityStart := schemeEnd + len("://")
+	authorityEnd := len(decoded)
+	if i := strings.IndexAny(string(decoded[authorityStart:]), "/?#"); i >= 0 {
+		authorityEnd = authorityStart + i
+	}
+	hostStart := authorityStart + strings.LastIndex(string(decoded[authorityStart:authorityEnd]), "@") + 1
+
+	var b strings.Builder
+	for i, unit := range units {
+		if i < schemeEnd || hostStart <= i && i < authorityEnd {
+			// Escapes are uppercase already, only literal letters are lowercased
+			if len(unit) == 1 {
+				unit = strings.ToLower(unit)
+			}
+		}
+		b.WriteString(unit)
+	}
+	return b.String()
+}
+
+// sourceKeyPrefix returns the folder grouping the variants of a source URL in the by-source layout
+func sourceKeyPrefix(source string) string {
+	hash := md5.Sum([]byte(normalizeSourceURL(source)))
+	return hex.EncodeToString(hash[:]) + "/"
+}
+
+// normalizeSourceURL lowercases the scheme and host of a source URL and makes its
+// percent-encoding consistent. The rest of the URL is left untouched since
+// paths and queries may be case-sensitive on the origin
+func normalizeSourceURL(source string) string {
+	schemeEnd := strings.Index(source, "://")
+	if schemeEnd < 0 {
+		return normalizePercentEncoding(source)
+	}
+
+	authorityStart := schemeEnd + len("://")
+	authorityEnd := len(source)
+	if i := strings.IndexAny(source[authorityStart:], "/?#"); i >= 0 {
+		authorityEnd = authorityStart + i
+	}
+
+	// Userinfo, if any, is case-sensitive too
+	authority := source[authorityStart:authorityEnd]
+	hostStart := strings.LastIndex(authority, "@") + 1
+
+	return strings.ToLower(source[:schemeEnd]) + "://" +
+		authority[:hostStart] + strings.ToLower(authority[hostStart:]) +
+		normalizePercentEncoding(source[authorityEnd:])
+}
+
+// normalizePercentEncoding decodes percent-encoded unreserved characters (RFC 3986 section 6.2.2.2)
+// and uppercases the hex digits of the remaining ones
+func normalizePercentEncoding(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
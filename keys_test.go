@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGenerateS3KeyCollapsesEncodingVariants(t *testing.T) {
+	for _, variants := range [][]string{
+		{
+			"/_/rs:fill:300:300/plain/https://example.com/images/Cat.jpg",
+			"/_/rs:fill:300:300/plain/https://EXAMPLE.com/images/Cat.jpg",
+			"/_/rs:fill:300:300/plain/HTTPS://Example.COM/images/Cat.jpg",
+			"/_/rs:fill:300:300/plain/https://example.com/%69mages/%43at.jpg",
+		},
+		{
+			"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fimages%2FCat.jpg",
+			"/_/rs:fill:300:300/plain/https%3a%2f%2fexample.com%2fimages%2fCat.jpg",
+			"/_/rs:fill:300:300/plain/HTTPS%3A%2F%2FExample.COM%2Fimages%2FCat.jpg",
+			"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2F%69mages%2F%43at.jpg",
+		},
+	} {
+		want := GenerateS3Key(variants[0])
+		if normalizeKeyPath(variants[0]) != variants[0] {
+			t.Errorf("Expected the normalized path %q to be hashed as is", variants[0])
+		}
+		for _, v := range variants[1:] {
+			if got := GenerateS3Key(v); got != want {
+				t.Errorf("GenerateS3Key(%q) = %s, want %s", v, got, want)
+			}
+		}
+	}
+}
+
+func TestGenerateS3KeyCollapsesBase64Variants(t *testing.T) {
+	encode := func(source string) string {
+		return "/_/rs:fill:300:300/" + base64.RawURLEncoding.EncodeToString([]byte(source)) + ".webp"
+	}
+
+	want := GenerateS3Key(encode("https://example.com/images/Cat.jpg"))
+	for _, source := range []string{"https://Example.com/images/Cat.jpg", "https://example.com/images/%43at.jpg"} {
+		if got := GenerateS3Key(encode(source)); got != want {
+			t.Errorf("GenerateS3Key of %q = %s, want %s", source, got, want)
+		}
+	}
+}
+
+func TestGenerateS3KeyKeepsCaseSensitiveParts(t *testing.T) {
+	distinct := []string{
+		"/_/rs:fill:300:300/plain/https://example.com/images/Cat.jpg",
+		"/_/rs:fill:300:300/plain/https://example.com/images/cat.jpg",
+		"/_/rs:fill:300:300/plain/https://example.com/images/Cat.jpg?v=A",
+		"/_/rs:fill:300:300/plain/https://example.com/images/Cat.jpg?v=a",
+		"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fimages%252FCat.jpg",
+		"/_/rs:fill:300:300/plain/https://example.com/images/Cat.jpg@webp",
+		"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fimages%2FCat.jpg%40webp",
+		"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fimages%2FCat.jpg",
+		"/_/rs:fill:300:300/plain/https%3A%2F%2Fexample.com%2Fimages%2FCat.jpg@webp",
+		"/_/rs:fill:200:200/plain/https://example.com/images/Cat.jpg",
+	}
+
+	seen := map[string]string{}
+	for _, path := range distinct {
+		key := GenerateS3Key(path)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%q and %q share the key %s", path, other, key)
+		}
+		seen[key] = path
+	}
+}
+
+func TestGenerateS3KeyOfNormalizedBase64PathIsItsHash(t *testing.T) {
+	path := "/sig/rs:fit:100:100/" + base64.RawURLEncoding.EncodeToString([]byte("https://example.com/cat.jpg")) + ".webp"
+	if normalizeKeyPath(path) != path {
+		t.Fatalf("Expected a normalized path to be kept as is, got %q", normalizeKeyPath(path))
+	}
+}
+
+func TestKeyExtensionMatchesFormat(t *testing.T) {
+	source := "https://example.com/cat.jpg"
+	tests := map[string]string{
+		"/_/rs:fill:300:300/plain/" + source:                                                  "",
+		"/_/rs:fill:300:300/plain/" + source + "@webp":                                        ".webp",
+		"/_/rs:fill:300:300/plain/" + source + "@jpeg":                                        ".jpg",
+		"/_/rs:fill:300:300/f:avif/plain/" + source:                                           ".avif",
+		"/_/rs:fill:300:300/format:png/plain/" + source:                                       ".png",
+		"/_/rs:fill:300:300/" + base64.RawURLEncoding.EncodeToString([]byte(source)) + ".jpg": ".jpg",
+	}
+
+	keys := newKeyScheme(Config{KeyExtension: true})
+	for path, ext := range tests {
+		key := keys.key("", path)
+		if len(key) != 32+len(ext) || !strings.HasSuffix(key, ext) {
+			t.Errorf("key(%q) = %s, want a hash with extension %q", path, key, ext)
+		}
+		if key := GenerateS3Key(path); len(key) != 32 {
+			t.Errorf("GenerateS3Key(%q) = %s, want a bare hash without KEY_EXTENSION", path, key)
+		}
+	}
+}
+
+func TestKeyIgnoringSignatureSharesInsecureAndSignedForms(t *testing.T) {
+	rest := "/rs:fill:300:300/plain/https://example.com/cat.jpg@webp"
+	forms := []string{"/_" + rest, "/insecure" + rest, "/oKfUtW34Dvo2BGQehJFR4Nr0_rIjOtdtzJ3QFsUcXH8" + rest, "/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" + rest}
+
+	keys := keyScheme{layout: keyLayoutFlat, ignoreSignature: true}
+	want := keys.key("", forms[0])
+	if want != GenerateS3Key(forms[0]) {
+		t.Fatalf("Expected the insecure form to keep its key, got %s", want)
+	}
+	for _, form := range forms[1:] {
+		if got := keys.key("", form); got != want {
+			t.Errorf("key(%q) = %s, want %s", form, got, want)
+		}
+	}
+
+	signed := keyScheme{layout: keyLayoutFlat}
+	if signed.key("", forms[0]) == signed.key("", forms[2]) {
+		t.Fatal("Expected signatures to be part of the key by default")
+	}
+}
+
+func TestVersionTagsProduceDisjointKeys(t *testing.T) {
+	path := "/rs:fill:300:300/plain/https://example.com/cat.jpg@webp"
+
+	for _, layout := range []string{keyLayoutFlat, keyLayoutBySource, keyLayoutBySourceOptions} {
+		v1 := keyScheme{layout: layout, versionTag: "v3.27.0"}
+		v2 := keyScheme{layout: layout, versionTag: "v3.28.0"}
+
+		k1, k2 := v1.key("", path), v2.key("", path)
+		if k1 == k2 {
+			t.Fatalf("Expected distinct keys for two version tags in the %s layout, got %s", layout, k1)
+		}
+		if !strings.HasPrefix(k1, "v3.27.0/") || !strings.HasPrefix(k2, "v3.28.0/") {
+			t.Errorf("Expected the keys under their version namespace, got %s and %s", k1, k2)
+		}
+		if got := v1.key("acme", path); !strings.HasPrefix(got, "v3.27.0/acme/") {
+			t.Errorf("Expected the tenant folder inside the version namespace, got %s", got)
+		}
+	}
+}
+
+func TestBySourceOptionsKeysGroupVariantsBySource(t *testing.T) {
+	keys := keyScheme{layout: keyLayoutBySourceOptions}
+	cat := "https://example.com/cat.jpg"
+
+	small := keys.key("", "/_/rs:fill:300:300/plain/"+cat+"@webp")
+	large := keys.key("", "/_/rs:fill:600:600/plain/"+cat+"@webp")
+	encoded := keys.key("", "/_/rs:fill:300:300/plain/"+url.QueryEscape(cat)+"@webp")
+	dog := keys.key("", "/_/rs:fill:300:300/plain/https://example.com/dog.jpg@webp")
+
+	source, variant, _ := strings.Cut(small, "/")
+	if source+"/" != sourceKeyPrefix(cat) {
+		t.Fatalf("Expected the key under the folder of its source, got %s", small)
+	}
+	if len(variant) != len("0123456789abcdef.webp") || !strings.HasSuffix(variant, ".webp") {
+		t.Fatalf("Expected a compact options hash with the format extension, got %s", variant)
+	}
+	if !strings.HasPrefix(large, source+"/") || large == small {
+		t.Fatalf("Expected other options of the source in the same folder under another name, got %s", large)
+	}
+	if encoded != small {
+		t.Fatalf("Expected the encodings of a source to share their key, got %s and %s", encoded, small)
+	}
+	if strings.HasPrefix(dog, source+"/") || strings.TrimPrefix(dog, sourceKeyPrefix("https://example.com/dog.jpg")) != variant {
+		t.Fatalf("Expected the same options of another source in another folder under the same name, got %s", dog)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// modernFormats are the output formats old browsers can't render, they're downgraded for LEGACY_UA_PATTERNS
+var modernFormats = []string{"webp", "avif", "jxl"}
+
+// legacyFormats are the formats a LEGACY_FORMAT downgrade may produce
+var legacyFormats = []string{"jpg", "png"}
+
+// applyLegacyDowngrade rewrites the path of a request from a user agent matching LEGACY_UA_PATTERNS
+// to request LEGACY_FORMAT instead of a modern format. The downgraded path has its own key, apart from
+// the modern image, so old browsers never get a cached image they can't render
+func (s *server) applyLegacyDowngrade(r *http.Request, w http.ResponseWriter) error {
+	if len(s.cfg.LegacyUAPatterns) == 0 {
+		return nil
+	}
+	w.Header().Add("Vary", "User-Agent")
+
+	if !isLegacyUserAgent(r.UserAgent(), s.cfg.LegacyUAPatterns) {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		if !slices.Contains(modernFormats, canonicalFormat(p.Format())) {
+			return false
+		}
+		*p = p.WithFormat(s.cfg.LegacyFormat)
+		return true
+	})
+}
+
+func isLegacyUserAgent(userAgent string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLegacyUAPatterns compiles the regular expressions of LEGACY_UA_PATTERNS
+func parseLegacyUAPatterns(items []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(items))
+	for _, item := range items {
+		pattern, err := regexp.Compile(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LEGACY_UA_PATTERNS item %q: %w", item, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
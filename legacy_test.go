@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLegacyUserAgentsGetJPEG(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	})
+	cfg := Config{LegacyUAPatterns: []*regexp.Regexp{regexp.MustCompile(`MSIE \d+\.`), regexp.MustCompile(`Trident/`)}, LegacyFormat: "jpg"}
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	path := "/_/rs:fill:50:50" + source + "@webp"
+
+	tests := []struct {
+		name, userAgent, want string
+	}{
+		{"legacy", "Mozilla/4.0 (compatible; MSIE 8.0; Windows NT 6.1; Trident/4.0)", "/_/rs:fill:50:50" + source + "@jpg"},
+		{"modern", "Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0 Safari/537.36", path},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, proxy, store := newTestServer(t, cfg, stub)
+
+			req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			srv.uploads.Wait()
+
+			if resp.Header.Get("Vary") != "User-Agent" {
+				t.Errorf("Expected the response to vary on the user agent, got %q", resp.Header.Get("Vary"))
+			}
+			if got, _ := requested.Load().(string); got != tt.want {
+				t.Fatalf("Expected imgproxy to be asked for %s, got %s", tt.want, got)
+			}
+			if _, ok := store.get(GenerateS3Key(tt.want)); !ok || store.len() != 1 {
+				t.Fatalf("Expected the image to be stored under the key of %s only", tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyDowngradeKeepsLegacyFormats(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Write([]byte("image"))
+	})
+	cfg := Config{LegacyUAPatterns: []*regexp.Regexp{regexp.MustCompile(`MSIE`)}, LegacyFormat: "jpg"}
+	_, proxy, _ := newTestServer(t, cfg, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/logo.png") + "@png"
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+	req.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 8.0)")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got, _ := requested.Load().(string); got != path {
+		t.Fatalf("Expected a PNG request to be left as is, got %s", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// S3 answers 503 SlowDown when its request rate is exceeded, the call is retried with an exponential
+// backoff starting at slowDownBackoff, by default. S3_THROTTLE_RETRIES and S3_THROTTLE_BACKOFF override them
+const (
+	slowDownRetries = 3
+	slowDownBackoff = 200 * time.Millisecond
+)
+
+// limitedStore bounds the number of in-flight calls to the underlying store,
+// shared across all the operations, and retries throttled calls
+type limitedStore struct {
+	store CacheStore
+	// slots is nil when the concurrency is unbounded
+	slots   chan struct{}
+	retries int
+	backoff time.Duration
+}
+
+// newLimitedStore wraps a store so that at most maxConcurrency calls are in flight, 0 meaning unbounded
+func newLimitedStore(store CacheStore, maxConcurrency int) *limitedStore {
+	l := &limitedStore{store: store, retries: slowDownRetries, backoff: slowDownBackoff}
+	if maxConcurrency > 0 {
+		l.slots = make(chan struct{}, maxConcurrency)
+	}
+	return l
+}
+
+// setThrottleRetries sets how many times a throttled call is retried, and the backoff before the first retry
+func (l *limitedStore) setThrottleRetries(retries int, backoff time.Duration) {
+	l.retries, l.backoff = retries, backoff
+}
+
+func (l *limitedStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	var obj *CachedObject
+	err := l.do(ctx, func() (err error) {
+		obj, err = l.store.Get(ctx, key)
+		return err
+	})
+	return obj, err
+}
+
+func (l *limitedStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := l.do(ctx, func() (err error) {
+		info, err = l.store.Head(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (l *limitedStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	put := func() error { return l.store.Put(ctx, key, r, meta) }
+
+	// A retried upload must resend the body from the start, bodies that can't be rewound aren't retried
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return l.acquired(ctx, put)
+	}
+	return l.do(ctx, func() error {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return put()
+	})
+}
+
+func (l *limitedStore) Delete(ctx context.Context, key string) error {
+	return l.do(ctx, func() error {
+		return l.store.Delete(ctx, key)
+	})
+}
+
+func (l *limitedStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	var page *ObjectPage
+	err := l.do(ctx, func() (err error) {
+		page, err = l.store.List(ctx, prefix, cursor, limit)
+		return err
+	})
+	return page, err
+}
+
+// do runs a call once a slot is free, retrying it while it's throttled.
+// The slot is released during the backoff so other callers aren't held up
+func (l *limitedStore) do(ctx context.Context, call func() error) error {
+	backoff := l.backoff
+	for retry := 0; ; retry++ {
+		err := l.acquired(ctx, call)
+		if !isSlowDown(err) || retry == l.retries {
+			return err
+		}
+
+		slog.Warn("S3 is throttling requests, backing off", "retry", retry+1, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			// The throttling error is kept, a caller may have a fallback for it
+			return fmt.Errorf("%w while backing off: %w", ctx.Err(), err)
+		}
+		backoff *= 2
+	}
+}
+
+// acquired runs a call while holding a slot, queued callers give up when their context is done
+func (l *limitedStore) acquired(ctx context.Context, call func() error) error {
+	if l.slots == nil {
+		return call()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l.slots }()
+
+	return call()
+}
+
+// slowDownRetryer is the SDK retryer without the retries of throttled calls, left to limitedStore
+// so that each SlowDown backs off once instead of being retried by both
+type slowDownRetryer struct {
+	aws.RetryerV2
+}
+
+func newSlowDownRetryer() aws.RetryerV2 {
+	return slowDownRetryer{retry.NewStandard()}
+}
+
+func (r slowDownRetryer) IsErrorRetryable(err error) bool {
+	return !isSlowDown(err) && r.RetryerV2.IsErrorRetryable(err)
+}
+
+// isSlowDown reports whether S3 rejected a call because of its request rate
+func isSlowDown(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "SlowDown" {
+		return true
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusServiceUnavailable
+}
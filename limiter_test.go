@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// slowStore counts the calls in flight, and fails the first calls with the given errors
+type slowStore struct {
+	*memoryStore
+	inFlight, maxInFlight atomic.Int32
+	calls                 atomic.Int32
+	errs                  []error
+}
+
+func (s *slowStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		max := s.maxInFlight.Load()
+		if n <= max || s.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if call := int(s.calls.Add(1)); call <= len(s.errs) {
+		io.Copy(io.Discard, r)
+		return s.errs[call-1]
+	}
+	return s.memoryStore.Put(ctx, key, r, meta)
+}
+
+func TestLimitedStoreCapsConcurrentCalls(t *testing.T) {
+	slow := &slowStore{memoryStore: newMemoryStore()}
+	store := newLimitedStore(slow, 3)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Put(context.Background(), string(rune('a'+i)), strings.NewReader("image"), ObjectMeta{})
+		}()
+	}
+	wg.Wait()
+
+	if max := slow.maxInFlight.Load(); max != 3 {
+		t.Fatalf("Expected at most 3 calls in flight, got %d", max)
+	}
+	if slow.len() != 20 {
+		t.Fatalf("Expected 20 stored objects, got %d", slow.len())
+	}
+}
+
+func TestLimitedStoreRetriesSlowDown(t *testing.T) {
+	slowDown := &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}
+	slow := &slowStore{memoryStore: newMemoryStore(), errs: []error{slowDown, slowDown}}
+	store := newLimitedStore(slow, 1)
+	store.backoff = time.Millisecond
+
+	if err := store.Put(context.Background(), "key", strings.NewReader("image"), ObjectMeta{}); err != nil {
+		t.Fatalf("Expected the throttled upload to be retried, got %v", err)
+	}
+	if stored, _ := slow.get("key"); string(stored) != "image" {
+		t.Fatalf("Expected the full body to be stored on retry, got %q", stored)
+	}
+	if slow.calls.Load() != 3 {
+		t.Fatalf("Expected 3 calls, got %d", slow.calls.Load())
+	}
+}
+
+func TestSDKRetryerLeavesSlowDownToTheLimiter(t *testing.T) {
+	retryer := newSlowDownRetryer()
+
+	if retryer.IsErrorRetryable(&smithy.GenericAPIError{Code: "SlowDown"}) {
+		t.Error("Expected the SDK not to retry SlowDown on top of the limiter")
+	}
+	if !retryer.IsErrorRetryable(&smithy.GenericAPIError{Code: "RequestTimeout"}) {
+		t.Error("Expected the SDK to keep retrying transient errors")
+	}
+}
+
+func TestLimitedStoreQueueRespectsContext(t *testing.T) {
+	stalling := &stallingStore{}
+	store := newLimitedStore(stalling, 1)
+
+	busy, cancelBusy := context.WithCancel(context.Background())
+	defer cancelBusy()
+	go store.Get(busy, "key")
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.Get(ctx, "key"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the queued call to give up with its context, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// LISTEN_NETWORK values: tcp binds dual-stack on a wildcard address, tcp4 and tcp6 a single family
+var listenNetworks = []string{"tcp", "tcp4", "tcp6"}
+
+// checkListenAddr validates LISTEN_ADDR, a host and port where an IPv6 host must be bracketed,
+// such as :8080, 0.0.0.0:8080, [::]:8080 or [2001:db8::1]:8080
+func checkListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid LISTEN_ADDR %q, expected host:port with IPv6 hosts in brackets: %w", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid LISTEN_ADDR %q, the port must be a number from 0 to 65535", addr)
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return fmt.Errorf("invalid LISTEN_ADDR %q, %q isn't an IPv6 address", addr, host)
+		}
+	}
+	return nil
+}
+
+// listen opens the listener of LISTEN_ADDR on LISTEN_NETWORK
+func listen(cfg Config) (net.Listener, error) {
+	return net.Listen(cfg.ListenNetwork, cfg.TigrisProxyBind)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckListenAddr(t *testing.T) {
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "[::]:8080", "[2001:db8::1]:8080", "[fe80::1%eth0]:8080", "localhost:8080"} {
+		if err := checkListenAddr(addr); err != nil {
+			t.Errorf("Expected %q to be valid: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"8080", "::8080", "2001:db8::1:8080", "[2001:db8::zz]:8080", "[::]:http", "[::]:70000"} {
+		if err := checkListenAddr(addr); err == nil {
+			t.Errorf("Expected %q to be rejected", addr)
+		}
+	}
+}
+
+func TestListenOnIPv6(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp6"} {
+		ln, err := listen(Config{ListenNetwork: network, TigrisProxyBind: "[::1]:0"})
+		if err != nil {
+			t.Skipf("IPv6 isn't available: %v", err)
+		}
+		addr := ln.Addr().(*net.TCPAddr)
+		ln.Close()
+		if addr.IP.To4() != nil || !addr.IP.Equal(net.IPv6loopback) {
+			t.Fatalf("Expected to listen on the IPv6 loopback with %s, got %s", network, addr)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFileFlushInterval bounds how long a buffered access log line waits before reaching the file
+const logFileFlushInterval = time.Second
+
+// rotatingFile is an ACCESS_LOG_FILE writer. Writes are buffered and flushed every second, and once
+// the file reaches maxSize it's renamed with a timestamp suffix, gzipped when compress is set, and a
+// new one is started. Writes never straddle two files, so every line stays whole
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	compress bool
+
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+
+	stop        chan struct{}
+	done        chan struct{}
+	compressing sync.WaitGroup
+}
+
+func openRotatingFile(path string, maxSize int64, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		compress: compress,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	go f.flushPeriodically()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the access log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open the access log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	if f.buf == nil {
+		f.buf = bufio.NewWriter(file)
+	} else {
+		f.buf.Reset(file)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.buf.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one, with the lock held
+func (f *rotatingFile) rotate() error {
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(f.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate the access log file: %w", err)
+	}
+	if f.compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			if err := gzipFile(rotated); err != nil {
+				slog.Warn("Failed to compress the rotated access log", "path", rotated, "error", err)
+			}
+		}()
+	}
+	return f.open()
+}
+
+// gzipFile replaces a file by its gzipped copy, with a .gz suffix
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (f *rotatingFile) flushPeriodically() {
+	defer close(f.done)
+	ticker := time.NewTicker(logFileFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				slog.Warn("Failed to flush the access log file", "error", err)
+			}
+		}
+	}
+}
+
+// Flush writes the buffered lines to the file
+func (f *rotatingFile) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	return f.buf.Flush()
+}
+
+// Close flushes the buffered lines, closes the file and waits for the rotated ones to be compressed
+func (f *rotatingFile) Close() error {
+	close(f.stop)
+	<-f.done
+
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.buf.Flush()
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+		f.file = nil
+	}
+	f.mu.Unlock()
+
+	f.compressing.Wait()
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logLines reads the lines of a log file, gunzipping it when it ends in .gz
+func logLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Failed to gunzip %s: %v", path, err)
+		}
+		r = zr
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestAccessLogFileIsWrittenAndFlushed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 1024*1024, false)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	logger := newAccessLogger(logFormatCombined, nil, file)
+	logger.log(accessLogEntry{remoteIP: "192.0.2.10", method: "GET", uri: "/_/plain/src", proto: "HTTP/1.1", status: 200})
+
+	if err := file.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if lines := logLines(t, path); len(lines) != 1 || !strings.HasPrefix(lines[0], "192.0.2.10 - - ") {
+		t.Fatalf("Expected the line to be flushed to the file, got %q", lines)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+}
+
+func TestAccessLogFileRotatesAtMaxSize(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "access.log")
+			// Each line is 10 bytes, so a file holds 10 of them
+			file, err := openRotatingFile(path, 100, compress)
+			if err != nil {
+				t.Fatalf("Failed to open: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			for i := range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := range 25 {
+						fmt.Fprintf(file, "line %d-%02d\n", i, j)
+					}
+				}()
+			}
+			wg.Wait()
+			if err := file.Close(); err != nil {
+				t.Fatalf("Failed to close: %v", err)
+			}
+
+			rotated, _ := filepath.Glob(path + ".*")
+			if len(rotated) != 9 {
+				t.Fatalf("Expected 9 rotated files, got %v", rotated)
+			}
+			total := len(logLines(t, path))
+			for _, name := range rotated {
+				if compress != strings.HasSuffix(name, ".gz") {
+					t.Fatalf("Unexpected rotated file %s with compress=%v", name, compress)
+				}
+				lines := logLines(t, name)
+				if len(lines) != 10 {
+					t.Fatalf("Expected the rotated file %s to hold 10 lines, got %d", name, len(lines))
+				}
+				total += len(lines)
+			}
+			if total != 100 {
+				t.Fatalf("Expected 100 lines overall, got %d", total)
+			}
+		})
+	}
+}
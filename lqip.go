@@ -0,0 +1,26 @@
+package main
+
+import "net/http"
+
+// lqipOptions turn any variant into a low-quality image placeholder of a few hundred bytes.
+// They come after the options of the path, so they override its size and quality
+var lqipOptions = []string{"rs:fit:32:32", "bl:2", "q:30"}
+
+// applyLQIP rewrites a request with ?lqip=1 to request the placeholder of its path.
+// The placeholder is a distinct path, so it's cached under its own key
+func (s *server) applyLQIP(r *http.Request) error {
+	query := r.URL.Query()
+	if query.Get("lqip") != "1" {
+		return nil
+	}
+	err := s.rewritePath(r, func(p *imgproxyPath) bool {
+		p.Options = append(p.Options, lqipOptions...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	query.Del("lqip")
+	r.URL.RawQuery = query.Encode()
+	return nil
+}
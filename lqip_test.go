@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLQIPIsSmallAndCachedSeparately(t *testing.T) {
+	var forwarded []string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.URL.RequestURI())
+		w.Header().Set("Content-Type", "image/jpeg")
+		if strings.Contains(r.URL.Path, "/rs:fit:32:32/") {
+			w.Write(bytes.Repeat([]byte("p"), 200))
+			return
+		}
+		w.Write(bytes.Repeat([]byte("x"), 50000))
+	})
+	srv, proxy, store := newTestServer(t, Config{}, stub)
+	path := "/_/rs:fill:800:600/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	resp := get(t, proxy.URL+path+"?lqip=1")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if len(body) > 1024 {
+		t.Fatalf("Expected a placeholder under 1KB, got %d bytes", len(body))
+	}
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	placeholder := "/_/rs:fill:800:600/rs:fit:32:32/bl:2/q:30/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	stored, ok := store.get(GenerateS3Key(placeholder))
+	if !ok || len(stored) != len(body) {
+		t.Fatal("Expected the placeholder to be stored under the key of its own path")
+	}
+	if full, ok := store.get(GenerateS3Key(path)); !ok || len(full) == len(body) {
+		t.Fatal("Expected the full image to keep its own key")
+	}
+	if strings.Contains(forwarded[0], "lqip") {
+		t.Fatalf("Expected the lqip query not to be forwarded to imgproxy, got %s", forwarded[0])
+	}
+}
@@ -1,184 +1,276 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	awscredentials "github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-type Config struct {
-	S3Bucket           string
-	S3Folder           string
-	TigrisProxyBind    string
-	HealthCheckTimeout time.Duration
+func main() {
+	// Every failure goes through run's return so that its deferred cleanups, such as stopping
+	// the embedded imgproxy, happen before exiting
+	if err := run(); err != nil {
+		slog.Error("Startup failed", "error", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	healthCheckTimeout := 30 * time.Second
-	if os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC") != "" {
-		t, err := strconv.ParseInt(os.Getenv("HEALTH_CHECK_TIMEOUT_IN_SEC"), 10, 64)
+func run() error {
+	cfg, err := loadConfigFile()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize the proxy
+	targetURL := cfg.ImgproxyURL
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse imgproxy local endpoint: %w", err)
+	}
+
+	if cfg.EmbedImgproxy {
+		slog.Info("Starting embedded imgproxy", "binary", cfg.ImgproxyBinary)
+		embedded, err := startEmbeddedImgproxy(cfg.ImgproxyBinary, nil, os.Environ(), cfg.HealthCheckTimeout)
 		if err != nil {
-			slog.Error("Failed to parse HEALTH_CHECK_TIMEOUT_IN_SEC", "error", err)
-			os.Exit(1)
+			return fmt.Errorf("failed to start embedded imgproxy: %w", err)
 		}
-		healthCheckTimeout = time.Duration(t) * time.Second
+		defer embedded.stop()
+
+		target = embedded.upstream
+		targetURL = target.String()
 	}
 
-	cfg := Config{
-		S3Bucket:           os.Getenv("S3_BUCKET"),
-		S3Folder:           os.Getenv("S3_FOLDER"),
-		TigrisProxyBind:    os.Getenv("IMGPROXY_BIND"),
-		HealthCheckTimeout: healthCheckTimeout,
+	if len(cfg.KeyInclude) > 0 {
+		slog.Warn("KEY_INCLUDE is set: paths differing only in the options left out share a key, so an image may be served with another quality or crop than requested", "include", cfg.KeyInclude)
 	}
-	if cfg.S3Bucket == "" {
-		slog.Error("Missing required environment variable(s)", "config", cfg)
-		os.Exit(1)
+	if cfg.InsecureSkipVerify {
+		slog.Warn("INSECURE_SKIP_VERIFY is set: TLS certificates of imgproxy and S3 are NOT verified, never use this in production")
 	}
-	if cfg.TigrisProxyBind == "" {
-		cfg.TigrisProxyBind = ":8080"
+	upstreamTransport, err := newClientTransport(cfg.UpstreamCAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("failed to configure the imgproxy client: %w", err)
 	}
-
-	// Initialize S3 uploader
-	uploader := manager.NewUploader(initS3Client(), func(u *manager.Uploader) {
-		u.PartSize = 5 * 1024 * 1024
-		u.BufferProvider = manager.NewBufferedReadSeekerWriteToPool(10 * 1024 * 1024)
-	})
-
-	// Initialize the proxy
-	targetURL := "http://127.0.0.1:8081"
-	target, err := url.Parse(targetURL)
+	s3Transport, err := newClientTransport(cfg.S3CAFile, cfg.InsecureSkipVerify)
 	if err != nil {
-		slog.Error("Failed to parse imgproxy local endpoint", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to configure the S3 client: %w", err)
 	}
 
 	// Wait for the health endpoint to be ready
 	slog.Info("Waiting for imgproxy to be ready...")
-	if err := waitForHealth(targetURL, cfg.HealthCheckTimeout); err != nil {
-		slog.Error("Health check failed", "error", err)
-		os.Exit(1)
+	if err := waitForHealth(targetURL, newHealthClient(cfg, upstreamTransport), cfg.HealthCheckTimeout); err != nil {
+		return fmt.Errorf("health check failed: %w", err)
 	}
 	slog.Info("imgproxy is ready")
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		if resp.StatusCode == http.StatusOK {
-			// Read the entire response body into a buffer
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				slog.Error("Failed to read response body", "error", err)
-				return err
-			}
-
-			// Create two separate readers from the same bytes
-			// One for the response and one for S3 upload
-			respReader := bytes.NewReader(bodyBytes)
-			s3Reader := bytes.NewReader(bodyBytes)
-
-			// Replace the response body with our buffered copy
-			resp.Body = io.NopCloser(respReader)
-
-			// Use RawPath if available (preserves URL encoding), otherwise use Path
-			originalPath := resp.Request.URL.Path
-			if resp.Request.URL.RawPath != "" {
-				originalPath = resp.Request.URL.RawPath
-			}
+	s3Client, err := initS3Client(s3Transport, getEnvWithDefault("S3_ENDPOINT", defaultS3Endpoint), nil)
+	if err != nil {
+		return err
+	}
+	buckets := cfg.S3Buckets
+	if len(buckets) == 0 {
+		buckets = []string{cfg.S3Bucket}
+	}
+	shards := make([]CacheStore, len(buckets))
+	for i, name := range buckets {
+		bucket := newS3Store(s3Client, name, cfg.S3Folder)
+		bucket.setObjectTags(cfg.S3ObjectTags)
+		if cfg.UploadMode == uploadModePresigned {
+			bucket.enablePresignedUploads()
+		}
+		if cfg.CleanupOrphanedUploads {
+			go bucket.cleanupOrphanedUploads(ctx, cfg.OrphanedUploadMaxAge, cfg.OrphanedUploadCleanupInterval)
+		}
+		shards[i] = bucket
+	}
+	primary := shards[0]
+	if len(shards) > 1 {
+		slog.Info("Sharding the cache across buckets", "buckets", buckets)
+		primary = newShardedStore(shards)
+	}
+	limited := newLimitedStore(primary, cfg.S3MaxConcurrency)
+	limited.setThrottleRetries(cfg.S3ThrottleRetries, cfg.S3ThrottleBackoff)
+	var store CacheStore = limited
+	if len(cfg.ReadFailover) > 0 {
+		store = withReadFailover(cfg, store, s3Client)
+	}
+	if cfg.SecondaryS3Bucket != "" {
+		store, err = withSecondaryStore(cfg, store, s3Transport)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.StaleCacheBytes > 0 {
+		store = newStaleStore(store, int64(cfg.StaleCacheBytes), cfg.MemoryCacheTTL)
+	}
+	srv := newServer(cfg, store, target)
+	srv.setUpstreamTransport(upstreamTransport)
+	if cfg.AccessLogFile != "" {
+		logFile, err := openRotatingFile(cfg.AccessLogFile, int64(cfg.AccessLogMaxSize), cfg.AccessLogCompress)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		srv.setAccessLogOutput(io.MultiWriter(os.Stdout, logFile))
+	}
+	if cfg.AuditLogFile != "" {
+		auditFile, err := openRotatingFile(cfg.AuditLogFile, int64(cfg.AccessLogMaxSize), cfg.AccessLogCompress)
+		if err != nil {
+			return err
+		}
+		defer auditFile.Close()
+		srv.setAuditLogOutput(auditFile)
+	}
 
-			// Upload the complete file to S3 in a goroutine
-			go func() {
-				if err := uploadToS3(context.Background(), uploader, cfg, s3Reader, originalPath); err != nil {
-					slog.Error("S3 upload failed", "error", err)
-				}
-			}()
+	if cfg.WarmSourceBucket != "" {
+		srv.setWarmSource(newS3Store(s3Client, cfg.WarmSourceBucket, ""))
+	}
+	if cfg.UploadSpoolDir != "" {
+		spool, err := openUploadSpool(cfg.UploadSpoolDir)
+		if err != nil {
+			return err
 		}
-		return nil
+		srv.setUploadSpool(spool)
+		go srv.runSpoolReplay(ctx)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		proxy.ServeHTTP(w, r)
-	})
+	go srv.reloadOnHangup(ctx)
+	if cfg.SyntheticProbeInterval > 0 {
+		go srv.runSyntheticProbe(ctx)
+	}
+	if cfg.CacheSizeScanInterval > 0 {
+		go srv.runCacheSizeScan(ctx)
+	}
+	if cfg.CompactFormat != "" {
+		go srv.runCompaction(ctx)
+	}
 
-	if err := http.ListenAndServe(fmt.Sprintf("%s", cfg.TigrisProxyBind), nil); err != nil {
+	httpServer := newHTTPServer(cfg, srv.handler())
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	if err := listenAndServe(httpServer, cfg); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("Server failed", "error", err)
 	}
+
+	// Let the background uploads finish before imgproxy is stopped
+	srv.uploads.Wait()
+	return nil
 }
 
-func uploadToS3(ctx context.Context, uploader *manager.Uploader, cfg Config, r io.Reader, path string) error {
-	key := GenerateS3Key(path)
+// newHTTPServer configures the incoming server with the timeouts and limits guarding against slow clients
+func newHTTPServer(cfg Config, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              cfg.TigrisProxyBind,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.TLSCertFile != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: cfg.TLSMinVersion}
+	}
+	return srv
+}
 
-	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(cfg.S3Bucket),
-		Key:    aws.String(fmt.Sprintf("%s%s", cfg.S3Folder, key)),
-		Body:   r,
-	})
+const defaultS3Endpoint = "https://fly.storage.tigris.dev"
 
+// withSecondaryStore reads through SECONDARY_S3_BUCKET, such as the bucket of a previous provider,
+// while writing to the primary store. Its credentials default to the primary ones
+func withSecondaryStore(cfg Config, primary CacheStore, transport http.RoundTripper) (CacheStore, error) {
+	var credentials aws.CredentialsProvider
+	if key := os.Getenv("SECONDARY_AWS_ACCESS_KEY_ID"); key != "" {
+		credentials = awscredentials.NewStaticCredentialsProvider(key, os.Getenv("SECONDARY_AWS_SECRET_ACCESS_KEY"), "")
+	}
+	client, err := initS3Client(transport, cfg.SecondaryS3Endpoint, credentials)
 	if err != nil {
-		slog.Error("Upload failed", "path", path, "key", key, "error", err)
-		return err
+		return nil, err
 	}
+	secondary := newLimitedStore(newS3Store(client, cfg.SecondaryS3Bucket, cfg.SecondaryS3Folder), cfg.S3MaxConcurrency)
+	secondary.setThrottleRetries(cfg.S3ThrottleRetries, cfg.S3ThrottleBackoff)
 
-	slog.Info("Uploaded to S3", "path", path, "bucket", cfg.S3Bucket, "key", key)
-	return nil
+	readers := []CacheStore{primary, secondary}
+	if cfg.StoreReadOrder[0] == storeSecondary {
+		readers = []CacheStore{secondary, primary}
+	}
+	slog.Info("Reading through the secondary bucket", "bucket", cfg.SecondaryS3Bucket, "endpoint", cfg.SecondaryS3Endpoint, "read_order", cfg.StoreReadOrder, "backfill", cfg.BackfillPrimary)
+	return newCompositeStore(primary, readers, cfg.BackfillPrimary), nil
 }
 
-// GenerateS3Key creates a hash from the imgproxy URL path
-func GenerateS3Key(path string) string {
-	hash := md5.Sum([]byte(path))
-	return hex.EncodeToString(hash[:])
+// withReadFailover reads from the READ_FAILOVER replicas when a read of the primary region fails.
+// Their clients are copies of the primary one in their own region, with the same credentials
+func withReadFailover(cfg Config, primary CacheStore, client *s3.Client) CacheStore {
+	replicas := make([]failoverReplica, len(cfg.ReadFailover))
+	for i, replica := range cfg.ReadFailover {
+		replicaClient := s3.New(client.Options(), func(o *s3.Options) {
+			o.Region = replica.region
+			if cfg.ReadFailoverEndpoint != "" {
+				o.BaseEndpoint = aws.String(strings.ReplaceAll(cfg.ReadFailoverEndpoint, "{region}", replica.region))
+			}
+		})
+		store := newLimitedStore(newS3Store(replicaClient, replica.bucket, cfg.S3Folder), cfg.S3MaxConcurrency)
+		store.setThrottleRetries(cfg.S3ThrottleRetries, cfg.S3ThrottleBackoff)
+		replicas[i] = failoverReplica{name: replica.region + "/" + replica.bucket, store: store}
+	}
+	names := make([]string, len(replicas))
+	for i, replica := range replicas {
+		names[i] = replica.name
+	}
+	slog.Info("Reads fail over to the replicas", "replicas", names, "timeout", cfg.ReadFailoverTimeout)
+	return newFailoverStore(primary, replicas, cfg.ReadFailoverTimeout)
 }
 
-func initS3Client() *s3.Client {
-	sdkConfig, err := config.LoadDefaultConfig(context.Background())
+// initS3Client configures an S3 client for an endpoint, credentials default to the SDK's chain when nil
+func initS3Client(transport http.RoundTripper, endpoint string, credentials aws.CredentialsProvider) (*s3.Client, error) {
+	options := []func(*config.LoadOptions) error{config.WithHTTPClient(&http.Client{Transport: transport})}
+	if credentials != nil {
+		options = append(options, config.WithCredentialsProvider(credentials))
+	}
+	sdkConfig, err := config.LoadDefaultConfig(context.Background(), options...)
 	if err != nil {
-		slog.Error("Failed to initialize AWS config", "error", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to initialize AWS config: %w", err)
 	}
 
 	svc := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(getEnvWithDefault("S3_ENDPOINT", "https://fly.storage.tigris.dev"))
+		o.BaseEndpoint = aws.String(endpoint)
 		o.UsePathStyle = true
 		o.Region = "auto"
+		o.Retryer = newSlowDownRetryer()
 	})
 
-	return svc
+	return svc, nil
 }
 
-func getEnvWithDefault(key, defaultValue string) string {
-	env, ok := os.LookupEnv(key)
-	if !ok {
-		return defaultValue
-	}
-	return env
-}
-
-func waitForHealth(target string, timeout time.Duration) error {
-	client := &http.Client{Timeout: 2 * time.Second}
+func waitForHealth(target string, client *http.Client, timeout time.Duration) error {
 	endTime := time.Now().Add(timeout)
 
 	for time.Now().Before(endTime) {
-		resp, err := client.Get(fmt.Sprintf("%s/health", target))
-		if err == nil {
-			if resp.StatusCode == http.StatusOK {
-				resp.Body.Close()
-				return nil
-			}
-			resp.Body.Close()
+		if probeHealth(context.Background(), client, target) == nil {
+			return nil
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
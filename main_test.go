@@ -84,7 +84,7 @@ func TestFullEndToEnd(t *testing.T) {
 	t.Log("✓ Response matches stored image")
 }
 
-func setupMinIOContainerWithNetwork(t *testing.T, ctx context.Context, network *testcontainers.DockerNetwork) (testcontainers.Container, string, string) {
+func setupMinIOContainerWithNetwork(t testing.TB, ctx context.Context, network *testcontainers.DockerNetwork) (testcontainers.Container, string, string) {
 	minioAlias := "minio"
 	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 		ContainerRequest: testcontainers.ContainerRequest{
@@ -123,7 +123,7 @@ func setupMinIOContainerWithNetwork(t *testing.T, ctx context.Context, network *
 	return container, externalEndpoint, internalEndpoint
 }
 
-func minIOClient(t *testing.T, endpoint string) *s3.Client {
+func minIOClient(t testing.TB, endpoint string) *s3.Client {
 	cfg, err := config.LoadDefaultConfig(context.Background(),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
 			minioAccessKey,
@@ -144,7 +144,7 @@ func minIOClient(t *testing.T, endpoint string) *s3.Client {
 	return client
 }
 
-func createDockerNetwork(t *testing.T, ctx context.Context) *testcontainers.DockerNetwork {
+func createDockerNetwork(t testing.TB, ctx context.Context) *testcontainers.DockerNetwork {
 	network, err := network.New(ctx)
 	if err != nil {
 		t.Fatalf("Failed to create network: %v", err)
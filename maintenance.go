@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// inMaintenance answers 503 with a Retry-After when maintenance mode is on
+func (s *server) inMaintenance(w http.ResponseWriter) bool {
+	if !s.maintenance.Load() {
+		return false
+	}
+
+	w.Header().Set("Retry-After", retryAfter(s.cfg.MaintenanceRetryAfter))
+	http.Error(w, "service under maintenance", http.StatusServiceUnavailable)
+	return true
+}
+
+// handleMaintenance reports whether maintenance mode is on
+func (s *server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, maintenanceState{Enabled: s.maintenance.Load()})
+}
+
+// handleSetMaintenance toggles maintenance mode, overriding MAINTENANCE_MODE until the next restart
+func (s *server) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var state maintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, fmt.Sprintf("invalid maintenance request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.maintenance.Store(state.Enabled)
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceModeAnswers503ExceptForHealth(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{MaintenanceMode: true, MaintenanceRetryAfter: 2 * time.Minute}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "120" {
+		t.Fatalf("Expected Retry-After: 120, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	if resp := get(t, proxy.URL+"/healthz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the liveness check to answer 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestMaintenanceModeCanBeToggled(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	image := proxy.URL + "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	toggle := func(enabled string) {
+		t.Helper()
+		resp := adminDoWithBody(t, http.MethodPut, proxy.URL+"/admin/maintenance", `{"enabled":`+enabled+`}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	toggle("true")
+	if resp := get(t, image); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 once enabled, got %d", resp.StatusCode)
+	}
+
+	toggle("false")
+	if resp := get(t, image); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 once disabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestSubSecondRetryAfterIsRoundedUp(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{MaintenanceMode: true, MaintenanceRetryAfter: 300 * time.Millisecond}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("Expected Retry-After: 1, got %q", resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// stripMetadataOptions are the imgproxy options deciding whether the output keeps the source's metadata
+var stripMetadataOptions = []string{"sm", "strip_metadata"}
+
+// stripsMetadata reports whether a path already asks imgproxy to strip metadata. The last option wins, as in imgproxy
+func stripsMetadata(p imgproxyPath) bool {
+	strips := false
+	for _, o := range p.Options {
+		if name, value, _ := strings.Cut(o, ":"); slices.Contains(stripMetadataOptions, name) {
+			strips = value == "1" || value == "t" || value == "true"
+		}
+	}
+	return strips
+}
+
+// applyStripMetadata rewrites the path of an image request to strip the metadata of its output with FORCE_STRIP_METADATA,
+// replacing the strip options the client may have set. The option is part of the key, so every cached image is stripped
+func (s *server) applyStripMetadata(r *http.Request) error {
+	if !s.cfg.ForceStripMetadata {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		if stripsMetadata(*p) {
+			return false
+		}
+		p.Options = slices.DeleteFunc(p.Options, func(o string) bool {
+			name, _, _ := strings.Cut(o, ":")
+			return slices.Contains(stripMetadataOptions, name)
+		})
+		p.Options = append(p.Options, "sm:1")
+		return true
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// exifStub answers with a JPEG carrying an EXIF segment, unless the path asks imgproxy to strip metadata
+func exifStub(requested *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := requestPath(r.URL)
+		*requested = append(*requested, path)
+
+		var out bytes.Buffer
+		jpeg.Encode(&out, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+		body := out.Bytes()
+		p, _ := parseImgproxyPath(path)
+		if !stripsMetadata(p) {
+			exif := append([]byte("Exif\x00\x00"), "GPS 48.8584 N 2.2945 E"...)
+			segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(exif)+2))
+			body = slices.Concat(body[:2], segment, exif, body[2:])
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(body)
+	})
+}
+
+// hasEXIF reports whether a JPEG has an APP1 segment holding EXIF metadata
+func hasEXIF(t *testing.T, body []byte) bool {
+	t.Helper()
+	if _, err := jpeg.Decode(bytes.NewReader(body)); err != nil {
+		t.Fatalf("Expected a valid JPEG: %v", err)
+	}
+	for i := 2; i+4 <= len(body) && body[i] == 0xFF && body[i+1] != 0xDA; {
+		size := int(binary.BigEndian.Uint16(body[i+2:]))
+		if body[i+1] == 0xE1 && bytes.HasPrefix(body[i+4:], []byte("Exif\x00\x00")) {
+			return true
+		}
+		i += 2 + size
+	}
+	return false
+}
+
+func TestStripsMetadata(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/_/w:300/plain/http://example.com/a.jpg":                           false,
+		"/_/w:300/sm:1/plain/http://example.com/a.jpg":                      true,
+		"/_/strip_metadata:true/plain/http://example.com/a.jpg":             true,
+		"/_/sm:1/w:300/strip_metadata:false/plain/http://example.com/a.jpg": false,
+	} {
+		p, _ := parseImgproxyPath(path)
+		if got := stripsMetadata(p); got != want {
+			t.Errorf("Expected stripsMetadata(%q) to be %v", path, want)
+		}
+	}
+}
+
+func TestForceStripMetadataInjectsTheOption(t *testing.T) {
+	var requested []string
+	srv, proxy, store := newTestServer(t, Config{ForceStripMetadata: true}, exifStub(&requested))
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := get(t, proxy.URL+"/_/w:300/sm:0"+source)
+	srv.uploads.Wait()
+	stripped := "/_/w:300/sm:1" + source
+	if len(requested) != 1 || requested[0] != stripped {
+		t.Fatalf("Expected imgproxy to be asked to strip metadata, got %v", requested)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	cached, ok := store.get(GenerateS3Key(stripped))
+	if !ok {
+		t.Fatal("Expected the image to be stored under the key of the stripped path")
+	}
+	if hasEXIF(t, cached) {
+		t.Fatal("Expected the cached image to have no EXIF metadata")
+	}
+
+	if resp := get(t, proxy.URL+"/_/w:300"+source); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected the path without a strip option to share the stripped image")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected a single cached image, got %d", store.len())
+	}
+}
+
+func TestMetadataIsKeptByDefault(t *testing.T) {
+	var requested []string
+	_, proxy, _ := newTestServer(t, Config{}, exifStub(&requested))
+
+	resp, err := http.Get(proxy.URL + "/_/w:300/plain/" + url.QueryEscape("http://example.com/kitten.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(requested[0], "sm:") || !hasEXIF(t, body) {
+		t.Fatal("Expected the metadata to be kept without FORCE_STRIP_METADATA")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// gauge is a float64 metric that can be set concurrently
+type gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// handleMetrics exposes the proxy's metrics in the Prometheus text format
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "imgproxy_cache_write_verify_failures_total", "counter",
+		"Uploads failing VERIFY_AFTER_WRITE", float64(s.writeVerifyFailures.Load()))
+	if s.newKeys != nil {
+		writeMetric(w, "imgproxy_cache_new_keys_over_limit_total", "counter",
+			"Misses over MAX_NEW_KEYS_PER_MINUTE, served uncached or rejected", float64(s.newKeysOverLimit.Load()))
+	}
+	if s.hedge != nil {
+		writeMetric(w, "imgproxy_cache_hedged_requests_total", "counter",
+			"Requests to imgproxy sent to HEDGE_IMGPROXY_URL too after HEDGE_DELAY", float64(s.hedge.hedged.Load()))
+		writeMetric(w, "imgproxy_cache_hedge_wins_total", "counter",
+			"Hedged requests answered first by HEDGE_IMGPROXY_URL", float64(s.hedge.wins.Load()))
+	}
+	if s.cfg.SyntheticProbeInterval > 0 {
+		writeMetric(w, "imgproxy_cache_synthetic_probe_duration_seconds", "gauge",
+			"Duration of the last successful synthetic fetch, process, store and read loop", s.probeDuration.Value())
+		writeMetric(w, "imgproxy_cache_synthetic_probe_success", "gauge",
+			"Whether the last synthetic probe succeeded", s.probeSuccess.Value())
+	}
+	if s.cfg.CacheSizeScanInterval > 0 {
+		writeMetric(w, "imgproxy_cache_objects_total", "gauge",
+			"Objects in the cache at the last CACHE_SIZE_SCAN_INTERVAL scan", s.cacheObjects.Value())
+		writeMetric(w, "imgproxy_cache_bytes_total", "gauge",
+			"Bytes of the objects in the cache at the last CACHE_SIZE_SCAN_INTERVAL scan", s.cacheBytes.Value())
+		writeMetric(w, "imgproxy_cache_size_scan_timestamp_seconds", "gauge",
+			"Unix time of the last successful cache size scan", s.cacheSizeScanned.Value())
+	}
+	s.tenantLimits.writeMetrics(w)
+	if s.uploadFlights != nil {
+		writeMetric(w, "imgproxy_cache_deduplicated_uploads_total", "counter",
+			"Uploads that waited for the upload of their key in flight with UPLOAD_DEDUP", float64(s.uploadFlights.joined.Load()))
+	}
+	if s.cfg.CompactFormat != "" {
+		writeMetric(w, "imgproxy_cache_compacted_images_total", "counter",
+			"Cached images re-encoded to COMPACT_FORMAT", float64(s.compacted.Load()))
+		writeMetric(w, "imgproxy_cache_compaction_saved_bytes_total", "counter",
+			"Bytes saved by re-encoding cached images to COMPACT_FORMAT", float64(s.compactionSaved.Load()))
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// MISS_BEHAVIOR values: how a miss is answered in read-only CACHE_MODE
+const (
+	missGenerate     = "generate"
+	missDefaultImage = "default_image"
+	missNotFound     = "not_found"
+)
+
+// serveMiss answers a miss without imgproxy when CACHE_MODE is read-only and MISS_BEHAVIOR doesn't
+// generate, for cache-only deployments: with MISS_DEFAULT_IMAGE or 404. It reports whether it answered
+func (s *server) serveMiss(w http.ResponseWriter, r *http.Request) bool {
+	if *s.cacheMode.Load() != cacheModeReadOnly {
+		return false
+	}
+	switch s.cfg.MissBehavior {
+	case missNotFound:
+		w.Header().Set("X-Cache", "MISS")
+		http.Error(w, "image not cached", http.StatusNotFound)
+	case missDefaultImage:
+		// The default image stands in for any path, shared caches must not keep it as the path's image
+		w.Header().Set("Content-Type", http.DetectContentType(s.cfg.MissDefaultImage))
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.cfg.MissDefaultImage)))
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Cache", "MISS")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(s.cfg.MissDefaultImage)
+		}
+	default:
+		return false
+	}
+	slog.Debug("Not generating a miss in read-only mode", "path", requestPath(r.URL), "miss_behavior", s.cfg.MissBehavior)
+	return true
+}
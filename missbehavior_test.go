@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// defaultPNG starts with the PNG signature, enough for its content type to be detected
+var defaultPNG = []byte("\x89PNG\r\n\x1a\ndefault")
+
+func TestMissBehaviors(t *testing.T) {
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	tests := []struct {
+		behavior    string
+		status      int
+		body        string
+		contentType string
+		processed   int64
+	}{
+		{missGenerate, http.StatusOK, "image", "", 1},
+		{missDefaultImage, http.StatusOK, string(defaultPNG), "image/png", 0},
+		{missNotFound, http.StatusNotFound, "image not cached\n", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behavior, func(t *testing.T) {
+			var processed atomic.Int64
+			cfg := Config{CacheMode: cacheModeReadOnly, MissBehavior: tt.behavior, MissDefaultImage: defaultPNG}
+			srv, proxy, store := newTestServer(t, cfg, countingStub(&processed))
+
+			resp := get(t, proxy.URL+path)
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Fatalf("Expected %d %q, got %d %q", tt.status, tt.body, resp.StatusCode, body)
+			}
+			if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+				t.Fatalf("Expected the content type %s, got %q", tt.contentType, resp.Header.Get("Content-Type"))
+			}
+			srv.uploads.Wait()
+			if processed.Load() != tt.processed {
+				t.Fatalf("Expected imgproxy to be called %d times, got %d", tt.processed, processed.Load())
+			}
+			if store.len() != 0 {
+				t.Fatal("Expected nothing to be stored in read-only mode")
+			}
+		})
+	}
+}
+
+func TestMissBehaviorStillServesHits(t *testing.T) {
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	_, proxy, store := newTestServer(t, Config{CacheMode: cacheModeReadOnly, MissBehavior: missNotFound}, imgproxyStub())
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached"), ObjectMeta{ContentType: "image/jpeg"})
+
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the cached image to be served, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestMissBehaviorOnlyAppliesInReadOnlyMode(t *testing.T) {
+	var processed atomic.Int64
+	srv, proxy, _ := newTestServer(t, Config{MissBehavior: missNotFound}, countingStub(&processed))
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the miss to be generated in read-write mode, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if processed.Load() != 1 {
+		t.Fatal("Expected imgproxy to process the miss")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// abortUploadsInitiatedBefore aborts the incomplete multipart uploads of the folder started
+// before the cutoff, whose parts are billed until they're aborted. It returns how many were aborted
+func (s *s3Store) abortUploadsInitiatedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.folder),
+	}
+
+	aborted := 0
+	for {
+		out, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, err
+		}
+
+		for _, upload := range out.Uploads {
+			if !aws.ToTime(upload.Initiated).Before(cutoff) {
+				continue
+			}
+			if _, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			}); err != nil {
+				return aborted, err
+			}
+			aborted++
+		}
+
+		if !aws.ToBool(out.IsTruncated) {
+			return aborted, nil
+		}
+		input.KeyMarker = out.NextKeyMarker
+		input.UploadIdMarker = out.NextUploadIdMarker
+	}
+}
+
+// cleanupOrphanedUploads aborts the uploads older than maxAge left by crashed instances, on startup
+// and then every interval until the context is done. A zero interval only cleans up on startup
+func (s *s3Store) cleanupOrphanedUploads(ctx context.Context, maxAge, interval time.Duration) {
+	for {
+		aborted, err := s.abortUploadsInitiatedBefore(ctx, time.Now().Add(-maxAge))
+		if err != nil {
+			slog.Error("Failed to clean up orphaned multipart uploads", "error", err)
+		} else if aborted > 0 {
+			slog.Info("Aborted orphaned multipart uploads", "count", aborted)
+		}
+
+		if interval == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestOrphanedMultipartUploadIsAbortedMinIO(t *testing.T) {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(t, ctx)
+	t.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(t, ctx, dockerNetwork)
+	t.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(t, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	// An upload started and never completed, as left by a crash
+	if _, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(processedBucket),
+		Key:    aws.String("processed/orphan"),
+	}); err != nil {
+		t.Fatalf("Failed to start a multipart upload: %v", err)
+	}
+
+	store := newS3Store(client, processedBucket, "processed/")
+	if aborted, err := store.abortUploadsInitiatedBefore(ctx, time.Now().Add(-time.Hour)); err != nil || aborted != 0 {
+		t.Fatalf("Expected a recent upload to be kept, aborted %d (%v)", aborted, err)
+	}
+	if aborted, err := store.abortUploadsInitiatedBefore(ctx, time.Now().Add(time.Hour)); err != nil || aborted != 1 {
+		t.Fatalf("Expected the orphaned upload to be aborted, aborted %d (%v)", aborted, err)
+	}
+
+	out, err := client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String(processedBucket)})
+	if err != nil {
+		t.Fatalf("Failed to list multipart uploads: %v", err)
+	}
+	if len(out.Uploads) != 0 {
+		t.Fatalf("Expected no incomplete upload left, found %d", len(out.Uploads))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FORMAT_PRECEDENCE values, deciding between the format pinned by a path and the one negotiated from Accept
+const (
+	precedencePath   = "path"
+	precedenceAccept = "accept"
+)
+
+// negotiableFormats are the formats ACCEPT_FORMATS may list, the ones browsers announce in Accept
+var negotiableFormats = []string{"avif", "webp", "jxl", "png", "jpg", "gif"}
+
+// acceptedFormats returns the imgproxy formats an Accept header lists explicitly with a non-zero quality.
+// Wildcards such as image/* are left out, browsers send them for formats they can't render
+func acceptedFormats(accept string) []string {
+	var formats []string
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(item, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		if format := formatFromContentType(strings.ToLower(strings.TrimSpace(mediaType))); format != "" {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// negotiateFormat returns the first of ACCEPT_FORMATS an Accept header lists, if any
+func negotiateFormat(accept string, candidates []string) (string, bool) {
+	accepted := acceptedFormats(accept)
+	for _, format := range candidates {
+		if slices.Contains(accepted, format) {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// applyFormatNegotiation rewrites the path of a request to the first of ACCEPT_FORMATS its Accept header lists.
+// A path pinning a format keeps it with FORMAT_PRECEDENCE=path, and isn't negotiated so its response doesn't vary
+// on Accept. With accept, the negotiated format replaces the pinned one. The negotiated path has its own key
+func (s *server) applyFormatNegotiation(r *http.Request, w http.ResponseWriter) error {
+	if len(s.cfg.AcceptFormats) == 0 {
+		return nil
+	}
+	p, err := parseImgproxyPath(requestPath(r.URL))
+	if err != nil || p.Encrypted {
+		return nil
+	}
+	if p.Format() != "" && s.cfg.FormatPrecedence == precedencePath {
+		return nil
+	}
+	w.Header().Add("Vary", "Accept")
+
+	format, ok := negotiateFormat(r.Header.Get("Accept"), s.cfg.AcceptFormats)
+	if !ok || format == canonicalFormat(p.Format()) {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		*p = p.WithFormat(format)
+		return true
+	})
+}
+
+// parseAcceptFormats reads the formats of ACCEPT_FORMATS, in order of preference
+func parseAcceptFormats(items []string) ([]string, error) {
+	formats := make([]string, 0, len(items))
+	for _, item := range items {
+		format := canonicalFormat(item)
+		if !slices.Contains(negotiableFormats, format) {
+			return nil, fmt.Errorf("invalid ACCEPT_FORMATS item %q", item)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
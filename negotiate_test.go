@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAcceptedFormats(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   []string
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", []string{"avif", "webp"}},
+		{"image/webp;q=0, image/png", []string{"png"}},
+		{"image/*,*/*", nil},
+	}
+	for _, tt := range tests {
+		if got := acceptedFormats(tt.accept); !slices.Equal(got, tt.want) {
+			t.Errorf("acceptedFormats(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestFormatPrecedence(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image"))
+	})
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	pinned := "/_/rs:fill:50:50" + source + "@webp"
+
+	tests := []struct {
+		name, precedence, path, want, vary string
+	}{
+		{"path wins", precedencePath, pinned, pinned, ""},
+		{"accept wins", precedenceAccept, pinned, "/_/rs:fill:50:50" + source + "@avif", "Accept"},
+		{"unpinned path", precedencePath, "/_/rs:fill:50:50" + source, "/_/rs:fill:50:50" + source + "@avif", "Accept"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{AcceptFormats: []string{"avif", "webp"}, FormatPrecedence: tt.precedence}
+			srv, proxy, store := newTestServer(t, cfg, stub)
+
+			req, _ := http.NewRequest(http.MethodGet, proxy.URL+tt.path, nil)
+			req.Header.Set("Accept", "image/avif,image/*;q=0.8")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			srv.uploads.Wait()
+
+			if resp.Header.Get("Vary") != tt.vary {
+				t.Errorf("Expected Vary %q, got %q", tt.vary, resp.Header.Get("Vary"))
+			}
+			if got, _ := requested.Load().(string); got != tt.want {
+				t.Fatalf("Expected imgproxy to be asked for %s, got %s", tt.want, got)
+			}
+			if _, ok := store.get(GenerateS3Key(tt.want)); !ok || store.len() != 1 {
+				t.Fatalf("Expected the image to be stored under the key of %s only", tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatNegotiationKeepsUnacceptedPaths(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Write([]byte("image"))
+	})
+	cfg := Config{AcceptFormats: []string{"avif"}, FormatPrecedence: precedenceAccept}
+	_, proxy, _ := newTestServer(t, cfg, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg") + "@webp"
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+	req.Header.Set("Accept", "image/webp,image/*")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got, _ := requested.Load().(string); got != path {
+		t.Fatalf("Expected the pinned format to be kept when no ACCEPT_FORMATS is accepted, got %s", got)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminRoute is an admin endpoint, described well enough to be documented in the OpenAPI document
+type adminRoute struct {
+	method      string
+	path        string
+	summary     string
+	params      []openAPIParameter
+	requestBody *openAPIRequestBody
+	// responses maps the status codes to their description and content type
+	responses map[int]adminResponse
+	handler   http.HandlerFunc
+	// global routes act on the whole instance rather than on a tenant's prefix,
+	// they always require ADMIN_TOKEN
+	global bool
+	// stream routes report their progress for as long as their work takes, ADMIN_TIMEOUT doesn't bound them
+	stream bool
+}
+
+type adminResponse struct {
+	description string
+	contentType string
+}
+
+// adminRoutes lists every admin endpoint, they are registered and documented from this list
+func (s *server) adminRoutes() []adminRoute {
+	return []adminRoute{
+		{
+			method:  http.MethodPost,
+			path:    "/admin/warm",
+			summary: "Process and store a batch of imgproxy paths, streaming progress as JSON lines",
+			requestBody: &openAPIRequestBody{
+				Required: true,
+				Content: map[string]openAPIMediaType{
+					"application/json": {Schema: openAPISchema{
+						Type:     "object",
+						Required: []string{"paths"},
+						Properties: map[string]openAPISchema{
+							"paths": {Type: "array", Items: &openAPISchema{Type: "string"}},
+						},
+					}},
+				},
+			},
+			responses: map[int]adminResponse{
+				http.StatusOK:         {"One progress line per path, then a summary line, or progress and summary events with Accept: text/event-stream", "application/x-ndjson"},
+				http.StatusBadRequest: {"Invalid warm request", "text/plain"},
+			},
+			handler: s.handleWarm,
+			stream:  true,
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/admin/warm/bucket",
+			summary: "Process and store the WARM_PRESETS variants of every object of WARM_SOURCE_BUCKET under a prefix, streaming progress as JSON lines",
+			requestBody: &openAPIRequestBody{
+				Content: map[string]openAPIMediaType{
+					"application/json": {Schema: openAPISchema{
+						Type: "object",
+						Properties: map[string]openAPISchema{
+							"prefix": {Type: "string"},
+						},
+					}},
+				},
+			},
+			responses: map[int]adminResponse{
+				http.StatusOK:             {"One progress line per variant, then a summary line, or progress and summary events with Accept: text/event-stream", "application/x-ndjson"},
+				http.StatusBadRequest:     {"Invalid warm request", "text/plain"},
+				http.StatusNotImplemented: {"WARM_SOURCE_BUCKET isn't set", "text/plain"},
+				http.StatusBadGateway:     {"The source bucket couldn't be listed", "text/plain"},
+			},
+			handler: s.handleWarmBucket,
+			stream:  true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/variants",
+			summary: "List the cached variants of a source URL",
+			params: []openAPIParameter{
+				{Name: "source", In: "query", Required: true, Schema: openAPISchema{Type: "string"}},
+				{Name: "limit", In: "query", Schema: openAPISchema{Type: "integer", Minimum: 1, Maximum: maxListLimit}},
+				{Name: "cursor", In: "query", Schema: openAPISchema{Type: "string"}},
+			},
+			responses: map[int]adminResponse{
+				http.StatusOK:             {"A page of variants", "application/json"},
+				http.StatusBadRequest:     {"Missing source or invalid limit", "text/plain"},
+				http.StatusNotImplemented: {"The key layout isn't by-source", "text/plain"},
+				http.StatusBadGateway:     {"The bucket couldn't be listed", "text/plain"},
+			},
+			handler: s.handleVariants,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/report.csv",
+			summary: "Export the cached objects as CSV, streamed page by page",
+			params:  []openAPIParameter{{Name: "prefix", In: "query", Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusOK:         {"One key,size,content_type,last_modified row per cached object", "text/csv"},
+				http.StatusBadGateway: {"The bucket couldn't be listed", "text/plain"},
+			},
+			handler: s.handleReport,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/cache",
+			summary: "Describe the cached image of an imgproxy path",
+			params:  []openAPIParameter{{Name: "path", In: "query", Required: true, Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusOK:         {"The cache entry", "application/json"},
+				http.StatusBadRequest: {"Missing path", "text/plain"},
+				http.StatusNotFound:   {"The path isn't cached", "text/plain"},
+				http.StatusBadGateway: {"The bucket couldn't be queried", "text/plain"},
+			},
+			handler: s.handleCacheInfo,
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/admin/cache",
+			summary: "Purge the cached image of an imgproxy path",
+			params:  []openAPIParameter{{Name: "path", In: "query", Required: true, Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusNoContent:  {"The cache entry was purged", ""},
+				http.StatusBadRequest: {"Missing path", "text/plain"},
+				http.StatusNotFound:   {"The path isn't cached", "text/plain"},
+				http.StatusBadGateway: {"The bucket couldn't be updated", "text/plain"},
+			},
+			handler: s.handleCachePurge,
+		},
+		{
+			method:  http.MethodPut,
+			path:    "/admin/pin",
+			summary: "Pin the cached image of an imgproxy path, so it's served past CACHE_TTL and never regenerated",
+			params:  []openAPIParameter{{Name: "path", In: "query", Required: true, Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusNoContent:  {"The cache entry is pinned", ""},
+				http.StatusBadRequest: {"Missing path", "text/plain"},
+				http.StatusNotFound:   {"The path isn't cached", "text/plain"},
+				http.StatusBadGateway: {"The bucket couldn't be updated", "text/plain"},
+			},
+			handler: s.handlePin,
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/admin/pin",
+			summary: "Unpin the cached image of an imgproxy path",
+			params:  []openAPIParameter{{Name: "path", In: "query", Required: true, Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusNoContent:  {"The cache entry is unpinned", ""},
+				http.StatusBadRequest: {"Missing path", "text/plain"},
+				http.StatusNotFound:   {"The path isn't cached", "text/plain"},
+				http.StatusBadGateway: {"The bucket couldn't be updated", "text/plain"},
+			},
+			handler: s.handleUnpin,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/key",
+			summary: "Compute the key of an imgproxy path, without querying the bucket",
+			params:  []openAPIParameter{{Name: "path", In: "query", Required: true, Schema: openAPISchema{Type: "string"}}},
+			responses: map[int]adminResponse{
+				http.StatusOK:         {"The key and the normalized path it's derived from", "application/json"},
+				http.StatusBadRequest: {"Missing path", "text/plain"},
+			},
+			handler: s.handleKey,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/maintenance",
+			summary: "Report whether maintenance mode is on",
+			responses: map[int]adminResponse{
+				http.StatusOK: {"The maintenance state", "application/json"},
+			},
+			handler: s.handleMaintenance,
+			global:  true,
+		},
+		{
+			method:  http.MethodPut,
+			path:    "/admin/maintenance",
+			summary: "Turn maintenance mode on or off, image requests answer 503 while it's on",
+			requestBody: &openAPIRequestBody{
+				Required: true,
+				Content: map[string]openAPIMediaType{
+					"application/json": {Schema: openAPISchema{
+						Type:       "object",
+						Required:   []string{"enabled"},
+						Properties: map[string]openAPISchema{"enabled": {Type: "boolean"}},
+					}},
+				},
+			},
+			responses: map[int]adminResponse{
+				http.StatusOK:         {"The new maintenance state", "application/json"},
+				http.StatusBadRequest: {"Invalid maintenance request", "text/plain"},
+			},
+			handler: s.handleSetMaintenance,
+			global:  true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/generation",
+			summary: "Report the cache generation keys are derived in",
+			responses: map[int]adminResponse{
+				http.StatusOK: {"The cache generation", "application/json"},
+			},
+			handler: s.handleCacheGeneration,
+			global:  true,
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/admin/generation",
+			summary: "Bump the cache generation, making every cached image unreachable without deleting it",
+			responses: map[int]adminResponse{
+				http.StatusOK: {"The new cache generation", "application/json"},
+			},
+			handler: s.handleBumpCacheGeneration,
+			global:  true,
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/admin/drain",
+			summary: "Make /healthz fail until the next restart, so the instance is taken out of the load balancer while still serving images",
+			responses: map[int]adminResponse{
+				http.StatusOK: {"The instance is draining", "application/json"},
+			},
+			handler: s.handleDrain,
+			global:  true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/admin/openapi.json",
+			summary: "This OpenAPI document",
+			responses: map[int]adminResponse{
+				http.StatusOK: {"The OpenAPI document of the admin API", "application/json"},
+			},
+			handler: s.handleOpenAPI,
+		},
+	}
+}
+
+type openAPIDocument struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required,omitempty"`
+	Schema   openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type       string                   `json:"type,omitempty"`
+	Required   []string                 `json:"required,omitempty"`
+	Properties map[string]openAPISchema `json:"properties,omitempty"`
+	Items      *openAPISchema           `json:"items,omitempty"`
+	Minimum    int                      `json:"minimum,omitempty"`
+	Maximum    int                      `json:"maximum,omitempty"`
+}
+
+// openAPIDocumentFor describes the given admin routes as an OpenAPI 3 document
+func openAPIDocumentFor(routes []adminRoute) openAPIDocument {
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "imgproxy-cache admin API", Version: "1.0.0"},
+		Paths:   map[string]map[string]openAPIOperation{},
+	}
+
+	for _, route := range routes {
+		op := openAPIOperation{
+			OperationID: operationID(route),
+			Summary:     route.summary,
+			Parameters:  route.params,
+			RequestBody: route.requestBody,
+			Responses:   map[string]openAPIResponse{},
+		}
+		for status, resp := range route.responses {
+			r := openAPIResponse{Description: resp.description}
+			if resp.contentType != "" {
+				r.Content = map[string]openAPIMediaType{resp.contentType: {Schema: openAPISchema{Type: schemaTypeOf(resp.contentType)}}}
+			}
+			op.Responses[strconv.Itoa(status)] = r
+		}
+		op.Responses[strconv.Itoa(http.StatusUnauthorized)] = openAPIResponse{Description: "Missing or invalid credentials"}
+
+		if doc.Paths[route.path] == nil {
+			doc.Paths[route.path] = map[string]openAPIOperation{}
+		}
+		doc.Paths[route.path][strings.ToLower(route.method)] = op
+	}
+
+	return doc
+}
+
+// operationID derives a stable identifier such as getAdminVariants from a route
+func operationID(route adminRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.method))
+	for _, part := range strings.FieldsFunc(route.path, func(r rune) bool { return r == '/' || r == '.' }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func schemaTypeOf(contentType string) string {
+	if contentType == "application/json" {
+		return "object"
+	}
+	return "string"
+}
+
+// handleOpenAPI serves the OpenAPI document of the admin API
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocumentFor(s.adminRoutes()))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIListsAdminRoutes(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/openapi.json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		OpenAPI string                                           `json:"openapi"`
+		Paths   map[string]map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("Invalid JSON document: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got version %q", doc.OpenAPI)
+	}
+
+	routes := srv.adminRoutes()
+	operations := 0
+	for _, ops := range doc.Paths {
+		operations += len(ops)
+	}
+	if operations != len(routes) {
+		t.Fatalf("Expected %d documented operations, got %d", len(routes), operations)
+	}
+	for _, route := range routes {
+		op, ok := doc.Paths[route.path][strings.ToLower(route.method)]
+		if !ok {
+			t.Errorf("Route %s %s is not documented", route.method, route.path)
+			continue
+		}
+		if _, ok := op["responses"]; !ok {
+			t.Errorf("Route %s %s has no responses", route.method, route.path)
+		}
+	}
+	for _, want := range []string{"/admin/warm", "/admin/variants", "/admin/openapi.json"} {
+		if _, ok := doc.Paths[want]; !ok {
+			t.Errorf("Expected %s to be documented", want)
+		}
+	}
+}
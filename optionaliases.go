@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// optionAliases maps the full names of imgproxy options to their short ones
+var optionAliases = map[string]string{
+	"resize": "rs", "size": "s", "resizing_type": "rt", "width": "w", "height": "h",
+	"enlarge": "el", "extend": "ex", "extend_aspect_ratio": "exar", "gravity": "g", "crop": "c",
+	"quality": "q", "format_quality": "fq", "format": "f", "background": "bg", "blur": "bl",
+	"sharpen": "sh", "padding": "pd", "rotate": "rot", "auto_rotate": "ar", "strip_metadata": "sm",
+	"keep_copyright": "kcr", "strip_color_profile": "scp", "enforce_thumbnail": "eth",
+	"return_attachment": "att", "skip_processing": "skp", "disable_animation": "da", "zoom": "z",
+	"min-width": "mw", "min-height": "mh", "trim": "t", "watermark": "wm", "preset": "pr",
+	"cachebuster": "cb", "filename": "fn", "max_bytes": "mb", "page": "pg", "pages": "pgs",
+}
+
+// booleanOptions are the short options whose first argument is a boolean, spelled 1, t, true... or 0, f, false...
+var booleanOptions = []string{"el", "ex", "exar", "ar", "sm", "kcr", "scp", "eth", "att", "skp", "raw", "da"}
+
+// defaultOptions are the options set explicitly to imgproxy's built-in default, the same as leaving them out
+var defaultOptions = []string{"dpr:1", "g:ce", "g:ce:0:0", "el:0", "ex:0", "rot:0", "bl:0", "sh:0"}
+
+// normalizeOptions returns a path with its options spelled one way, for NORMALIZE_OPTIONS: short names,
+// booleans as 1 or 0, without trailing empty arguments, and without the options set to their default.
+// Only the key is derived from it, imgproxy still gets the path as requested
+func normalizeOptions(path string) string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return path
+	}
+	options := make([]string, 0, len(p.Options))
+	for _, o := range p.Options {
+		if o = normalizeOption(o); !slices.Contains(defaultOptions, o) {
+			options = append(options, o)
+		}
+	}
+	p.Options = options
+	return p.String()
+}
+
+func normalizeOption(option string) string {
+	args := strings.Split(option, ":")
+	if short, ok := optionAliases[args[0]]; ok {
+		args[0] = short
+	}
+	if len(args) > 1 && slices.Contains(booleanOptions, args[0]) {
+		if b, err := strconv.ParseBool(args[1]); err == nil {
+			args[1] = map[bool]string{true: "1", false: "0"}[b]
+		}
+	}
+	for len(args) > 1 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return strings.Join(args, ":")
+}
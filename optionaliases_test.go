@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeOptions(t *testing.T) {
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for _, tc := range []struct{ path, want string }{
+		{"/_/resize:fill:300:300/gravity:sm", "/_/rs:fill:300:300/g:sm"},
+		{"/_/enlarge:true/strip_metadata:t", "/_/el:1/sm:1"},
+		{"/_/rs:fill:300:300:/q:80", "/_/rs:fill:300:300/q:80"},
+		{"/_/w:300/dpr:1/g:ce/rot:0/el:false", "/_/w:300"},
+		{"/_/g:ce:0:0/ex:0", "/_"},
+		// Conservative: these change the output, or mean something else than their look-alike
+		{"/_/g:ce:10:0/c:300:200:ce/dpr:2/ar:0", "/_/g:ce:10:0/c:300:200:ce/dpr:2/ar:0"},
+		{"/_/custom_option:true/el:maybe", "/_/custom_option:true/el:maybe"},
+	} {
+		if got := normalizeOptions(tc.path + source); got != tc.want+source {
+			t.Errorf("normalizeOptions(%q) = %q, want %q", tc.path, got, tc.want+source)
+		}
+	}
+}
+
+func TestOptionAliasesShareAKey(t *testing.T) {
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	canonical := "/_/rs:fill:300:300/el:1" + source
+	aliases := []string{
+		"/_/resize:fill:300:300/enlarge:true" + source,
+		"/_/rs:fill:300:300:/el:t/g:ce/dpr:1" + source,
+	}
+
+	keys := newKeyScheme(Config{NormalizeOptions: true})
+	for _, alias := range aliases {
+		if keys.key("", alias) != keys.key("", canonical) {
+			t.Errorf("Expected %s to share the key of %s", alias, canonical)
+		}
+	}
+
+	keys = newKeyScheme(Config{})
+	for _, alias := range aliases {
+		if keys.key("", alias) == keys.key("", canonical) {
+			t.Errorf("Expected %s to keep its own key without NORMALIZE_OPTIONS", alias)
+		}
+	}
+}
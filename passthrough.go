@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// passthroughSource returns the source of a path when its content type is one of PASSTHROUGH_CONTENT_TYPES,
+// such as already optimized SVGs, or when IDENTITY_POLICY passes it through, so it's served and cached as is
+// instead of being processed by imgproxy. A cheap HEAD decides, so the other sources aren't downloaded twice
+func (s *server) passthroughSource(ctx context.Context, path string) (*upstreamResponse, bool) {
+	// The source is served without imgproxy, so its signature is checked here, imgproxy rejects the forged ones
+	if err := s.signatures.verify(path); err != nil {
+		return nil, false
+	}
+	if s.isIdentityPassthrough(path) {
+		source, err := s.sources.fetch(ctx, path)
+		if err != nil {
+			slog.Warn("Failed to fetch an identity source, processing it instead", "path", path, "error", err)
+			return nil, false
+		}
+		return source, true
+	}
+	if len(s.cfg.PassthroughContentTypes) == 0 {
+		return nil, false
+	}
+	head, err := s.sources.head(ctx, path)
+	if err != nil || head.StatusCode != http.StatusOK || !s.isPassthroughType(head.Header.Get("Content-Type")) {
+		return nil, false
+	}
+
+	source, err := s.sources.fetch(ctx, path)
+	if err == nil && !s.isPassthroughType(source.contentType) {
+		err = fmt.Errorf("source content type changed to %q", source.contentType)
+	}
+	if err != nil {
+		slog.Warn("Failed to fetch a passthrough source, processing it instead", "path", path, "error", err)
+		return nil, false
+	}
+	return source, true
+}
+
+// isPassthroughType reports whether a content type, without its parameters, is listed in PASSTHROUGH_CONTENT_TYPES
+func (s *server) isPassthroughType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(s.cfg.PassthroughContentTypes, func(t string) bool {
+		return strings.EqualFold(t, mediaType)
+	})
+}
+
+// servePassthrough answers a miss with its source when it's passed through, and stores it
+func (s *server) servePassthrough(w http.ResponseWriter, r *http.Request, path string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	source, ok := s.passthroughSource(r.Context(), path)
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Content-Type", source.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(source.body)))
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(http.StatusOK)
+	w.Write(source.body)
+
+	if !s.skipStore(r) {
+		s.storeInBackground(r.Context(), path, source.body, ObjectMeta{ContentType: source.contentType})
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+const testSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"/>`
+
+func TestPassthroughTypeIsServedAndCachedUntouched(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logo.svg":
+			w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+			w.Write([]byte(testSVG))
+		default:
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("jpeg source"))
+		}
+	}))
+	t.Cleanup(source.Close)
+
+	var processed atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processed.Add(1)
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("processed"))
+	})
+	cfg := Config{PassthroughContentTypes: []string{"image/svg+xml"}, AllowLoopbackSources: true}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	svg := "/_/rs:fill:50:50/plain/" + url.QueryEscape(source.URL+"/logo.svg")
+	resp := get(t, proxy.URL+svg)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != testSVG {
+		t.Fatalf("Expected the SVG source untouched, got %d %q", resp.StatusCode, body)
+	}
+	srv.uploads.Wait()
+	if processed.Load() != 0 {
+		t.Fatal("Expected the SVG not to be processed by imgproxy")
+	}
+	if stored, ok := store.get(GenerateS3Key(svg)); !ok || string(stored) != testSVG {
+		t.Fatalf("Expected the SVG to be cached as is, got %q", stored)
+	}
+
+	jpeg := "/_/rs:fill:50:50/plain/" + url.QueryEscape(source.URL+"/cat.jpg")
+	resp = get(t, proxy.URL+jpeg)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "processed" {
+		t.Fatalf("Expected the JPEG to be processed, got %q", body)
+	}
+	if processed.Load() != 1 {
+		t.Fatalf("Expected imgproxy to process the JPEG once, got %d calls", processed.Load())
+	}
+}
+
+func TestPassthroughRequiresAValidSignature(t *testing.T) {
+	var fetched atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(testSVG))
+	}))
+	t.Cleanup(source.Close)
+
+	// imgproxy rejects forged signatures
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+	})
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	cfg := Config{PassthroughContentTypes: []string{"image/svg+xml"}, AllowLoopbackSources: true, ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	resp := get(t, proxy.URL+"/forged/rs:fill:50:50/plain/"+url.QueryEscape(source.URL+"/logo.svg"))
+	srv.uploads.Wait()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the forged path to be left to imgproxy, got %d", resp.StatusCode)
+	}
+	if fetched.Load() != 0 || store.len() != 0 {
+		t.Fatalf("Expected the source of a forged path neither fetched nor cached, got %d fetches and %d objects", fetched.Load(), store.len())
+	}
+}
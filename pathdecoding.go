@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var errMalformedPath = errors.New("malformed percent-encoding in the path")
+
+// strictPath checks the percent-encoding of a path with STRICT_PATH_DECODING and returns its canonical form,
+// the one both its key and imgproxy get, so equivalent spellings can't be keyed apart from what imgproxy
+// processes. A path that doesn't decode, or whose plain source URL doesn't, is rejected with errMalformedPath.
+// The canonical path is signed again, so the original signature is verified first
+func (s *server) strictPath(path string) (string, error) {
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		return "", errMalformedPath
+	}
+	// imgproxy decodes plain sources once more, after the path itself
+	if p, err := parseImgproxyPath(decoded); err == nil && p.Plain {
+		if _, err := url.PathUnescape(p.Source); err != nil {
+			return "", fmt.Errorf("%w: source URL %q", errMalformedPath, p.Source)
+		}
+	}
+
+	canonical := normalizePercentEncoding(path)
+	if canonical == path {
+		return path, nil
+	}
+	if err := s.signatures.verify(path); err != nil {
+		return "", err
+	}
+	return s.signatures.resignPath(canonical), nil
+}
+
+// applyStrictPath replaces the path of a request with its canonical form, see strictPath
+func (s *server) applyStrictPath(r *http.Request) error {
+	escaped := r.URL.EscapedPath()
+	strict, err := s.strictPath(escaped)
+	if err != nil || strict == escaped {
+		return err
+	}
+	return setRequestPath(r, strict)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStrictPathDecodingRejectsMalformedEncoding(t *testing.T) {
+	var processed atomic.Int64
+	_, proxy, store := newTestServer(t, Config{StrictPathDecoding: true}, countingStub(&processed))
+
+	// %25zz decodes to %zz, which imgproxy can't decode in the source URL
+	if resp := get(t, proxy.URL+"/_/w:300/plain/http%3A%2F%2Fexample.com%2F%25zz.jpg"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for a malformed source, got %d", resp.StatusCode)
+	}
+	if processed.Load() != 0 || store.len() != 0 {
+		t.Fatal("Expected the malformed path neither to be processed nor stored")
+	}
+}
+
+func TestStrictPathDecodingCanonicalizesEscapes(t *testing.T) {
+	var forwarded atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.URL.EscapedPath())
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{StrictPathDecoding: true}, stub)
+
+	canonical := "/_/w:300/plain/http%3A%2F%2Fexample.com%2Fkitten.jpg"
+	if resp := get(t, proxy.URL+"/_/w:300/plain/http%3a%2f%2fexample.com%2fk%69tten.jpg"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if got := forwarded.Load(); got != canonical {
+		t.Fatalf("Expected imgproxy to get the canonical path %s, got %v", canonical, got)
+	}
+	if _, ok := store.get(GenerateS3Key(canonical)); !ok {
+		t.Fatal("Expected the image to be stored under the key of the canonical path")
+	}
+
+	if resp := get(t, proxy.URL+canonical); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the canonical spelling to hit the same image, got %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestStrictPathDecodingSignsTheCanonicalPath(t *testing.T) {
+	key, salt := []byte("key"), []byte("salt")
+	var forwarded atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.URL.EscapedPath())
+		w.Write([]byte("image"))
+	})
+	srv, proxy, _ := newTestServer(t, Config{StrictPathDecoding: true, ImgproxyKey: key, ImgproxySalt: salt}, stub)
+
+	if resp := get(t, proxy.URL+"/forged/w:300/plain/http%3a%2f%2fexample.com%2fkitten.jpg"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a forged signature to be rejected, got %d", resp.StatusCode)
+	}
+	if resp := get(t, proxy.URL+sign(key, salt, "/w:300/plain/http%3a%2f%2fexample.com%2fkitten.jpg")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if want := sign(key, salt, "/w:300/plain/http%3A%2F%2Fexample.com%2Fkitten.jpg"); forwarded.Load() != want {
+		t.Fatalf("Expected imgproxy to get the canonical path signed again %s, got %v", want, forwarded.Load())
+	}
+}
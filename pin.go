@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// expired reports whether a cached image is older than its TTL, CACHE_TTL or TTL_BY_STATUS, and must be
+// regenerated. Pinned images never expire
+func (s *server) expired(meta ObjectMeta, lastModified time.Time) bool {
+	ttl := s.ttl(meta)
+	return ttl > 0 && !meta.Pinned && time.Since(lastModified) > ttl
+}
+
+// handlePin pins the cached image of an imgproxy path, within the caller's tenant
+func (s *server) handlePin(w http.ResponseWriter, r *http.Request) {
+	s.handleSetPinned(w, r, true)
+}
+
+// handleUnpin lets the cached image of an imgproxy path expire again
+func (s *server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	s.handleSetPinned(w, r, false)
+}
+
+func (s *server) handleSetPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	path, key, ok := s.cacheEntryKey(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.setPinned(r.Context(), key, pinned)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update cache entry", "path", path, "key", key, "pinned", pinned, "error", err)
+		http.Error(w, "failed to update cache entry", http.StatusBadGateway)
+		return
+	}
+
+	slog.Info("Updated cache entry", "path", path, "key", key, "pinned", pinned)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPinned stores the pin in the object's metadata. S3 metadata can't be changed in place,
+// so the object is uploaded again with its body and its other metadata
+func (s *server) setPinned(ctx context.Context, key string, pinned bool) error {
+	obj, err := s.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	if obj.Pinned == pinned {
+		return nil
+	}
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return err
+	}
+
+	meta := obj.ObjectMeta
+	meta.Pinned = pinned
+	return s.store.Put(ctx, key, bytes.NewReader(body), meta)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPinnedEntrySurvivesTTLExpiry(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("regenerated"))
+	})
+	srv, proxy, store := newTestServer(t, Config{CacheTTL: time.Hour}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/hero.jpg")
+	pinned, unpinned := "/_/rs:fill:1200:600"+source, "/_/rs:fill:300:300"+source
+	for _, path := range []string{pinned, unpinned} {
+		store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("original"), ObjectMeta{ContentType: "image/jpeg"})
+	}
+
+	if resp := adminDo(t, http.MethodPut, proxy.URL+"/admin/pin?path="+url.QueryEscape(pinned)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 when pinning, got %d", resp.StatusCode)
+	}
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/admin/cache?path="+url.QueryEscape(pinned))
+	var entry cacheEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	if !entry.Pinned {
+		t.Fatal("Expected the cache entry to be reported as pinned")
+	}
+
+	store.age(GenerateS3Key(pinned), 2*time.Hour)
+	store.age(GenerateS3Key(unpinned), 2*time.Hour)
+
+	if resp := get(t, proxy.URL+pinned); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the pinned entry to be served past its TTL, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected the pinned entry not to be regenerated")
+	}
+
+	if resp := get(t, proxy.URL+unpinned); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the expired entry to be regenerated, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	srv.uploads.Wait()
+	if body, _ := store.get(GenerateS3Key(unpinned)); string(body) != "regenerated" {
+		t.Fatalf("Expected the regenerated image to replace the expired one, got %q", body)
+	}
+	if resp := get(t, proxy.URL+unpinned); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the regenerated entry to be fresh, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestPinnedEntryIsNotOverwritten(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	path := "/_/rs:fill:1200:600/plain/" + url.QueryEscape("http://example.com/hero.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("original"), ObjectMeta{ContentType: "image/jpeg", Pinned: true})
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	srv.uploads.Wait()
+
+	if body, _ := store.get(GenerateS3Key(path)); string(body) != "original" {
+		t.Fatalf("Expected the pinned entry to be kept, got %q", body)
+	}
+
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/pin?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 when unpinning, got %d", resp.StatusCode)
+	}
+	info, err := store.Head(context.Background(), GenerateS3Key(path))
+	if err != nil || info.Pinned {
+		t.Fatalf("Expected the entry to be unpinned, got %+v, %v", info, err)
+	}
+	if body, _ := store.get(GenerateS3Key(path)); string(body) != "original" {
+		t.Fatalf("Expected the body to be kept when unpinning, got %q", body)
+	}
+}
+
+func TestPinningAMissingEntry(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	path := "/_/w:300/plain/" + url.QueryEscape("http://example.com/missing.jpg")
+	if resp := adminDo(t, http.MethodPut, proxy.URL+"/admin/pin?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestPinIsStoredAsMetadata(t *testing.T) {
+	meta := ObjectMeta{Pinned: true}
+	if got := meta.userMetadata()[pinnedMetadata]; got != "true" {
+		t.Fatalf("Expected the pin in the user metadata, got %q", got)
+	}
+	if !objectMeta(nil, meta.userMetadata()).Pinned {
+		t.Fatal("Expected the pin to be read back from the metadata")
+	}
+}
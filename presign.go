@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Upload modes: through the SDK uploader, or with a plain HTTP PUT on a presigned URL
+const (
+	uploadModeSDK       = "sdk"
+	uploadModePresigned = "presigned"
+)
+
+// presignExpiry only has to cover the upload following the signature
+const presignExpiry = 5 * time.Minute
+
+// presignedUploadError is returned when S3 rejects a presigned upload.
+// It exposes the status like the SDK errors do, so throttled uploads are retried
+type presignedUploadError struct {
+	status int
+	body   string
+}
+
+func (e *presignedUploadError) Error() string {
+	return fmt.Sprintf("presigned upload failed with status %d: %s", e.status, e.body)
+}
+
+func (e *presignedUploadError) HTTPStatusCode() int {
+	return e.status
+}
+
+// enablePresignedUploads makes Put sign the request once and send it as a plain HTTP PUT.
+// The signing client is built once, and the signed URL never leaves the store, so it's never logged
+func (s *s3Store) enablePresignedUploads() {
+	s.presigner = s3.NewPresignClient(s.client, s3.WithPresignExpires(presignExpiry))
+	// The S3 client's own HTTP client carries its TLS settings, such as S3_CA_FILE
+	s.httpClient = s.client.Options().HTTPClient
+}
+
+func (s *s3Store) putPresigned(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	}
+	if meta.ContentType != "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+	input.Metadata = meta.userMetadata()
+	tagging := s.tagging(meta)
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	if meta.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(meta.ContentMD5)
+	}
+
+	signed, err := s.presigner.PresignPutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to presign upload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, signed.Method, signed.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// The signed headers must be sent as they were signed
+	for name, values := range signed.SignedHeader {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	// The content type and tags aren't part of the signature, but still have to be sent
+	if meta.ContentType != "" {
+		req.Header.Set("Content-Type", meta.ContentType)
+	}
+	if tagging != "" && req.Header.Get("X-Amz-Tagging") == "" {
+		req.Header.Set("X-Amz-Tagging", tagging)
+	}
+	if meta.ContentMD5 != "" && req.Header.Get("Content-Md5") == "" {
+		req.Header.Set("Content-MD5", meta.ContentMD5)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		// Only keep the cause, the url.Error would include the signed URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("presigned upload of %s failed: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &presignedUploadError{status: resp.StatusCode, body: string(msg)}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestPresignedUploadSendsSignedPut(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(fakeS3.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "auto",
+		BaseEndpoint: aws.String(fakeS3.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	store := newS3Store(client, "bucket", "cache/")
+	store.enablePresignedUploads()
+
+	err := store.Put(context.Background(), "abc.webp", strings.NewReader("image"), ObjectMeta{ContentType: "image/webp", ContentHash: "hash"})
+	if err != nil {
+		t.Fatalf("Presigned upload failed: %v", err)
+	}
+
+	if got.Method != http.MethodPut || got.URL.Path != "/bucket/cache/abc.webp" {
+		t.Fatalf("Expected a PUT of the object, got %s %s", got.Method, got.URL.Path)
+	}
+	if got.URL.Query().Get("X-Amz-Signature") == "" {
+		t.Fatal("Expected the upload to be presigned")
+	}
+	if got.Header.Get("Content-Type") != "image/webp" || got.Header.Get("X-Amz-Meta-Content-Sha256") != "hash" {
+		t.Fatalf("Expected the signed headers to be sent, got %v", got.Header)
+	}
+	if string(body) != "image" {
+		t.Fatalf("Expected the body to be uploaded, got %q", body)
+	}
+}
+
+func TestPresignedUploadMinIO(t *testing.T) {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(t, ctx)
+	t.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(t, ctx, dockerNetwork)
+	t.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(t, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	store := newS3Store(client, processedBucket, "cache/")
+	store.enablePresignedUploads()
+
+	if err := store.Put(ctx, "abc.webp", strings.NewReader("image"), ObjectMeta{ContentType: "image/webp", ContentHash: "hash"}); err != nil {
+		t.Fatalf("Presigned upload failed: %v", err)
+	}
+
+	obj, err := store.Get(ctx, "abc.webp")
+	if err != nil {
+		t.Fatalf("Uploaded object not found: %v", err)
+	}
+	defer obj.Body.Close()
+
+	body, _ := io.ReadAll(obj.Body)
+	if string(body) != "image" || obj.ContentType != "image/webp" || obj.ContentHash != "hash" {
+		t.Fatalf("Unexpected object %q with %+v", body, obj.ObjectMeta)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preflightBackoff is the wait before the first retry of a source answering a preflight HEAD with a 5xx,
+// doubled for each of the next ones
+const preflightBackoff = 100 * time.Millisecond
+
+var (
+	errSourceMissing     = errors.New("source not found")
+	errSourceUnavailable = errors.New("source is unavailable")
+)
+
+// circuitOpenError rejects the requests for a source host whose circuit is open, until it may be tried again
+type circuitOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("source host %s is unavailable, retry later", e.host)
+}
+
+// sourceCircuit opens the circuit of a source host once its preflights failed PREVALIDATE_SOURCE_FAILURES
+// times in a row, so its requests fail fast for PREVALIDATE_SOURCE_COOLDOWN instead of each waiting for it.
+// The first request after the cooldown tries the host again, any success closes the circuit
+type sourceCircuit struct {
+	failures int
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+type hostCircuit struct {
+	failures int
+	openedAt time.Time
+}
+
+func newSourceCircuit(failures int, cooldown time.Duration) *sourceCircuit {
+	return &sourceCircuit{failures: failures, cooldown: cooldown, hosts: map[string]*hostCircuit{}}
+}
+
+// allow returns an error while the circuit of the host is open
+func (c *sourceCircuit) allow(host string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[host]
+	if !ok || h.failures < c.failures {
+		return nil
+	}
+	if until := h.openedAt.Add(c.cooldown); now.Before(until) {
+		return &circuitOpenError{host: host, until: until}
+	}
+	// Half open: this request tries the host again, the others are rejected for another cooldown unless it succeeds
+	h.openedAt = now
+	return nil
+}
+
+// record counts a failed preflight of the host, or forgets its failures on a success
+func (c *sourceCircuit) record(host string, failed bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		delete(c.hosts, host)
+		return
+	}
+	h, ok := c.hosts[host]
+	if !ok {
+		h = &hostCircuit{}
+		c.hosts[host] = h
+	}
+	if h.failures++; h.failures == c.failures {
+		slog.Warn("Opening the circuit of a failing source host", "host", host, "failures", h.failures, "cooldown", c.cooldown)
+	}
+	h.openedAt = now
+}
+
+// preflightSource sends a HEAD to the source of a miss with PREVALIDATE_SOURCE, so a broken source fails fast
+// instead of waiting for imgproxy. A missing source returns errSourceMissing with its status, a source still
+// answering 5xx after PREVALIDATE_SOURCE_RETRIES returns errSourceUnavailable. Anything else, including an
+// unreachable source, is left for imgproxy to report
+func (s *server) preflightSource(ctx context.Context, path string) (int, error) {
+	if !s.cfg.PrevalidateSource {
+		return 0, nil
+	}
+	source, err := decodeSource(path)
+	if err != nil {
+		return 0, nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return 0, nil
+	}
+	host := strings.ToLower(u.Host)
+	if err := s.sourceCircuit.allow(host, time.Now()); err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	backoff := preflightBackoff
+	for retry := 0; ; retry++ {
+		resp, err := s.sources.head(ctx, path)
+		if err != nil {
+			if errors.Is(err, errSourceNotAllowed) || errors.Is(err, errUncheckableSource) {
+				return http.StatusForbidden, err
+			}
+			return 0, nil
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			s.sourceCircuit.record(host, false, time.Now())
+			return resp.StatusCode, errSourceMissing
+		case resp.StatusCode < 500:
+			s.sourceCircuit.record(host, false, time.Now())
+			return 0, nil
+		case retry == s.cfg.PrevalidateSourceRetries:
+			s.sourceCircuit.record(host, true, time.Now())
+			return http.StatusBadGateway, fmt.Errorf("%w: status %d", errSourceUnavailable, resp.StatusCode)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return 0, nil
+		}
+	}
+}
+
+// rejectSource answers a request whose preflight failed. A missing source is cached as such
+// when TTL_BY_STATUS gives its status a TTL, so its next requests don't reach the source at all
+func (s *server) rejectSource(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		w.Header().Set("Retry-After", retryAfter(time.Until(open.until)))
+	}
+	if errors.Is(err, errSourceMissing) && s.cachesStatus(status) && !s.skipStore(r) {
+		body := []byte(err.Error() + "\n")
+		meta := ObjectMeta{ContentType: "text/plain; charset=utf-8", Status: status}
+		s.storeInBackground(r.Context(), keyPath(r.Context(), requestPath(r.URL)), body, meta)
+		w.Header().Set("X-Cache", "MISS")
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// preflightSourceServer answers the HEAD requests of the preflight with a status, and counts them
+func preflightSourceServer(t *testing.T, status int, heads *atomic.Int64) *httptest.Server {
+	t.Helper()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(source.Close)
+	return source
+}
+
+func countingStub(processed *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processed.Add(1)
+		w.Write([]byte("image"))
+	})
+}
+
+func preflightConfig() Config {
+	return Config{
+		PrevalidateSource:         true,
+		PrevalidateSourceRetries:  1,
+		PrevalidateSourceFailures: 2,
+		PrevalidateSourceCooldown: time.Minute,
+		AllowLoopbackSources:      true,
+	}
+}
+
+func TestMissingSourceShortCircuits(t *testing.T) {
+	var heads, processed atomic.Int64
+	source := preflightSourceServer(t, http.StatusNotFound, &heads)
+	cfg := preflightConfig()
+	cfg.TTLByStatus = map[int]time.Duration{http.StatusNotFound: time.Minute}
+	srv, proxy, store := newTestServer(t, cfg, countingStub(&processed))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape(source.URL+"/missing.jpg")
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if processed.Load() != 0 {
+		t.Fatal("Expected imgproxy not to be called for a missing source")
+	}
+	if obj, err := store.Head(context.Background(), GenerateS3Key(path)); err != nil || obj.Status != http.StatusNotFound {
+		t.Fatal("Expected the missing source to be negative-cached")
+	}
+
+	resp := get(t, proxy.URL+path)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a cached 404, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if heads.Load() != 1 {
+		t.Fatalf("Expected a single preflight, got %d", heads.Load())
+	}
+}
+
+func TestPresentSourceIsProcessed(t *testing.T) {
+	var heads, processed atomic.Int64
+	source := preflightSourceServer(t, http.StatusOK, &heads)
+	srv, proxy, store := newTestServer(t, preflightConfig(), countingStub(&processed))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape(source.URL+"/kitten.jpg")
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if heads.Load() != 1 || processed.Load() != 1 {
+		t.Fatalf("Expected a preflight then processing, got %d HEAD and %d processed", heads.Load(), processed.Load())
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected the image to be stored, found %d objects", store.len())
+	}
+}
+
+func TestFailingSourceOpensTheCircuit(t *testing.T) {
+	var heads, processed atomic.Int64
+	source := preflightSourceServer(t, http.StatusServiceUnavailable, &heads)
+	_, proxy, _ := newTestServer(t, preflightConfig(), countingStub(&processed))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape(source.URL+"/kitten.jpg")
+	for range 2 {
+		if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected status 502 for a failing source, got %d", resp.StatusCode)
+		}
+	}
+	if heads.Load() != 4 {
+		t.Fatalf("Expected each preflight to be retried once, got %d HEAD", heads.Load())
+	}
+
+	resp := get(t, proxy.URL+path)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected status 503 with a Retry-After once the circuit is open, got %d", resp.StatusCode)
+	}
+	if heads.Load() != 4 || processed.Load() != 0 {
+		t.Fatalf("Expected neither the source nor imgproxy to be called, got %d HEAD and %d processed", heads.Load(), processed.Load())
+	}
+}
+
+func TestSourceCircuitClosesAfterASuccess(t *testing.T) {
+	c := newSourceCircuit(1, time.Minute)
+	now := time.Now()
+	c.record("example.com", true, now)
+	if err := c.allow("example.com", now.Add(time.Second)); err == nil {
+		t.Fatal("Expected the circuit to be open")
+	}
+	if err := c.allow("example.com", now.Add(2*time.Minute)); err != nil {
+		t.Fatal("Expected a request to try the host again after the cooldown")
+	}
+	c.record("example.com", false, now.Add(2*time.Minute))
+	if err := c.allow("example.com", now.Add(2*time.Minute)); err != nil {
+		t.Fatal("Expected the circuit to be closed after a success")
+	}
+}
+
+func TestPreflightRespectsTheAllowList(t *testing.T) {
+	var heads atomic.Int64
+	source := preflightSourceServer(t, http.StatusOK, &heads)
+	cfg := preflightConfig()
+	cfg.AllowedSourceHosts = []string{"example.com"}
+	srv, _, _ := newTestServer(t, cfg, imgproxyStub())
+
+	status, err := srv.preflightSource(context.Background(), "/_/plain/"+url.QueryEscape(source.URL+"/kitten.jpg"))
+	if status != http.StatusForbidden || !errors.Is(err, errSourceNotAllowed) {
+		t.Fatalf("Expected a disallowed host to be rejected, got %d %v", status, err)
+	}
+	if heads.Load() != 0 {
+		t.Fatal("Expected no HEAD to reach a disallowed host")
+	}
+}
+
+func TestForgedPathIsNotPreflighted(t *testing.T) {
+	var heads, processed atomic.Int64
+	source := preflightSourceServer(t, http.StatusServiceUnavailable, &heads)
+	cfg := preflightConfig()
+	cfg.ImgproxyKey, cfg.ImgproxySalt, cfg.SignatureSize = []byte("secret-key"), []byte("secret-salt"), 32
+	_, proxy, _ := newTestServer(t, cfg, countingStub(&processed))
+
+	for range 3 {
+		if resp := get(t, proxy.URL+"/forged/rs:fill:50:50/plain/"+url.QueryEscape(source.URL+"/cat.jpg")); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected the forged path to be rejected, got %d", resp.StatusCode)
+		}
+	}
+	if heads.Load() != 0 || processed.Load() != 0 {
+		t.Fatalf("Expected the source of a forged path not to be probed, got %d HEADs", heads.Load())
+	}
+
+	path := sign(cfg.ImgproxyKey, cfg.ImgproxySalt, "/rs:fill:50:50/plain/"+url.QueryEscape(source.URL+"/cat.jpg"))
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusBadGateway || heads.Load() == 0 {
+		t.Fatalf("Expected a signed path to be preflighted, got %d after %d HEADs", resp.StatusCode, heads.Load())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// probeKeyPrefix is the folder of the images stored by the synthetic probe, apart from the real traffic
+const probeKeyPrefix = "_synthetic/"
+
+// runSyntheticProbe runs probeOnce every SYNTHETIC_PROBE_INTERVAL until ctx is done
+func (s *server) runSyntheticProbe(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.SyntheticProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		s.probeOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeOnce processes SYNTHETIC_PROBE_PATH with imgproxy, stores it under probeKeyPrefix and reads it back,
+// timing the whole loop. The duration of a successful loop is the probe gauge, a failure only resets the
+// success gauge so the last duration stays meaningful
+func (s *server) probeOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.probeCacheLoop(ctx); err != nil {
+		s.probeSuccess.Set(0)
+		slog.Warn("Synthetic probe failed", "path", s.cfg.SyntheticProbePath, "error", err)
+		return
+	}
+
+	s.probeDuration.Set(time.Since(start).Seconds())
+	s.probeSuccess.Set(1)
+}
+
+func (s *server) probeCacheLoop(ctx context.Context) error {
+	path := s.cfg.SyntheticProbePath
+	resp, err := s.fetchUpstream(ctx, path)
+	if err != nil {
+		return &stageError{stage: stageProcessing, err: err}
+	}
+	if resp.status != http.StatusOK {
+		return &stageError{stage: stageProcessing, err: fmt.Errorf("imgproxy answered %d", resp.status)}
+	}
+
+	key := probeKeyPrefix + s.keys.key("", path)
+	if err := s.store.Put(ctx, key, bytes.NewReader(resp.body), ObjectMeta{ContentType: resp.contentType}); err != nil {
+		return &stageError{stage: stageS3Write, err: err}
+	}
+
+	obj, err := s.store.Get(ctx, key)
+	if err != nil {
+		return &stageError{stage: stageS3Read, err: err}
+	}
+	defer obj.Body.Close()
+
+	stored, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return &stageError{stage: stageS3Read, err: err}
+	}
+	if !bytes.Equal(stored, resp.body) {
+		return &stageError{stage: stageS3Read, err: fmt.Errorf("read back %d bytes, stored %d", len(stored), len(resp.body))}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyntheticProbeUpdatesTheGauge(t *testing.T) {
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/probe.jpg")
+	cfg := Config{SyntheticProbeInterval: 10 * time.Millisecond, SyntheticProbePath: path}
+	srv, proxy, store := newTestServer(t, cfg, imgproxyStub())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.runSyntheticProbe(ctx)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.probeSuccess.Value() != 1 || srv.probeDuration.Value() <= 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the probe to run and set the gauge")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if _, ok := store.get(probeKeyPrefix + GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the probe image to be stored under the probe prefix")
+	}
+	if _, ok := store.get(GenerateS3Key(path)); ok {
+		t.Fatal("Expected the probe image to stay out of the real traffic keys")
+	}
+
+	resp := get(t, proxy.URL+"/metrics")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "\nimgproxy_cache_synthetic_probe_duration_seconds ") ||
+		!strings.Contains(string(body), "\nimgproxy_cache_synthetic_probe_success 1\n") {
+		t.Fatalf("Expected the probe gauges in the metrics, got %s", body)
+	}
+}
+
+func TestFailingSyntheticProbeResetsSuccess(t *testing.T) {
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/probe.jpg")
+	srv, _, store := newTestServer(t, Config{SyntheticProbeInterval: time.Minute, SyntheticProbePath: path}, stub)
+
+	srv.probeSuccess.Set(1)
+	srv.probeOnce(context.Background())
+
+	if srv.probeSuccess.Value() != 0 {
+		t.Fatal("Expected a failing probe to reset the success gauge")
+	}
+	if store.len() != 0 {
+		t.Fatal("Expected nothing to be stored by a failing probe")
+	}
+}
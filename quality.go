@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// qualityOptions are the imgproxy options setting the output quality, a default doesn't override them
+var qualityOptions = []string{"q", "quality", "fq", "format_quality"}
+
+// applyQualityDefault rewrites the path of a request that doesn't set a quality to request the
+// QUALITY_DEFAULTS quality of its output format. The quality is then part of the key, so the cached
+// images are the ones the default produced. Paths keeping the source format are left as is
+func (s *server) applyQualityDefault(r *http.Request) error {
+	if len(s.cfg.QualityDefaults) == 0 {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		if setsQuality(*p) {
+			return false
+		}
+		quality, ok := s.cfg.QualityDefaults[canonicalFormat(p.Format())]
+		if !ok {
+			return false
+		}
+		p.Options = append(p.Options, fmt.Sprintf("q:%d", quality))
+		return true
+	})
+}
+
+// applyQualityFloor rewrites the path of a request asking for a quality below MIN_QUALITY to request
+// MIN_QUALITY instead, in its q/quality and fq/format_quality options alike. The key is the one of the
+// clamped path, so requests below the floor share the image. A quality of 0 is imgproxy's default, it's kept
+func (s *server) applyQualityFloor(r *http.Request) error {
+	if s.cfg.MinQuality == 0 {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		options, clamped := clampQuality(p.Options, s.cfg.MinQuality)
+		p.Options = options
+		return clamped
+	})
+}
+
+// clampQuality raises the qualities of the options below the floor, reporting whether any was
+func clampQuality(options []string, floor int) ([]string, bool) {
+	clamped := false
+	raise := func(value string) string {
+		q, err := strconv.Atoi(value)
+		if err != nil || q == 0 || q >= floor {
+			return value
+		}
+		clamped = true
+		return strconv.Itoa(floor)
+	}
+
+	result := make([]string, len(options))
+	for i, o := range options {
+		name, args, _ := strings.Cut(o, ":")
+		switch name {
+		case "q", "quality":
+			o = name + ":" + raise(args)
+		case "fq", "format_quality":
+			// Format and quality pairs, e.g. fq:webp:50:avif:40
+			pairs := strings.Split(args, ":")
+			for j := 1; j < len(pairs); j += 2 {
+				pairs[j] = raise(pairs[j])
+			}
+			o = name + ":" + strings.Join(pairs, ":")
+		}
+		result[i] = o
+	}
+	return result, clamped
+}
+
+func setsQuality(p imgproxyPath) bool {
+	for _, o := range p.Options {
+		name, _, _ := strings.Cut(o, ":")
+		if slices.Contains(qualityOptions, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalFormat lowercases a format name and maps jpeg to jpg, as imgproxy does
+func canonicalFormat(format string) string {
+	format = strings.ToLower(format)
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// parseQualityDefaults reads the format:quality pairs of QUALITY_DEFAULTS
+func parseQualityDefaults(items []string) (map[string]int, error) {
+	defaults := map[string]int{}
+	for _, item := range items {
+		format, value, ok := strings.Cut(item, ":")
+		quality, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(format) == "" || err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("invalid QUALITY_DEFAULTS item %q, expected format:quality with a quality from 1 to 100", item)
+		}
+		defaults[canonicalFormat(strings.TrimSpace(format))] = quality
+	}
+	return defaults, nil
+}
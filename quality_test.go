@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseQualityDefaults(t *testing.T) {
+	got, err := parseQualityDefaults([]string{"webp:75", "JPEG:80"})
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if got["webp"] != 75 || got["jpg"] != 80 {
+		t.Fatalf("Unexpected defaults %v", got)
+	}
+	for _, item := range []string{"webp", "webp:0", "avif:101", ":80", "png:high"} {
+		if _, err := parseQualityDefaults([]string{item}); err == nil {
+			t.Errorf("Expected %q to be rejected", item)
+		}
+	}
+}
+
+func TestQualityDefaults(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("image"))
+	})
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"default applied", "/_/rs:fit:300:200" + source + "@webp", "/_/rs:fit:300:200/q:75" + source + "@webp"},
+		{"jpeg alias", "/_/w:300" + source + "@jpeg", "/_/w:300/q:80" + source + "@jpeg"},
+		{"explicit quality kept", "/_/w:300/q:90" + source + "@webp", "/_/w:300/q:90" + source + "@webp"},
+		{"format quality kept", "/_/w:300/fq:webp:50" + source + "@webp", "/_/w:300/fq:webp:50" + source + "@webp"},
+		{"no default for the format", "/_/w:300" + source + "@png", "/_/w:300" + source + "@png"},
+		{"source format kept", "/_/w:300" + source, "/_/w:300" + source},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, proxy, store := newTestServer(t, Config{QualityDefaults: map[string]int{"webp": 75, "jpg": 80}}, stub)
+			if resp := get(t, proxy.URL+tt.path); resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+			srv.uploads.Wait()
+
+			if got, _ := requested.Load().(string); got != tt.want {
+				t.Fatalf("Expected imgproxy to be asked for %s, got %s", tt.want, got)
+			}
+			if _, ok := store.get(GenerateS3Key(tt.want)); !ok {
+				t.Fatalf("Expected the image to be stored under the key of %s", tt.want)
+			}
+		})
+	}
+}
+
+func TestQualityFloor(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Write([]byte("image"))
+	})
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"below the floor clamped", "/_/w:300/q:5" + source, "/_/w:300/q:40" + source},
+		{"long name clamped", "/_/quality:10/w:300" + source, "/_/quality:40/w:300" + source},
+		{"format qualities clamped", "/_/fq:webp:20:avif:60" + source + "@webp", "/_/fq:webp:40:avif:60" + source + "@webp"},
+		{"above the floor kept", "/_/w:300/q:80" + source, "/_/w:300/q:80" + source},
+		{"default quality kept", "/_/w:300/q:0" + source, "/_/w:300/q:0" + source},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, proxy, store := newTestServer(t, Config{MinQuality: 40}, stub)
+			if resp := get(t, proxy.URL+tt.path); resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+			srv.uploads.Wait()
+
+			if got, _ := requested.Load().(string); got != tt.want {
+				t.Fatalf("Expected imgproxy to be asked for %s, got %s", tt.want, got)
+			}
+			if _, ok := store.get(GenerateS3Key(tt.want)); !ok {
+				t.Fatalf("Expected the image to be stored under the key of %s", tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type queryContextKey struct{}
+
+// withQuery records the query string a request is keyed and processed with
+func withQuery(ctx context.Context, query string) context.Context {
+	return context.WithValue(ctx, queryContextKey{}, query)
+}
+
+// queryFrom returns the query string of a request with QUERY_IN_KEY, empty otherwise
+func queryFrom(ctx context.Context) string {
+	query, _ := ctx.Value(queryContextKey{}).(string)
+	return query
+}
+
+// applyQueryPolicy decides what becomes of the query string of an image request, which some proxies
+// append to the path. With QUERY_IN_KEY, it's part of the key and forwarded to imgproxy, otherwise
+// it's dropped so that it neither reaches imgproxy nor splits the cache
+func (s *server) applyQueryPolicy(r *http.Request) *http.Request {
+	if !s.cfg.QueryInKey {
+		// The URL is shared with the access log, which reports the requested query
+		u := *r.URL
+		u.RawQuery = ""
+		r.URL = &u
+		return r
+	}
+	if r.URL.RawQuery == "" {
+		return r
+	}
+	return r.WithContext(withQuery(r.Context(), r.URL.RawQuery))
+}
+
+// normalizeQuery sorts the parameters of a query string, so their order doesn't change the key.
+// Query strings that can't be parsed are used as is
+func normalizeQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	return values.Encode()
+}
+
+// cacheKey returns the key of a path for the tenant, the query string and the forwarded Accept header of a request
+func (s *server) cacheKey(ctx context.Context, path string) string {
+	return s.keys.variantKey(tenantFrom(ctx), path, keyVariant{query: queryFrom(ctx), accept: acceptFrom(ctx)})
+}
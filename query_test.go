@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func queryRecordingStub(query *atomic.Value) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query.Store(r.URL.RawQuery)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	})
+}
+
+func TestQueryIsStrippedByDefault(t *testing.T) {
+	var query atomic.Value
+	srv, proxy, store := newTestServer(t, Config{}, queryRecordingStub(&query))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+path+"?utm_source=newsletter"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	if got, _ := query.Load().(string); got != "" {
+		t.Fatalf("Expected the query not to reach imgproxy, got %q", got)
+	}
+	if _, ok := store.get(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the image to be stored under the key of the path alone")
+	}
+	if resp := get(t, proxy.URL+path+"?utm_source=ads"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected another query to hit the same key, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestQueryInKey(t *testing.T) {
+	var query atomic.Value
+	srv, proxy, store := newTestServer(t, Config{QueryInKey: true}, queryRecordingStub(&query))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+path+"?v=2&lang=fr"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	if got, _ := query.Load().(string); got != "v=2&lang=fr" {
+		t.Fatalf("Expected the query to be forwarded to imgproxy, got %q", got)
+	}
+	if _, ok := store.get(GenerateS3Key(path)); ok {
+		t.Fatal("Expected the query to be part of the key")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected a single stored image, got %d", store.len())
+	}
+
+	if resp := get(t, proxy.URL+path+"?lang=fr&v=2"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the same parameters in another order to hit, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if resp := get(t, proxy.URL+path+"?v=3&lang=fr"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected another query to miss, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the path without a query to miss, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
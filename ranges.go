@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable is returned by the Get of a byte range starting past the end of the object
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+type byteRangeContextKey struct{}
+
+// withByteRange makes the Get of a store read a single byte range of the object, given as a Range header value.
+// A store that can't read ranges returns the whole object, with an empty ContentRange
+func withByteRange(ctx context.Context, byteRange string) context.Context {
+	return context.WithValue(ctx, byteRangeContextKey{}, byteRange)
+}
+
+// byteRangeFrom returns the byte range a Get should read, empty for the whole object
+func byteRangeFrom(ctx context.Context) string {
+	byteRange, _ := ctx.Value(byteRangeContextKey{}).(string)
+	return byteRange
+}
+
+// requestedByteRange returns the Range of a GET served from the cache with RANGE_REQUESTS. Only single byte ranges
+// are read from the store, as S3 only serves those. Other and invalid ranges, and ranges with an If-Range when
+// IF_RANGE isn't set, since hits then carry no validator, are ignored and the whole image is served, as HTTP allows
+func (s *server) requestedByteRange(r *http.Request) (string, bool) {
+	if !s.cfg.RangeRequests || (!s.cfg.IfRange && r.Header.Get("If-Range") != "") {
+		return "", false
+	}
+	byteRange := strings.TrimSpace(r.Header.Get("Range"))
+	spec, ok := strings.CutPrefix(byteRange, "bytes=")
+	if !ok {
+		return "", false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || (first == "" && last == "") {
+		return "", false
+	}
+	start, startErr := strconv.ParseUint(first, 10, 63)
+	end, endErr := strconv.ParseUint(last, 10, 63)
+	switch {
+	case first == "":
+		ok = endErr == nil && end > 0
+	case last == "":
+		ok = startErr == nil
+	default:
+		ok = startErr == nil && endErr == nil && start <= end
+	}
+	return byteRange, ok
+}
+
+// getCachedRange reads a byte range of a cached image. Cached errors are read whole, their status doesn't allow
+// a partial body, and so are images whose validators don't match the If-Range of the request. A range starting
+// past the end of an image reads it whole too and reports it as unsatisfiable, its size is needed to answer 416
+func (s *server) getCachedRange(ctx context.Context, key, byteRange, ifRange string) (obj *CachedObject, unsatisfiable bool, err error) {
+	obj, err = s.store.Get(withByteRange(ctx, byteRange), key)
+	switch {
+	case errors.Is(err, errRangeNotSatisfiable):
+		unsatisfiable = true
+	case err == nil && obj.ContentRange != "" && (obj.Status != 0 || !ifRangeMatches(ifRange, obj.ObjectMeta, obj.LastModified)):
+		obj.Body.Close()
+	default:
+		return obj, false, err
+	}
+
+	obj, err = s.store.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return obj, unsatisfiable && obj.Status == 0 && ifRangeMatches(ifRange, obj.ObjectMeta, obj.LastModified), nil
+}
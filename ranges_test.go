@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func getRange(t *testing.T, requestURL, byteRange string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, requestURL, nil)
+	req.Header.Set("Range", byteRange)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestRequestedByteRange(t *testing.T) {
+	srv := &server{cfg: Config{RangeRequests: true}}
+	for byteRange, want := range map[string]bool{
+		"bytes=0-99":      true,
+		"bytes=100-":      true,
+		"bytes=-100":      true,
+		"bytes=-0":        false,
+		"bytes=10-5":      false,
+		"bytes=0-9,20-29": false,
+		"bytes=-":         false,
+		"items=0-9":       false,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", byteRange)
+		if _, ok := srv.requestedByteRange(req); ok != want {
+			t.Errorf("Expected %q to be served from the store: %v", byteRange, want)
+		}
+	}
+}
+
+func TestRangeRequestReadsTheRangeFromTheStore(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{RangeRequests: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	image, _ := store.get(GenerateS3Key(path))
+
+	resp, body := getRange(t, proxy.URL+path, "bytes=0-8")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, image[:9]) {
+		t.Fatalf("Expected the first 9 bytes with a 206, got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 0-8/"+strconv.Itoa(len(image)) {
+		t.Fatalf("Unexpected Content-Range %q", got)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a hit accepting ranges, got %v", resp.Header)
+	}
+
+	resp, _ = getRange(t, proxy.URL+path, "bytes=100000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */"+strconv.Itoa(len(image)) {
+		t.Fatalf("Expected a range past the end to be answered 416 with the size, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	resp, body = getRange(t, proxy.URL+path, "bytes=0-1,4-5")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) {
+		t.Fatalf("Expected several ranges to be answered with the whole image, got %d", resp.StatusCode)
+	}
+}
+
+func TestRangeRequestsAreIgnoredByDefault(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	image, _ := store.get(GenerateS3Key(path))
+
+	resp, body := getRange(t, proxy.URL+path, "bytes=0-8")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) || resp.Header.Get("Accept-Ranges") != "" {
+		t.Fatalf("Expected the whole image without RANGE_REQUESTS, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRangeRequestOfACachedErrorIsServedWhole(t *testing.T) {
+	cfg := Config{RangeRequests: true, TTLByStatus: map[int]time.Duration{http.StatusNotFound: time.Minute}}
+	srv, proxy, _ := newTestServer(t, cfg, http.NotFoundHandler())
+
+	path := "/_/plain/" + url.QueryEscape("http://example.com/missing.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	resp, body := getRange(t, proxy.URL+path, "bytes=0-2")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Range") != "" || len(body) <= 3 {
+		t.Fatalf("Expected the cached error to be served whole, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRangeReadDoesNotBackfillThePrimary(t *testing.T) {
+	primary, secondary := newMemoryStore(), newMemoryStore()
+	secondary.Put(context.Background(), "old", strings.NewReader("old image"), ObjectMeta{ContentType: "image/jpeg"})
+	store := newCompositeStore(primary, []CacheStore{primary, secondary}, true)
+
+	obj, err := store.Get(withByteRange(context.Background(), "bytes=0-2"), "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+	if body, _ := io.ReadAll(obj.Body); string(body) != "old" || obj.ContentRange != "bytes 0-2/9" {
+		t.Fatalf("Expected the range of the secondary object, got %q %q", body, obj.ContentRange)
+	}
+	if primary.len() != 0 {
+		t.Fatal("Expected a range not to be back-filled as the whole object")
+	}
+}
+
+// countingHTTPClient counts the bytes of the response bodies S3 sends
+type countingHTTPClient struct {
+	s3.HTTPClient
+	read *atomic.Int64
+}
+
+func (c countingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err == nil {
+		resp.Body = countingBody{ReadCloser: resp.Body, read: c.read}
+	}
+	return resp, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	read *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read.Add(int64(n))
+	return n, err
+}
+
+func TestRangeRequestMinIO(t *testing.T) {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(t, ctx)
+	t.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(t, ctx, dockerNetwork)
+	t.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(t, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	var read atomic.Int64
+	counted := s3.New(client.Options(), func(o *s3.Options) {
+		o.HTTPClient = countingHTTPClient{HTTPClient: o.HTTPClient, read: &read}
+	})
+	store := newS3Store(counted, processedBucket, "")
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/poster.jpg")
+	image := []byte(strings.Repeat("0123456789", 100000))
+	if err := store.Put(ctx, GenerateS3Key(path), bytes.NewReader(image), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+		t.Fatalf("Failed to store the image: %v", err)
+	}
+	_, proxy := newTestServerWithStore(t, Config{RangeRequests: true}, imgproxyStub(), store)
+
+	read.Store(0)
+	resp, body := getRange(t, proxy.URL+path, "bytes=1000-1099")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, image[1000:1100]) {
+		t.Fatalf("Expected the 100 requested bytes with a 206, got %d (%d bytes)", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 1000-1099/1000000" {
+		t.Fatalf("Expected the Content-Range of S3, got %q", got)
+	}
+	if read.Load() != 100 {
+		t.Fatalf("Expected only the requested bytes to be read from S3, read %d", read.Load())
+	}
+
+	resp, _ = getRange(t, proxy.URL+path, "bytes=2000000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */1000000" {
+		t.Fatalf("Expected a range past the end to be answered 416, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+}
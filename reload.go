@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadOnHangup reloads the configuration on every SIGHUP until the context is done
+func (s *server) reloadOnHangup(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-hangups:
+			s.reloadConfig(loadConfigFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadConfigFile sets the variables of the CONFIG_FILE, if any, in the environment before loading the configuration.
+// The environment of a running process can't be changed from outside, the file is what a reload reads again
+func loadConfigFile() (Config, error) {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := setEnvFromFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	return loadConfig()
+}
+
+// configFileEnv holds the environment the CONFIG_FILE overrode, by key, so a key removed from the file gets its
+// previous value back on the next reload, or is unset if it had none
+var configFileEnv = struct {
+	sync.Mutex
+	previous map[string]*string
+}{previous: map[string]*string{}}
+
+// setEnvFromFile sets the KEY=VALUE lines of a file as environment variables, skipping blank lines and # comments.
+// The keys a previous load of the file set and it no longer contains are restored
+func setEnvFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+
+	env := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid CONFIG_FILE line %d, expected KEY=VALUE", i+1)
+		}
+		env[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	configFileEnv.Lock()
+	defer configFileEnv.Unlock()
+	for key, previous := range configFileEnv.previous {
+		if _, ok := env[key]; ok {
+			continue
+		}
+		if previous == nil {
+			err = os.Unsetenv(key)
+		} else {
+			err = os.Setenv(key, *previous)
+		}
+		if err != nil {
+			return err
+		}
+		delete(configFileEnv.previous, key)
+	}
+	for key, value := range env {
+		if _, ok := configFileEnv.previous[key]; !ok {
+			if previous, set := os.LookupEnv(key); set {
+				configFileEnv.previous[key] = &previous
+			} else {
+				configFileEnv.previous[key] = nil
+			}
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadConfig loads the configuration again and applies its reloadable settings: the source
+// allow-list and redirect policy, the admission limits, the cache mode and a raised CACHE_GENERATION.
+// The other settings, such as the bound ports and the clients, keep their startup values. An invalid configuration is ignored
+func (s *server) reloadConfig(load func() (Config, error)) {
+	cfg, err := load()
+	if err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "error", err)
+		return
+	}
+
+	s.sources.setRules(cfg)
+	// Requests admitted by the previous queue release their slot there
+	if !s.admission.Load().hasLimits(cfg) {
+		s.admission.Store(newAdmissionQueue(cfg))
+	}
+	s.cacheMode.Store(&cfg.CacheMode)
+	generation := s.keys.raiseGeneration(int64(cfg.CacheGeneration))
+
+	slog.Info("Configuration reloaded", "allowed_source_hosts", cfg.AllowedSourceHosts, "max_concurrent", cfg.MaxConcurrent, "cache_mode", cfg.CacheMode, "cache_generation", generation)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadTogglesCacheMode(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	cached := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	fresh := "/_/rs:fill:60:60/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	get(t, proxy.URL+cached)
+	srv.uploads.Wait()
+	if resp := get(t, proxy.URL+cached); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a hit before the reload, got %q", resp.Header.Get("X-Cache"))
+	}
+
+	srv.reloadConfig(func() (Config, error) { return Config{CacheMode: cacheModeOff}, nil })
+	if resp := get(t, proxy.URL+cached); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the cache to be bypassed once off, got %q", resp.Header.Get("X-Cache"))
+	}
+
+	srv.reloadConfig(func() (Config, error) { return Config{CacheMode: cacheModeReadOnly}, nil })
+	if resp := get(t, proxy.URL+cached); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected cached images to be served in read-only mode, got %q", resp.Header.Get("X-Cache"))
+	}
+	get(t, proxy.URL+fresh)
+	srv.uploads.Wait()
+	if store.len() != 1 {
+		t.Fatalf("Expected nothing new stored in read-only mode, got %d objects", store.len())
+	}
+}
+
+func TestReloadSwapsTheSourceAllowList(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	image := proxy.URL + "/_/plain/" + url.QueryEscape("http://example.org/kitten.jpg")
+
+	srv.reloadConfig(func() (Config, error) { return Config{AllowedSourceHosts: []string{"example.com"}}, nil })
+	if resp := get(t, image); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the reloaded allow-list to reject the source, got %d", resp.StatusCode)
+	}
+}
+
+func TestInvalidReloadKeepsTheConfiguration(t *testing.T) {
+	srv, _, _ := newTestServer(t, Config{CacheMode: cacheModeReadOnly}, imgproxyStub())
+
+	srv.reloadConfig(func() (Config, error) { return Config{}, errors.New("invalid CACHE_MODE") })
+	if mode := *srv.cacheMode.Load(); mode != cacheModeReadOnly {
+		t.Fatalf("Expected the cache mode to be kept, got %q", mode)
+	}
+}
+
+func TestConfigFileOverridesTheEnvironment(t *testing.T) {
+	t.Setenv("S3_BUCKET", "images")
+	t.Setenv("CACHE_MODE", cacheModeReadWrite)
+	t.Cleanup(func() { configFileEnv.previous = map[string]*string{} })
+	path := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(path, []byte("# reloadable\n\nCACHE_MODE = read-only\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := loadConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	if cfg.CacheMode != cacheModeReadOnly {
+		t.Fatalf("Expected CACHE_MODE from the file, got %q", cfg.CacheMode)
+	}
+}
+
+func TestReloadRestoresTheKeysRemovedFromTheConfigFile(t *testing.T) {
+	t.Setenv("S3_BUCKET", "images")
+	t.Setenv("CACHE_MODE", cacheModeReadWrite)
+	t.Setenv("MAX_CONCURRENT", "")
+	os.Unsetenv("MAX_CONCURRENT")
+	t.Cleanup(func() { configFileEnv.previous = map[string]*string{} })
+
+	path := filepath.Join(t.TempDir(), "env")
+	t.Setenv("CONFIG_FILE", path)
+	if err := os.WriteFile(path, []byte("CACHE_MODE=read-only\nMAX_CONCURRENT=4\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := loadConfigFile(); err != nil || cfg.CacheMode != cacheModeReadOnly || cfg.MaxConcurrent != 4 {
+		t.Fatalf("Expected the values of the file, got %+v (%v)", cfg, err)
+	}
+
+	if err := os.WriteFile(path, []byte("# emptied\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	if cfg.CacheMode != cacheModeReadWrite {
+		t.Fatalf("Expected CACHE_MODE to get its environment value back, got %q", cfg.CacheMode)
+	}
+	if _, set := os.LookupEnv("MAX_CONCURRENT"); set {
+		t.Fatal("Expected MAX_CONCURRENT, only set by the file, to be unset")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var reportHeader = []string{"key", "size", "content_type", "last_modified"}
+
+// handleReport streams the cached objects as CSV, one page of the listing at a time so that large
+// buckets aren't held in memory. The content types come from a HEAD per object, WARM_CONCURRENCY at a
+// time and each one through the S3 limiter. Once streaming, a failure can only cut the report short,
+// so it's logged with the number of rows sent
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request) {
+	// In tenant mode, a report never goes beyond the caller's prefix
+	prefix := r.URL.Query().Get("prefix")
+	if tenant := tenantFrom(r.Context()); tenant != "" {
+		prefix = s.keys.prefix(tenant) + prefix
+	}
+
+	page, err := s.store.List(r.Context(), prefix, "", maxListLimit)
+	if err != nil {
+		slog.Error("Failed to list the cached objects", "prefix", prefix, "error", err)
+		http.Error(w, "failed to list the cached objects", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+	rc := http.NewResponseController(w)
+	out := csv.NewWriter(w)
+	out.Write(reportHeader)
+
+	rows := 0
+	for {
+		infos, err := s.headPage(r.Context(), page.Objects)
+		if err != nil {
+			slog.Error("Failed to describe the cached objects, the report is incomplete", "prefix", prefix, "rows", rows, "error", err)
+			return
+		}
+		for _, info := range infos {
+			out.Write([]string{info.Key, strconv.FormatInt(info.Size, 10), info.ContentType, info.LastModified.UTC().Format(time.RFC3339)})
+			rows++
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			return
+		}
+		rc.Flush()
+
+		if page.NextCursor == "" {
+			return
+		}
+		page, err = s.store.List(r.Context(), prefix, page.NextCursor, maxListLimit)
+		if err != nil {
+			slog.Error("Failed to list the cached objects, the report is incomplete", "prefix", prefix, "rows", rows, "error", err)
+			return
+		}
+	}
+}
+
+// headPage describes the listed objects in their order, skipping the ones purged since
+func (s *server) headPage(ctx context.Context, objects []ObjectInfo) ([]*ObjectInfo, error) {
+	infos := make([]*ObjectInfo, len(objects))
+	errs := make([]error, len(objects))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.cfg.WarmConcurrency)
+	for i, obj := range objects {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			info, err := s.store.Head(ctx, obj.Key)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				errs[i] = err
+				return
+			}
+			if info != nil {
+				info.Key = obj.Key
+				if info.LastModified.IsZero() {
+					info.LastModified = obj.LastModified
+				}
+			}
+			infos[i] = info
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	described := infos[:0]
+	for _, info := range infos {
+		if info != nil {
+			described = append(described, info)
+		}
+	}
+	return described, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func readReport(t *testing.T, resp *http.Response) [][]string {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Expected a CSV report, got %s", ct)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse the report: %v", err)
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != "key,size,content_type,last_modified" {
+		t.Fatalf("Expected the CSV header first, got %v", rows)
+	}
+	return rows[1:]
+}
+
+func TestReportListsCachedObjects(t *testing.T) {
+	_, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	store.Put(context.Background(), "photos/a", strings.NewReader("jpeg image"), ObjectMeta{ContentType: "image/jpeg"})
+	store.Put(context.Background(), "photos/b", strings.NewReader("webp"), ObjectMeta{ContentType: "image/webp"})
+	store.Put(context.Background(), "avatars/c", strings.NewReader("png"), ObjectMeta{ContentType: "image/png"})
+
+	rows := readReport(t, adminDo(t, http.MethodGet, proxy.URL+"/admin/report.csv"))
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %v", rows)
+	}
+	if got := strings.Join(rows[1][:3], ","); got != "photos/a,10,image/jpeg" {
+		t.Fatalf("Unexpected row %v", rows[1])
+	}
+
+	rows = readReport(t, adminDo(t, http.MethodGet, proxy.URL+"/admin/report.csv?prefix=photos/"))
+	if len(rows) != 2 || rows[0][0] != "photos/a" || rows[1][0] != "photos/b" || rows[1][2] != "image/webp" {
+		t.Fatalf("Expected the rows of the prefix only, got %v", rows)
+	}
+}
+
+func TestReportWalksEveryPage(t *testing.T) {
+	_, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	for i := range maxListLimit + 5 {
+		store.Put(context.Background(), fmt.Sprintf("key-%04d", i), strings.NewReader("image"), ObjectMeta{ContentType: "image/jpeg"})
+	}
+
+	if rows := readReport(t, adminDo(t, http.MethodGet, proxy.URL+"/admin/report.csv")); len(rows) != maxListLimit+5 {
+		t.Fatalf("Expected %d rows, got %d", maxListLimit+5, len(rows))
+	}
+}
+
+func TestReportRequiresTheAdminToken(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	if resp := get(t, proxy.URL+"/admin/report.csv"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 without the admin token, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// rewritePath applies rewrite to the parsed path of a request and signs the result again when rewrite reports a change.
+// Resigning would turn a forged path into a valid one, so the original signature is verified first.
+// A path that doesn't parse is left as is, imgproxy rejects it
+func (s *server) rewritePath(r *http.Request, rewrite func(*imgproxyPath) bool) error {
+	path := requestPath(r.URL)
+	p, err := parseImgproxyPath(path)
+	if err != nil || !rewrite(&p) {
+		return nil
+	}
+	if err := s.signatures.verify(path); err != nil {
+		return err
+	}
+	return setRequestPath(r, s.signatures.resign(p).String())
+}
+
+// rewriteError is a path rewrite that failed, with the rule it failed in
+type rewriteError struct {
+	rule string
+	err  error
+}
+
+func (e *rewriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rewriteError) Unwrap() error {
+	return e.err
+}
+
+// status is the status a request failing the rewrite is answered with, invalid requests are told apart from forged ones
+func (e *rewriteError) status() int {
+	if errors.Is(e.err, errIdentityTransform) || errors.Is(e.err, errOversizeRequest) || errors.Is(e.err, errTooManyPixels) {
+		return http.StatusBadRequest
+	}
+	return http.StatusForbidden
+}
+
+// rewriteImagePath applies the rewrites of the proxy's configuration to the path of an image request: SOURCE_HOST_ALIASES,
+// QUALITY_DEFAULTS, MIN_QUALITY, FORCE_STRIP_METADATA, IDENTITY_POLICY, MAX_PIXELS and MAX_OUTPUT_DIMENSION, in that order.
+// Image requests, generations and the admin endpoints all key their paths after it, so they agree on the stored image.
+// The rewrites depending on the client's headers come first, the quality default depends on the negotiated format
+func (s *server) rewriteImagePath(r *http.Request) error {
+	for _, rewrite := range []struct {
+		rule  string
+		apply func(*http.Request) error
+	}{
+		{"source alias", s.applySourceAlias},
+		{"quality default", s.applyQualityDefault},
+		{"quality floor", s.applyQualityFloor},
+		{"metadata stripping", s.applyStripMetadata},
+		{"identity transform", s.applyIdentityPolicy},
+		{"oversize request", s.applyDimensionLimit},
+	} {
+		if err := rewrite.apply(r); err != nil {
+			return &rewriteError{rule: rewrite.rule, err: err}
+		}
+	}
+	return nil
+}
+
+// rewrittenPath is rewriteImagePath for a path requested without a client, by a generation or an admin endpoint
+func (s *server) rewrittenPath(ctx context.Context, path string) (string, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := setRequestPath(r, path); err != nil {
+		return "", err
+	}
+	if err := s.rewriteImagePath(r); err != nil {
+		return "", err
+	}
+	return requestPath(r.URL), nil
+}
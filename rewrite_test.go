@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewriteResignsOnlyValidPaths(t *testing.T) {
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	srv := &server{signatures: newSignatureVerifier(Config{ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32})}
+	addWidth := func(p *imgproxyPath) bool {
+		p.Options = append(p.Options, "w:100")
+		return true
+	}
+	rewrite := func(path string, rewrite func(*imgproxyPath) bool) (string, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if err := setRequestPath(r, path); err != nil {
+			t.Fatal(err)
+		}
+		err := srv.rewritePath(r, rewrite)
+		return requestPath(r.URL), err
+	}
+
+	path := "/rs:fit:300:300/plain/https://example.com/cat.jpg"
+	rewritten, err := rewrite(sign(key, salt, path), addWidth)
+	if err != nil {
+		t.Fatalf("Expected the signed path to be rewritten, got %v", err)
+	}
+	if want := sign(key, salt, "/rs:fit:300:300/w:100/plain/https://example.com/cat.jpg"); rewritten != want {
+		t.Fatalf("Expected %q, got %q", want, rewritten)
+	}
+
+	if _, err := rewrite("/_"+path, addWidth); err != errInvalidSignature {
+		t.Fatalf("Expected a forged path not to be signed again, got %v", err)
+	}
+
+	unchanged, err := rewrite("/_"+path, func(*imgproxyPath) bool { return false })
+	if err != nil || unchanged != "/_"+path {
+		t.Fatalf("Expected a path the rewrite leaves alone to be kept as is, got %q, %v", unchanged, err)
+	}
+}
+
+func TestGenerationsAreRewrittenLikeRequests(t *testing.T) {
+	cfg := Config{QualityDefaults: map[string]int{"webp": 75}, MinQuality: 40, MaxPixels: 1_000_000}
+	srv, _, store := newTestServer(t, cfg, imgproxyStub())
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	if _, err := srv.processAndStore(context.Background(), "/_/w:300"+source+"@webp"); err != nil {
+		t.Fatalf("Failed to generate the image: %v", err)
+	}
+	if _, ok := store.get(GenerateS3Key("/_/w:300/q:75" + source + "@webp")); !ok {
+		t.Fatal("Expected the generated image to be stored under the key of the path with the default quality")
+	}
+
+	if _, err := srv.processAndStore(context.Background(), "/_/w:300/q:10"+source+"@png"); err != nil {
+		t.Fatalf("Failed to generate the image: %v", err)
+	}
+	if _, ok := store.get(GenerateS3Key("/_/w:300/q:40" + source + "@png")); !ok {
+		t.Fatal("Expected the generated image to be stored under the key of the path with the quality floor")
+	}
+
+	status, err := srv.processAndStore(context.Background(), "/_/rs:fit:2000:2000"+source)
+	if !errors.Is(err, errTooManyPixels) || status != http.StatusBadRequest {
+		t.Fatalf("Expected a generation above MAX_PIXELS to be rejected, got %d (%v)", status, err)
+	}
+}
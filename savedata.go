@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// applySaveData rewrites the path of a request carrying Save-Data: on to request the SAVE_DATA_QUALITY
+// quality in place of its own, so data-saver clients get a lighter image cached under its own key.
+// A path already asking for that quality or a lower one is left as is
+func (s *server) applySaveData(r *http.Request, w http.ResponseWriter) error {
+	if s.cfg.SaveDataQuality == 0 {
+		return nil
+	}
+	w.Header().Add("Vary", "Save-Data")
+
+	if !saveData(r.Header) {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		if maxQuality(*p) <= s.cfg.SaveDataQuality {
+			return false
+		}
+		p.Options = slices.DeleteFunc(p.Options, func(o string) bool {
+			name, _, _ := strings.Cut(o, ":")
+			return slices.Contains(qualityOptions, name)
+		})
+		p.Options = append(p.Options, fmt.Sprintf("q:%d", s.cfg.SaveDataQuality))
+		return true
+	})
+}
+
+// saveData tells whether the client asked for reduced data usage, the only value of the hint being on
+func saveData(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Save-Data")), "on")
+}
+
+// maxQuality returns the highest quality a path may produce, 100 when it doesn't set one or sets
+// per format qualities, which imgproxy may apply in place of its q option
+func maxQuality(p imgproxyPath) int {
+	quality := 0
+	for _, o := range p.Options {
+		name, value, _ := strings.Cut(o, ":")
+		switch name {
+		case "q", "quality":
+			q, err := strconv.Atoi(value)
+			if err != nil || q < 1 {
+				return 100
+			}
+			quality = max(quality, q)
+		case "fq", "format_quality":
+			return 100
+		}
+	}
+	if quality == 0 {
+		return 100
+	}
+	return quality
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func getWithSaveData(t *testing.T, requestURL, saveData string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, requestURL, nil)
+	if saveData != "" {
+		req.Header.Set("Save-Data", saveData)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSaveDataRequestsGetALowerQualityVariant(t *testing.T) {
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[requestPath(r.URL)] = true
+		mu.Unlock()
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{SaveDataQuality: 40}, stub)
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	normal := getWithSaveData(t, proxy.URL+"/_/w:300/q:80"+source, "")
+	saver := getWithSaveData(t, proxy.URL+"/_/w:300/q:80"+source, "On")
+	for _, resp := range []*http.Response{normal, saver} {
+		if resp.Header.Get("Vary") != "Save-Data" {
+			t.Errorf("Expected the response to vary on Save-Data, got %q", resp.Header.Get("Vary"))
+		}
+	}
+	srv.uploads.Wait()
+
+	if !requested["/_/w:300/q:80"+source] || !requested["/_/w:300/q:40"+source] {
+		t.Fatalf("Expected imgproxy to process both qualities, got %v", requested)
+	}
+	if _, ok := store.get(GenerateS3Key("/_/w:300/q:40" + source)); !ok {
+		t.Fatal("Expected the data saver variant to be stored under its own key")
+	}
+	if store.len() != 2 {
+		t.Fatalf("Expected 2 stored variants, found %d", store.len())
+	}
+
+	if resp := getWithSaveData(t, proxy.URL+"/_/w:300/q:80"+source, "on"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected another data saver request to hit its variant, got %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestSaveDataQualityRewrites(t *testing.T) {
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	tests := []struct {
+		name, path, want string
+	}{
+		{"quality added", "/_/w:300" + source, "/_/w:300/q:40" + source},
+		{"higher quality lowered", "/_/quality:90/w:300" + source, "/_/w:300/q:40" + source},
+		{"format quality replaced", "/_/fq:webp:80/w:300" + source + "@webp", "/_/w:300/q:40" + source + "@webp"},
+		{"lower quality kept", "/_/w:300/q:30" + source, "/_/w:300/q:30" + source},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested string
+			stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = requestPath(r.URL)
+				w.Write([]byte("image"))
+			})
+			srv, proxy, _ := newTestServer(t, Config{SaveDataQuality: 40}, stub)
+			getWithSaveData(t, proxy.URL+tt.path, "on")
+			srv.uploads.Wait()
+			if requested != tt.want {
+				t.Fatalf("Expected imgproxy to get %s, got %s", tt.want, requested)
+			}
+		})
+	}
+}
+
+func TestSaveDataIsIgnoredByDefault(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	path := "/_/w:300/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	if resp := getWithSaveData(t, proxy.URL+path, "on"); resp.Header.Get("Vary") != "" {
+		t.Fatalf("Expected no Vary without SAVE_DATA_QUALITY, got %q", resp.Header.Get("Vary"))
+	}
+	srv.uploads.Wait()
+	if _, ok := store.get(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the path to be cached as requested")
+	}
+}
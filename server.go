@@ -0,0 +1,978 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stages of an image request, used to attribute failures
+const (
+	stageS3Read     = "s3_read"
+	stageProcessing = "processing"
+	stageS3Write    = "s3_write"
+)
+
+// The REQUEST_TIMEOUT budget is split across the stages: the S3 read gets a fifth of it
+// so a slow lookup still leaves time for processing, which gets whatever remains.
+// The S3 write happens after the response is sent, so it gets its own deadline
+const (
+	s3ReadBudgetDivisor  = 5
+	s3WriteBudgetDivisor = 2
+)
+
+// stageError records which stage of a request failed
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s stage failed: %v", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+type server struct {
+	// cfg is the startup configuration, the reloadable settings are read from sources, admission and cacheMode
+	cfg        Config
+	keys       keyScheme
+	store      CacheStore
+	sources    *sourcePolicy
+	tenants    *tenantResolver
+	signatures *signatureVerifier
+	access     *accessLogger
+	audit      *auditLogger
+	// sourceCircuit fails the misses of a source host fast once its PREVALIDATE_SOURCE preflights kept failing
+	sourceCircuit *sourceCircuit
+	// generations deduplicates the images generated by HEAD requests and srcset prefetches
+	generations *generations
+	// hook transforms processed images, it must be set before serving
+	hook     ResponseHook
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+	client   *http.Client
+	// hedge sends the slow requests to HEDGE_IMGPROXY_URL too, nil when it isn't set
+	hedge *hedgedTransport
+	// health probes imgproxy for /readyz
+	health *http.Client
+
+	// copyBuffers holds the COPY_BUFFER_SIZE buffers used to stream cached images
+	copyBuffers sync.Pool
+	// responseBuffers holds the RESPONSE_BUFFER_SIZE writers coalescing the writes of cached images
+	responseBuffers sync.Pool
+
+	// admission is swapped when the configuration is reloaded, admitted requests release their own queue
+	admission atomic.Pointer[admissionQueue]
+	// cacheMode is the CACHE_MODE, swapped when the configuration is reloaded
+	cacheMode atomic.Pointer[string]
+
+	// maintenance makes image requests answer 503, it starts as MAINTENANCE_MODE
+	maintenance atomic.Bool
+	// writeVerifyFailures counts the uploads failing VERIFY_AFTER_WRITE
+	writeVerifyFailures atomic.Int64
+	// probeDuration and probeSuccess are the results of the last synthetic probe
+	probeDuration gauge
+	probeSuccess  gauge
+	// cacheObjects, cacheBytes and cacheSizeScanned are the results of the last cache size scan
+	cacheObjects     gauge
+	cacheBytes       gauge
+	cacheSizeScanned gauge
+	// compacted and compactionSaved count the images re-encoded to COMPACT_FORMAT and the bytes it saved
+	compacted       atomic.Int64
+	compactionSaved atomic.Int64
+
+	// draining makes /healthz fail ahead of a shutdown, images are still served
+	draining atomic.Bool
+
+	// uploads tracks the background uploads still in flight
+	uploads sync.WaitGroup
+	// spool persists the background uploads with UPLOAD_SPOOL_DIR, nil otherwise
+	spool *uploadSpool
+	// warmSource lists WARM_SOURCE_BUCKET for bucket warmups, nil when it isn't set
+	warmSource objectLister
+	// newKeys caps the keys created per minute with MAX_NEW_KEYS_PER_MINUTE, nil when it isn't set
+	newKeys *newKeyGuard
+	// newKeysOverLimit counts the misses over MAX_NEW_KEYS_PER_MINUTE
+	newKeysOverLimit atomic.Int64
+	// tenantLimits enforces TENANT_LIMITS, nil when it isn't set
+	tenantLimits *tenantLimiter
+	// keyLocks coordinates the purges and reads of a key with PURGE_LOCKS, nil otherwise
+	keyLocks *keyLocks
+	// uploadFlights runs a single upload per key at a time with UPLOAD_DEDUP, nil otherwise
+	uploadFlights *uploadFlights
+	// prefetchSlots bounds the srcset prefetches running at once to SRCSET_PREFETCH_CONCURRENCY
+	prefetchSlots chan struct{}
+}
+
+func newServer(cfg Config, store CacheStore, upstream *url.URL) *server {
+	s := &server{
+		cfg:        cfg,
+		keys:       newKeyScheme(cfg),
+		store:      store,
+		sources:    newSourcePolicy(cfg),
+		tenants:    newTenantResolver(cfg),
+		signatures: newSignatureVerifier(cfg),
+		access:     newAccessLogger(cfg.LogFormat, cfg.TrustedProxies, os.Stdout),
+		audit:      newAuditLogger(os.Stdout),
+		hook:       noopHook{},
+		upstream:   upstream,
+		client:     &http.Client{},
+		health:     newHealthClient(cfg, nil),
+	}
+
+	s.generations = newGenerations(&s.uploads)
+	s.sourceCircuit = newSourceCircuit(cfg.PrevalidateSourceFailures, cfg.PrevalidateSourceCooldown)
+	s.prefetchSlots = make(chan struct{}, cfg.SrcsetPrefetchConcurrency)
+	if cfg.PurgeLocks {
+		s.keyLocks = newKeyLocks()
+	}
+	if cfg.UploadDedup {
+		s.uploadFlights = newUploadFlights()
+	}
+	if cfg.MaxNewKeysPerMinute > 0 {
+		s.newKeys = newNewKeyGuard(cfg.MaxNewKeysPerMinute)
+	}
+	s.tenantLimits = newTenantLimiter(cfg.TenantLimits)
+	s.admission.Store(newAdmissionQueue(cfg))
+	s.cacheMode.Store(&cfg.CacheMode)
+	s.maintenance.Store(cfg.MaintenanceMode)
+	s.copyBuffers.New = func() any {
+		buf := make([]byte, cfg.CopyBufferSize)
+		return &buf
+	}
+	s.responseBuffers.New = func() any {
+		return bufio.NewWriterSize(nil, cfg.ResponseBufferSize)
+	}
+
+	s.proxy = httputil.NewSingleHostReverseProxy(upstream)
+	s.proxy.ModifyResponse = s.modifyResponse
+	s.proxy.ErrorHandler = s.proxyError
+	s.proxy.Transport = s.hedged(http.DefaultTransport)
+	s.client.Transport = s.proxy.Transport
+
+	return s
+}
+
+// setAccessLogOutput sends the access log to out, such as stdout along with ACCESS_LOG_FILE.
+// It must be set before serving
+func (s *server) setAccessLogOutput(out io.Writer) {
+	s.access = newAccessLogger(s.cfg.LogFormat, s.cfg.TrustedProxies, out)
+}
+
+// setUpstreamTransport makes the requests to imgproxy go through the given transport,
+// such as one trusting UPSTREAM_CA_FILE. It must be set before serving
+func (s *server) setUpstreamTransport(transport http.RoundTripper) {
+	// Health checks probe imgproxy itself, they're never hedged
+	s.health.Transport = transport
+	s.proxy.Transport = s.hedged(transport)
+	s.client.Transport = s.proxy.Transport
+}
+
+func (s *server) handler() http.Handler {
+	// Health checks and global admin routes don't belong to a tenant
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+	scoped := http.NewServeMux()
+	for _, route := range s.adminRoutes() {
+		handler := s.adminAuth(route)
+		if !route.stream {
+			handler = withRouteTimeout(s.cfg.AdminTimeout, handler)
+		}
+		handler = s.audited(route, handler)
+		if route.global {
+			mux.Handle(route.method+" "+route.path, handler)
+			continue
+		}
+		scoped.Handle(route.method+" "+route.path, handler)
+	}
+	scoped.HandleFunc("POST /sprite", s.handleSprite)
+	scoped.HandleFunc("/", s.handleImage)
+	mux.Handle("/", s.tenants.middleware(scoped))
+
+	// Image paths skip the mux, whose path cleaning would merge the slashes of plain source URLs
+	images := s.tenants.middleware(http.HandlerFunc(s.handleImage))
+	routes := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReservedPath(r.URL.Path) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		images.ServeHTTP(w, r)
+	})
+	return s.access.middleware(serverTimingMiddleware(routes))
+}
+
+// isReservedPath reports whether a path is one of the proxy's own endpoints rather than an imgproxy path
+func isReservedPath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics" || path == "/sprite" || strings.HasPrefix(path, "/admin/")
+}
+
+// handleHealthz reports that the proxy is alive, including during maintenance, until it's drained
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleImage serves the processed image from the cache when available, from imgproxy otherwise
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	s.setClientHints(w)
+	s.setTimingAllowOrigin(w, r)
+	if r.Method == http.MethodOptions {
+		s.handleImageOptions(w, r)
+		return
+	}
+	if s.inMaintenance(w) {
+		return
+	}
+	if !s.admitTenant(w, r) {
+		return
+	}
+	if s.tenantLimits != nil {
+		tenant, rec := tenantFrom(r.Context()), &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() { s.tenantLimits.record(tenant, 0, rec.bytes, time.Now()) }()
+		w = rec
+	}
+	release, ok := s.admitted(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	if s.cfg.StrictPathDecoding {
+		if err := s.applyStrictPath(r); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, errMalformedPath) {
+				status = http.StatusBadRequest
+			}
+			slog.Warn("Rejected path encoding", "path", r.URL.EscapedPath(), "error", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	path := requestPath(r.URL)
+	cleaned, err := s.cleanPath(path)
+	if err != nil {
+		slog.Warn("Rejected signature", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s.linkCanonical(w, path, cleaned)
+	if cleaned != path {
+		if err := setRequestPath(r, cleaned); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		path = cleaned
+	}
+
+	if err := s.applyLQIP(r); err != nil {
+		slog.Warn("Rejected placeholder request", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.applyWidthHint(r, w); err != nil {
+		slog.Warn("Rejected width hint", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.applyFormatNegotiation(r, w); err != nil {
+		slog.Warn("Rejected format negotiation", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.applyLegacyDowngrade(r, w); err != nil {
+		slog.Warn("Rejected legacy downgrade", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.applySaveData(r, w); err != nil {
+		slog.Warn("Rejected data saver quality", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.rewriteImagePath(r); err != nil {
+		rewriteErr := err.(*rewriteError)
+		slog.Warn("Rejected "+rewriteErr.rule, "path", path, "error", err)
+		http.Error(w, err.Error(), rewriteErr.status())
+		return
+	}
+	path = requestPath(r.URL)
+
+	if err := s.sources.checkHost(path); err != nil {
+		slog.Warn("Rejected source", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Signed and insecure forms share their keys, so the signature must be checked before a cache hit bypasses imgproxy
+	if s.keys.sharesKeysAcrossSignatures() {
+		if err := s.signatures.verify(path); err != nil {
+			slog.Warn("Rejected signature", "path", path, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	r, err = s.applyDownload(r, w)
+	if err != nil {
+		slog.Warn("Rejected download", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r = s.applyQueryPolicy(r)
+	r = s.applyAcceptPolicy(r, w)
+	s.exposeTransform(w, r)
+
+	if !s.cacheControl(r.Header).skipRead() {
+		var served bool
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			served, err = s.serveCached(w, r)
+		case http.MethodHead:
+			served, err = s.serveHead(w, r)
+		}
+		if err != nil {
+			slog.Warn("Cache lookup failed, processing the image instead", "path", path, "stage", stageS3Read, "error", err)
+		}
+		if served {
+			return
+		}
+	}
+
+	if s.serveMiss(w, r) {
+		return
+	}
+	if s.rejectOverStorage(w, r) {
+		return
+	}
+
+	r, ok = s.admitNewKey(w, r)
+	if !ok {
+		return
+	}
+
+	// The source is probed before imgproxy checks the signature, a forged path must not reach it
+	if err := s.signatures.verify(path); err != nil {
+		slog.Warn("Rejected signature", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.sources.checkRedirects(ctx, path); err != nil {
+		slog.Warn("Rejected source", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if status, err := s.preflightSource(ctx, path); err != nil {
+		slog.Warn("Source failed its preflight", "path", path, "status", status, "error", err)
+		s.rejectSource(w, r, status, err)
+		return
+	}
+
+	if s.servePassthrough(w, r, requestPath(r.URL)) {
+		return
+	}
+	r, err = s.applyAnimatedPolicy(r)
+	if err != nil {
+		slog.Warn("Rejected animated source", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	timingFrom(ctx).upstreamStart = time.Now()
+	s.proxy.ServeHTTP(w, r)
+}
+
+// cleanPath removes the duplicate and trailing slashes of a path when NORMALIZE_PATH_SLASHES is set.
+// The cleaned path is signed again, so the original signature is verified first
+func (s *server) cleanPath(path string) (string, error) {
+	cleaned := s.keys.cleanPath(path)
+	if cleaned == path {
+		return path, nil
+	}
+	if err := s.signatures.verify(path); err != nil {
+		return "", err
+	}
+	return cleaned, nil
+}
+
+// serveCached writes the cached image if there is one
+func (s *server) serveCached(w http.ResponseWriter, r *http.Request) (bool, error) {
+	// The object found is streamed in full before a purge can remove it, a purge in flight is waited
+	// for outside of the S3 read budget
+	key := s.cacheKey(r.Context(), requestPath(r.URL))
+	unlock, err := s.lockRead(r.Context(), key)
+	if err != nil {
+		return false, &stageError{stage: stageS3Read, err: err}
+	}
+	defer unlock()
+
+	// Only waiting for the object is bounded by the S3 read budget,
+	// streaming its body may use the rest of the request budget
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	timer := time.AfterFunc(s.cfg.RequestTimeout/s3ReadBudgetDivisor, func() {
+		cancel(context.DeadlineExceeded)
+	})
+
+	lookupStart := time.Now()
+	var obj *CachedObject
+	var unsatisfiable bool
+	if byteRange, ok := s.requestedByteRange(r); ok {
+		obj, unsatisfiable, err = s.getCachedRange(ctx, key, byteRange, r.Header.Get("If-Range"))
+	} else {
+		obj, err = s.store.Get(ctx, key)
+	}
+	timer.Stop()
+	timingFrom(ctx).cache = time.Since(lookupStart)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+		}
+		return false, &stageError{stage: stageS3Read, err: err}
+	}
+	defer obj.Body.Close()
+	if !obj.Stale && s.expired(obj.ObjectMeta, obj.LastModified) {
+		return false, nil
+	}
+
+	if obj.Stale {
+		w.Header().Set("X-Cache", "STALE")
+	} else {
+		w.Header().Set("X-Cache", "HIT")
+	}
+	if s.cfg.RangeRequests && obj.Status == 0 {
+		w.Header().Set("Accept-Ranges", "bytes")
+		s.setValidators(w, obj.ObjectMeta, obj.LastModified)
+	}
+	if unsatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.ContentLength))
+		http.Error(w, errRangeNotSatisfiable.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentLength > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.ContentLength, 10))
+	}
+	if obj.ContentRange != "" {
+		w.Header().Set("Content-Range", obj.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(obj.status())
+	}
+
+	out, flush := s.bufferResponse(w)
+	_, err = s.copyBody(out, obj.Body)
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		slog.Error("Failed to stream cached image", "path", requestPath(r.URL), "error", err)
+	}
+	return true, nil
+}
+
+// serveHead answers a HEAD with the metadata of the cached image, without fetching it.
+// On a miss, it answers 404 unless HEAD_TRIGGERS_GENERATE is set, in which case the image is
+// generated and stored so that the following GET is a hit. The HEAD waits for the generation
+// to answer with its headers, keeping its admission slot, and concurrent HEADs share it
+func (s *server) serveHead(w http.ResponseWriter, r *http.Request) (bool, error) {
+	path := requestPath(r.URL)
+	key := s.cacheKey(r.Context(), path)
+	lookupStart := time.Now()
+	info, err := s.headCached(r.Context(), key)
+	timingFrom(r.Context()).cache = time.Since(lookupStart)
+	if err == nil && s.expired(info.ObjectMeta, info.LastModified) {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.Header().Set("X-Cache", "MISS")
+		if !s.cfg.HeadTriggersGenerate || s.cacheControl(r.Header).skipWrite() {
+			w.WriteHeader(http.StatusNotFound)
+			return true, nil
+		}
+		s.headAfterGeneration(w, r, key, path)
+		return true, nil
+	}
+	if err != nil {
+		return false, &stageError{stage: stageS3Read, err: err}
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("X-Cache", "HIT")
+	if s.cfg.RangeRequests && info.Status == 0 {
+		w.Header().Set("Accept-Ranges", "bytes")
+		s.setValidators(w, info.ObjectMeta, info.LastModified)
+	}
+	w.WriteHeader(info.status())
+	return true, nil
+}
+
+// headAfterGeneration generates the image of a HEAD miss, or joins its generation in flight,
+// and answers with the headers of the stored image
+func (s *server) headAfterGeneration(w http.ResponseWriter, r *http.Request, key, path string) {
+	gen := s.generations.do(key, func() (int, error) {
+		status, err := s.processAndStore(context.WithoutCancel(r.Context()), path)
+		if err != nil {
+			slog.Error("Generation triggered by HEAD failed", "path", path, "error", err)
+		}
+		return status, err
+	})
+
+	select {
+	case <-gen.done:
+	case <-r.Context().Done():
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if gen.err != nil && gen.status != http.StatusOK {
+		w.WriteHeader(cmp.Or(gen.status, http.StatusBadGateway))
+		return
+	}
+
+	// Images that weren't stored, below MIN_CACHE_BYTES for instance, have no headers to report
+	if info, err := s.headCached(r.Context(), key); err == nil {
+		setObjectHeaders(w, info)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// headCached gets the metadata of a cached image within the S3 read budget
+func (s *server) headCached(ctx context.Context, key string) (*ObjectInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout/s3ReadBudgetDivisor)
+	defer cancel()
+	return s.store.Head(ctx, key)
+}
+
+func setObjectHeaders(w http.ResponseWriter, info *ObjectInfo) {
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+}
+
+// copyBody streams a cached image through a COPY_BUFFER_SIZE buffer.
+// Both ends are wrapped so that the buffer is used rather than their own ReadFrom or WriteTo
+func (s *server) copyBody(w io.Writer, r io.Reader) (int64, error) {
+	buf := s.copyBuffers.Get().(*[]byte)
+	defer s.copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *buf)
+}
+
+// bufferResponse coalesces the small writes of a cached image into RESPONSE_BUFFER_SIZE writes.
+// flush must be called once the body is copied, whether it failed or not, it hands the buffer back
+func (s *server) bufferResponse(w io.Writer) (out io.Writer, flush func() error) {
+	if s.cfg.ResponseBufferSize == 0 {
+		return w, func() error { return nil }
+	}
+
+	buf := s.responseBuffers.Get().(*bufio.Writer)
+	buf.Reset(w)
+	return buf, func() error {
+		defer s.responseBuffers.Put(buf)
+		err := buf.Flush()
+		buf.Reset(nil)
+		return err
+	}
+}
+
+func (s *server) modifyResponse(resp *http.Response) error {
+	// The attachment disposition of a download is already set on the response
+	if isDownload(resp.Request.Context()) {
+		resp.Header.Del("Content-Disposition")
+	}
+
+	// HEAD responses proxied when the cache can't be used have no body to store
+	if resp.Request.Method != http.MethodGet {
+		return nil
+	}
+
+	// The fallback image is cached under the path of the format actually produced
+	path := keyPath(resp.Request.Context(), requestPath(resp.Request.URL))
+	if isFallbackStatus(resp.StatusCode) {
+		if fallbackPath, fallback, ok := s.fetchFallback(resp.Request.Context(), path); ok {
+			replaceWithFallback(resp, fallback)
+			path = fallbackPath
+		}
+	}
+	if isFallbackStatus(resp.StatusCode) && s.cfg.SourceFallback && s.serveSourceFallback(resp, path) {
+		return nil
+	}
+	if !s.cachesStatus(resp.StatusCode) {
+		return nil
+	}
+	// Read the entire response body into a buffer
+	bodyBytes, err := readFullBody(resp)
+	if err != nil {
+		slog.Error("Failed to read response body", "path", requestPath(resp.Request.URL), "error", err)
+		return err
+	}
+
+	encoded := bodyBytes
+	bodyBytes, err = decodeContent(resp.Header, bodyBytes)
+	if errors.Is(err, errUnsupportedEncoding) {
+		// Served as imgproxy sent it, but caching it without its encoding would corrupt it
+		slog.Warn("Not caching a response with an unsupported encoding", "path", path, "error", err)
+		resp.Body = io.NopCloser(bytes.NewReader(encoded))
+		return nil
+	}
+	if err != nil {
+		slog.Error("Failed to decode response body", "path", path, "error", err)
+		return err
+	}
+
+	meta := ObjectMeta{ContentType: resp.Header.Get("Content-Type")}
+	// Errors cached with TTL_BY_STATUS aren't images, they're stored as imgproxy sent them
+	if resp.StatusCode != http.StatusOK {
+		meta.Status = resp.StatusCode
+	} else if bodyBytes, meta, err = s.hook.Transform(resp.Request.Context(), path, bodyBytes, meta); err != nil {
+		slog.Error("Response hook failed", "path", path, "error", err)
+		return err
+	}
+
+	// Replace the response body with our buffered, transformed copy
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	resp.ContentLength = int64(len(bodyBytes))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	if meta.ContentType != "" {
+		resp.Header.Set("Content-Type", meta.ContentType)
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	meta = s.animatedMeta(isAnimatedRequest(resp.Request.Context()), meta)
+
+	// The outgoing request carries the client headers
+	if s.skipStore(resp.Request) {
+		return nil
+	}
+
+	s.storeInBackground(resp.Request.Context(), path, bodyBytes, meta)
+
+	if meta.Status == 0 {
+		s.prefetchSiblings(context.WithoutCancel(resp.Request.Context()), path)
+	}
+
+	if len(s.cfg.PregenerateFormats) > 0 && meta.Status == 0 {
+		s.uploads.Add(1)
+		go func() {
+			defer s.uploads.Done()
+			s.pregenerate(context.WithoutCancel(resp.Request.Context()), path, formatFromContentType(meta.ContentType))
+		}()
+	}
+
+	return nil
+}
+
+// proxyError answers with 504 when imgproxy ran out of time, 502 for any other failure
+func (s *server) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+
+	err = &stageError{stage: stageProcessing, err: err}
+	slog.Error("imgproxy request failed", "path", requestPath(r.URL), "stage", stageProcessing, "status", status, "error", err)
+	http.Error(w, err.Error(), status)
+}
+
+// pregenerate processes and stores the same path in the other PREGENERATE_FORMATS,
+// so that clients falling back to another format find it already cached
+func (s *server) pregenerate(ctx context.Context, path, servedFormat string) {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		slog.Warn("Skipping pregeneration of an unparsable path", "path", path, "error", err)
+		return
+	}
+
+	requested := p.Format()
+	if requested == "" {
+		requested = servedFormat
+	}
+
+	for _, format := range s.cfg.PregenerateFormats {
+		if format == requested {
+			continue
+		}
+
+		variant := p.WithFormat(format).String()
+		if _, err := s.processAndStore(ctx, variant); err != nil {
+			slog.Error("Pregeneration failed", "path", variant, "error", err)
+		}
+	}
+}
+
+// processAndStore requests a path from imgproxy and stores the result, within the request budget.
+// It returns the status imgproxy responded with, if any
+func (s *server) processAndStore(ctx context.Context, path string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	if s.cfg.StrictPathDecoding {
+		strict, err := s.strictPath(path)
+		if errors.Is(err, errMalformedPath) {
+			return http.StatusBadRequest, err
+		}
+		if err != nil {
+			return http.StatusForbidden, err
+		}
+		path = strict
+	}
+	path, err := s.cleanPath(path)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	// The path is keyed as the one of an image request without client hints
+	if path, err = s.rewrittenPath(ctx, path); err != nil {
+		var rewriteErr *rewriteError
+		if errors.As(err, &rewriteErr) {
+			return rewriteErr.status(), err
+		}
+		return http.StatusBadRequest, err
+	}
+	if err := s.sources.checkHost(path); err != nil {
+		return http.StatusForbidden, err
+	}
+	// The source is probed before imgproxy checks the signature, a forged path must not reach it
+	if err := s.signatures.verify(path); err != nil {
+		return http.StatusForbidden, err
+	}
+	if err := s.sources.checkRedirects(ctx, path); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	if status, err := s.preflightSource(ctx, path); err != nil {
+		return status, err
+	}
+
+	if source, ok := s.passthroughSource(ctx, path); ok {
+		return http.StatusOK, s.storeProcessed(ctx, path, source.body, ObjectMeta{ContentType: source.contentType})
+	}
+
+	processed, animated, err := s.animatedPath(ctx, path)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	resp, err := s.fetchUpstream(ctx, processed)
+	if err != nil {
+		return 0, &stageError{stage: stageProcessing, err: err}
+	}
+	if isFallbackStatus(resp.status) {
+		if fallbackPath, fallback, ok := s.fetchFallback(ctx, path); ok {
+			path, resp = fallbackPath, fallback
+		}
+	}
+	if resp.status != http.StatusOK {
+		return resp.status, &stageError{stage: stageProcessing, err: fmt.Errorf("imgproxy responded with status %d", resp.status)}
+	}
+
+	body, meta, err := s.hook.Transform(ctx, path, resp.body, ObjectMeta{ContentType: resp.contentType})
+	if err != nil {
+		return resp.status, &stageError{stage: stageProcessing, err: fmt.Errorf("response hook failed: %w", err)}
+	}
+
+	return resp.status, s.storeProcessed(ctx, path, body, s.animatedMeta(animated, meta))
+}
+
+// storeInBackground stores a processed image without holding the response, within the S3 write budget.
+// The upload outlives the request, only the values of its context are kept
+func (s *server) storeInBackground(ctx context.Context, path string, body []byte, meta ObjectMeta) {
+	s.storeKeyInBackground(ctx, s.cacheKey(ctx, path), path, body, meta)
+}
+
+// storeKeyInBackground stores an image under a key already derived, as storeInBackground does
+func (s *server) storeKeyInBackground(ctx context.Context, key, path string, body []byte, meta ObjectMeta) {
+	id := s.spoolUpload(key, path, body, meta)
+
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.RequestTimeout/s3WriteBudgetDivisor)
+		defer cancel()
+
+		err := s.storeObject(ctx, key, path, body, meta)
+		if err != nil {
+			slog.Error("S3 upload failed", "error", err)
+		}
+		s.finishSpooled(id, err)
+	}()
+}
+
+// storeProcessed persists an image processed by imgproxy under the key derived from its path.
+// Images smaller than MIN_CACHE_BYTES are cheaper to regenerate than to store, they are skipped,
+// and so are images inflated beyond MAX_OUTPUT_SIZE_RATIO, pinned images and images already stored
+// with the same content by a retry or another instance. With VERIFY_AFTER_WRITE, the upload is checked once done.
+// Errors cached with TTL_BY_STATUS skip the size checks, they aren't images
+func (s *server) storeProcessed(ctx context.Context, path string, body []byte, meta ObjectMeta) error {
+	return s.storeObject(ctx, s.cacheKey(ctx, path), path, body, meta)
+}
+
+// storeObject stores an image under a key already derived from its path, as storeProcessed does
+func (s *server) storeObject(ctx context.Context, key, path string, body []byte, meta ObjectMeta) error {
+	if meta.Status == 0 && len(body) < s.cfg.MinCacheBytes {
+		slog.Debug("Image below MIN_CACHE_BYTES, not storing it", "path", path, "key", key, "size", len(body))
+		return nil
+	}
+	if meta.Status == 0 && s.exceedsSourceSize(ctx, path, len(body)) {
+		slog.Warn("Image larger than its source beyond MAX_OUTPUT_SIZE_RATIO, not storing it", "path", path, "key", key, "size", len(body))
+		return nil
+	}
+
+	if s.tenantLimits.overStorage(tenantFrom(ctx), time.Now(), false) {
+		slog.Warn("Tenant over its monthly storage quota, not storing the image", "tenant", tenantFrom(ctx), "path", path, "key", key)
+		return nil
+	}
+
+	if s.cfg.StoreSourceMetadata {
+		meta.SourceURL, meta.Options, meta.Format = sourceMetadata(path)
+	}
+	return s.dedupUpload(ctx, key, func() error { return s.uploadObject(ctx, key, path, body, meta) })
+}
+
+// uploadObject uploads an image unless it's pinned or already stored, and verifies the upload with VERIFY_AFTER_WRITE
+func (s *server) uploadObject(ctx context.Context, key, path string, body []byte, meta ObjectMeta) error {
+	hash := sha256.Sum256(body)
+	meta.ContentHash = hex.EncodeToString(hash[:])
+	meta = s.withContentMD5(meta, body)
+	if info, err := s.store.Head(ctx, key); err == nil {
+		if info.Pinned {
+			slog.Debug("Image pinned, keeping the stored one", "path", path, "key", key)
+			return nil
+		}
+		// An expired image is uploaded again even when identical, to reset its age
+		if info.ContentHash == meta.ContentHash && !s.expired(info.ObjectMeta, info.LastModified) {
+			slog.Debug("Identical image already stored, skipping the upload", "path", path, "key", key)
+			return nil
+		}
+	}
+
+	if err := s.store.Put(ctx, key, bytes.NewReader(body), meta); err != nil {
+		slog.Error("Upload failed", "path", path, "key", key, "stage", stageS3Write, "error", err)
+		return &stageError{stage: stageS3Write, err: err}
+	}
+	if err := s.verifyWrite(ctx, key, len(body), meta.ContentHash); err != nil {
+		return err
+	}
+
+	s.tenantLimits.record(tenantFrom(ctx), int64(len(body)), 0, time.Now())
+	slog.Info("Uploaded to S3", "path", path, "key", key)
+	return nil
+}
+
+// upstreamResponse is a fully read imgproxy response
+type upstreamResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// fetchUpstream requests a path from imgproxy and reads the full response.
+// The query string of a request with QUERY_IN_KEY is forwarded too
+func (s *server) fetchUpstream(ctx context.Context, path string) (*upstreamResponse, error) {
+	target := s.upstream.String() + path
+	if query := queryFrom(ctx); query != "" {
+		target += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept := acceptFrom(ctx); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readFullBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	body, err = decodeContent(resp.Header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamResponse{
+		status:      resp.StatusCode,
+		contentType: resp.Header.Get("Content-Type"),
+		body:        body,
+	}, nil
+}
+
+var errTruncatedBody = errors.New("truncated imgproxy response")
+
+// readFullBody reads an imgproxy response, failing when the connection dropped before its end:
+// a truncated image must never be cached. Without a Content-Length, only a clean EOF ends the body
+func readFullBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errTruncatedBody, err)
+	}
+	if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+		return nil, fmt.Errorf("%w: read %d of %d bytes", errTruncatedBody, len(body), resp.ContentLength)
+	}
+	return body, nil
+}
+
+// requestPath returns the path as sent by the client.
+// RawPath is used when available since it preserves the URL encoding
+func requestPath(u *url.URL) string {
+	if u.RawPath != "" {
+		return u.RawPath
+	}
+	return u.Path
+}
+
+// setRequestPath replaces the path of a request rewritten by the proxy
+func setRequestPath(r *http.Request, path string) error {
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return err
+	}
+
+	// The URL is shared with the access log, which reports the requested path
+	u := *r.URL
+	u.Path, u.RawPath = unescaped, path
+	r.URL = &u
+	return nil
+}
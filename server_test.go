@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a proxy in front of the given imgproxy stub, backed by an in-memory store
+func newTestServer(t testing.TB, cfg Config, imgproxy http.Handler) (*server, *httptest.Server, *memoryStore) {
+	t.Helper()
+
+	store := newMemoryStore()
+	srv, proxy := newTestServerWithStore(t, cfg, imgproxy, store)
+	return srv, proxy, store
+}
+
+func newTestServerWithStore(t testing.TB, cfg Config, imgproxy http.Handler, store CacheStore) (*server, *httptest.Server) {
+	t.Helper()
+
+	upstream := httptest.NewServer(imgproxy)
+	t.Cleanup(upstream.Close)
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse upstream URL: %v", err)
+	}
+
+	if cfg.WarmConcurrency == 0 {
+		cfg.WarmConcurrency = 4
+	}
+	if cfg.SrcsetPrefetchConcurrency == 0 {
+		cfg.SrcsetPrefetchConcurrency = 2
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = 5 * time.Second
+	}
+	if cfg.AdminTimeout == 0 {
+		cfg.AdminTimeout = 5 * time.Second
+	}
+	if cfg.HealthCheckProbeTimeout == 0 {
+		cfg.HealthCheckProbeTimeout = 2 * time.Second
+	}
+	if cfg.CopyBufferSize == 0 {
+		cfg.CopyBufferSize = 32 * 1024
+	}
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = testAdminToken
+	}
+
+	srv := newServer(cfg, store, target)
+	proxy := httptest.NewServer(srv.handler())
+	t.Cleanup(proxy.Close)
+
+	return srv, proxy
+}
+
+// imgproxyStub answers every path with a body derived from it
+func imgproxyStub() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("processed:" + requestPath(r.URL)))
+	})
+}
+
+func TestProxyStoresProcessedImage(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp, err := http.Get(proxy.URL + path)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	srv.uploads.Wait()
+	stored, ok := store.get(GenerateS3Key(path))
+	if !ok {
+		t.Fatalf("Processed image not stored under %s", GenerateS3Key(path))
+	}
+	if !bytes.Equal(body, stored) {
+		t.Fatal("Stored image does not match response image")
+	}
+}
+
+func TestProxyDoesNotStoreErrors(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, http.NotFoundHandler())
+
+	resp, err := http.Get(proxy.URL + "/_/plain/" + url.QueryEscape("http://example.com/missing.jpg"))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", resp.StatusCode)
+	}
+
+	srv.uploads.Wait()
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
+
+func TestProxyPregeneratesOtherFormats(t *testing.T) {
+	formatStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := parseImgproxyPath(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/"+p.Format())
+		w.Write([]byte("processed:" + requestPath(r.URL)))
+	})
+	srv, proxy, store := newTestServer(t, Config{PregenerateFormats: []string{"webp", "jpg", "avif"}}, formatStub)
+
+	source := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp, err := http.Get(proxy.URL + source + "@webp")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+
+	srv.uploads.Wait()
+	for _, format := range []string{"webp", "jpg", "avif"} {
+		path := source + "@" + format
+		if _, ok := store.get(GenerateS3Key(path)); !ok {
+			t.Errorf("Variant %s not stored", format)
+		}
+	}
+	if store.len() != 3 {
+		t.Fatalf("Expected 3 stored variants, got %d", store.len())
+	}
+}
+
+func TestProxyServesCachedImage(t *testing.T) {
+	var calls atomic.Int32
+	countingStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		imgproxyStub().ServeHTTP(w, r)
+	})
+	srv, proxy, _ := newTestServer(t, Config{}, countingStub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	first := get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	second := get(t, proxy.URL+path)
+
+	if first.Header.Get("X-Cache") != "MISS" || second.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a miss then a hit, got %q then %q", first.Header.Get("X-Cache"), second.Header.Get("X-Cache"))
+	}
+	if second.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected the stored content type, got %q", second.Header.Get("Content-Type"))
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected imgproxy to be called once, got %d calls", calls.Load())
+	}
+}
+
+func TestStalledS3ReadLeavesTimeForProcessing(t *testing.T) {
+	store := &stallingStore{}
+	_, proxy := newTestServerWithStore(t, Config{RequestTimeout: 500 * time.Millisecond}, imgproxyStub(), store)
+
+	start := time.Now()
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the image to be processed, got status %d (%s)", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("The S3 read used more than its share of the budget: %v", elapsed)
+	}
+}
+
+func TestStalledProcessingTimesOut(t *testing.T) {
+	slowImgproxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	})
+	_, proxy, _ := newTestServer(t, Config{RequestTimeout: 200 * time.Millisecond}, slowImgproxy)
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status 504, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), stageProcessing) {
+		t.Fatalf("Expected the processing stage to be blamed, got %q", body)
+	}
+}
+
+func TestUnreachableImgproxyIsBadGateway(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	srv.proxy = newServer(srv.cfg, srv.store, &url.URL{Scheme: "http", Host: "127.0.0.1:1"}).proxy
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), stageProcessing) {
+		t.Fatalf("Expected the processing stage to be blamed, got %q", body)
+	}
+}
+
+func TestStalledS3WriteIsBoundedByItsBudget(t *testing.T) {
+	store := &stallingStore{}
+	srv, proxy := newTestServerWithStore(t, Config{RequestTimeout: 200 * time.Millisecond}, imgproxyStub(), store)
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	srv.uploads.Wait()
+	if len(store.errs) != 1 || !errors.Is(store.errs[0], context.DeadlineExceeded) {
+		t.Fatalf("Expected the upload to hit its deadline, got %v", store.errs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := srv.storeProcessed(ctx, "/_/plain/x", nil, ObjectMeta{})
+
+	var stageErr *stageError
+	if !errors.As(err, &stageErr) || stageErr.stage != stageS3Write {
+		t.Fatalf("Expected the S3 write stage to be blamed, got %v", err)
+	}
+}
+
+// get requests a URL through the proxy, the body is closed at the end of the test
+func get(t *testing.T, requestURL string) *http.Response {
+	t.Helper()
+
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestSmallImagesAreNotCached(t *testing.T) {
+	sizedStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := parseImgproxyPath(requestPath(r.URL))
+		width, _ := strconv.Atoi(strings.TrimPrefix(p.Options[0], "w:"))
+		w.Write(bytes.Repeat([]byte("x"), width))
+	})
+	srv, proxy, store := newTestServer(t, Config{MinCacheBytes: 100}, sizedStub)
+
+	small := "/_/w:5/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	large := "/_/w:500/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for _, path := range []string{small, large} {
+		if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+	srv.uploads.Wait()
+
+	if _, ok := store.get(GenerateS3Key(small)); ok {
+		t.Error("Expected the image below MIN_CACHE_BYTES not to be stored")
+	}
+	if _, ok := store.get(GenerateS3Key(large)); !ok {
+		t.Error("Expected the image above MIN_CACHE_BYTES to be stored")
+	}
+}
+
+func TestKeyExtensionMatchesServedContentType(t *testing.T) {
+	formatStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := parseImgproxyPath(requestPath(r.URL))
+		w.Header().Set("Content-Type", "image/"+strings.Replace(p.Format(), "jpg", "jpeg", 1))
+		w.Write([]byte("processed:" + requestPath(r.URL)))
+	})
+	srv, proxy, store := newTestServer(t, Config{KeyExtension: true}, formatStub)
+
+	source := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	keys := map[string]bool{}
+	for _, format := range []string{"webp", "avif", "jpg", "png"} {
+		resp := get(t, proxy.URL+source+"@"+format)
+		srv.uploads.Wait()
+
+		key := srv.keys.key("", source+"@"+format)
+		if _, ok := store.get(key); !ok {
+			t.Fatalf("Expected %s to be stored under %s", format, key)
+		}
+		if ext := "." + formatFromContentType(resp.Header.Get("Content-Type")); !strings.HasSuffix(key, ext) {
+			t.Errorf("Key %s doesn't match the served Content-Type %s", key, resp.Header.Get("Content-Type"))
+		}
+		keys[key] = true
+	}
+
+	if len(keys) != 4 {
+		t.Fatalf("Expected 4 distinct keys, got %d", len(keys))
+	}
+}
+
+func TestCacheControlNoStoreBypassesTheCache(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("stale"), ObjectMeta{ContentType: "image/jpeg"})
+
+	resp := getWithCacheControl(t, proxy.URL+path, "no-store")
+	srv.uploads.Wait()
+
+	if body, _ := io.ReadAll(resp.Body); string(body) != "processed:"+path {
+		t.Fatalf("Expected the image processed by imgproxy, got %q", body)
+	}
+	if stored, _ := store.get(GenerateS3Key(path)); string(stored) != "stale" {
+		t.Fatalf("Expected the stored image to be left untouched, got %q", stored)
+	}
+}
+
+func TestCacheControlNoCacheRevalidates(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("stale"), ObjectMeta{ContentType: "image/jpeg"})
+
+	resp := getWithCacheControl(t, proxy.URL+path, "no-cache")
+	srv.uploads.Wait()
+
+	if resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a miss, got %q", resp.Header.Get("X-Cache"))
+	}
+	if stored, _ := store.get(GenerateS3Key(path)); string(stored) != "processed:"+path {
+		t.Fatalf("Expected the fresh image to be stored, got %q", stored)
+	}
+}
+
+// getWithCacheControl requests a URL with the given Cache-Control header
+func getWithCacheControl(t *testing.T, requestURL, cacheControl string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Cache-Control", cacheControl)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHeadOnHitReturnsCachedMetadata(t *testing.T) {
+	var calls atomic.Int32
+	countingStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		imgproxyStub().ServeHTTP(w, r)
+	})
+	_, proxy, store := newTestServer(t, Config{}, countingStub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached image"), ObjectMeta{ContentType: "image/webp"})
+
+	resp := head(t, proxy.URL+path)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a 200 hit, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if resp.Header.Get("Content-Type") != "image/webp" || resp.ContentLength != int64(len("cached image")) {
+		t.Fatalf("Expected the cached metadata, got %q with length %d", resp.Header.Get("Content-Type"), resp.ContentLength)
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("Expected imgproxy not to be called, got %d calls", calls.Load())
+	}
+}
+
+func TestHeadOnMissReturnsNotFound(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+
+	resp := head(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	srv.uploads.Wait()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", resp.StatusCode)
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
+
+func TestHeadOnMissTriggersGeneration(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{HeadTriggersGenerate: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := head(t, proxy.URL+path)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a 200 miss, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	if resp.Header.Get("Content-Type") != "image/jpeg" || resp.ContentLength != int64(len("processed:"+path)) {
+		t.Fatalf("Expected the headers of the generated image, got %q and %d bytes", resp.Header.Get("Content-Type"), resp.ContentLength)
+	}
+
+	srv.uploads.Wait()
+	if next := get(t, proxy.URL+path); next.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the following GET to be a hit, got %q", next.Header.Get("X-Cache"))
+	}
+}
+
+func TestConcurrentHeadsShareOneGeneration(t *testing.T) {
+	var calls atomic.Int32
+	slowStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		imgproxyStub().ServeHTTP(w, r)
+	})
+	srv, proxy, _ := newTestServer(t, Config{HeadTriggersGenerate: true}, slowStub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := http.Head(proxy.URL + path); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	srv.uploads.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("Expected a single generation, imgproxy was called %d times", calls.Load())
+	}
+}
+
+// head sends a HEAD request through the proxy
+func head(t *testing.T, requestURL string) *http.Response {
+	t.Helper()
+
+	resp, err := http.Head(requestURL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// countingStore counts the uploads reaching a memory store
+type countingStore struct {
+	*memoryStore
+	puts atomic.Int32
+}
+
+func (c *countingStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	c.puts.Add(1)
+	return c.memoryStore.Put(ctx, key, r, meta)
+}
+
+func TestDuplicateUploadIsSkipped(t *testing.T) {
+	store := &countingStore{memoryStore: newMemoryStore()}
+	srv, _ := newTestServerWithStore(t, Config{}, imgproxyStub(), store)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for range 2 {
+		if err := srv.storeProcessed(context.Background(), path, []byte("image"), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+			t.Fatalf("Failed to store: %v", err)
+		}
+	}
+	if store.puts.Load() != 1 {
+		t.Fatalf("Expected the identical upload to be skipped, got %d uploads", store.puts.Load())
+	}
+
+	if err := srv.storeProcessed(context.Background(), path, []byte("new image"), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if stored, _ := store.get(GenerateS3Key(path)); string(stored) != "new image" || store.puts.Load() != 2 {
+		t.Fatalf("Expected different content to be uploaded, got %q after %d uploads", stored, store.puts.Load())
+	}
+}
+
+func TestSlowHeadersAreDisconnected(t *testing.T) {
+	httpServer := newHTTPServer(Config{ReadHeaderTimeout: 100 * time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish its headers
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("Expected the server to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the connection to be closed after the read header timeout, took %v", elapsed)
+	}
+}
+
+// truncatingStub sends the given raw response, then drops the connection before its end
+func truncatingStub(t *testing.T, raw string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack the connection: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString(raw)
+		buf.Flush()
+	})
+}
+
+const (
+	truncatedResponse        = "HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\nContent-Length: 100\r\n\r\npartial"
+	truncatedChunkedResponse = "HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\nTransfer-Encoding: chunked\r\n\r\n7\r\npartial\r\n"
+)
+
+func TestTruncatedResponseIsNotCached(t *testing.T) {
+	for name, raw := range map[string]string{"content-length": truncatedResponse, "chunked": truncatedChunkedResponse} {
+		t.Run(name, func(t *testing.T) {
+			srv, proxy, store := newTestServer(t, Config{}, truncatingStub(t, raw))
+
+			path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+			resp := get(t, proxy.URL+path)
+			srv.uploads.Wait()
+
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("Expected status 502, got %d", resp.StatusCode)
+			}
+			if store.len() != 0 {
+				t.Fatalf("Expected nothing stored, found %d objects", store.len())
+			}
+		})
+	}
+}
+
+func TestTruncatedWarmupIsNotCached(t *testing.T) {
+	srv, _, store := newTestServer(t, Config{}, truncatingStub(t, truncatedResponse))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if _, err := srv.processAndStore(context.Background(), path); !errors.Is(err, errTruncatedBody) {
+		t.Fatalf("Expected a truncated body error, got %v", err)
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
+
+func TestDuplicateSlashesShareTheCleanKey(t *testing.T) {
+	var forwarded []string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, requestPath(r.URL))
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{NormalizePathSlashes: true}, stub)
+
+	clean := "/_/rs:fill:300:300/plain/https://example.com/cat.jpg"
+	for _, path := range []string{
+		"/_/rs:fill:300:300/plain//https://example.com/cat.jpg",
+		"/_//rs:fill:300:300/plain/https://example.com/cat.jpg",
+	} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+	srv.uploads.Wait()
+
+	if _, ok := store.get(GenerateS3Key(clean)); !ok || store.len() != 1 {
+		t.Fatalf("Expected both forms stored once under the key of %s, found %d objects", clean, store.len())
+	}
+	for _, path := range forwarded {
+		if path != clean {
+			t.Errorf("Expected imgproxy to receive %s, got %s", clean, path)
+		}
+	}
+}
+
+func TestSignedPathWithDuplicateSlashesIsSignedAgain(t *testing.T) {
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	var forwarded string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = requestPath(r.URL)
+		w.Write([]byte("image"))
+	})
+	cfg := Config{NormalizePathSlashes: true, KeyIgnoreSignature: true, ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32}
+	_, proxy, _ := newTestServer(t, cfg, stub)
+
+	source := base64.RawURLEncoding.EncodeToString([]byte("https://example.com/cat.jpg"))
+	path := sign(key, salt, "/rs:fill:300:300/"+source[:8]+"//"+source[8:])
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the valid signature to be accepted, got %d", resp.StatusCode)
+	}
+	if want := sign(key, salt, "/rs:fill:300:300/"+source[:8]+"/"+source[8:]); forwarded != want {
+		t.Fatalf("Expected imgproxy to receive the cleaned path signed again %s, got %s", want, forwarded)
+	}
+
+	if resp := get(t, proxy.URL+"/_/rs:fill:300:300/"+source[:8]+"//"+source[8:]); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected an invalid signature not to be signed again, got %d", resp.StatusCode)
+	}
+}
+
+func TestSourceMetadataIsStored(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{StoreSourceMetadata: true}, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/q:80/plain/" + url.QueryEscape("http://example.com/chat-noir-é.jpg") + "@webp"
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	info, err := store.Head(context.Background(), GenerateS3Key(path))
+	if err != nil {
+		t.Fatalf("Expected the image to be stored: %v", err)
+	}
+	if info.SourceURL != "http://example.com/chat-noir-%C3%A9.jpg" {
+		t.Errorf("Expected the ASCII source URL in the metadata, got %q", info.SourceURL)
+	}
+	if info.Options != "rs:fill:50:50/q:80" {
+		t.Errorf("Expected the processing options in the metadata, got %q", info.Options)
+	}
+	if info.Format != "webp" {
+		t.Errorf("Expected the requested format in the metadata, got %q", info.Format)
+	}
+	if got := info.userMetadata(); got[sourceURLMetadata] != info.SourceURL || got[optionsMetadata] != info.Options {
+		t.Errorf("Expected the metadata to be sent as S3 user metadata, got %v", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Metric names of the Server-Timing header
+const (
+	timingCache    = "cache"
+	timingUpstream = "upstream"
+	timingTotal    = "total"
+)
+
+// serverTiming collects the durations of the stages of a request, for the Server-Timing header
+type serverTiming struct {
+	start         time.Time
+	cache         time.Duration
+	upstreamStart time.Time
+}
+
+type serverTimingContextKey struct{}
+
+// timingFrom returns the timing of the request, a detached one outside of the middleware
+func timingFrom(ctx context.Context) *serverTiming {
+	if t, ok := ctx.Value(serverTimingContextKey{}).(*serverTiming); ok {
+		return t
+	}
+	return &serverTiming{start: time.Now()}
+}
+
+// header formats the metrics in milliseconds. imgproxy is done once the response
+// headers are written, so that's when its duration is taken
+func (t *serverTiming) header(now time.Time) string {
+	var upstream time.Duration
+	if !t.upstreamStart.IsZero() {
+		upstream = now.Sub(t.upstreamStart)
+	}
+	return fmt.Sprintf("%s;dur=%s, %s;dur=%s, %s;dur=%s",
+		timingCache, milliseconds(t.cache),
+		timingUpstream, milliseconds(upstream),
+		timingTotal, milliseconds(now.Sub(t.start)))
+}
+
+func milliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000)
+}
+
+// serverTimingMiddleware adds a Server-Timing header to every response
+func serverTimingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &serverTiming{start: time.Now()}
+		tw := &timingWriter{ResponseWriter: w, timing: t}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingContextKey{}, t)))
+		tw.setHeader()
+	})
+}
+
+// timingWriter sets the Server-Timing header right before the response headers are written
+type timingWriter struct {
+	http.ResponseWriter
+	timing *serverTiming
+	done   bool
+}
+
+func (w *timingWriter) setHeader() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.Header().Set("Server-Timing", w.timing.header(time.Now()))
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush streamed responses
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServerTimingOnMissAndHit(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	path := "/_/w:100/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	miss := get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	hit := get(t, proxy.URL+path)
+
+	for name, resp := range map[string]*http.Response{"miss": miss, "hit": hit} {
+		header := resp.Header.Get("Server-Timing")
+		if header == "" {
+			t.Fatalf("Expected a Server-Timing header on the %s", name)
+		}
+
+		var metrics []string
+		for _, entry := range strings.Split(header, ",") {
+			metric, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+			if !strings.HasPrefix(params, "dur=") {
+				t.Errorf("Expected a duration for %s on the %s, got %q", metric, name, entry)
+			}
+			metrics = append(metrics, metric)
+		}
+		if got := strings.Join(metrics, ","); got != "cache,upstream,total" {
+			t.Errorf("Expected the cache, upstream and total metrics on the %s, got %s", name, got)
+		}
+	}
+
+	if miss.Header.Get("X-Cache") != "MISS" || hit.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a miss then a hit, got %s then %s", miss.Header.Get("X-Cache"), hit.Header.Get("X-Cache"))
+	}
+}
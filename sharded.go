@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// shardedStore spreads the keys across several stores, such as the buckets of S3_BUCKETS, to avoid hot prefixes
+// at very high request rates. A key is hashed to pick its store, so its reads and writes always go to the same one
+type shardedStore struct {
+	shards []CacheStore
+}
+
+func newShardedStore(shards []CacheStore) *shardedStore {
+	return &shardedStore{shards: shards}
+}
+
+// shardIndex returns the index of the shard holding a key among n. Changing n moves most keys to another shard
+func shardIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *shardedStore) shard(key string) CacheStore {
+	return s.shards[shardIndex(key, len(s.shards))]
+}
+
+func (s *shardedStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	return s.shard(key).Get(ctx, key)
+}
+
+func (s *shardedStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	return s.shard(key).Head(ctx, key)
+}
+
+func (s *shardedStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	return s.shard(key).Put(ctx, key, r, meta)
+}
+
+func (s *shardedStore) Delete(ctx context.Context, key string) error {
+	return s.shard(key).Delete(ctx, key)
+}
+
+// List lists the shards one after the other. Its cursor is the index of the shard being listed and the cursor within it
+func (s *shardedStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	index, shardCursor, err := parseShardCursor(cursor, len(s.shards))
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.shards[index].List(ctx, prefix, shardCursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case page.NextCursor != "":
+		page.NextCursor = strconv.Itoa(index) + ":" + page.NextCursor
+	case index+1 < len(s.shards):
+		page.NextCursor = strconv.Itoa(index+1) + ":"
+	}
+	return page, nil
+}
+
+// parseShardCursor reads a cursor returned by shardedStore.List, the first shard's start when empty
+func parseShardCursor(cursor string, n int) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	i, shardCursor, _ := strings.Cut(cursor, ":")
+	index, err := strconv.Atoi(i)
+	if err != nil || index < 0 || index >= n {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return index, shardCursor, nil
+}
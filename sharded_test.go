@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestShardedStoreDistributesKeys(t *testing.T) {
+	shards := []*memoryStore{newMemoryStore(), newMemoryStore(), newMemoryStore()}
+	store := newShardedStore([]CacheStore{shards[0], shards[1], shards[2]})
+
+	const keys = 300
+	for i := range keys {
+		key := GenerateS3Key(fmt.Sprintf("/_/w:%d/plain/src", i))
+		if err := store.Put(context.Background(), key, strings.NewReader(key), ObjectMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := 0
+	for i, shard := range shards {
+		if shard.len() < keys/6 {
+			t.Errorf("Expected the keys to be spread across the buckets, shard %d holds %d of %d", i, shard.len(), keys)
+		}
+		total += shard.len()
+	}
+	if total != keys {
+		t.Fatalf("Expected every key to be stored in a single bucket, got %d objects for %d keys", total, keys)
+	}
+
+	for i := range keys {
+		key := GenerateS3Key(fmt.Sprintf("/_/w:%d/plain/src", i))
+		if _, ok := shards[shardIndex(key, len(shards))].get(key); !ok {
+			t.Fatalf("Expected key %s in the bucket it hashes to", key)
+		}
+
+		obj, err := store.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Expected key %s to be read from its bucket: %v", key, err)
+		}
+		body, _ := io.ReadAll(obj.Body)
+		obj.Body.Close()
+		if string(body) != key {
+			t.Fatalf("Expected the object of key %s, got %q", key, body)
+		}
+	}
+}
+
+func TestShardedStoreListsEveryBucket(t *testing.T) {
+	shards := []CacheStore{newMemoryStore(), newMemoryStore()}
+	store := newShardedStore(shards)
+	for i := range 10 {
+		store.Put(context.Background(), fmt.Sprintf("key-%d", i), strings.NewReader("image"), ObjectMeta{})
+	}
+
+	listed := map[string]bool{}
+	cursor := ""
+	for range 20 {
+		page, err := store.List(context.Background(), "key-", cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Objects {
+			listed[obj.Key] = true
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(listed) != 10 {
+		t.Fatalf("Expected the 10 keys to be listed across the buckets, got %d", len(listed))
+	}
+
+	if _, err := store.List(context.Background(), "", "5:", 3); err == nil {
+		t.Fatal("Expected an error for a cursor past the last bucket")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var errInvalidSignature = errors.New("invalid imgproxy signature")
+
+// signatureVerifier checks imgproxy signatures the way imgproxy does, with the same IMGPROXY_KEY and IMGPROXY_SALT.
+// It's nil when no key is configured, imgproxy then accepts any signature
+type signatureVerifier struct {
+	key  []byte
+	salt []byte
+	size int
+}
+
+func newSignatureVerifier(cfg Config) *signatureVerifier {
+	if len(cfg.ImgproxyKey) == 0 {
+		return nil
+	}
+	return &signatureVerifier{key: cfg.ImgproxyKey, salt: cfg.ImgproxySalt, size: cfg.SignatureSize}
+}
+
+// verify checks the signature of a path: the URL-safe base64 HMAC-SHA256 of the salt and the rest of the path,
+// truncated to IMGPROXY_SIGNATURE_SIZE bytes
+func (v *signatureVerifier) verify(path string) error {
+	if v == nil {
+		return nil
+	}
+
+	signature, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return errInvalidSignature
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signature, "="))
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	if !hmac.Equal(got, v.sign(rest)) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// sign returns the signature of the rest of a path, after its signature
+func (v *signatureVerifier) sign(rest string) []byte {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write(v.salt)
+	mac.Write([]byte("/" + rest))
+	signature := mac.Sum(nil)
+	if v.size > 0 && v.size < len(signature) {
+		signature = signature[:v.size]
+	}
+	return signature
+}
+
+// resign replaces the signature of a path rewritten by the proxy. Without a key, imgproxy
+// accepts any signature and the path is left untouched
+func (v *signatureVerifier) resign(p imgproxyPath) imgproxyPath {
+	if v == nil {
+		return p
+	}
+	_, rest, _ := strings.Cut(strings.TrimPrefix(p.String(), "/"), "/")
+	p.Signature = base64.RawURLEncoding.EncodeToString(v.sign(rest))
+	return p
+}
+
+// resignPath replaces the signature of a raw path rewritten by the proxy, as resign does
+func (v *signatureVerifier) resignPath(path string) string {
+	if v == nil {
+		return path
+	}
+	_, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + base64.RawURLEncoding.EncodeToString(v.sign(rest)) + "/" + rest
+}
+
+// unsignedPath replaces the signature of a path with the insecure "_" placeholder
+func unsignedPath(path string) string {
+	_, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return path
+	}
+	return "/_/" + rest
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// sign signs a path the way imgproxy clients do
+func sign(key, salt []byte, path string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(path))
+	return "/" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) + path
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	verifier := newSignatureVerifier(Config{ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32})
+
+	path := "/rs:fill:300:300/plain/https://example.com/cat.jpg"
+	if err := verifier.verify(sign(key, salt, path)); err != nil {
+		t.Fatalf("Expected a valid signature, got %v", err)
+	}
+
+	for _, invalid := range []string{
+		"/_" + path,
+		sign(key, salt, path) + "@webp",
+		sign([]byte("other-key"), salt, path),
+		"/",
+	} {
+		if err := verifier.verify(invalid); err != errInvalidSignature {
+			t.Errorf("verify(%q) = %v, want an invalid signature", invalid, err)
+		}
+	}
+
+	truncated := newSignatureVerifier(Config{ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 8})
+	full := sign(key, salt, path)
+	sig, rest, _ := strings.Cut(strings.TrimPrefix(full, "/"), "/")
+	raw, _ := base64.RawURLEncoding.DecodeString(sig)
+	if err := truncated.verify("/" + base64.RawURLEncoding.EncodeToString(raw[:8]) + "/" + rest); err != nil {
+		t.Fatalf("Expected a valid truncated signature, got %v", err)
+	}
+
+	var unconfigured *signatureVerifier
+	if err := unconfigured.verify("/_" + path); err != nil {
+		t.Fatalf("Expected any signature to be accepted without a key, got %v", err)
+	}
+}
+
+func TestInvalidSignatureIsRejectedBeforeTheCache(t *testing.T) {
+	key, salt := []byte("secret-key"), []byte("secret-salt")
+	cfg := Config{KeyIgnoreSignature: true, ImgproxyKey: key, ImgproxySalt: salt, SignatureSize: 32}
+	srv, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+sign(key, salt, path)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	if resp := get(t, proxy.URL+"/_"+path); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the cached image not to be served without a valid signature, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// exceedsSourceSize reports whether a processed image is larger than its source by more
+// than MAX_OUTPUT_SIZE_RATIO, which usually means a format conversion going the wrong way.
+// The source size comes from a HEAD, when it can't be known the image is deemed fine
+func (s *server) exceedsSourceSize(ctx context.Context, path string, size int) bool {
+	if s.cfg.MaxOutputSizeRatio == 0 {
+		return false
+	}
+
+	sourceSize, ok := s.sourceSize(ctx, path)
+	if !ok || sourceSize == 0 {
+		return false
+	}
+	return float64(size) > float64(sourceSize)*s.cfg.MaxOutputSizeRatio
+}
+
+// sourceSize returns the Content-Length announced by the source of a path
+func (s *server) sourceSize(ctx context.Context, path string) (int64, bool) {
+	size, err := s.sources.contentLength(ctx, path)
+	if err != nil {
+		slog.Debug("Failed to get the source size", "path", path, "error", err)
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInflatedImageIsNotCached(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("s"), 100))
+	}))
+	t.Cleanup(source.Close)
+
+	sizedStub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := 150
+		if p, _ := parseImgproxyPath(requestPath(r.URL)); p.Format() == "png" {
+			size = 1000
+		}
+		w.Write(bytes.Repeat([]byte("x"), size))
+	})
+	srv, proxy, store := newTestServer(t, Config{MaxOutputSizeRatio: 2, AllowLoopbackSources: true}, sizedStub)
+
+	inflated := "/_/plain/" + url.QueryEscape(source.URL+"/kitten.jpg") + "@png"
+	fine := "/_/plain/" + url.QueryEscape(source.URL+"/kitten.jpg") + "@webp"
+	for _, path := range []string{inflated, fine} {
+		if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+	srv.uploads.Wait()
+
+	if _, ok := store.get(GenerateS3Key(inflated)); ok {
+		t.Error("Expected the image inflated beyond MAX_OUTPUT_SIZE_RATIO not to be stored")
+	}
+	if _, ok := store.get(GenerateS3Key(fine)); !ok {
+		t.Error("Expected the image within MAX_OUTPUT_SIZE_RATIO to be stored")
+	}
+}
+
+func TestSourceSizeIsNotFetchedFromForbiddenSources(t *testing.T) {
+	var reached atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Write([]byte("internal"))
+	}))
+	t.Cleanup(internal.Close)
+	redirecting := httptest.NewServer(http.RedirectHandler(internal.URL+"/secret", http.StatusFound))
+	t.Cleanup(redirecting.Close)
+
+	for name, cfg := range map[string]Config{
+		"loopback":         {MaxOutputSizeRatio: 2},
+		"disallowed host":  {MaxOutputSizeRatio: 2, AllowLoopbackSources: true, AllowedSourceHosts: []string{"cdn.example.com"}},
+		"redirected to it": {MaxOutputSizeRatio: 2, AllowLoopbackSources: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reached.Store(0)
+			srv, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+			source := internal.URL
+			if name == "redirected to it" {
+				source = redirecting.URL
+			}
+			get(t, proxy.URL+"/_/plain/"+url.QueryEscape(source+"/kitten.jpg"))
+			srv.uploads.Wait()
+
+			if n := reached.Load(); n != 0 {
+				t.Errorf("Expected the internal source not to be reached, got %d requests", n)
+			}
+		})
+	}
+}
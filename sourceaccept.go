@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type acceptContextKey struct{}
+
+// acceptFrom returns the Accept header forwarded with FORWARD_ACCEPT_TO_SOURCE, empty otherwise
+func acceptFrom(ctx context.Context) string {
+	accept, _ := ctx.Value(acceptContextKey{}).(string)
+	return accept
+}
+
+// normalizeAccept lowercases the media ranges of Accept headers and removes their spaces, so the same
+// preferences written differently share a key. Their order is kept, it may matter to the source
+func normalizeAccept(values []string) string {
+	var ranges []string
+	for _, value := range values {
+		for _, r := range strings.Split(value, ",") {
+			if r = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(r), " ", "")); r != "" {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+// applyAcceptPolicy decides whether the Accept header of an image request reaches imgproxy, which may
+// negotiate the source with it. With FORWARD_ACCEPT_TO_SOURCE, its normalized form is forwarded, sent
+// along the proxy's own source fetches and made part of the key so negotiated sources aren't mixed.
+// Otherwise it's removed, so that every client gets the image of the same source
+func (s *server) applyAcceptPolicy(r *http.Request, w http.ResponseWriter) *http.Request {
+	if !s.cfg.ForwardAcceptToSource {
+		r.Header.Del("Accept")
+		return r
+	}
+	if !slices.Contains(w.Header().Values("Vary"), "Accept") {
+		w.Header().Add("Vary", "Accept")
+	}
+
+	accept := normalizeAccept(r.Header.Values("Accept"))
+	if accept == "" {
+		return r
+	}
+	r.Header.Set("Accept", accept)
+	return r.WithContext(context.WithValue(r.Context(), acceptContextKey{}, accept))
+}
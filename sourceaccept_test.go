@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func getWithAccept(t *testing.T, requestURL, accept string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, requestURL, nil)
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestNormalizeAccept(t *testing.T) {
+	if got := normalizeAccept([]string{"Image/WebP, image/*; q=0.8", "*/*"}); got != "image/webp,image/*;q=0.8,*/*" {
+		t.Fatalf("Unexpected normalized Accept %q", got)
+	}
+}
+
+func TestAcceptIsNotForwardedByDefault(t *testing.T) {
+	var forwarded atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.Header.Get("Accept"))
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{}, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := getWithAccept(t, proxy.URL+path, "image/webp,image/*")
+	srv.uploads.Wait()
+	if got, _ := forwarded.Load().(string); got != "" {
+		t.Fatalf("Expected Accept not to reach imgproxy, got %q", got)
+	}
+	if resp.Header.Get("Vary") != "" {
+		t.Fatalf("Expected the response not to vary on Accept, got %q", resp.Header.Get("Vary"))
+	}
+
+	if resp := getWithAccept(t, proxy.URL+path, "image/avif"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected another Accept to share the cached image")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected a single cached image, got %d", store.len())
+	}
+}
+
+func TestForwardedAcceptIsPartOfTheKey(t *testing.T) {
+	var forwarded atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.Header.Get("Accept"))
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{ForwardAcceptToSource: true}, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := getWithAccept(t, proxy.URL+path, "Image/WebP, image/*")
+	srv.uploads.Wait()
+	if got, _ := forwarded.Load().(string); got != "image/webp,image/*" {
+		t.Fatalf("Expected the normalized Accept to reach imgproxy, got %q", got)
+	}
+	if resp.Header.Get("Vary") != "Accept" {
+		t.Fatalf("Expected the response to vary on Accept, got %q", resp.Header.Get("Vary"))
+	}
+	webpKey := srv.keys.variantKey("", path, keyVariant{accept: "image/webp,image/*"})
+	if _, ok := store.get(webpKey); !ok {
+		t.Fatal("Expected the image to be stored under the key of its Accept")
+	}
+	if _, ok := store.get(GenerateS3Key(path)); ok {
+		t.Fatal("Expected the negotiated image not to be stored under the key of the path alone")
+	}
+
+	if resp := getWithAccept(t, proxy.URL+path, "image/webp, image/*"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected the same normalized Accept to hit the cache")
+	}
+	if resp := getWithAccept(t, proxy.URL+path, "image/avif"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatal("Expected another Accept not to be served the negotiated image")
+	}
+	srv.uploads.Wait()
+	if store.len() != 2 {
+		t.Fatalf("Expected an image per Accept, got %d", store.len())
+	}
+}
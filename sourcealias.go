@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseSourceHostAliases reads the alias=canonical host pairs of SOURCE_HOST_ALIASES. A canonical host
+// can't be an alias itself, so a source is rewritten at most once
+func parseSourceHostAliases(pairs []string) (map[string]string, error) {
+	aliases := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		alias, canonical, ok := strings.Cut(strings.ToLower(pair), "=")
+		if !ok || !isSourceHost(alias) || !isSourceHost(canonical) || alias == canonical {
+			return nil, fmt.Errorf("failed to parse SOURCE_HOST_ALIASES, expected alias=canonical host pairs: %q", pair)
+		}
+		if _, dup := aliases[alias]; dup {
+			return nil, fmt.Errorf("failed to parse SOURCE_HOST_ALIASES, duplicate alias: %q", alias)
+		}
+		aliases[alias] = canonical
+	}
+	for alias, canonical := range aliases {
+		if _, ok := aliases[canonical]; ok {
+			return nil, fmt.Errorf("failed to parse SOURCE_HOST_ALIASES, canonical host %q of %q is an alias", canonical, alias)
+		}
+	}
+	return aliases, nil
+}
+
+func isSourceHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, "/?#@ ")
+}
+
+// canonicalSourceURL replaces the host of a source URL with its canonical one when it's an alias.
+// The rest of the URL is kept byte for byte
+func canonicalSourceURL(source string, aliases map[string]string) (string, bool) {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source, false
+	}
+	canonical, ok := aliases[strings.ToLower(u.Host)]
+	if !ok {
+		return source, false
+	}
+
+	authority := strings.Index(source, "//") + 2
+	at := authority + strings.Index(strings.ToLower(source[authority:]), strings.ToLower(u.Host))
+	return source[:at] + canonical + source[at+len(u.Host):], true
+}
+
+// applySourceAlias rewrites the source URL of a path whose host is one of SOURCE_HOST_ALIASES to its canonical host,
+// so every alias shares one key and imgproxy fetches the canonical URL
+func (s *server) applySourceAlias(r *http.Request) error {
+	if len(s.cfg.SourceHostAliases) == 0 {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		source, err := p.SourceURL()
+		if err != nil {
+			return false
+		}
+		canonical, ok := canonicalSourceURL(source, s.cfg.SourceHostAliases)
+		if !ok {
+			return false
+		}
+		if p.Plain {
+			p.Source = url.QueryEscape(canonical)
+		} else {
+			p.Source = base64.RawURLEncoding.EncodeToString([]byte(canonical))
+		}
+		return true
+	})
+}
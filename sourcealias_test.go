@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestParseSourceHostAliases(t *testing.T) {
+	aliases, err := parseSourceHostAliases([]string{"CDN.example.com=images.example.com", "www.example.com:8080=images.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases["cdn.example.com"] != "images.example.com" || aliases["www.example.com:8080"] != "images.example.com" {
+		t.Fatalf("Unexpected aliases %v", aliases)
+	}
+
+	for _, invalid := range [][]string{
+		{"cdn.example.com"},
+		{"=images.example.com"},
+		{"cdn.example.com=images.example.com/path"},
+		{"cdn.example.com=cdn.example.com"},
+		{"cdn.example.com=a.example.com", "cdn.example.com=b.example.com"},
+		{"cdn.example.com=www.example.com", "www.example.com=images.example.com"},
+	} {
+		if _, err := parseSourceHostAliases(invalid); err == nil {
+			t.Errorf("Expected SOURCE_HOST_ALIASES %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestCanonicalSourceURL(t *testing.T) {
+	aliases := map[string]string{"cdn.example.com": "images.example.com"}
+	if got, ok := canonicalSourceURL("https://user@CDN.example.com/a%20b.jpg?v=1", aliases); !ok || got != "https://user@images.example.com/a%20b.jpg?v=1" {
+		t.Fatalf("Unexpected canonical URL %q", got)
+	}
+	if _, ok := canonicalSourceURL("https://cdn.example.com:8443/a.jpg", aliases); ok {
+		t.Fatal("Expected another port not to match the alias")
+	}
+	if _, ok := canonicalSourceURL("https://images.example.com/cdn.example.com.jpg", aliases); ok {
+		t.Fatal("Expected a canonical host not to be rewritten")
+	}
+}
+
+func TestSourceHostAliasesShareAKey(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, requestPath(r.URL))
+		mu.Unlock()
+		w.Write([]byte("image"))
+	})
+	cfg := Config{SourceHostAliases: map[string]string{
+		"cdn.example.com": "images.example.com",
+		"www.example.com": "images.example.com",
+	}}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	canonical := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://images.example.com/kitten.jpg")
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/http://cdn.example.com/kitten.jpg")
+	srv.uploads.Wait()
+	if resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatal("Expected the first alias to miss")
+	}
+	if len(requested) != 1 || requested[0] != canonical {
+		t.Fatalf("Expected imgproxy to be sent the canonical path, got %v", requested)
+	}
+	if _, ok := store.get(GenerateS3Key(canonical)); !ok {
+		t.Fatal("Expected the image to be stored under the key of the canonical path")
+	}
+
+	if resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://WWW.example.com/kitten.jpg")); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("Expected the second alias to hit the image cached for the first one")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected a single cached image, got %d", store.len())
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("http://cdn.example.com/kitten.jpg"))
+	get(t, proxy.URL+"/_/rs:fill:50:50/"+encoded)
+	srv.uploads.Wait()
+	if want := "/_/rs:fill:50:50/" + base64.RawURLEncoding.EncodeToString([]byte("http://images.example.com/kitten.jpg")); requested[1] != want {
+		t.Fatalf("Expected an encoded source to stay encoded, got %q", requested[1])
+	}
+}
+
+func TestSourceHostAliasesVerifyTheOriginalSignature(t *testing.T) {
+	key, salt := []byte("key"), []byte("salt")
+	cfg := Config{
+		ImgproxyKey:       key,
+		ImgproxySalt:      salt,
+		SourceHostAliases: map[string]string{"cdn.example.com": "images.example.com"},
+	}
+	var forwarded string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = requestPath(r.URL)
+		w.Write([]byte("image"))
+	})
+	srv, proxy, _ := newTestServer(t, cfg, stub)
+
+	path := "/rs:fill:50:50/plain/" + url.QueryEscape("http://cdn.example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+"/forged"+path); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a forged signature to be rejected, got %d", resp.StatusCode)
+	}
+
+	if resp := get(t, proxy.URL+sign(key, salt, path)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	canonical := "/rs:fill:50:50/plain/" + url.QueryEscape("http://images.example.com/kitten.jpg")
+	if forwarded != sign(key, salt, canonical) {
+		t.Fatalf("Expected imgproxy to be sent the canonical path signed again, got %q", forwarded)
+	}
+}
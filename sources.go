@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxSourceRedirects bounds the redirect chains followed when validating a source
+const maxSourceRedirects = 10
+
+var (
+	errSourceNotAllowed  = errors.New("source host is not allowed")
+	errSourceRedirect    = errors.New("source redirects are not allowed")
+	errTooManyRedirects  = errors.New("too many source redirects")
+	errUncheckableSource = errors.New("source URL can't be checked against the allowed hosts")
+	errSourceAddress     = errors.New("source address is not allowed")
+)
+
+// sourcePolicy decides which source URLs may be processed
+type sourcePolicy struct {
+	// rules are swapped when the configuration is reloaded
+	rules atomic.Pointer[sourceRules]
+	// allowLoopback and allowLinkLocal mirror imgproxy's own restrictions on source addresses
+	allowLoopback  bool
+	allowLinkLocal bool
+	// client reaches sources directly, without following redirects nor reaching forbidden addresses
+	client *http.Client
+}
+
+// sourceRules are the ALLOWED_SOURCE_HOSTS and FOLLOW_SOURCE_REDIRECTS settings
+type sourceRules struct {
+	allowedHosts    []string
+	followRedirects bool
+}
+
+func newSourcePolicy(cfg Config) *sourcePolicy {
+	p := &sourcePolicy{
+		allowLoopback:  cfg.AllowLoopbackSources,
+		allowLinkLocal: cfg.AllowLinkLocalSources,
+	}
+	p.setRules(cfg)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, Control: p.checkAddress}).DialContext
+	p.client = &http.Client{
+		Transport: transport,
+		// Redirects are inspected one hop at a time
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p
+}
+
+// setRules applies the allow-list and redirect settings of a configuration to the next checks
+func (p *sourcePolicy) setRules(cfg Config) {
+	p.rules.Store(&sourceRules{allowedHosts: cfg.AllowedSourceHosts, followRedirects: !cfg.BlockSourceRedirects})
+}
+
+// checkAddress rejects the connections to the source addresses imgproxy refuses by default,
+// once the host is resolved so that a DNS name can't point them to the proxy's own network
+func (p *sourcePolicy) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errSourceAddress
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return errSourceAddress
+	}
+
+	ip = ip.Unmap()
+	switch {
+	case ip.IsUnspecified():
+		return errSourceAddress
+	case ip.IsLoopback() && !p.allowLoopback:
+		return errSourceAddress
+	case (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) && !p.allowLinkLocal:
+		return errSourceAddress
+	}
+	return nil
+}
+
+// maxSourceFallbackSize bounds the sources downloaded by the proxy itself, which are held in memory
+const maxSourceFallbackSize = 32 << 20
+
+var errSourceFallback = errors.New("source can't be served as a fallback")
+
+// fetch downloads the source of a path, for SOURCE_FALLBACK and PASSTHROUGH_CONTENT_TYPES. It asks for gzip, which the default
+// transport stops decoding once Accept-Encoding is set, so the body is decoded here and served as is
+func (p *sourcePolicy) fetch(ctx context.Context, path string) (*upstreamResponse, error) {
+	if err := p.checkHost(path); err != nil {
+		return nil, err
+	}
+	source, err := decodeSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	if accept := acceptFrom(ctx); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Redirects aren't followed, the source would have to be checked hop by hop again
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("%w: status %d, content type %q", errSourceFallback, resp.StatusCode, contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceFallbackSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSourceFallbackSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", errSourceFallback, maxSourceFallbackSize)
+	}
+	body, err = decodeContent(resp.Header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamResponse{status: http.StatusOK, contentType: contentType, body: body}, nil
+}
+
+// head sends a HEAD to the source of a path once it's checked against ALLOWED_SOURCE_HOSTS.
+// Redirects aren't followed, the response of a redirecting source is returned as is
+func (p *sourcePolicy) head(ctx context.Context, path string) (*http.Response, error) {
+	if err := p.checkHost(path); err != nil {
+		return nil, err
+	}
+	source, err := decodeSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// contentLength returns the size announced by the source of a path, unknown when it redirects
+func (p *sourcePolicy) contentLength(ctx context.Context, path string) (int64, error) {
+	resp, err := p.head(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, fmt.Errorf("source size unknown, status %d", resp.StatusCode)
+	}
+	return resp.ContentLength, nil
+}
+
+// checkHost rejects paths whose source host isn't in ALLOWED_SOURCE_HOSTS
+func (p *sourcePolicy) checkHost(path string) error {
+	rules := p.rules.Load()
+	if len(rules.allowedHosts) == 0 {
+		return nil
+	}
+
+	source, err := decodeSource(path)
+	if err != nil {
+		return errUncheckableSource
+	}
+	return rules.checkURL(source)
+}
+
+// checkRedirects follows the redirects of the source, as imgproxy would, and rejects
+// the path if a hop isn't allowed. Without allow-list nor redirect restriction, it's a no-op
+func (p *sourcePolicy) checkRedirects(ctx context.Context, path string) error {
+	rules := p.rules.Load()
+	if len(rules.allowedHosts) == 0 && rules.followRedirects {
+		return nil
+	}
+
+	source, err := decodeSource(path)
+	if err != nil {
+		return errUncheckableSource
+	}
+
+	for range maxSourceRedirects {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, source, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			// Unreachable sources are left for imgproxy to report
+			return nil
+		}
+		resp.Body.Close()
+
+		location, err := resp.Location()
+		if err != nil {
+			return nil
+		}
+		if !rules.followRedirects {
+			return errSourceRedirect
+		}
+		if err := rules.checkURL(location.String()); err != nil {
+			return fmt.Errorf("redirect to %s: %w", location.Host, err)
+		}
+		source = location.String()
+	}
+	return errTooManyRedirects
+}
+
+func (r *sourceRules) checkURL(source string) error {
+	if len(r.allowedHosts) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return errUncheckableSource
+	}
+	if !hostAllowed(strings.ToLower(u.Hostname()), r.allowedHosts) {
+		return errSourceNotAllowed
+	}
+	return nil
+}
+
+// hostAllowed matches a host against exact hosts and "*.example.com" wildcards
+func hostAllowed(host string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(a, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSource returns the source URL of an imgproxy path
+func decodeSource(path string) (string, error) {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return "", err
+	}
+	return p.SourceURL()
+}
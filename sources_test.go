@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// sourceServer serves /image.jpg and redirects /redirect to the given location
+func sourceServer(t *testing.T, location string) *httptest.Server {
+	t.Helper()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		w.Write([]byte("source image"))
+	}))
+	t.Cleanup(source.Close)
+	return source
+}
+
+func TestRedirectToDisallowedHostIsBlocked(t *testing.T) {
+	source := sourceServer(t, "http://disallowed.example/image.jpg")
+	srv, proxy, store := newTestServer(t, Config{AllowedSourceHosts: []string{"127.0.0.1"}, AllowLoopbackSources: true}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape(source.URL+"/redirect"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", resp.StatusCode)
+	}
+
+	srv.uploads.Wait()
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
+
+func TestRedirectToAllowedHostIsProcessed(t *testing.T) {
+	source := sourceServer(t, "/image.jpg")
+	_, proxy, _ := newTestServer(t, Config{AllowedSourceHosts: []string{"127.0.0.1"}, AllowLoopbackSources: true}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/plain/"+url.QueryEscape(source.URL+"/redirect"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestDisallowedSourceHostIsBlocked(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{AllowedSourceHosts: []string{"*.example.com"}}, imgproxyStub())
+
+	allowed := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://cdn.example.com/image.jpg"))
+	if allowed.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for an allowed host, got %d", allowed.StatusCode)
+	}
+
+	blocked := get(t, proxy.URL+"/_/plain/"+url.QueryEscape("http://example.org/image.jpg"))
+	if blocked.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403 for a disallowed host, got %d", blocked.StatusCode)
+	}
+}
+
+func TestBlockedSourceRedirects(t *testing.T) {
+	source := sourceServer(t, "/image.jpg")
+	_, proxy, _ := newTestServer(t, Config{BlockSourceRedirects: true, AllowLoopbackSources: true}, imgproxyStub())
+
+	redirected := get(t, proxy.URL+"/_/plain/"+url.QueryEscape(source.URL+"/redirect"))
+	if redirected.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403 for a redirecting source, got %d", redirected.StatusCode)
+	}
+
+	direct := get(t, proxy.URL+"/_/plain/"+url.QueryEscape(source.URL+"/image.jpg"))
+	if direct.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for a direct source, got %d", direct.StatusCode)
+	}
+}
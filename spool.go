@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errCorruptSpooledBody = errors.New("spooled body doesn't match its hash")
+
+// spoolMaxAttempts bounds the uploads of a spooled image, it's dropped once they all failed
+const spoolMaxAttempts = 10
+
+// spoolEntry is a pending upload persisted in UPLOAD_SPOOL_DIR, next to the file holding its body
+type spoolEntry struct {
+	Key      string     `json:"key"`
+	Path     string     `json:"path"`
+	Meta     ObjectMeta `json:"meta"`
+	BodyFile string     `json:"body_file"`
+	// BodyHash is the SHA-256 of the body, a body damaged on disk is dropped rather than uploaded
+	BodyHash string `json:"body_hash,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// uploadSpool persists the background uploads to disk until they're done, so the ones a crash or a restart
+// interrupts, and the failed ones, are retried. Each upload is an <id>.json entry and an <id>.body file
+type uploadSpool struct {
+	dir string
+
+	mu sync.Mutex
+	// inFlight holds the ids of the entries being uploaded, a replay skips them
+	inFlight map[string]bool
+}
+
+func openUploadSpool(dir string) (*uploadSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create UPLOAD_SPOOL_DIR: %w", err)
+	}
+	return &uploadSpool{dir: dir, inFlight: map[string]bool{}}, nil
+}
+
+// add persists an upload and marks it in flight. The body is written first and the entry renamed
+// into place, so a crash never leaves an entry without its body
+func (s *uploadSpool) add(key, path string, body []byte, meta ObjectMeta) (string, error) {
+	var random [8]byte
+	rand.Read(random[:])
+	id := hex.EncodeToString(random[:])
+
+	hash := sha256.Sum256(body)
+	entry := spoolEntry{Key: key, Path: path, Meta: meta, BodyFile: id + ".body", BodyHash: hex.EncodeToString(hash[:])}
+	if err := os.WriteFile(filepath.Join(s.dir, entry.BodyFile), body, 0o600); err != nil {
+		return "", err
+	}
+	if err := s.write(id, entry); err != nil {
+		os.Remove(filepath.Join(s.dir, entry.BodyFile))
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.inFlight[id] = true
+	s.mu.Unlock()
+	return id, nil
+}
+
+func (s *uploadSpool) write(id string, entry spoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, id+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, id+".json"))
+}
+
+// done removes an upload once it's stored, or no longer needs to be
+func (s *uploadSpool) done(id string) {
+	s.release(id)
+	os.Remove(filepath.Join(s.dir, id+".json"))
+	os.Remove(filepath.Join(s.dir, id+".body"))
+}
+
+// release lets a failed upload be retried by the next replay
+func (s *uploadSpool) release(id string) {
+	s.mu.Lock()
+	delete(s.inFlight, id)
+	s.mu.Unlock()
+}
+
+// claim marks an entry in flight, it reports false when it already is
+func (s *uploadSpool) claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[id] {
+		return false
+	}
+	s.inFlight[id] = true
+	return true
+}
+
+// pending returns the ids of the spooled entries
+func (s *uploadSpool) pending() ([]string, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if id, ok := strings.CutSuffix(f.Name(), ".json"); ok && !f.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *uploadSpool) read(id string) (spoolEntry, []byte, error) {
+	var entry spoolEntry
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return entry, nil, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, nil, err
+	}
+	body, err := os.ReadFile(filepath.Join(s.dir, filepath.Base(entry.BodyFile)))
+	if err != nil {
+		return entry, nil, err
+	}
+	// Entries spooled before the hash was recorded can't be checked
+	if hash := sha256.Sum256(body); entry.BodyHash != "" && entry.BodyHash != hex.EncodeToString(hash[:]) {
+		return entry, nil, errCorruptSpooledBody
+	}
+	return entry, body, nil
+}
+
+// setUploadSpool persists the background uploads to UPLOAD_SPOOL_DIR. It must be set before serving
+func (s *server) setUploadSpool(spool *uploadSpool) {
+	s.spool = spool
+}
+
+// spoolUpload persists a background upload when UPLOAD_SPOOL_DIR is set. Failing to spool it
+// only loses the retry, the upload goes on
+func (s *server) spoolUpload(key, path string, body []byte, meta ObjectMeta) string {
+	if s.spool == nil {
+		return ""
+	}
+	id, err := s.spool.add(key, path, body, meta)
+	if err != nil {
+		slog.Warn("Failed to spool an upload", "path", path, "key", key, "error", err)
+		return ""
+	}
+	return id
+}
+
+// finishSpooled removes a spooled upload once it succeeded, a failed one stays for the next replay
+func (s *server) finishSpooled(id string, err error) {
+	if id == "" {
+		return
+	}
+	if err != nil {
+		s.spool.release(id)
+		return
+	}
+	s.spool.done(id)
+}
+
+// runSpoolReplay uploads the spooled entries left by a previous process on startup,
+// then retries the failed ones every UPLOAD_SPOOL_RETRY_INTERVAL
+func (s *server) runSpoolReplay(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.UploadSpoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.replaySpool(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replaySpool uploads every spooled entry that isn't in flight, one at a time
+func (s *server) replaySpool(ctx context.Context) {
+	ids, err := s.spool.pending()
+	if err != nil {
+		slog.Error("Failed to list UPLOAD_SPOOL_DIR", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.spool.claim(id) {
+			s.replayEntry(ctx, id)
+		}
+	}
+}
+
+func (s *server) replayEntry(ctx context.Context, id string) {
+	entry, body, err := s.spool.read(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.spool.release(id)
+		return
+	}
+	if err != nil {
+		slog.Error("Dropping an unreadable spooled upload", "id", id, "error", err)
+		s.spool.done(id)
+		return
+	}
+
+	uploadCtx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout/s3WriteBudgetDivisor)
+	err = s.storeObject(uploadCtx, entry.Key, entry.Path, body, entry.Meta)
+	cancel()
+	if err == nil {
+		slog.Info("Uploaded a spooled image", "path", entry.Path, "key", entry.Key)
+		s.spool.done(id)
+		return
+	}
+
+	entry.Attempts++
+	if entry.Attempts >= spoolMaxAttempts {
+		slog.Error("Dropping a spooled upload after its last attempt", "path", entry.Path, "key", entry.Key, "attempts", entry.Attempts, "error", err)
+		s.spool.done(id)
+		return
+	}
+	slog.Warn("Spooled upload failed, retrying it later", "path", entry.Path, "key", entry.Key, "attempts", entry.Attempts, "error", err)
+	if err := s.spool.write(id, entry); err != nil {
+		slog.Warn("Failed to update a spooled upload", "id", id, "error", err)
+	}
+	s.spool.release(id)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingStore fails every upload, as a provider unreachable until the process dies would
+type failingStore struct {
+	*memoryStore
+}
+
+func (f failingStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	return errors.New("connection refused")
+}
+
+func TestSpooledUploadSurvivesACrash(t *testing.T) {
+	dir := t.TempDir()
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	spool, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, proxy := newTestServerWithStore(t, Config{}, imgproxyStub(), failingStore{newMemoryStore()})
+	srv.setUploadSpool(spool)
+
+	if resp := get(t, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	ids, err := spool.pending()
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("Expected the failed upload to be left in the spool, got %v %v", ids, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ids[0]+".body")); err != nil {
+		t.Fatalf("Expected the spool entry to reference its body file: %v", err)
+	}
+
+	// The next process replays the spool on startup
+	restarted, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, _, store := newTestServer(t, Config{}, imgproxyStub())
+	next.setUploadSpool(restarted)
+	next.replaySpool(context.Background())
+
+	if _, ok := store.get(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the spooled image to be uploaded on replay")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the spool to be empty once replayed, got %d files", len(files))
+	}
+}
+
+func TestSpooledUploadIsRemovedOnceStored(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, proxy, store := newTestServer(t, Config{}, imgproxyStub())
+	srv.setUploadSpool(spool)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+
+	if _, ok := store.get(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the image to be stored")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the spool entry to be removed after the upload, got %d files", len(files))
+	}
+}
+
+func TestSpooledUploadIsDroppedAfterItsLastAttempt(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openUploadSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newTestServerWithStore(t, Config{}, imgproxyStub(), failingStore{newMemoryStore()})
+	srv.setUploadSpool(spool)
+
+	id, err := spool.add("key", "/_/plain/src", []byte("image"), ObjectMeta{ContentType: "image/jpeg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.release(id)
+
+	for range spoolMaxAttempts {
+		srv.replaySpool(context.Background())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the entry to be dropped after %d attempts, got %d files", spoolMaxAttempts, len(files))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// maxSpriteThumbSize bounds the width and height of the thumbnails of a sprite
+const maxSpriteThumbSize = 1024
+
+// spriteKeyPrefix is the folder of the cached sprites, under the prefix of their tenant
+const spriteKeyPrefix = "sprites/"
+
+// spriteRequest is the body of POST /sprite: the sources of a contact sheet, in order, and its grid
+type spriteRequest struct {
+	Sources []string `json:"sources"`
+	// Columns defaults to the square root of the number of sources, rounded up
+	Columns int `json:"columns,omitempty"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	// Format of the sprite, png by default or jpg
+	Format string `json:"format,omitempty"`
+}
+
+// validate checks a sprite request against SPRITE_MAX_IMAGES and fills its defaults
+func (req *spriteRequest) validate(maxImages int) error {
+	if len(req.Sources) == 0 || len(req.Sources) > maxImages {
+		return fmt.Errorf("expected 1 to %d sources, got %d", maxImages, len(req.Sources))
+	}
+	if req.Width <= 0 || req.Width > maxSpriteThumbSize || req.Height <= 0 || req.Height > maxSpriteThumbSize {
+		return fmt.Errorf("expected a thumbnail width and height between 1 and %d", maxSpriteThumbSize)
+	}
+	if req.Columns == 0 {
+		req.Columns = int(math.Ceil(math.Sqrt(float64(len(req.Sources)))))
+	}
+	if req.Columns < 0 {
+		return errors.New("expected a positive number of columns")
+	}
+	req.Columns = min(req.Columns, len(req.Sources))
+
+	switch req.Format = canonicalFormat(req.Format); req.Format {
+	case "":
+		req.Format = "png"
+	case "png", "jpg":
+	default:
+		return fmt.Errorf("invalid sprite format %q, expected png or jpg", req.Format)
+	}
+	return nil
+}
+
+// key returns the key of a sprite, the hash of its sources and grid
+func (req spriteRequest) key() string {
+	spec, _ := json.Marshal(req)
+	hash := md5.Sum(spec)
+	return spriteKeyPrefix + hex.EncodeToString(hash[:]) + "." + req.Format
+}
+
+// handleSprite answers POST /sprite with a contact sheet of its sources, each processed by imgproxy into a
+// thumbnail and laid out left to right, top to bottom. Sprites are cached under spriteKeyPrefix.
+// The proxy signs the thumbnail paths itself, so sources are only bounded by ALLOWED_SOURCE_HOSTS
+func (s *server) handleSprite(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.SpriteMaxImages == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if s.inMaintenance(w) {
+		return
+	}
+	release, ok := s.admitted(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var req spriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid sprite request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(s.cfg.SpriteMaxImages); err != nil {
+		http.Error(w, fmt.Sprintf("invalid sprite request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+	defer cancel()
+
+	key := s.keys.prefix(tenantFrom(ctx)) + req.key()
+	cc := s.cacheControl(r.Header)
+	if !cc.skipRead() {
+		obj, err := s.store.Get(ctx, key)
+		if err == nil {
+			defer obj.Body.Close()
+			w.Header().Set("Content-Type", obj.ContentType)
+			w.Header().Set("Content-Length", strconv.FormatInt(obj.ContentLength, 10))
+			w.Header().Set("X-Cache", "HIT")
+			io.Copy(w, obj.Body)
+			return
+		}
+		if !errors.Is(err, ErrNotFound) {
+			slog.Warn("Sprite lookup failed, generating it instead", "key", key, "stage", stageS3Read, "error", err)
+		}
+	}
+
+	thumbs := make([]image.Image, len(req.Sources))
+	for i, source := range req.Sources {
+		thumb, status, err := s.spriteThumb(ctx, source, req.Width, req.Height)
+		if err != nil {
+			slog.Warn("Failed to generate a sprite thumbnail", "source", source, "error", err)
+			http.Error(w, fmt.Sprintf("source %d: %v", i, err), status)
+			return
+		}
+		thumbs[i] = thumb
+	}
+
+	body, contentType, err := composeSprite(thumbs, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+
+	if !cc.skipWrite() {
+		s.storeKeyInBackground(ctx, key, "/"+req.key(), body, ObjectMeta{ContentType: contentType})
+	}
+}
+
+// spriteThumb processes a source into a thumbnail with imgproxy, it returns the status to answer with on failure
+func (s *server) spriteThumb(ctx context.Context, source string, width, height int) (image.Image, int, error) {
+	options := []string{"rs:fill:" + strconv.Itoa(width) + ":" + strconv.Itoa(height)}
+	path := s.signatures.resign(plainPath(source, options, "png")).String()
+	if err := s.sources.checkHost(path); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err := s.sources.checkRedirects(ctx, path); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	resp, err := s.fetchUpstream(ctx, path)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, http.StatusBadGateway, fmt.Errorf("imgproxy responded with status %d", resp.status)
+	}
+	thumb, _, err := image.Decode(bytes.NewReader(resp.body))
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to decode the thumbnail: %w", err)
+	}
+	return thumb, http.StatusOK, nil
+}
+
+// composeSprite lays thumbnails out on the grid of a sprite request, each centered in its cell, and encodes it
+func composeSprite(thumbs []image.Image, req spriteRequest) ([]byte, string, error) {
+	rows := (len(thumbs) + req.Columns - 1) / req.Columns
+	sprite := image.NewRGBA(image.Rect(0, 0, req.Columns*req.Width, rows*req.Height))
+
+	for i, thumb := range thumbs {
+		cell := image.Rect(0, 0, req.Width, req.Height).Add(image.Pt(i%req.Columns*req.Width, i/req.Columns*req.Height))
+		size := thumb.Bounds().Size()
+		offset := image.Pt(max(req.Width-size.X, 0)/2, max(req.Height-size.Y, 0)/2)
+		draw.Draw(sprite, cell.Add(offset).Intersect(cell), thumb, thumb.Bounds().Min, draw.Over)
+	}
+
+	var buf bytes.Buffer
+	if req.Format == "jpg" {
+		if err := jpeg.Encode(&buf, sprite, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&buf, sprite); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
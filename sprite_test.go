@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// thumbStub answers imgproxy requests with a PNG of the requested rs:fill size
+func thumbStub(calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		p, err := parseImgproxyPath(requestPath(r.URL))
+		if err != nil || len(p.Options) == 0 {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		args := strings.Split(p.Options[0], ":")
+		width, _ := strconv.Atoi(args[2])
+		height, _ := strconv.Atoi(args[3])
+
+		thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+		for i := range thumb.Pix {
+			thumb.Pix[i] = 0xff
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, thumb)
+	})
+}
+
+func postSprite(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url+"/sprite", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestSpriteIsComposedAndCached(t *testing.T) {
+	var calls atomic.Int32
+	srv, proxy, store := newTestServer(t, Config{SpriteMaxImages: 16}, thumbStub(&calls))
+
+	body := `{"sources": ["http://example.com/1.jpg", "http://example.com/2.jpg", "http://example.com/3.jpg", "http://example.com/4.jpg"], "columns": 2, "width": 40, "height": 30}`
+	resp := postSprite(t, proxy.URL, body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a generated sprite, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	sprite, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected a PNG sprite: %v", err)
+	}
+	if size := sprite.Bounds().Size(); size != image.Pt(80, 60) {
+		t.Fatalf("Expected a 2x2 sprite of 80x60, got %v", size)
+	}
+	if got := color.RGBAModel.Convert(sprite.At(79, 59)).(color.RGBA); got.A != 0xff {
+		t.Fatalf("Expected the last cell to hold a thumbnail, got %v", got)
+	}
+	if calls.Load() != 4 {
+		t.Fatalf("Expected imgproxy to process the 4 thumbnails, got %d calls", calls.Load())
+	}
+	srv.uploads.Wait()
+
+	req := spriteRequest{Sources: []string{"http://example.com/1.jpg", "http://example.com/2.jpg", "http://example.com/3.jpg", "http://example.com/4.jpg"}, Columns: 2, Width: 40, Height: 30}
+	req.validate(16)
+	stored, ok := store.get(req.key())
+	if !ok {
+		t.Fatal("Expected the sprite to be cached")
+	}
+	if cached, err := png.Decode(bytes.NewReader(stored)); err != nil || cached.Bounds().Size() != image.Pt(80, 60) {
+		t.Fatalf("Expected the cached sprite to be 80x60, got %v", err)
+	}
+
+	resp = postSprite(t, proxy.URL, body)
+	if resp.Header.Get("X-Cache") != "HIT" || calls.Load() != 4 {
+		t.Fatalf("Expected the sprite to be served from the cache, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestInvalidSpriteRequestIsRejected(t *testing.T) {
+	var calls atomic.Int32
+	_, proxy, _ := newTestServer(t, Config{SpriteMaxImages: 2}, thumbStub(&calls))
+
+	for _, body := range []string{
+		`{"sources": [], "width": 40, "height": 30}`,
+		`{"sources": ["http://example.com/1.jpg", "http://example.com/2.jpg", "http://example.com/3.jpg"], "width": 40, "height": 30}`,
+		`{"sources": ["http://example.com/1.jpg"], "width": 5000, "height": 30}`,
+		`{"sources": ["http://example.com/1.jpg"], "width": 40, "height": 30, "format": "gif"}`,
+		`not json`,
+	} {
+		if resp := postSprite(t, proxy.URL, body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, resp.StatusCode)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected invalid sprite requests not to reach imgproxy")
+	}
+}
+
+func TestSpriteIsDisabledByDefault(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	if resp := postSprite(t, proxy.URL, `{"sources": ["http://example.com/1.jpg"], "width": 40, "height": 30}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404 without SPRITE_MAX_IMAGES, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ladderWidthOptions are the options whose width selects a step of SRCSET_LADDER. Resizing options
+// also set a height or a crop, so their siblings wouldn't be the other steps of a srcset
+var ladderWidthOptions = []string{"w", "width"}
+
+// ladderWidth returns the width set by the last width option of a path, when it's a step of the ladder
+func ladderWidth(p imgproxyPath, ladder []int) (int, int, bool) {
+	for i := len(p.Options) - 1; i >= 0; i-- {
+		name, value, _ := strings.Cut(p.Options[i], ":")
+		if !slices.Contains(ladderWidthOptions, name) {
+			continue
+		}
+		width, err := strconv.Atoi(value)
+		return i, width, err == nil && slices.Contains(ladder, width)
+	}
+	return 0, 0, false
+}
+
+// siblingPaths returns the paths of the other SRCSET_LADDER widths of a path requesting one of them,
+// signed when IMGPROXY_KEY is set. Other paths have no siblings
+func (s *server) siblingPaths(path string) []string {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return nil
+	}
+	i, width, ok := ladderWidth(p, s.cfg.SrcsetLadder)
+	if !ok {
+		return nil
+	}
+	name, _, _ := strings.Cut(p.Options[i], ":")
+
+	var siblings []string
+	for _, step := range s.cfg.SrcsetLadder {
+		if step == width {
+			continue
+		}
+		sibling := p
+		sibling.Options = slices.Clone(p.Options)
+		sibling.Options[i] = fmt.Sprintf("%s:%d", name, step)
+		siblings = append(siblings, s.signatures.resign(sibling).String())
+	}
+	return siblings
+}
+
+// prefetchSiblings generates the other widths of SRCSET_LADDER in the background after a miss on one
+// of them, as a page's srcset is usually requested moments later. A sibling already cached or being
+// generated is skipped, and so is one over MAX_NEW_KEYS_PER_MINUTE. SRCSET_PREFETCH_CONCURRENCY bounds
+// the generations running at once
+func (s *server) prefetchSiblings(ctx context.Context, path string) {
+	if len(s.cfg.SrcsetLadder) == 0 {
+		return
+	}
+	for _, sibling := range s.siblingPaths(path) {
+		key := s.cacheKey(ctx, sibling)
+		s.generations.do(key, func() (int, error) {
+			s.prefetchSlots <- struct{}{}
+			defer func() { <-s.prefetchSlots }()
+
+			if info, err := s.headCached(ctx, key); err == nil && !s.expired(info.ObjectMeta, info.LastModified) {
+				return 0, nil
+			}
+			if s.newKeys != nil {
+				if ok, _ := s.newKeys.admit(key, time.Now()); !ok {
+					return 0, nil
+				}
+			}
+			status, err := s.processAndStore(ctx, sibling)
+			if err != nil {
+				slog.Error("Srcset prefetch failed", "path", sibling, "error", err)
+			}
+			return status, err
+		})
+	}
+}
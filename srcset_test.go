@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSiblingPaths(t *testing.T) {
+	srv := &server{cfg: Config{SrcsetLadder: []int{320, 640, 960}}, signatures: newSignatureVerifier(Config{})}
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	got := srv.siblingPaths("/_/w:640/q:80" + source)
+	want := []string{"/_/w:320/q:80" + source, "/_/w:960/q:80" + source}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Expected the siblings %v, got %v", want, got)
+	}
+	if got := srv.siblingPaths("/_/width:320" + source); len(got) != 2 || !strings.HasPrefix(got[0], "/_/width:640/") {
+		t.Fatalf("Expected the siblings to keep the width option's name, got %v", got)
+	}
+
+	for _, path := range []string{"/_/w:500" + source, "/_/rs:fill:640:480" + source, "/_/q:80" + source} {
+		if got := srv.siblingPaths(path); len(got) != 0 {
+			t.Errorf("Expected %s to have no siblings, got %v", path, got)
+		}
+	}
+}
+
+func TestSrcsetPrefetchWarmsTheLadder(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image"))
+	})
+	srv, proxy, store := newTestServer(t, Config{SrcsetLadder: []int{320, 640, 960}}, stub)
+
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key("/_/w:320"+source), strings.NewReader("cached"), ObjectMeta{})
+
+	if resp := get(t, proxy.URL+"/_/w:640"+source); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a miss, got %q", resp.Header.Get("X-Cache"))
+	}
+	srv.uploads.Wait()
+	if calls.Load() != 2 {
+		t.Fatalf("Expected the missing sibling to be generated and the cached one skipped, got %d calls", calls.Load())
+	}
+
+	for _, width := range []string{"320", "960"} {
+		if resp := get(t, proxy.URL+"/_/w:"+width+source); resp.Header.Get("X-Cache") != "HIT" {
+			t.Errorf("Expected the sibling of width %s to hit, got %q", width, resp.Header.Get("X-Cache"))
+		}
+	}
+	if body, _ := store.get(GenerateS3Key("/_/w:320" + source)); string(body) != "cached" {
+		t.Fatalf("Expected the cached sibling to be kept, got %q", body)
+	}
+	srv.uploads.Wait()
+	if calls.Load() != 2 {
+		t.Fatalf("Expected hits not to prefetch their siblings, got %d calls", calls.Load())
+	}
+}
+
+func TestSrcsetPrefetchIsConcurrencyLimited(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.Write([]byte("image"))
+	})
+	cfg := Config{SrcsetLadder: []int{320, 480, 640, 960, 1280}, SrcsetPrefetchConcurrency: 1}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	get(t, proxy.URL+"/_/w:640/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	srv.uploads.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak != 1 {
+		t.Fatalf("Expected a single prefetch at a time, got %d", peak)
+	}
+	if store.len() != 5 {
+		t.Fatalf("Expected every step of the ladder to be cached, got %d", store.len())
+	}
+}
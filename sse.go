@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventStreamType = "text/event-stream"
+
+// wantsEventStream reports whether a request accepts server-sent events, which long admin jobs then stream
+// their progress as instead of JSON lines
+func wantsEventStream(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, accepted := range strings.Split(value, ",") {
+			if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == eventStreamType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// progressStream writes the progress of a long admin job, either as one JSON line per message or as
+// server-sent events named after their message, with heartbeat comments keeping idle connections open
+type progressStream struct {
+	mu  sync.Mutex
+	w   io.Writer
+	rc  *http.ResponseController
+	sse bool
+}
+
+// newProgressStream starts the response of a job, as server-sent events when the request accepts them.
+// The response may last longer than WRITE_TIMEOUT, the job's own steps are bounded instead
+func newProgressStream(w http.ResponseWriter, r *http.Request) *progressStream {
+	stream := &progressStream{w: w, rc: http.NewResponseController(w), sse: wantsEventStream(r)}
+	stream.rc.SetWriteDeadline(time.Time{})
+
+	if stream.sse {
+		w.Header().Set("Content-Type", eventStreamType)
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	stream.rc.Flush()
+	return stream
+}
+
+// send writes a message, as a line or as an event of the given name
+func (s *progressStream) send(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	} else {
+		_, err = s.w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// heartbeat writes a comment every interval until stop is closed, so proxies don't close an event stream
+// waiting on slow steps. JSON lines have no comments, they get no heartbeat
+func (s *progressStream) heartbeat(interval time.Duration, stop <-chan struct{}) {
+	if !s.sse || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			_, err := io.WriteString(s.w, ": heartbeat\n\n")
+			if err == nil {
+				s.rc.Flush()
+			}
+			s.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
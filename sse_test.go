@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents reads the events of a stream until it ends, counting its comments
+func readEvents(t *testing.T, resp *http.Response) ([]sseEvent, int) {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	comments := 0
+	for scanner := bufio.NewScanner(resp.Body); scanner.Scan(); {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+			comments++
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		case line == "" && current.name != "":
+			events = append(events, current)
+			current = sseEvent{}
+		}
+	}
+	return events, comments
+}
+
+func warmRequestBody(n int) string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/_/rs:fill:%d:%d/plain/http://example.com/kitten.jpg", i+1, i+1)
+	}
+	body, _ := json.Marshal(warmRequest{Paths: paths})
+	return string(body)
+}
+
+func TestWantsEventStream(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"text/event-stream":                   true,
+		"application/json, text/event-stream": true,
+		"text/event-stream; q=0.9":            true,
+		"application/x-ndjson":                false,
+		"":                                    false,
+	} {
+		r, _ := http.NewRequest(http.MethodPost, "/admin/warm", nil)
+		r.Header.Set("Accept", accept)
+		if got := wantsEventStream(r); got != want {
+			t.Errorf("Expected wantsEventStream(%q) to be %v", accept, want)
+		}
+	}
+}
+
+func TestWarmStreamsServerSentEvents(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte("image"))
+	})
+	_, proxy, store := newTestServer(t, Config{WarmConcurrency: 1, SSEHeartbeatInterval: 10 * time.Millisecond}, slow)
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/admin/warm", strings.NewReader(warmRequestBody(3)))
+	req.Header.Set(adminTokenHeader, testAdminToken)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != eventStreamType {
+		t.Fatalf("Expected an event stream, got Content-Type %q", ct)
+	}
+
+	events, heartbeats := readEvents(t, resp)
+	if len(events) != 4 {
+		t.Fatalf("Expected 3 progress events and a summary, got %+v", events)
+	}
+	for i, event := range events[:3] {
+		var p warmProgress
+		if err := json.Unmarshal([]byte(event.data), &p); err != nil || event.name != "progress" || p.Done != i+1 || p.Total != 3 {
+			t.Fatalf("Unexpected progress event %+v", event)
+		}
+	}
+	var summary warmSummary
+	json.Unmarshal([]byte(events[3].data), &summary)
+	if events[3].name != "summary" || summary.Done != 3 || summary.Failed != 0 {
+		t.Fatalf("Unexpected summary event %+v", events[3])
+	}
+	if heartbeats == 0 {
+		t.Fatal("Expected heartbeat comments while the paths were processed")
+	}
+	if store.len() != 3 {
+		t.Fatalf("Expected the 3 paths to be stored, got %d", store.len())
+	}
+}
+
+func TestClosingTheEventStreamCancelsTheWarmup(t *testing.T) {
+	var processed atomic.Int32
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processed.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("image"))
+	})
+	srv, proxy, _ := newTestServer(t, Config{WarmConcurrency: 1}, slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/admin/warm", strings.NewReader(warmRequestBody(50)))
+	req.Header.Set(adminTokenHeader, testAdminToken)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "event: progress") {
+	}
+	cancel()
+	resp.Body.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	srv.uploads.Wait()
+	if n := processed.Load(); n >= 50 {
+		t.Fatalf("Expected the warmup to stop once the client is gone, %d paths were processed", n)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// staleStore keeps a memory copy of the most recently read objects, up to STALE_CACHE_BYTES. When the
+// store is still throttling reads once their retries are spent, the copy is served stale rather than
+// turning a hit into a miss, which would add to the load of imgproxy during the traffic spike.
+// Copies older than MEMORY_CACHE_TTL are dropped rather than served, bounding how stale they can be
+type staleStore struct {
+	CacheStore
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used
+	recent *list.List
+	size   int64
+}
+
+type staleEntry struct {
+	key    string
+	meta   ObjectMeta
+	body   []byte
+	copied time.Time
+}
+
+func newStaleStore(store CacheStore, maxBytes int64, ttl time.Duration) *staleStore {
+	return &staleStore{
+		CacheStore: store,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		recent:     list.New(),
+	}
+}
+
+func (s *staleStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	obj, err := s.CacheStore.Get(ctx, key)
+	if err == nil {
+		// A byte range isn't the object, only whole reads are copied
+		if obj.ContentRange == "" && obj.ContentLength >= 0 && obj.ContentLength <= s.maxBytes {
+			obj.Body = &copyingBody{ReadCloser: obj.Body, store: s, key: key, meta: obj.ObjectMeta, length: obj.ContentLength}
+		}
+		return obj, nil
+	}
+	if !isSlowDown(err) {
+		return nil, err
+	}
+
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil, err
+	}
+	slog.Warn("S3 is throttling reads, serving the memory copy", "key", key, "error", err)
+	return &CachedObject{
+		ObjectMeta:    entry.meta,
+		Body:          io.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Stale:         true,
+	}, nil
+}
+
+// Put and Delete drop the memory copy, which would be outdated
+func (s *staleStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	s.remove(key)
+	return s.CacheStore.Put(ctx, key, r, meta)
+}
+
+// Delete drops the copy again once the object is deleted, a read finishing during the delete may have copied it
+func (s *staleStore) Delete(ctx context.Context, key string) error {
+	s.remove(key)
+	defer s.remove(key)
+	return s.CacheStore.Delete(ctx, key)
+}
+
+func (s *staleStore) lookup(key string) (*staleEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*staleEntry)
+	if s.ttl > 0 && time.Since(entry.copied) > s.ttl {
+		s.removeLocked(key)
+		return nil, false
+	}
+	s.recent.MoveToFront(elem)
+	return entry, true
+}
+
+// add keeps a copy of an object, evicting the least recently used ones beyond maxBytes
+func (s *staleStore) add(entry *staleEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(entry.key)
+	s.entries[entry.key] = s.recent.PushFront(entry)
+	s.size += int64(len(entry.body))
+	for s.size > s.maxBytes {
+		s.removeLocked(s.recent.Back().Value.(*staleEntry).key)
+	}
+}
+
+func (s *staleStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *staleStore) removeLocked(key string) {
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.recent.Remove(elem)
+	delete(s.entries, key)
+	s.size -= int64(len(elem.Value.(*staleEntry).body))
+}
+
+// copyingBody copies an object's body as it's streamed to the client. The copy is only kept once
+// the whole body was read, a partial copy would serve a truncated image
+type copyingBody struct {
+	io.ReadCloser
+	store  *staleStore
+	key    string
+	meta   ObjectMeta
+	length int64
+	buf    bytes.Buffer
+	eof    bool
+}
+
+func (b *copyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *copyingBody) Close() error {
+	if b.eof && int64(b.buf.Len()) == b.length {
+		b.store.add(&staleEntry{key: b.key, meta: b.meta, body: b.buf.Bytes(), copied: time.Now()})
+	}
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// throttlingStore answers SlowDown to every read while throttled is set
+type throttlingStore struct {
+	*memoryStore
+	throttled atomic.Bool
+	gets      atomic.Int32
+}
+
+func (s *throttlingStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	s.gets.Add(1)
+	if s.throttled.Load() {
+		return nil, &smithy.GenericAPIError{Code: "SlowDown"}
+	}
+	return s.memoryStore.Get(ctx, key)
+}
+
+func TestMemoryCopyIsServedWhileS3ThrottlesReads(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("processed"))
+	})
+
+	throttling := &throttlingStore{memoryStore: newMemoryStore()}
+	limited := newLimitedStore(throttling, 0)
+	limited.setThrottleRetries(2, time.Millisecond)
+	_, proxy := newTestServerWithStore(t, Config{StaleCacheBytes: 1024}, stub, newStaleStore(limited, 1024, 0))
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	throttling.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached"), ObjectMeta{ContentType: "image/jpeg"})
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a hit, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+
+	throttling.throttled.Store(true)
+	throttling.gets.Store(0)
+	resp := get(t, proxy.URL+path)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "STALE" || string(body) != "cached" {
+		t.Fatalf("Expected the memory copy to be served stale, got %d, X-Cache %q, %q", resp.StatusCode, resp.Header.Get("X-Cache"), body)
+	}
+	if got := throttling.gets.Load(); got != 3 {
+		t.Fatalf("Expected the read to be tried 3 times with 2 retries, got %d", got)
+	}
+	if calls.Load() != 0 {
+		t.Fatal("Expected imgproxy not to be called while a memory copy exists")
+	}
+
+	other := "/_/rs:fill:80:80/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+other); resp.Header.Get("X-Cache") != "MISS" || calls.Load() != 1 {
+		t.Fatalf("Expected an image without a memory copy to be processed, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestStaleStoreEvictsAndDropsOutdatedCopies(t *testing.T) {
+	store := newStaleStore(newMemoryStore(), 10, 0)
+	read := func(key, content string) {
+		store.Put(context.Background(), key, strings.NewReader(content), ObjectMeta{})
+		obj, err := store.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		io.ReadAll(obj.Body)
+		obj.Body.Close()
+	}
+
+	read("a", "aaaa")
+	read("b", "bbbb")
+	if _, ok := store.lookup("a"); !ok {
+		t.Fatal("Expected a copy of a")
+	}
+	read("c", "cccc")
+	if _, ok := store.lookup("b"); ok {
+		t.Fatal("Expected the least recently used copy to be evicted beyond the max bytes")
+	}
+
+	store.Put(context.Background(), "a", strings.NewReader("new"), ObjectMeta{})
+	if _, ok := store.lookup("a"); ok {
+		t.Fatal("Expected an overwritten object to drop its copy")
+	}
+}
+
+func TestMemoryCopiesExpireAfterMemoryCacheTTL(t *testing.T) {
+	throttling := &throttlingStore{memoryStore: newMemoryStore()}
+	store := newStaleStore(throttling, 1024, time.Hour)
+	throttling.Put(context.Background(), "key", strings.NewReader("cached"), ObjectMeta{})
+	obj, _ := store.Get(context.Background(), "key")
+	io.ReadAll(obj.Body)
+	obj.Body.Close()
+
+	throttling.throttled.Store(true)
+	if obj, err := store.Get(context.Background(), "key"); err != nil || !obj.Stale {
+		t.Fatalf("Expected a fresh memory copy to be served stale, got %v", err)
+	}
+
+	store.entries["key"].Value.(*staleEntry).copied = time.Now().Add(-2 * time.Hour)
+	if _, err := store.Get(context.Background(), "key"); !isSlowDown(err) {
+		t.Fatalf("Expected an expired memory copy not to be served, got %v", err)
+	}
+	if _, ok := store.lookup("key"); ok {
+		t.Fatal("Expected the expired memory copy to be dropped")
+	}
+}
+
+// copyOnDeleteStore completes a read of the deleted object while deleting it, as a read racing a purge would
+type copyOnDeleteStore struct {
+	*memoryStore
+	stale *staleStore
+}
+
+func (s *copyOnDeleteStore) Delete(ctx context.Context, key string) error {
+	s.stale.add(&staleEntry{key: key, body: []byte("cached"), copied: time.Now()})
+	return s.memoryStore.Delete(ctx, key)
+}
+
+func TestPurgeDropsTheMemoryCopy(t *testing.T) {
+	inner := &copyOnDeleteStore{memoryStore: newMemoryStore()}
+	store := newStaleStore(inner, 1024, 0)
+	inner.stale = store
+	_, proxy := newTestServerWithStore(t, Config{StaleCacheBytes: 1024}, imgproxyStub(), store)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	inner.Put(context.Background(), GenerateS3Key(path), strings.NewReader("cached"), ObjectMeta{})
+	if resp := get(t, proxy.URL+path); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a hit, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if _, ok := store.lookup(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the hit to be copied in memory")
+	}
+
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if _, ok := store.lookup(GenerateS3Key(path)); ok {
+		t.Fatal("Expected the purge to drop the memory copy, even one made during the delete")
+	}
+}
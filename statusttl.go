@@ -0,0 +1,53 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTTLByStatus reads the status=TTL pairs of TTL_BY_STATUS, e.g. 200=720h,404=1m. Only successful
+// images and errors can be cached, a redirect or an interim response has headers an object can't keep
+func parseTTLByStatus(pairs []string) (map[int]time.Duration, error) {
+	ttls := make(map[int]time.Duration, len(pairs))
+	for _, pair := range pairs {
+		code, value, _ := strings.Cut(pair, "=")
+		status, err := strconv.Atoi(code)
+		if err != nil || (status != http.StatusOK && (status < 400 || status > 599)) {
+			return nil, fmt.Errorf("failed to parse TTL_BY_STATUS, expected 200 or an error status: %q", pair)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("failed to parse TTL_BY_STATUS, expected a positive duration: %q", pair)
+		}
+		if _, dup := ttls[status]; dup {
+			return nil, fmt.Errorf("failed to parse TTL_BY_STATUS, duplicate status: %d", status)
+		}
+		ttls[status] = ttl
+	}
+	return ttls, nil
+}
+
+// status returns the status a cached object is served with, 200 for an image
+func (m ObjectMeta) status() int {
+	return cmp.Or(m.Status, http.StatusOK)
+}
+
+// cachesStatus reports whether a response of imgproxy with this status is stored. Errors are only
+// stored when TTL_BY_STATUS gives them a TTL, so a negative result expires on its own
+func (s *server) cachesStatus(status int) bool {
+	_, ok := s.cfg.TTLByStatus[status]
+	return status == http.StatusOK || ok
+}
+
+// ttl returns the age past which a cached object is regenerated: its status's TTL_BY_STATUS, CACHE_TTL
+// for images otherwise. Zero means it never expires
+func (s *server) ttl(meta ObjectMeta) time.Duration {
+	if ttl, ok := s.cfg.TTLByStatus[meta.status()]; ok {
+		return ttl
+	}
+	return s.cfg.CacheTTL
+}
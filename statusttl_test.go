@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTTLByStatus(t *testing.T) {
+	ttls, err := parseTTLByStatus([]string{"200=720h", "404=1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ttls) != 2 || ttls[200] != 720*time.Hour || ttls[404] != time.Minute {
+		t.Fatalf("Unexpected TTLs %v", ttls)
+	}
+
+	for _, invalid := range []string{"404", "404=", "404=0s", "abc=1m", "302=1m", "404=1m,404=2m"} {
+		if _, err := parseTTLByStatus(strings.Split(invalid, ",")); err == nil {
+			t.Errorf("Expected TTL_BY_STATUS %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestTTLByStatus(t *testing.T) {
+	var calls atomic.Int32
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if strings.Contains(r.URL.Path, "missing") {
+			http.Error(w, "source not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	})
+	cfg := Config{CacheTTL: time.Hour, TTLByStatus: map[int]time.Duration{http.StatusOK: 720 * time.Hour, http.StatusNotFound: time.Minute}}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	found := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	missing := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/missing.jpg")
+	for _, path := range []string{found, missing} {
+		get(t, proxy.URL+path)
+	}
+	srv.uploads.Wait()
+
+	resp, err := http.Get(proxy.URL + missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("X-Cache") != "HIT" || !strings.Contains(string(body), "source not found") {
+		t.Fatalf("Expected the cached 404 to be served, got %d %q %q", resp.StatusCode, resp.Header.Get("X-Cache"), body)
+	}
+	if info, _ := store.Head(context.Background(), GenerateS3Key(missing)); info.Status != http.StatusNotFound {
+		t.Fatalf("Expected the 404 to be stored with its status, got %d", info.Status)
+	}
+
+	// Past the 404's minute and CACHE_TTL, but within the 200's TTL
+	store.age(GenerateS3Key(found), 2*time.Hour)
+	store.age(GenerateS3Key(missing), 2*time.Minute)
+	calls.Store(0)
+
+	if resp := get(t, proxy.URL+found); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the image to be fresh for its long TTL, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if resp := get(t, proxy.URL+missing); resp.StatusCode != http.StatusNotFound || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the 404 to expire after its short TTL, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	srv.uploads.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("Expected only the expired 404 to be regenerated, got %d calls", calls.Load())
+	}
+}
+
+func TestErrorsAreNotCachedWithoutATTL(t *testing.T) {
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "source not found", http.StatusNotFound)
+	})
+	srv, proxy, store := newTestServer(t, Config{TTLByStatus: map[int]time.Duration{http.StatusGone: time.Minute}}, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/missing.jpg")
+	get(t, proxy.URL+path)
+	srv.uploads.Wait()
+	if store.len() != 0 {
+		t.Fatalf("Expected a 404 without a TTL_BY_STATUS entry not to be cached, got %d objects", store.len())
+	}
+}
+
+func TestStatusIsStoredAsMetadata(t *testing.T) {
+	meta := ObjectMeta{Status: http.StatusNotFound}
+	if got := meta.userMetadata()[statusMetadata]; got != "404" {
+		t.Fatalf("Expected the status in the user metadata, got %q", got)
+	}
+	if got := objectMeta(nil, meta.userMetadata()).status(); got != http.StatusNotFound {
+		t.Fatalf("Expected the status to be read back from the metadata, got %d", got)
+	}
+	if got := objectMeta(nil, nil).status(); got != http.StatusOK {
+		t.Fatalf("Expected images to be served with 200, got %d", got)
+	}
+}
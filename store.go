@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrNotFound is returned by a CacheStore when the key isn't cached
+var ErrNotFound = errors.New("object not found")
+
+// CacheStore is where processed images are persisted
+type CacheStore interface {
+	Get(ctx context.Context, key string) (*CachedObject, error)
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error
+	// Delete removes an object, deleting a missing key isn't an error
+	Delete(ctx context.Context, key string) error
+	// List returns up to limit objects whose key starts with prefix, after the given cursor.
+	// Their ObjectMeta isn't filled, it takes a Head per object
+	List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error)
+}
+
+// ObjectMeta describes a stored object
+type ObjectMeta struct {
+	ContentType string
+	// ContentHash is the hex SHA-256 of the body, used to skip re-uploading identical content
+	ContentHash string
+	// SourceURL, Options and Format describe how the image was produced, set with STORE_SOURCE_METADATA.
+	// Format is the output format the path asked for, formatAuto when it left it to imgproxy
+	SourceURL string
+	Options   string
+	Format    string
+	// Pinned objects are never regenerated, they're served past CACHE_TTL until purged or unpinned
+	Pinned bool
+	// Tags are added to the S3_OBJECT_TAGS of an upload, such as ANIMATED_OBJECT_TAGS. They aren't read back
+	Tags map[string]string
+	// Status is the status of a cached error of TTL_BY_STATUS, served in place of 200. Zero for images
+	Status int
+	// ContentMD5 is the base64 MD5 of the body sent as Content-MD5 with SEND_CONTENT_MD5. It isn't read back
+	ContentMD5 string
+}
+
+// The S3 user metadata holding the fields of ObjectMeta, sent as x-amz-meta-* headers
+const (
+	contentHashMetadata = "content-sha256"
+	sourceURLMetadata   = "source-url"
+	optionsMetadata     = "options"
+	formatMetadata      = "format"
+	pinnedMetadata      = "pinned"
+	statusMetadata      = "status"
+)
+
+// userMetadata returns the S3 user metadata of an object, nil when there's none
+func (m ObjectMeta) userMetadata() map[string]string {
+	metadata := map[string]string{}
+	for name, value := range map[string]string{
+		contentHashMetadata: m.ContentHash,
+		sourceURLMetadata:   m.SourceURL,
+		optionsMetadata:     m.Options,
+		formatMetadata:      m.Format,
+		pinnedMetadata:      pinnedValue(m.Pinned),
+		statusMetadata:      statusValue(m.Status),
+	} {
+		if value != "" {
+			metadata[name] = value
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+func pinnedValue(pinned bool) string {
+	if pinned {
+		return "true"
+	}
+	return ""
+}
+
+func statusValue(status int) string {
+	if status == 0 {
+		return ""
+	}
+	return strconv.Itoa(status)
+}
+
+// formatAuto is the Format metadata of an image whose path didn't ask for an output format
+const formatAuto = "auto"
+
+// sourceMetadata returns the source URL, the processing options and the requested format of a path, stored with
+// STORE_SOURCE_METADATA. Encrypted sources are left out. Metadata values are sent as headers, their non-ASCII
+// bytes are percent-encoded
+func sourceMetadata(path string) (sourceURL, options, format string) {
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return "", "", ""
+	}
+	if source, err := p.SourceURL(); err == nil {
+		sourceURL = asciiMetadata(source)
+	}
+	if format = asciiMetadata(p.Format()); format == "" {
+		format = formatAuto
+	}
+	return sourceURL, asciiMetadata(strings.Join(p.Options, "/")), format
+}
+
+func asciiMetadata(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// objectMeta reads the ObjectMeta of a stored object
+func objectMeta(contentType *string, metadata map[string]string) ObjectMeta {
+	status, _ := strconv.Atoi(metadata[statusMetadata])
+	return ObjectMeta{
+		ContentType: aws.ToString(contentType),
+		ContentHash: metadata[contentHashMetadata],
+		SourceURL:   metadata[sourceURLMetadata],
+		Options:     metadata[optionsMetadata],
+		Format:      metadata[formatMetadata],
+		Pinned:      metadata[pinnedMetadata] == "true",
+		Status:      status,
+	}
+}
+
+// ObjectInfo describes a stored object without its body
+type ObjectInfo struct {
+	ObjectMeta
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectPage is a page of listed objects, NextCursor is empty on the last page
+type ObjectPage struct {
+	Objects    []ObjectInfo
+	NextCursor string
+}
+
+// CachedObject is a stored object, the caller must close its body
+type CachedObject struct {
+	ObjectMeta
+	Body          io.ReadCloser
+	ContentLength int64
+	LastModified  time.Time
+	// Stale is set on a memory copy served while the store throttles reads, see staleStore
+	Stale bool
+	// ContentRange is set when only the byte range of withByteRange was read, ContentLength is then its length
+	ContentRange string
+}
+
+// s3Store stores objects in an S3-compatible bucket, under an optional folder
+type s3Store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	folder   string
+
+	// tags are the S3_OBJECT_TAGS applied to uploads
+	tags map[string]string
+
+	// presigner is set when uploads are sent on presigned URLs
+	presigner  *s3.PresignClient
+	httpClient s3.HTTPClient
+}
+
+func newS3Store(client *s3.Client, bucket, folder string) *s3Store {
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = 5 * 1024 * 1024
+		u.BufferProvider = manager.NewBufferedReadSeekerWriteToPool(10 * 1024 * 1024)
+	})
+
+	return &s3Store{
+		client:   client,
+		uploader: uploader,
+		bucket:   bucket,
+		folder:   folder,
+	}
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (*CachedObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	}
+	if byteRange := byteRangeFrom(ctx); byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrNotFound
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			return nil, errRangeNotSatisfiable
+		}
+		return nil, err
+	}
+
+	return &CachedObject{
+		ObjectMeta:    objectMeta(out.ContentType, out.Metadata),
+		Body:          out.Body,
+		ContentLength: aws.ToInt64(out.ContentLength),
+		LastModified:  aws.ToTime(out.LastModified),
+		ContentRange:  aws.ToString(out.ContentRange),
+	}, nil
+}
+
+func (s *s3Store) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		ObjectMeta:   objectMeta(out.ContentType, out.Metadata),
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	if s.presigner != nil {
+		return s.putPresigned(ctx, key, r, meta)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Body:   r,
+	}
+	if meta.ContentType != "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+	input.Metadata = meta.userMetadata()
+	if tagging := s.tagging(meta); tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+
+	// The uploader drops Content-MD5 from multipart uploads, the body is sent in a single PUT instead
+	if meta.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(meta.ContentMD5)
+		_, err := s.client.PutObject(ctx, input)
+		return err
+	}
+	_, err := s.uploader.Upload(ctx, input)
+	return err
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	return err
+}
+
+func (s *s3Store) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.objectKey(prefix)),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	if cursor != "" {
+		input.ContinuationToken = aws.String(cursor)
+	}
+
+	out, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ObjectPage{NextCursor: aws.ToString(out.NextContinuationToken)}
+	for _, obj := range out.Contents {
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          strings.TrimPrefix(aws.ToString(obj.Key), s.folder),
+			Size:         aws.ToInt64(obj.Size),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+	return page, nil
+}
+
+func (s *s3Store) objectKey(key string) string {
+	return fmt.Sprintf("%s%s", s.folder, key)
+}
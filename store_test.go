@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is an in-memory CacheStore used by the tests
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	meta     ObjectMeta
+	body     []byte
+	modified time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string]memoryObject{}}
+}
+
+func (m *memoryStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if byteRange := byteRangeFrom(ctx); byteRange != "" {
+		return obj.byteRange(byteRange)
+	}
+	return &CachedObject{
+		ObjectMeta:    obj.meta,
+		Body:          io.NopCloser(bytes.NewReader(obj.body)),
+		ContentLength: int64(len(obj.body)),
+		LastModified:  obj.modified,
+	}, nil
+}
+
+// byteRange reads a single byte range of the object, as S3 does
+func (o memoryObject) byteRange(byteRange string) (*CachedObject, error) {
+	size := int64(len(o.body))
+	first, last, _ := strings.Cut(strings.TrimPrefix(byteRange, "bytes="), "-")
+	start, _ := strconv.ParseInt(first, 10, 64)
+	end, err := strconv.ParseInt(last, 10, 64)
+	if first == "" {
+		start, end = max(size-end, 0), size-1
+	} else if err != nil || end >= size {
+		end = size - 1
+	}
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	return &CachedObject{
+		ObjectMeta:    o.meta,
+		Body:          io.NopCloser(bytes.NewReader(o.body[start : end+1])),
+		ContentLength: end - start + 1,
+		LastModified:  o.modified,
+		ContentRange:  fmt.Sprintf("bytes %d-%d/%d", start, end, size),
+	}, nil
+}
+
+func (m *memoryStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{ObjectMeta: obj.meta, Key: key, Size: int64(len(obj.body)), LastModified: obj.modified}, nil
+}
+
+func (m *memoryStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{meta: meta, body: body, modified: time.Now()}
+	return nil
+}
+
+// age makes a stored object look older, as if it was stored d ago
+func (m *memoryStore) age(key string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj := m.objects[key]
+	obj.modified = obj.modified.Add(-d)
+	m.objects[key] = obj
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// List uses the last returned key as the cursor
+func (m *memoryStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) && key > cursor {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	page := &ObjectPage{}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		page.NextCursor = keys[limit-1]
+	}
+	for _, key := range keys {
+		obj := m.objects[key]
+		page.Objects = append(page.Objects, ObjectInfo{Key: key, Size: int64(len(obj.body))})
+	}
+	return page, nil
+}
+
+func (m *memoryStore) get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	return obj.body, ok
+}
+
+func (m *memoryStore) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.objects)
+}
+
+// stallingStore blocks every operation until its context is done
+type stallingStore struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (s *stallingStore) Get(ctx context.Context, key string) (*CachedObject, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *stallingStore) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *stallingStore) Delete(ctx context.Context, key string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *stallingStore) List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *stallingStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	<-ctx.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, ctx.Err())
+	return ctx.Err()
+}
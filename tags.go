@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"strings"
+)
+
+// S3 limits on object tags
+const (
+	maxObjectTags        = 10
+	maxObjectTagKeyLen   = 128
+	maxObjectTagValueLen = 256
+)
+
+// parseObjectTags reads key=value tags, as applied to uploaded objects for lifecycle rules
+func parseObjectTags(pairs []string) (map[string]string, error) {
+	return parseTags("S3_OBJECT_TAGS", pairs)
+}
+
+// parseTags reads the key=value tags of the variable name
+func parseTags(name string, pairs []string) (map[string]string, error) {
+	if len(pairs) > maxObjectTags {
+		return nil, fmt.Errorf("failed to parse %s, expected at most %d tags: got %d", name, maxObjectTags, len(pairs))
+	}
+
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || len(key) > maxObjectTagKeyLen || len(value) > maxObjectTagValueLen || !isTagText(key) || !isTagText(value) {
+			return nil, fmt.Errorf("failed to parse %s, expected key=value tags made of letters, digits, spaces and + - = . _ : / @: %q", name, pair)
+		}
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("failed to parse %s, duplicate tag: %q", name, key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+func isTagText(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(" +-=._:/@", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// encodeObjectTags returns the tags in the query string form expected by S3
+func encodeObjectTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// setObjectTags makes every upload carry the given tags
+func (s *s3Store) setObjectTags(tags map[string]string) {
+	s.tags = tags
+}
+
+// tagging returns the encoded tags of an upload: the S3_OBJECT_TAGS, overridden by the object's own tags
+func (s *s3Store) tagging(meta ObjectMeta) string {
+	if len(meta.Tags) == 0 {
+		return encodeObjectTags(s.tags)
+	}
+	tags := maps.Clone(s.tags)
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	maps.Copy(tags, meta.Tags)
+	return encodeObjectTags(tags)
+}
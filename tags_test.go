@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestParseObjectTags(t *testing.T) {
+	tags, err := parseObjectTags([]string{"app=imgcache", "tier=processed", "path=a/b:c@d"})
+	if err != nil {
+		t.Fatalf("Expected valid tags, got %v", err)
+	}
+	if encoded := encodeObjectTags(tags); encoded != "app=imgcache&path=a%2Fb%3Ac%40d&tier=processed" {
+		t.Fatalf("Unexpected encoding %q", encoded)
+	}
+
+	for _, invalid := range [][]string{
+		{"app"},
+		{"=imgcache"},
+		{"app=img&cache"},
+		{"app=a", "app=b"},
+		{strings.Repeat("k", 129) + "=v"},
+		strings.Split("a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11", ","),
+	} {
+		if _, err := parseObjectTags(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestUploadsCarryObjectTags(t *testing.T) {
+	for _, presigned := range []bool{false, true} {
+		var tagging string
+		fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tagging = r.Header.Get("X-Amz-Tagging")
+			if tagging == "" {
+				tagging = r.URL.Query().Get("x-amz-tagging")
+			}
+		}))
+		t.Cleanup(fakeS3.Close)
+
+		store := newS3Store(s3.New(s3.Options{
+			Region:       "auto",
+			BaseEndpoint: aws.String(fakeS3.URL),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		}), "bucket", "")
+		store.setObjectTags(map[string]string{"app": "imgcache", "tier": "processed"})
+		if presigned {
+			store.enablePresignedUploads()
+		}
+
+		if err := store.Put(context.Background(), "key", strings.NewReader("image"), ObjectMeta{}); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		if tagging != "app=imgcache&tier=processed" {
+			t.Errorf("Expected the upload to carry the tags (presigned: %v), got %q", presigned, tagging)
+		}
+	}
+}
+
+func TestObjectTagsMinIO(t *testing.T) {
+	ctx := context.Background()
+
+	dockerNetwork := createDockerNetwork(t, ctx)
+	t.Cleanup(func() { dockerNetwork.Remove(ctx) })
+	minioContainer, minioEndpoint, _ := setupMinIOContainerWithNetwork(t, ctx, dockerNetwork)
+	t.Cleanup(func() { testcontainers.TerminateContainer(minioContainer) })
+
+	client := minIOClient(t, minioEndpoint)
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(processedBucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	store := newS3Store(client, processedBucket, "")
+	store.setObjectTags(map[string]string{"app": "imgcache", "tier": "processed"})
+	if err := store.Put(ctx, "key", strings.NewReader("image"), ObjectMeta{ContentType: "image/jpeg"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	out, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(processedBucket), Key: aws.String("key")})
+	if err != nil {
+		t.Fatalf("Failed to get the object tags: %v", err)
+	}
+	tags := map[string]string{}
+	for _, tag := range out.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if len(tags) != 2 || tags["app"] != "imgcache" || tags["tier"] != "processed" {
+		t.Fatalf("Unexpected tags %v", tags)
+	}
+}
+
+func TestImageTagsOverrideObjectTags(t *testing.T) {
+	store := &s3Store{}
+	store.setObjectTags(map[string]string{"app": "imgcache", "tier": "processed"})
+
+	if got := store.tagging(ObjectMeta{}); got != "app=imgcache&tier=processed" {
+		t.Fatalf("Unexpected tagging %q", got)
+	}
+	if got := store.tagging(ObjectMeta{Tags: map[string]string{"tier": "animated"}}); got != "app=imgcache&tier=animated" {
+		t.Fatalf("Expected the image's tags to override S3_OBJECT_TAGS, got %q", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Tenant modes: the tenant is the subdomain of TENANT_DOMAIN the request is addressed to,
+// or the one TENANT_TOKENS associates with the bearer token of the request
+const (
+	tenantModeSubdomain = "subdomain"
+	tenantModeToken     = "token"
+)
+
+var (
+	errMissingTenantToken = errors.New("missing or unknown tenant token")
+	errUnknownTenantHost  = errors.New("host is not a tenant subdomain")
+)
+
+// tenantResolver finds the tenant of a request, the cache of each tenant is isolated under its own prefix
+type tenantResolver struct {
+	mode   string
+	domain string
+	// tokens maps bearer tokens to tenants
+	tokens map[string]string
+}
+
+func newTenantResolver(cfg Config) *tenantResolver {
+	return &tenantResolver{
+		mode:   cfg.TenantMode,
+		domain: strings.ToLower(cfg.TenantDomain),
+		tokens: cfg.TenantTokens,
+	}
+}
+
+// resolve returns the tenant of a request, empty when tenants are disabled
+func (t *tenantResolver) resolve(r *http.Request) (string, error) {
+	switch t.mode {
+	case tenantModeToken:
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tenant, known := t.tokens[strings.TrimSpace(token)]
+		if !ok || !known {
+			return "", errMissingTenantToken
+		}
+		return tenant, nil
+	case tenantModeSubdomain:
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tenant, ok := strings.CutSuffix(strings.ToLower(host), "."+t.domain)
+		if !ok || !isTenantName(tenant) {
+			return "", errUnknownTenantHost
+		}
+		return tenant, nil
+	}
+	return "", nil
+}
+
+// middleware rejects requests without a tenant and scopes the others to theirs
+func (t *tenantResolver) middleware(next http.Handler) http.Handler {
+	if t.mode == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := t.resolve(r)
+		if errors.Is(err, errMissingTenantToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(withTenant(r.Context(), tenant))
+		if t.mode == tenantModeToken {
+			// The tenant token is the proxy's credential, it isn't forwarded to imgproxy
+			r.Header = r.Header.Clone()
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type tenantContextKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFrom returns the tenant a request was scoped to, empty when tenants are disabled
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// isTenantName reports whether a tenant name is safe to use as a key prefix
+func isTenantName(s string) bool {
+	if s == "" || len(s) > 63 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTenantTokens reads token:tenant pairs
+func parseTenantTokens(pairs []string) (map[string]string, error) {
+	tokens := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		token, tenant, ok := strings.Cut(pair, ":")
+		if !ok || token == "" || !isTenantName(tenant) {
+			return nil, fmt.Errorf("failed to parse TENANT_TOKENS, expected token:tenant pairs with lowercase tenant names: %q", pair)
+		}
+		tokens[token] = tenant
+	}
+	return tokens, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+var tenantTestConfig = Config{
+	TenantMode:   tenantModeToken,
+	TenantTokens: map[string]string{"token-a": "tenant-a", "token-b": "tenant-b"},
+}
+
+// doAs sends a request authenticated with a tenant token
+func doAs(t *testing.T, token, method, requestURL string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTenantsHaveIsolatedKeys(t *testing.T) {
+	srv, proxy, store := newTestServer(t, tenantTestConfig, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	doAs(t, "token-a", http.MethodGet, proxy.URL+path)
+	srv.uploads.Wait()
+
+	if _, ok := store.get("tenant-a/" + GenerateS3Key(path)); !ok {
+		t.Fatalf("Expected the image to be stored under the tenant prefix")
+	}
+	if resp := doAs(t, "token-b", http.MethodGet, proxy.URL+path); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected another tenant not to hit the cached image, got %q", resp.Header.Get("X-Cache"))
+	}
+	if resp := doAs(t, "token-b", http.MethodGet, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the tenant to see its own entry, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if store.len() != 2 {
+		t.Fatalf("Expected one entry per tenant, got %d", store.len())
+	}
+}
+
+func TestTenantPurgeOnlyAffectsItsPrefix(t *testing.T) {
+	srv, proxy, store := newTestServer(t, tenantTestConfig, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	doAs(t, "token-a", http.MethodGet, proxy.URL+path)
+	srv.uploads.Wait()
+
+	purge := proxy.URL + "/admin/cache?path=" + url.QueryEscape(path)
+	if resp := doAs(t, "token-b", http.MethodDelete, purge); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected another tenant's purge to find nothing, got %d", resp.StatusCode)
+	}
+	if _, ok := store.get("tenant-a/" + GenerateS3Key(path)); !ok {
+		t.Fatal("Expected the image to survive another tenant's purge")
+	}
+
+	if resp := doAs(t, "token-a", http.MethodDelete, purge); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the tenant's purge to succeed, got %d", resp.StatusCode)
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected the image to be purged, found %d objects", store.len())
+	}
+}
+
+func TestTenantTokenIsRequired(t *testing.T) {
+	_, proxy, _ := newTestServer(t, tenantTestConfig, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for _, token := range []string{"", "unknown"} {
+		if resp := doAs(t, token, http.MethodGet, proxy.URL+path); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestTenantFromSubdomain(t *testing.T) {
+	resolver := newTenantResolver(Config{TenantMode: tenantModeSubdomain, TenantDomain: "img.example.com"})
+
+	tests := map[string]string{
+		"acme.img.example.com":      "acme",
+		"ACME.img.example.com:8080": "acme",
+		"img.example.com":           "",
+		"a.b.img.example.com":       "",
+		"acme.example.org":          "",
+	}
+	for host, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+
+		tenant, err := resolver.resolve(r)
+		if tenant != want || (err != nil) != (want == "") {
+			t.Errorf("resolve(%q) = %q, %v, want %q", host, tenant, err, want)
+		}
+	}
+}
+
+func TestTenantCannotToggleMaintenance(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, tenantTestConfig, imgproxyStub())
+
+	if resp := doAs(t, "token-a", http.MethodPut, proxy.URL+"/admin/maintenance"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a tenant token to be refused, got %d", resp.StatusCode)
+	}
+	if srv.maintenance.Load() {
+		t.Fatal("Expected maintenance to stay off")
+	}
+	if resp := adminDoWithBody(t, http.MethodPut, proxy.URL+"/admin/maintenance", `{"enabled":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the admin token to toggle maintenance without a tenant, got %d", resp.StatusCode)
+	}
+}
+
+func TestTenantTokenIsNotForwardedToImgproxy(t *testing.T) {
+	forwarded := make(chan string, 1)
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	})
+	srv, proxy, _ := newTestServer(t, tenantTestConfig, stub)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := doAs(t, "token-a", http.MethodGet, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+
+	if auth := <-forwarded; auth != "" {
+		t.Fatalf("Expected the tenant token not to reach imgproxy, got %q", auth)
+	}
+}
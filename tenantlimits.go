@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The limits of TENANT_LIMITS: requests per second, and bytes stored and served per calendar month (UTC)
+const (
+	tenantLimitRate      = "rate"
+	tenantLimitStorage   = "storage"
+	tenantLimitBandwidth = "bandwidth"
+)
+
+// tenantLimit holds the TENANT_LIMITS of a tenant, zero being unlimited
+type tenantLimit struct {
+	rate      int
+	storage   int64
+	bandwidth int64
+}
+
+// parseTenantLimits reads the tenant:limit=value items of TENANT_LIMITS, e.g. acme:rate=50,acme:storage=10737418240
+func parseTenantLimits(items []string) (map[string]tenantLimit, error) {
+	limits := map[string]tenantLimit{}
+	for _, item := range items {
+		tenant, setting, _ := strings.Cut(item, ":")
+		name, value, _ := strings.Cut(setting, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !isTenantName(tenant) || err != nil || n < 1 {
+			return nil, fmt.Errorf("failed to parse TENANT_LIMITS, expected tenant:limit=positive integer items: %q", item)
+		}
+		limit := limits[tenant]
+		switch name {
+		case tenantLimitRate:
+			limit.rate = int(n)
+		case tenantLimitStorage:
+			limit.storage = n
+		case tenantLimitBandwidth:
+			limit.bandwidth = n
+		default:
+			return nil, fmt.Errorf("failed to parse TENANT_LIMITS, expected a %s, %s or %s limit: %q", tenantLimitRate, tenantLimitStorage, tenantLimitBandwidth, item)
+		}
+		limits[tenant] = limit
+	}
+	return limits, nil
+}
+
+// tenantLimiter enforces TENANT_LIMITS with counters kept in memory, so each instance enforces them on its own
+// traffic and a restart starts the month over. It's nil when TENANT_LIMITS is unset, every request is then allowed
+type tenantLimiter struct {
+	limits map[string]tenantLimit
+
+	mu     sync.Mutex
+	usages map[string]*tenantUsage
+}
+
+// tenantUsage is the usage of a tenant. The rate is a token bucket holding a second of requests,
+// the bytes are counted over the month
+type tenantUsage struct {
+	tokens   float64
+	refilled time.Time
+	month    string
+	stored   int64
+	served   int64
+	// rejected counts the requests over each limit, since startup
+	rejected map[string]int64
+}
+
+func newTenantLimiter(limits map[string]tenantLimit) *tenantLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &tenantLimiter{limits: limits, usages: map[string]*tenantUsage{}}
+}
+
+// usage returns the usage of a tenant, its byte counters reset when a new month started. The caller holds mu
+func (l *tenantLimiter) usage(tenant string, now time.Time) *tenantUsage {
+	u, ok := l.usages[tenant]
+	if !ok {
+		u = &tenantUsage{tokens: float64(l.limits[tenant].rate), refilled: now, rejected: map[string]int64{}}
+		l.usages[tenant] = u
+	}
+	if month := now.UTC().Format("2006-01"); u.month != month {
+		u.month, u.stored, u.served = month, 0, 0
+	}
+	return u
+}
+
+// admit checks a request of a tenant against its rate and bandwidth. A request over the limit returns
+// which limit it's over and, for the rate, how long until a request is allowed again
+func (l *tenantLimiter) admit(tenant string, now time.Time) (string, time.Duration) {
+	if l == nil {
+		return "", 0
+	}
+	limit, ok := l.limits[tenant]
+	if !ok {
+		return "", 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usage(tenant, now)
+	if limit.bandwidth > 0 && u.served >= limit.bandwidth {
+		u.rejected[tenantLimitBandwidth]++
+		return tenantLimitBandwidth, 0
+	}
+	if limit.rate > 0 {
+		u.tokens = min(u.tokens+now.Sub(u.refilled).Seconds()*float64(limit.rate), float64(limit.rate))
+		u.refilled = now
+		if u.tokens < 1 {
+			u.rejected[tenantLimitRate]++
+			return tenantLimitRate, time.Duration((1 - u.tokens) / float64(limit.rate) * float64(time.Second))
+		}
+		u.tokens--
+	}
+	return "", 0
+}
+
+// overStorage reports whether a tenant stored its monthly storage quota, counting the request when reject is set
+func (l *tenantLimiter) overStorage(tenant string, now time.Time, reject bool) bool {
+	if l == nil || l.limits[tenant].storage == 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usage(tenant, now)
+	if u.stored < l.limits[tenant].storage {
+		return false
+	}
+	if reject {
+		u.rejected[tenantLimitStorage]++
+	}
+	return true
+}
+
+// record adds the bytes a tenant stored and served to its monthly usage
+func (l *tenantLimiter) record(tenant string, stored, served int64, now time.Time) {
+	if l == nil {
+		return
+	}
+	if _, ok := l.limits[tenant]; !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usage(tenant, now)
+	u.stored += stored
+	u.served += served
+}
+
+// admitTenant rejects an image request of a tenant over TENANT_LIMITS: 429 over its rate, with a Retry-After,
+// and 507 once it was served its monthly bandwidth
+func (s *server) admitTenant(w http.ResponseWriter, r *http.Request) bool {
+	tenant := tenantFrom(r.Context())
+	over, wait := s.tenantLimits.admit(tenant, time.Now())
+	switch over {
+	case "":
+		return true
+	case tenantLimitRate:
+		w.Header().Set("Retry-After", retryAfter(wait))
+		http.Error(w, "tenant request rate exceeded, retry later", http.StatusTooManyRequests)
+	default:
+		slog.Warn("Rejected request over the tenant's monthly bandwidth", "tenant", tenant, "path", requestPath(r.URL))
+		http.Error(w, "tenant monthly bandwidth quota exceeded", http.StatusInsufficientStorage)
+	}
+	return false
+}
+
+// rejectOverStorage answers 507 to a miss that would be stored for a tenant over its monthly storage quota.
+// Its cached images are still served
+func (s *server) rejectOverStorage(w http.ResponseWriter, r *http.Request) bool {
+	tenant := tenantFrom(r.Context())
+	if s.skipStore(r) || !s.tenantLimits.overStorage(tenant, time.Now(), true) {
+		return false
+	}
+	slog.Warn("Rejected miss over the tenant's monthly storage quota", "tenant", tenant, "path", requestPath(r.URL))
+	http.Error(w, "tenant monthly storage quota exceeded", http.StatusInsufficientStorage)
+	return true
+}
+
+// writeMetrics exposes the monthly usage of the tenants of TENANT_LIMITS and their rejected requests
+func (l *tenantLimiter) writeMetrics(w http.ResponseWriter) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tenants := make([]string, 0, len(l.usages))
+	for tenant := range l.usages {
+		tenants = append(tenants, tenant)
+	}
+	slices.Sort(tenants)
+	now := time.Now()
+
+	fmt.Fprintf(w, "# HELP imgproxy_cache_tenant_stored_bytes Bytes stored for the tenant this month\n# TYPE imgproxy_cache_tenant_stored_bytes gauge\n")
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "imgproxy_cache_tenant_stored_bytes{tenant=%q} %d\n", tenant, l.usage(tenant, now).stored)
+	}
+	fmt.Fprintf(w, "# HELP imgproxy_cache_tenant_served_bytes Bytes of images served to the tenant this month\n# TYPE imgproxy_cache_tenant_served_bytes gauge\n")
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "imgproxy_cache_tenant_served_bytes{tenant=%q} %d\n", tenant, l.usage(tenant, now).served)
+	}
+	fmt.Fprintf(w, "# HELP imgproxy_cache_tenant_rejected_requests_total Requests rejected over a TENANT_LIMITS limit\n# TYPE imgproxy_cache_tenant_rejected_requests_total counter\n")
+	for _, tenant := range tenants {
+		for _, limit := range []string{tenantLimitRate, tenantLimitStorage, tenantLimitBandwidth} {
+			fmt.Fprintf(w, "imgproxy_cache_tenant_rejected_requests_total{tenant=%q,limit=%q} %d\n", tenant, limit, l.usages[tenant].rejected[limit])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTenantLimits(t *testing.T) {
+	limits, err := parseTenantLimits([]string{"tenant-a:rate=5", "tenant-a:storage=1000", "tenant-b:bandwidth=2000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["tenant-a"] != (tenantLimit{rate: 5, storage: 1000}) || limits["tenant-b"] != (tenantLimit{bandwidth: 2000}) {
+		t.Fatalf("Unexpected limits %+v", limits)
+	}
+	for _, item := range []string{"tenant-a:rate=0", "tenant-a:speed=5", "Tenant:rate=5", "tenant-a=5"} {
+		if _, err := parseTenantLimits([]string{item}); err == nil {
+			t.Errorf("Expected %q to be rejected", item)
+		}
+	}
+}
+
+func TestTenantOverItsRateIsRejected(t *testing.T) {
+	cfg := tenantTestConfig
+	cfg.TenantLimits = map[string]tenantLimit{"tenant-a": {rate: 2}}
+	_, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for range 2 {
+		if resp := doAs(t, "token-a", http.MethodGet, proxy.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the requests within the rate to be served, got %d", resp.StatusCode)
+		}
+	}
+	resp := doAs(t, "token-a", http.MethodGet, proxy.URL+path)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("Expected the request over the rate to get a 429 with a Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := doAs(t, "token-b", http.MethodGet, proxy.URL+path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected another tenant not to be limited, got %d", resp.StatusCode)
+	}
+}
+
+func TestTenantOverItsStorageQuotaIsRejected(t *testing.T) {
+	cfg := tenantTestConfig
+	cfg.TenantLimits = map[string]tenantLimit{"tenant-a": {storage: 10}}
+	srv, proxy, store := newTestServer(t, cfg, imgproxyStub())
+
+	cached := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	doAs(t, "token-a", http.MethodGet, proxy.URL+cached)
+	srv.uploads.Wait()
+
+	resp := doAs(t, "token-a", http.MethodGet, proxy.URL+"/_/rs:fill:60:60/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("Expected a miss over the storage quota to get a 507, got %d", resp.StatusCode)
+	}
+	if resp := doAs(t, "token-a", http.MethodGet, proxy.URL+cached); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the cached images of the tenant to still be served, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+	if resp := doAs(t, "token-b", http.MethodGet, proxy.URL+cached); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected another tenant not to be limited, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if store.len() != 2 {
+		t.Fatalf("Expected an image per tenant, got %d", store.len())
+	}
+
+	metrics := doAs(t, "", http.MethodGet, proxy.URL+"/metrics")
+	body, _ := io.ReadAll(metrics.Body)
+	if !strings.Contains(string(body), `imgproxy_cache_tenant_rejected_requests_total{tenant="tenant-a",limit="storage"} 1`) {
+		t.Fatalf("Expected the rejected miss to be counted, got:\n%s", body)
+	}
+}
+
+func TestTenantOverItsBandwidthQuotaIsRejected(t *testing.T) {
+	cfg := tenantTestConfig
+	cfg.TenantLimits = map[string]tenantLimit{"tenant-a": {bandwidth: 10}}
+	_, proxy, _ := newTestServer(t, cfg, imgproxyStub())
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	resp := doAs(t, "token-a", http.MethodGet, proxy.URL+path)
+	io.ReadAll(resp.Body)
+	if resp := doAs(t, "token-a", http.MethodGet, proxy.URL+path); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("Expected a request over the bandwidth quota to get a 507, got %d", resp.StatusCode)
+	}
+}
+
+func TestTenantUsageResetsEachMonth(t *testing.T) {
+	limiter := newTenantLimiter(map[string]tenantLimit{"tenant-a": {storage: 10}})
+	october := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	limiter.record("tenant-a", 10, 0, october)
+	if !limiter.overStorage("tenant-a", october, false) {
+		t.Fatal("Expected the tenant to be over its quota")
+	}
+	if limiter.overStorage("tenant-a", october.Add(2*time.Hour), false) {
+		t.Fatal("Expected the quota to start over with the month")
+	}
+}
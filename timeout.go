@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// routeWriteGrace is the time a route has to write its response once its timeout has expired
+const routeWriteGrace = 5 * time.Second
+
+// withRouteTimeout bounds the requests of a route by their own timeout rather than the server's WRITE_TIMEOUT,
+// so that admin operations such as a purge may take longer than image requests are allowed to
+func withRouteTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + routeWriteGrace))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowDeleteStore takes a while to delete, as a purge of many objects does
+type slowDeleteStore struct {
+	*memoryStore
+	delay time.Duration
+}
+
+func (s slowDeleteStore) Delete(ctx context.Context, key string) error {
+	select {
+	case <-time.After(s.delay):
+		return s.memoryStore.Delete(ctx, key)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newTimeoutTestServer serves the proxy with a WRITE_TIMEOUT shorter than the slow operations of the tests
+func newTimeoutTestServer(t *testing.T, cfg Config, imgproxy http.Handler, store CacheStore) *httptest.Server {
+	t.Helper()
+	srv, _ := newTestServerWithStore(t, cfg, imgproxy, store)
+	proxy := httptest.NewUnstartedServer(srv.handler())
+	proxy.Config.WriteTimeout = 150 * time.Millisecond
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestAdminRoutesOutlastTheImageTimeout(t *testing.T) {
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(400 * time.Millisecond):
+			w.Write([]byte("image"))
+		case <-r.Context().Done():
+		}
+	})
+	store := slowDeleteStore{memoryStore: newMemoryStore(), delay: 400 * time.Millisecond}
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("image"), ObjectMeta{})
+
+	cfg := Config{RequestTimeout: 50 * time.Millisecond, AdminTimeout: 2 * time.Second}
+	proxy := newTimeoutTestServer(t, cfg, stub, store)
+
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the slow purge to complete, got status %d", resp.StatusCode)
+	}
+
+	miss := "/_/rs:fill:80:80/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	if resp := get(t, proxy.URL+miss); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Expected the slow image request to time out, got status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminTimeoutBoundsAdminRoutes(t *testing.T) {
+	store := slowDeleteStore{memoryStore: newMemoryStore(), delay: time.Second}
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	store.Put(context.Background(), GenerateS3Key(path), strings.NewReader("image"), ObjectMeta{})
+
+	proxy := newTimeoutTestServer(t, Config{AdminTimeout: 50 * time.Millisecond}, imgproxyStub(), store)
+
+	start := time.Now()
+	if resp := adminDo(t, http.MethodDelete, proxy.URL+"/admin/cache?path="+url.QueryEscape(path)); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected the purge to be cut at ADMIN_TIMEOUT, got status %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("Expected the purge to be cut before it completes, took %v", elapsed)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// parseTimingAllowOrigins reads the origins of TIMING_ALLOW_ORIGINS, scheme://host[:port] or * for any origin
+func parseTimingAllowOrigins(items []string) ([]string, error) {
+	origins := make([]string, 0, len(items))
+	for _, item := range items {
+		if item == "*" {
+			origins = append(origins, item)
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+			strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("invalid TIMING_ALLOW_ORIGINS item %q, expected scheme://host[:port] or *", item)
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return origins, nil
+}
+
+// setTimingAllowOrigin lets the pages of the TIMING_ALLOW_ORIGINS origins read the detailed Resource Timing of
+// image responses. A listed Origin is echoed back, the response then varying on it, and * allows every origin
+func (s *server) setTimingAllowOrigin(w http.ResponseWriter, r *http.Request) {
+	if len(s.cfg.TimingAllowOrigins) == 0 {
+		return
+	}
+	if slices.Contains(s.cfg.TimingAllowOrigins, "*") {
+		w.Header().Set("Timing-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := strings.ToLower(r.Header.Get("Origin")); slices.Contains(s.cfg.TimingAllowOrigins, origin) {
+		w.Header().Set("Timing-Allow-Origin", r.Header.Get("Origin"))
+	}
+}
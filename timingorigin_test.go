@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func getFromOrigin(t *testing.T, rawURL, origin string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTimingAllowOriginIsSentToAllowedOrigins(t *testing.T) {
+	srv, proxy, _ := newTestServer(t, Config{TimingAllowOrigins: []string{"https://www.example.com"}}, imgproxyStub())
+	path := proxy.URL + "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	miss := getFromOrigin(t, path, "https://www.example.com")
+	srv.uploads.Wait()
+	hit := getFromOrigin(t, path, "https://www.example.com")
+	for name, resp := range map[string]*http.Response{"miss": miss, "hit": hit} {
+		if resp.Header.Get("Timing-Allow-Origin") != "https://www.example.com" {
+			t.Errorf("Expected the allowed origin in Timing-Allow-Origin on the %s, got %q", name, resp.Header.Get("Timing-Allow-Origin"))
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Origin") {
+			t.Errorf("Expected the %s to vary on Origin, got %q", name, resp.Header.Values("Vary"))
+		}
+	}
+
+	if resp := getFromOrigin(t, path, "https://evil.example.com"); resp.Header.Get("Timing-Allow-Origin") != "" {
+		t.Fatalf("Expected no Timing-Allow-Origin for another origin, got %q", resp.Header.Get("Timing-Allow-Origin"))
+	}
+}
+
+func TestTimingAllowOriginWildcard(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{TimingAllowOrigins: []string{"*"}}, imgproxyStub())
+
+	resp := get(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.Header.Get("Timing-Allow-Origin") != "*" {
+		t.Fatalf("Expected Timing-Allow-Origin: *, got %q", resp.Header.Get("Timing-Allow-Origin"))
+	}
+}
+
+func TestTimingAllowOriginIsOmittedByDefault(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+
+	resp := getFromOrigin(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"), "https://www.example.com")
+	if resp.Header.Get("Timing-Allow-Origin") != "" {
+		t.Fatalf("Expected no Timing-Allow-Origin header, got %q", resp.Header.Get("Timing-Allow-Origin"))
+	}
+}
+
+func TestParseTimingAllowOrigins(t *testing.T) {
+	origins, err := parseTimingAllowOrigins([]string{"https://WWW.Example.com/", "http://localhost:3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(origins, []string{"https://www.example.com", "http://localhost:3000"}) {
+		t.Fatalf("Unexpected origins %q", origins)
+	}
+	for _, item := range []string{"www.example.com", "https://www.example.com/images", "ftp://example.com"} {
+		if _, err := parseTimingAllowOrigins([]string{item}); err == nil {
+			t.Errorf("Expected %q to be rejected", item)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// tlsVersions are the accepted values of TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS_MIN_VERSION %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// listenAndServe serves HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are set, plain HTTP otherwise
+func listenAndServe(srv *http.Server, cfg Config) error {
+	ln, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.TLSCertFile == "" {
+		return srv.Serve(ln)
+	}
+	return srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+}
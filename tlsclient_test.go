@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientTransportTrustsCustomCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	withCA, err := newClientTransport(caFile, false)
+	if err != nil {
+		t.Fatalf("Failed to build transport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: withCA}).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected the request to succeed with the CA bundle: %v", err)
+	}
+	resp.Body.Close()
+
+	withoutCA, err := newClientTransport("", false)
+	if err != nil {
+		t.Fatalf("Failed to build transport: %v", err)
+	}
+	if resp, err := (&http.Client{Transport: withoutCA}).Get(upstream.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected the request to fail without the CA bundle")
+	}
+
+	insecure, err := newClientTransport("", true)
+	if err != nil {
+		t.Fatalf("Failed to build transport: %v", err)
+	}
+	resp, err = (&http.Client{Transport: insecure}).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected the request to succeed without verification: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientTransportRejectsEmptyBundle(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+	if _, err := newClientTransport(caFile, false); err == nil {
+		t.Fatal("Expected a bundle without certificates to be rejected")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// transformHeader reports the processing options of an image request once the proxy applied its defaults and rewrites
+const transformHeader = "X-Imgproxy-Transform"
+
+// exposeTransform sets the X-Imgproxy-Transform header of a request carrying ADMIN_TOKEN with DEBUG_HEADERS.
+// It holds the options of the path the image is processed and keyed with, spelled as NORMALIZE_OPTIONS keys them,
+// and the output format. Other requests never get it, it tells how the proxy rewrites paths
+func (s *server) exposeTransform(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.DebugHeaders || !s.hasAdminToken(r) {
+		return
+	}
+	path := keyPath(r.Context(), requestPath(r.URL))
+	if s.keys.cleanOptions {
+		path = normalizeOptions(path)
+	}
+	p, err := parseImgproxyPath(path)
+	if err != nil {
+		return
+	}
+	transform := strings.Join(p.Options, "/")
+	if p.Extension != "" {
+		transform += "@" + p.Extension
+	}
+	w.Header().Set(transformHeader, transform)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransformHeaderReportsTheAppliedTransform(t *testing.T) {
+	var requested atomic.Value
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(requestPath(r.URL))
+		w.Write([]byte("image"))
+	})
+	cfg := Config{DebugHeaders: true, NormalizeOptions: true, QualityDefaults: map[string]int{"webp": 75}}
+	srv, proxy, _ := newTestServer(t, cfg, stub)
+	source := "/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/_/width:300"+source+"@webp")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	srv.uploads.Wait()
+	if got := requested.Load(); got != "/_/width:300/q:75"+source+"@webp" {
+		t.Fatalf("Unexpected path sent to imgproxy %v", got)
+	}
+	if got := resp.Header.Get(transformHeader); got != "w:300/q:75@webp" {
+		t.Fatalf("Expected the header to report the applied transform, got %q", got)
+	}
+
+	if resp := adminDo(t, http.MethodGet, proxy.URL+"/_/width:300"+source+"@webp"); resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get(transformHeader) != "w:300/q:75@webp" {
+		t.Fatalf("Expected a cached image to report its transform too, got %q", resp.Header.Get(transformHeader))
+	}
+}
+
+func TestTransformHeaderRequiresTheAdminToken(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{DebugHeaders: true}, imgproxyStub())
+	path := "/_/w:300/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	if resp := get(t, proxy.URL+path); resp.Header.Get(transformHeader) != "" {
+		t.Fatalf("Expected no transform header without the admin token, got %q", resp.Header.Get(transformHeader))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+	req.Header.Set(adminTokenHeader, "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(transformHeader) != "" {
+		t.Fatal("Expected no transform header with an invalid admin token")
+	}
+}
+
+func TestTransformHeaderIsOffByDefault(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	resp := adminDo(t, http.MethodGet, proxy.URL+"/_/w:300/plain/"+url.QueryEscape("http://example.com/kitten.jpg"))
+	if resp.Header.Get(transformHeader) != "" {
+		t.Fatalf("Expected no transform header without DEBUG_HEADERS, got %q", resp.Header.Get(transformHeader))
+	}
+}
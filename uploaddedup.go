@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// uploadFlights deduplicates the uploads of a key within the process, with UPLOAD_DEDUP: requests that
+// each decided to store the same key, such as concurrent no-cache requests, run a single upload and
+// the others wait for its result rather than writing the same object again
+type uploadFlights struct {
+	mu       sync.Mutex
+	inFlight map[string]*uploadFlight
+	// joined counts the uploads that waited for the one of their key instead of writing it again
+	joined atomic.Int64
+}
+
+// uploadFlight is an upload running, its error is set once done is closed
+type uploadFlight struct {
+	done chan struct{}
+	err  error
+}
+
+func newUploadFlights() *uploadFlights {
+	return &uploadFlights{inFlight: map[string]*uploadFlight{}}
+}
+
+// do uploads a key with fn, or waits for the upload of the key already running and returns its error.
+// The upload runs in the caller, a waiter whose context is done gives up on it
+func (f *uploadFlights) do(ctx context.Context, key string, fn func() error) error {
+	f.mu.Lock()
+	if flight, ok := f.inFlight[key]; ok {
+		f.mu.Unlock()
+		f.joined.Add(1)
+		select {
+		case <-flight.done:
+			return flight.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	flight := &uploadFlight{done: make(chan struct{})}
+	f.inFlight[key] = flight
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.inFlight, key)
+		f.mu.Unlock()
+		close(flight.done)
+	}()
+	flight.err = fn()
+	return flight.err
+}
+
+// dedupUpload runs the upload of a key with UPLOAD_DEDUP, joining the one already running for the key.
+// The image of the joined upload is stored instead, the images of a key being the same
+func (s *server) dedupUpload(ctx context.Context, key string, fn func() error) error {
+	if s.uploadFlights == nil {
+		return fn()
+	}
+	return s.uploadFlights.do(ctx, key, fn)
+}
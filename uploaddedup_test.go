@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// blockingPutStore holds the uploads reaching a memory store until release is closed, and counts them
+type blockingPutStore struct {
+	*memoryStore
+	puts    atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingPutStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	b.puts.Add(1)
+	<-b.release
+	return b.memoryStore.Put(ctx, key, r, meta)
+}
+
+// bypassConcurrently sends no-cache requests for the same image at once
+func bypassConcurrently(t *testing.T, rawURL string, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+			req.Header.Set("Cache-Control", "no-cache")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected the bypass to be served, got %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUploadDedupRunsOneUploadPerKey(t *testing.T) {
+	store := &blockingPutStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	srv, proxy := newTestServerWithStore(t, Config{UploadDedup: true}, imgproxyStub(), store)
+
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	bypassConcurrently(t, proxy.URL+path, 5)
+	waitFor(t, func() bool { return srv.uploadFlights.joined.Load() == 4 })
+	close(store.release)
+	srv.uploads.Wait()
+
+	if store.puts.Load() != 1 {
+		t.Fatalf("Expected a single upload of the key, got %d", store.puts.Load())
+	}
+	if stored, ok := store.get(GenerateS3Key(path)); !ok || string(stored) != "processed:"+path {
+		t.Fatalf("Expected the image to be stored, got %q", stored)
+	}
+
+	resp := get(t, proxy.URL+"/metrics")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "\nimgproxy_cache_deduplicated_uploads_total 4\n") {
+		t.Fatalf("Expected the deduplicated uploads to be counted, got:\n%s", body)
+	}
+}
+
+func TestUploadsOfAKeyRunConcurrentlyByDefault(t *testing.T) {
+	store := &blockingPutStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	srv, proxy := newTestServerWithStore(t, Config{}, imgproxyStub(), store)
+
+	bypassConcurrently(t, proxy.URL+"/_/rs:fill:50:50/plain/"+url.QueryEscape("http://example.com/kitten.jpg"), 3)
+	waitFor(t, func() bool { return store.puts.Load() == 3 })
+	close(store.release)
+	srv.uploads.Wait()
+}
+
+func TestUploadDedupWaiterGivesUpWithItsContext(t *testing.T) {
+	flights := newUploadFlights()
+	started, release := make(chan struct{}), make(chan struct{})
+	go flights.do(context.Background(), "key", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := flights.do(ctx, "key", func() error {
+		t.Fatal("Expected the upload in flight to be joined")
+		return nil
+	})
+	if err != context.Canceled || flights.joined.Load() != 1 {
+		t.Fatalf("Expected the waiter to give up with its context, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// VERIFY_AFTER_WRITE values
+const (
+	verifyOff      = "off"
+	verifySize     = "size"
+	verifyChecksum = "checksum"
+)
+
+var errWriteVerification = errors.New("stored object doesn't match the uploaded image")
+
+// verifyWrite checks that an uploaded object landed as it was sent, to catch a provider corrupting
+// writes or a misconfigured bucket. With VERIFY_AFTER_WRITE=size, a HEAD compares its size and the
+// content hash of its metadata; with checksum, its body is read back and hashed.
+// A mismatch is logged and counted in writeVerifyFailures
+func (s *server) verifyWrite(ctx context.Context, key string, size int, hash string) error {
+	var err error
+	switch s.cfg.VerifyAfterWrite {
+	case verifySize:
+		err = s.verifyStoredSize(ctx, key, size, hash)
+	case verifyChecksum:
+		err = s.verifyStoredChecksum(ctx, key, hash)
+	default:
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	failures := s.writeVerifyFailures.Add(1)
+	slog.Error("Write verification failed", "key", key, "mode", s.cfg.VerifyAfterWrite, "failures", failures, "error", err)
+	return &stageError{stage: stageS3Write, err: err}
+}
+
+func (s *server) verifyStoredSize(ctx context.Context, key string, size int, hash string) error {
+	info, err := s.store.Head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWriteVerification, err)
+	}
+	if info.Size != int64(size) {
+		return fmt.Errorf("%w: stored %d bytes, uploaded %d", errWriteVerification, info.Size, size)
+	}
+	if info.ContentHash != hash {
+		return fmt.Errorf("%w: stored content hash %q, uploaded %q", errWriteVerification, info.ContentHash, hash)
+	}
+	return nil
+}
+
+func (s *server) verifyStoredChecksum(ctx context.Context, key, hash string) error {
+	obj, err := s.store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWriteVerification, err)
+	}
+	defer obj.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, obj.Body); err != nil {
+		return fmt.Errorf("%w: %w", errWriteVerification, err)
+	}
+	if stored := hex.EncodeToString(h.Sum(nil)); stored != hash {
+		return fmt.Errorf("%w: stored SHA-256 %s, uploaded %s", errWriteVerification, stored, hash)
+	}
+	return nil
+}
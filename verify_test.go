@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+)
+
+// corruptingStore alters the bodies it stores, as a faulty provider would
+type corruptingStore struct {
+	*memoryStore
+	corrupt func([]byte) []byte
+}
+
+func (c *corruptingStore) Put(ctx context.Context, key string, r io.Reader, meta ObjectMeta) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.memoryStore.Put(ctx, key, bytes.NewReader(c.corrupt(body)), meta)
+}
+
+func TestWriteVerification(t *testing.T) {
+	truncate := func(b []byte) []byte { return b[:len(b)-1] }
+	flip := func(b []byte) []byte {
+		b = bytes.Clone(b)
+		b[0] ^= 0xff
+		return b
+	}
+	keep := func(b []byte) []byte { return b }
+
+	tests := []struct {
+		name    string
+		mode    string
+		corrupt func([]byte) []byte
+		fails   bool
+	}{
+		{"size passes", verifySize, keep, false},
+		{"size catches truncation", verifySize, truncate, true},
+		{"checksum passes", verifyChecksum, keep, false},
+		{"checksum catches corruption", verifyChecksum, flip, true},
+		{"off", verifyOff, truncate, false},
+	}
+	path := "/_/rs:fill:50:50/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &corruptingStore{memoryStore: newMemoryStore(), corrupt: tt.corrupt}
+			srv, _ := newTestServerWithStore(t, Config{VerifyAfterWrite: tt.mode}, imgproxyStub(), store)
+
+			err := srv.storeProcessed(context.Background(), path, []byte("image"), ObjectMeta{ContentType: "image/jpeg"})
+			if tt.fails != errors.Is(err, errWriteVerification) {
+				t.Fatalf("Expected failing=%v, got %v", tt.fails, err)
+			}
+			if want := map[bool]int64{false: 0, true: 1}[tt.fails]; srv.writeVerifyFailures.Load() != want {
+				t.Fatalf("Expected %d counted failures, got %d", want, srv.writeVerifyFailures.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+type warmRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// warmProgress is streamed as one JSON line per processed path
+type warmProgress struct {
+	Path   string `json:"path"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+}
+
+// warmSummary is the last line of the stream
+type warmSummary struct {
+	Done     int  `json:"done"`
+	Failed   int  `json:"failed"`
+	Total    int  `json:"total"`
+	Canceled bool `json:"canceled,omitempty"`
+}
+
+// handleWarm processes and stores a batch of imgproxy paths, streaming progress as JSON lines or server-sent events.
+// At most WARM_CONCURRENCY paths are processed at the same time, and the batch
+// is abandoned as soon as the client closes the request.
+func (s *server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	var req warmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid warm request: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.warmBatch(w, r, req.Paths)
+}
+
+// warmBatch processes and stores paths for a warm request, streaming progress as JSON lines or server-sent events
+func (s *server) warmBatch(w http.ResponseWriter, r *http.Request, paths []string) {
+	stream := newProgressStream(w, r)
+	stop := make(chan struct{})
+	defer close(stop)
+	go stream.heartbeat(s.cfg.SSEHeartbeatInterval, stop)
+
+	ctx := r.Context()
+	total := len(paths)
+
+	var mu sync.Mutex
+	done, failed := 0, 0
+	report := func(p warmProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		done++
+		if p.Error != "" {
+			failed++
+		}
+		p.Done, p.Total = done, total
+		stream.send("progress", p)
+	}
+
+	sem := make(chan struct{}, s.cfg.WarmConcurrency)
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			report(s.warm(ctx, path))
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		slog.Info("Warmup canceled", "done", done, "total", total)
+		return
+	}
+
+	stream.send("summary", warmSummary{Done: done, Failed: failed, Total: total})
+}
+
+// warm processes a single path through imgproxy and stores the result
+func (s *server) warm(ctx context.Context, path string) warmProgress {
+	status, err := s.processAndStore(ctx, path)
+	progress := warmProgress{Path: path, Status: status}
+	if err != nil {
+		progress.Error = err.Error()
+	}
+	return progress
+}
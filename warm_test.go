@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmStreamsProgressWithinConcurrencyLimit(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	slowImgproxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("processed:" + r.URL.Path))
+	})
+
+	_, proxy, store := newTestServer(t, Config{WarmConcurrency: 2}, slowImgproxy)
+
+	var paths []string
+	for i := range 10 {
+		paths = append(paths, fmt.Sprintf("/_/rs:fill:%d:%d/plain/http://example.com/kitten.jpg", i+1, i+1))
+	}
+	body, _ := json.Marshal(warmRequest{Paths: paths})
+
+	resp := adminDoWithBody(t, http.MethodPost, proxy.URL+"/admin/warm", string(body))
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Expected streamed JSON lines, got Content-Type %q", ct)
+	}
+
+	var progress []warmProgress
+	var summary warmSummary
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if strings.Contains(string(line), `"path"`) {
+			var p warmProgress
+			if err := json.Unmarshal(line, &p); err != nil {
+				t.Fatalf("Invalid progress line %q: %v", line, err)
+			}
+			progress = append(progress, p)
+			continue
+		}
+		if err := json.Unmarshal(line, &summary); err != nil {
+			t.Fatalf("Invalid summary line %q: %v", line, err)
+		}
+	}
+
+	if len(progress) != len(paths) {
+		t.Fatalf("Expected %d progress lines, got %d", len(paths), len(progress))
+	}
+	for i, p := range progress {
+		if p.Done != i+1 || p.Total != len(paths) || p.Status != http.StatusOK {
+			t.Fatalf("Unexpected progress line %d: %+v", i, p)
+		}
+	}
+	if summary.Done != len(paths) || summary.Failed != 0 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+	if maxInFlight.Load() > 2 {
+		t.Fatalf("Concurrency exceeded the limit: %d requests in flight", maxInFlight.Load())
+	}
+	if store.len() != len(paths) {
+		t.Fatalf("Expected %d stored images, got %d", len(paths), store.len())
+	}
+}
+
+func TestWarmReportsFailures(t *testing.T) {
+	_, proxy, store := newTestServer(t, Config{}, http.NotFoundHandler())
+
+	resp := adminDoWithBody(t, http.MethodPost, proxy.URL+"/admin/warm", `{"paths":["/_/plain/http://example.com/missing.jpg"]}`)
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected a progress and a summary line, got %q", lines)
+	}
+
+	var summary warmSummary
+	json.Unmarshal([]byte(lines[1]), &summary)
+	if summary.Failed != 1 {
+		t.Fatalf("Expected 1 failure, got %+v", summary)
+	}
+	if store.len() != 0 {
+		t.Fatalf("Expected nothing stored, found %d objects", store.len())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// objectLister lists the objects of a bucket, such as the WARM_SOURCE_BUCKET of a bucket warmup
+type objectLister interface {
+	List(ctx context.Context, prefix, cursor string, limit int) (*ObjectPage, error)
+}
+
+// warmPreset is one of WARM_PRESETS: imgproxy options and an optional output format, e.g. rs:fill:300:300/q:80@webp
+type warmPreset struct {
+	options []string
+	format  string
+}
+
+// parseWarmPresets reads the presets of WARM_PRESETS
+func parseWarmPresets(items []string) ([]warmPreset, error) {
+	presets := make([]warmPreset, 0, len(items))
+	for _, item := range items {
+		options, format, _ := strings.Cut(item, "@")
+		preset := warmPreset{options: strings.Split(options, "/"), format: format}
+		for _, o := range preset.options {
+			if name, _, ok := strings.Cut(o, ":"); !ok || name == "" {
+				return nil, fmt.Errorf("invalid WARM_PRESETS item %q, expected options such as rs:fill:300:300", item)
+			}
+		}
+		if format != "" && !isExtension(format) {
+			return nil, fmt.Errorf("invalid WARM_PRESETS item %q, unknown format %q", item, format)
+		}
+		presets = append(presets, preset)
+	}
+	return presets, nil
+}
+
+// warmBucketRequest is the optional body of POST /admin/warm/bucket
+type warmBucketRequest struct {
+	Prefix string `json:"prefix"`
+}
+
+// setWarmSource lets POST /admin/warm/bucket list WARM_SOURCE_BUCKET. It must be set before serving
+func (s *server) setWarmSource(source objectLister) {
+	s.warmSource = source
+}
+
+// handleWarmBucket warms every WARM_PRESETS variant of the objects of WARM_SOURCE_BUCKET under a prefix,
+// such as after an import. The whole listing is read first, then the paths are warmed as /admin/warm does
+func (s *server) handleWarmBucket(w http.ResponseWriter, r *http.Request) {
+	if s.warmSource == nil {
+		http.Error(w, "WARM_SOURCE_BUCKET isn't set", http.StatusNotImplemented)
+		return
+	}
+	var req warmBucketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("invalid warm request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	setAuditTarget(r.Context(), req.Prefix)
+	keys, err := s.listWarmSources(r.Context(), req.Prefix)
+	if err != nil {
+		slog.Error("Failed to list the warm source bucket", "prefix", req.Prefix, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	slog.Info("Warming the source bucket", "prefix", req.Prefix, "objects", len(keys), "presets", len(s.cfg.WarmPresets))
+	s.warmBatch(w, r, s.warmPaths(keys))
+}
+
+// listWarmSources returns the keys of the source objects under a prefix, without the folder placeholders
+func (s *server) listWarmSources(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	cursor := ""
+	for {
+		page, err := s.warmSource.List(ctx, prefix, cursor, maxListLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Objects {
+			if obj.Size > 0 && !strings.HasSuffix(obj.Key, "/") {
+				keys = append(keys, obj.Key)
+			}
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// warmPaths returns the imgproxy path of every preset for every source key, signed when IMGPROXY_KEY is set.
+// A key's source URL is WARM_SOURCE_URL_PREFIX followed by the escaped key
+func (s *server) warmPaths(keys []string) []string {
+	paths := make([]string, 0, len(keys)*len(s.cfg.WarmPresets))
+	for _, key := range keys {
+		source := s.cfg.WarmSourceURLPrefix + (&url.URL{Path: key}).EscapedPath()
+		for _, preset := range s.cfg.WarmPresets {
+			paths = append(paths, s.signatures.resign(plainPath(source, preset.options, preset.format)).String())
+		}
+	}
+	return paths
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseWarmPresets(t *testing.T) {
+	presets, err := parseWarmPresets([]string{"rs:fill:300:300/q:80@webp", "rs:fit:1200:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(presets[0].options, []string{"rs:fill:300:300", "q:80"}) || presets[0].format != "webp" || presets[1].format != "" {
+		t.Fatalf("Unexpected presets %+v", presets)
+	}
+
+	for _, invalid := range []string{"", "thumbnail", "rs:fill:300:300@web.p"} {
+		if _, err := parseWarmPresets([]string{invalid}); err == nil {
+			t.Errorf("Expected WARM_PRESETS item %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestWarmBucketWarmsEveryPresetOfEverySource(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	stub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, requestPath(r.URL))
+		mu.Unlock()
+		w.Write([]byte("image"))
+	})
+
+	presets, _ := parseWarmPresets([]string{"rs:fill:100:100@webp", "rs:fit:800:0"})
+	cfg := Config{WarmPresets: presets, WarmSourceURLPrefix: "s3://imports/", WarmConcurrency: 2}
+	srv, proxy, store := newTestServer(t, cfg, stub)
+
+	source := newMemoryStore()
+	for key, body := range map[string]string{
+		"2024/a.jpg":      "a",
+		"2024/b c.png":    "b",
+		"2024/":           "",
+		"archive/old.jpg": "old",
+	} {
+		source.Put(context.Background(), key, strings.NewReader(body), ObjectMeta{})
+	}
+	srv.setWarmSource(source)
+
+	resp := adminDoWithBody(t, http.MethodPost, proxy.URL+"/admin/warm/bucket", `{"prefix": "2024/"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var summary warmSummary
+	for scanner := bufio.NewScanner(resp.Body); scanner.Scan(); {
+		json.Unmarshal(scanner.Bytes(), &summary)
+	}
+
+	want := []string{
+		"/_/rs:fill:100:100/plain/" + url.QueryEscape("s3://imports/2024/a.jpg") + "@webp",
+		"/_/rs:fit:800:0/plain/" + url.QueryEscape("s3://imports/2024/a.jpg"),
+		"/_/rs:fill:100:100/plain/" + url.QueryEscape("s3://imports/2024/b%20c.png") + "@webp",
+		"/_/rs:fit:800:0/plain/" + url.QueryEscape("s3://imports/2024/b%20c.png"),
+	}
+	slices.Sort(want)
+	slices.Sort(requested)
+	if !slices.Equal(requested, want) {
+		t.Fatalf("Expected the warm tasks\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(requested, "\n"))
+	}
+	if summary.Total != 4 || summary.Done != 4 || summary.Failed != 0 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+	if store.len() != 4 {
+		t.Fatalf("Expected the 4 variants to be stored, got %d", store.len())
+	}
+}
+
+func TestWarmBucketRequiresASourceBucket(t *testing.T) {
+	_, proxy, _ := newTestServer(t, Config{}, imgproxyStub())
+	if resp := adminDo(t, http.MethodPost, proxy.URL+"/admin/warm/bucket"); resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected status 501 without WARM_SOURCE_BUCKET, got %d", resp.StatusCode)
+	}
+}
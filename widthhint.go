@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// widthOptions are the imgproxy options that already set the output width, the hint doesn't override them
+var widthOptions = []string{"w", "width", "rs", "resize", "s", "size"}
+
+// applyWidthHint rewrites the path of a request carrying a Sec-CH-Width or Width client hint
+// to request the width of WIDTH_HINT_BUCKETS closest above it. The width option is then part
+// of the key, and the buckets bound the number of variants. A path setting a width itself is left as is
+func (s *server) applyWidthHint(r *http.Request, w http.ResponseWriter) error {
+	if len(s.cfg.WidthHintBuckets) == 0 {
+		return nil
+	}
+	w.Header().Add("Vary", "Sec-CH-Width, Width")
+
+	width, ok := widthHint(r.Header)
+	if !ok {
+		return nil
+	}
+	return s.rewritePath(r, func(p *imgproxyPath) bool {
+		if setsWidth(*p) {
+			return false
+		}
+		p.Options = append(p.Options, fmt.Sprintf("w:%d", bucketWidth(width, s.cfg.WidthHintBuckets)))
+		return true
+	})
+}
+
+// widthHint reads the width of the image in physical pixels: the hint is the layout width already multiplied by the DPR
+func widthHint(h http.Header) (int, bool) {
+	value := h.Get("Sec-CH-Width")
+	if value == "" {
+		value = h.Get("Width")
+	}
+	if value == "" {
+		return 0, false
+	}
+
+	width, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || width <= 0 || math.IsInf(width, 0) {
+		return 0, false
+	}
+	return int(math.Ceil(width)), true
+}
+
+// bucketWidth returns the smallest bucket fitting the width, the largest one for wider images.
+// The buckets are sorted
+func bucketWidth(width int, buckets []int) int {
+	for _, b := range buckets {
+		if b >= width {
+			return b
+		}
+	}
+	return buckets[len(buckets)-1]
+}
+
+func setsWidth(p imgproxyPath) bool {
+	for _, o := range p.Options {
+		name, _, _ := strings.Cut(o, ":")
+		if slices.Contains(widthOptions, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWidthBuckets reads the WIDTH_HINT_BUCKETS widths and sorts them
+func parseWidthBuckets(items []string) ([]int, error) {
+	return parseWidths("WIDTH_HINT_BUCKETS", items)
+}
+
+// parseWidths reads the widths of the variable name and sorts them
+func parseWidths(name string, items []string) ([]int, error) {
+	var widths []int
+	for _, item := range items {
+		width, err := strconv.Atoi(item)
+		if err != nil || width < 1 {
+			return nil, fmt.Errorf("invalid %s width %q, expected a positive integer", name, item)
+		}
+		widths = append(widths, width)
+	}
+	slices.Sort(widths)
+	return slices.Compact(widths), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func getWithWidth(t *testing.T, requestURL, header, width string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	req.Header.Set(header, width)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestWidthHintsProduceBucketedKeys(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{WidthHintBuckets: []int{320, 640, 1024}}, imgproxyStub())
+	source := url.QueryEscape("http://example.com/kitten.jpg")
+
+	small := getWithWidth(t, proxy.URL+"/_/plain/"+source, "Sec-CH-Width", "500")
+	large := getWithWidth(t, proxy.URL+"/_/plain/"+source, "Width", "900.5")
+	for _, resp := range []*http.Response{small, large} {
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(resp.Header.Get("Vary"), "Width") {
+			t.Errorf("Expected Vary to list Width, got %q", resp.Header.Get("Vary"))
+		}
+	}
+	srv.uploads.Wait()
+
+	for _, path := range []string{"/_/w:640/plain/" + source, "/_/w:1024/plain/" + source} {
+		if _, ok := store.get(GenerateS3Key(path)); !ok {
+			t.Errorf("Expected the bucketed variant %s to be stored", path)
+		}
+	}
+	if store.len() != 2 {
+		t.Fatalf("Expected 2 stored variants, found %d", store.len())
+	}
+
+	// A width within the same bucket is a hit on the same variant
+	if resp := getWithWidth(t, proxy.URL+"/_/plain/"+source, "Sec-CH-Width", "600"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a hit for a width in the 640 bucket, got %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestWidthHintKeepsExplicitWidths(t *testing.T) {
+	srv, proxy, store := newTestServer(t, Config{WidthHintBuckets: []int{320, 640}}, imgproxyStub())
+	path := "/_/rs:fill:100:100/plain/" + url.QueryEscape("http://example.com/kitten.jpg")
+
+	getWithWidth(t, proxy.URL+path, "Sec-CH-Width", "500")
+	srv.uploads.Wait()
+
+	if _, ok := store.get(GenerateS3Key(path)); !ok {
+		t.Fatal("Expected a path setting its own width to be stored as requested")
+	}
+}
+
+func TestWidthHintResignsThePath(t *testing.T) {
+	v := &signatureVerifier{key: []byte("key"), salt: []byte("salt"), size: 32}
+	p, _ := parseImgproxyPath("/_/plain/http://example.com/kitten.jpg")
+	p.Options = append(p.Options, "w:640")
+
+	if err := v.verify(v.resign(p).String()); err != nil {
+		t.Fatalf("Expected the rewritten path to carry a valid signature: %v", err)
+	}
+}